@@ -1,31 +1,48 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 
+	"tritontube/internal/catalog"
 	"tritontube/internal/chash"
 	"tritontube/internal/metadata"
 	"tritontube/internal/metadata/etcdsim"
+	grpc "tritontube/internal/metadata/grpcstub"
 	"tritontube/internal/metadata/pgxsim"
+	webapipb "tritontube/internal/webapi/proto"
 )
 
 type server struct {
-	ring *chash.Ring
-	svc  *metadata.Service
+	ring     *chash.Ring
+	svc      *metadata.Service
+	rpc      *grpc.Server
+	videos   *catalog.Store
+	sessions *metadata.UploadSessionStore
 }
 
 func main() {
 	srv := newServer()
 
+	reaper := &metadata.UploadSessionReaper{Store: srv.sessions, OnExpire: srv.failExpiredUpload}
+	go func() {
+		if err := reaper.Run(context.Background()); err != nil {
+			log.Printf("upload session reaper stopped: %v", err)
+		}
+	}()
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte("ok")) })
 	mux.HandleFunc("/videos", srv.handleCreateVideo)
 	mux.HandleFunc("/videos/", srv.routeVideo)
+	mux.Handle("/metadata.v1.MetadataService/", srv.rpc)
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write([]byte("<h1>TritonTube Metadata gRPC</h1>"))
 	})
@@ -50,9 +67,38 @@ func newServer() *server {
 	if err != nil {
 		log.Fatalf("failed to init metadata service: %v", err)
 	}
-	return &server{ring: ring, svc: svc}
+	rpc := grpc.NewServer()
+	metadata.RegisterMetadataServiceServer(rpc, svc)
+	client := metadata.NewMetadataServiceClient(rpc.NewInProcessConn())
+	videos, err := catalog.NewStore(client)
+	if err != nil {
+		log.Fatalf("failed to init video catalog: %v", err)
+	}
+	sessions, err := metadata.NewUploadSessionStore(metadata.UploadSessionStoreConfig{Client: client})
+	if err != nil {
+		log.Fatalf("failed to init upload sessions: %v", err)
+	}
+	return &server{ring: ring, svc: svc, rpc: rpc, videos: videos, sessions: sessions}
 }
 
+// failExpiredUpload marks the video of an abandoned upload as failed so the UI can
+// prompt for a re-upload.
+func (s *server) failExpiredUpload(ctx context.Context, sess *metadata.UploadSession) {
+	_, err := s.videos.Update(ctx, sess.VideoID, func(v *catalog.Video) error {
+		if v.Status != webapipb.VideoStatus_VIDEO_STATUS_UPLOADING {
+			return errNoChange
+		}
+		v.Status = webapipb.VideoStatus_VIDEO_STATUS_FAILED
+		v.FailureReason = "upload session expired"
+		return nil
+	})
+	if err != nil && !errors.Is(err, errNoChange) && grpc.CodeOf(err) != grpc.NotFound {
+		log.Printf("failed to mark video %s as failed: %v", sess.VideoID, err)
+	}
+}
+
+var errNoChange = errors.New("no change")
+
 func loadNodesFromEnv() []string {
 	raw := os.Getenv("STORAGE_NODES")
 	if raw == "" {
@@ -84,8 +130,8 @@ func (s *server) handleCreateVideo(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "missing id", http.StatusBadRequest)
 		return
 	}
-	item := &metadata.MetadataItem{Key: "video/" + q.ID, Value: `{"status":"ingesting"}`}
-	if _, err := s.svc.PutMetadata(r.Context(), &metadata.PutMetadataRequest{Item: item, ExpectedEtcdRevision: -1}); err != nil {
+	video := &catalog.Video{ID: q.ID, Status: webapipb.VideoStatus_VIDEO_STATUS_UPLOADING}
+	if err := s.videos.Put(r.Context(), video); err != nil {
 		http.Error(w, fmt.Sprintf("store video: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -119,11 +165,22 @@ func (s *server) handlePutSegment(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "need id,rend,idx", http.StatusBadRequest)
 		return
 	}
-	var idx int
-	if _, err := fmt.Sscanf(idxStr, "%d", &idx); err != nil {
+	idx, init, err := catalog.ParseSegmentIndex(idxStr)
+	if err != nil {
 		http.Error(w, "bad idx", http.StatusBadRequest)
 		return
 	}
+	if !init {
+		idxStr = strconv.Itoa(idx)
+	}
+	var durMillis int64
+	if d := r.URL.Query().Get("dur"); d != "" {
+		durMillis, err = strconv.ParseInt(d, 10, 64)
+		if err != nil || durMillis <= 0 {
+			http.Error(w, "bad dur", http.StatusBadRequest)
+			return
+		}
+	}
 
 	keyBytes := []byte(id + "|" + rend + "|" + idxStr)
 	replicas := s.ring.Lookup(keyBytes, 2)
@@ -132,8 +189,9 @@ func (s *server) handlePutSegment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	payload, _ := json.Marshal(map[string]any{"video": id, "rend": rend, "idx": idx, "replicas": replicas})
-	item := &metadata.MetadataItem{Key: segmentKey(id, rend, idx), Value: string(payload)}
+	seg := catalog.Segment{VideoID: id, Rendition: rend, Index: idx, Init: init, DurationMillis: durMillis, Replicas: replicas}
+	payload, _ := json.Marshal(seg)
+	item := &metadata.MetadataItem{Key: catalog.SegmentKey(id, rend, idxStr), Value: string(payload)}
 
 	existing, err := s.svc.GetMetadata(r.Context(), &metadata.GetMetadataRequest{Key: item.Key})
 	if err == nil {
@@ -151,12 +209,7 @@ func (s *server) handlePutSegment(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(map[string]any{
-		"video":    id,
-		"rend":     rend,
-		"idx":      idx,
-		"replicas": replicas,
-	})
+	_ = json.NewEncoder(w).Encode(seg)
 }
 
 func (s *server) handleGetLocations(w http.ResponseWriter, r *http.Request) {
@@ -173,24 +226,21 @@ func (s *server) handleGetLocations(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "need id,rend,idx", http.StatusBadRequest)
 		return
 	}
-	var idx int
-	if _, err := fmt.Sscanf(idxStr, "%d", &idx); err != nil {
+	idx, init, err := catalog.ParseSegmentIndex(idxStr)
+	if err != nil {
 		http.Error(w, "bad idx", http.StatusBadRequest)
 		return
 	}
+	if !init {
+		idxStr = strconv.Itoa(idx)
+	}
 
-	resp, err := s.svc.GetMetadata(r.Context(), &metadata.GetMetadataRequest{Key: segmentKey(id, rend, idx)})
+	resp, err := s.svc.GetMetadata(r.Context(), &metadata.GetMetadataRequest{Key: catalog.SegmentKey(id, rend, idxStr)})
 	if err != nil {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
-	type stored struct {
-		Video    string   `json:"video"`
-		Rend     string   `json:"rend"`
-		Idx      int      `json:"idx"`
-		Replicas []string `json:"replicas"`
-	}
-	var info stored
+	var info catalog.Segment
 	_ = json.Unmarshal([]byte(resp.Item.Value), &info)
 	if len(info.Replicas) == 0 {
 		http.Error(w, "not found", http.StatusNotFound)
@@ -198,14 +248,5 @@ func (s *server) handleGetLocations(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(map[string]any{
-		"video":    info.Video,
-		"rend":     info.Rend,
-		"idx":      info.Idx,
-		"replicas": info.Replicas,
-	})
-}
-
-func segmentKey(id, rend string, idx int) string {
-	return fmt.Sprintf("segment/%s/%s/%d", id, rend, idx)
+	_ = json.NewEncoder(w).Encode(info)
 }
@@ -10,7 +10,9 @@ import (
 	"syscall"
 	"time"
 
+	"tritontube/internal/chash"
 	"tritontube/internal/metadata/etcdsim"
+	"tritontube/internal/metadata/etcdsim/concurrency"
 	"tritontube/internal/storage"
 	storagepb "tritontube/internal/storage/proto"
 )
@@ -19,9 +21,24 @@ func main() {
 	var prefix string
 	var deadline time.Duration
 	var statePath string
+	var drain string
+	var replicas int
+	var leaseTTL, grace time.Duration
+	var elect string
+	var sessionTTL int
+	var zoneAware bool
+	var placement string
 	flag.StringVar(&prefix, "prefix", "/storage/cluster", "etcd prefix used for the ring state")
 	flag.DurationVar(&deadline, "deadline", 5*time.Second, "maximum time to start migrations after a change")
 	flag.StringVar(&statePath, "state", "", "optional path to a ring state snapshot (JSON)")
+	flag.StringVar(&drain, "drain", "", "print a plan that evacuates this node and exit")
+	flag.IntVar(&replicas, "replicas", 3, "replicas per token range")
+	flag.DurationVar(&leaseTTL, "lease-ttl", 15*time.Second, "heartbeat lease after which a node is suspect")
+	flag.DurationVar(&grace, "grace", time.Minute, "time a suspect node has to heartbeat before it is removed")
+	flag.StringVar(&elect, "elect", "", "campaign for leadership as this id and only rebalance while leading")
+	flag.IntVar(&sessionTTL, "session-ttl", 10, "seconds a leader may go silent before another admin takes over")
+	flag.BoolVar(&zoneAware, "zone-aware", false, "spread replicas across node zones and racks (must match the storage nodes)")
+	flag.StringVar(&placement, "placement", "", "switch the cluster's replica placement algorithm to ring, rendezvous or bounded-load")
 	flag.Parse()
 
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
@@ -41,10 +58,17 @@ func main() {
 		}
 	}
 
-	manager, err := storage.NewRingManager(storage.RingManagerConfig{Etcd: etcd, Prefix: prefix})
+	manager, err := storage.NewRingManager(storage.RingManagerConfig{Etcd: etcd, Prefix: prefix, ZoneAware: zoneAware})
 	if err != nil {
 		log.Fatalf("failed to create ring manager: %v", err)
 	}
+	if placement != "" {
+		version, err := manager.SetPlacement(ctx, chash.Algorithm(placement))
+		if err != nil {
+			log.Fatalf("failed to set placement: %v", err)
+		}
+		log.Printf("ring placement is %s at version %d", placement, version)
+	}
 
 	executor := storage.MigrationFunc(func(ctx context.Context, plan *storagepb.RebalancePlan) error {
 		encoder := json.NewEncoder(os.Stdout)
@@ -52,7 +76,33 @@ func main() {
 		return encoder.Encode(plan)
 	})
 
-	rebalancer := storage.Rebalancer{Manager: manager, Executor: executor, Deadline: deadline}
+	if drain != "" {
+		plan, err := manager.DrainPlan(drain, replicas)
+		if err != nil {
+			log.Fatalf("failed to plan drain: %v", err)
+		}
+		if err := executor.ExecutePlan(ctx, plan); err != nil {
+			log.Fatalf("failed to print drain plan: %v", err)
+		}
+		return
+	}
+
+	sweeper := &storage.NodeSweeper{Manager: manager, LeaseTTL: leaseTTL, GracePeriod: grace}
+	go func() {
+		if err := sweeper.Run(ctx); err != nil {
+			log.Printf("node sweeper stopped: %v", err)
+		}
+	}()
+
+	rebalancer := storage.Rebalancer{Manager: manager, Executor: executor, Deadline: deadline, ReplicationFactor: replicas}
+	if elect != "" {
+		session, err := concurrency.NewSession(etcd, concurrency.WithTTL(sessionTTL))
+		if err != nil {
+			log.Fatalf("failed to create election session: %v", err)
+		}
+		defer session.Close()
+		rebalancer.Session, rebalancer.ID = session, elect
+	}
 	if err := rebalancer.Run(ctx); err != nil && ctx.Err() == nil {
 		log.Fatalf("rebalance failed: %v", err)
 	}
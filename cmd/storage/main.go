@@ -2,7 +2,8 @@ package main
 
 import (
 	"encoding/json"
-	"io"
+	"errors"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
@@ -22,6 +23,7 @@ func main() {
 		root = "./data-" + port
 	}
 	store := st.NewFS(root)
+	verifyOnRead := os.Getenv("VERIFY_ON_READ") == "true" || os.Getenv("VERIFY_ON_READ") == "1"
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
@@ -40,30 +42,48 @@ func main() {
 
 		switch r.Method {
 		case http.MethodPut:
-			n, sum, err := store.Put(bucket, object, r.Body)
+			n, sum, err := store.PutVerified(bucket, object, r.Body, r.Header.Get(st.ChecksumHeader))
+			if errors.Is(err, st.ErrChecksumMismatch) || errors.Is(err, st.ErrReservedName) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("ETag", st.ObjectInfo{SHA256: sum}.ETag())
 			w.WriteHeader(http.StatusCreated)
-			w.WriteHeader(http.StatusOK)
 			_ = json.NewEncoder(w).Encode(map[string]interface{}{
 				"size":   n,
 				"sha256": sum,
 				"bucket": bucket,
 				"object": object,
 			})
-		case http.MethodGet:
-			rc, err := store.Get(bucket, object)
+		case http.MethodGet, http.MethodHead:
+			if verifyOnRead && r.Method == http.MethodGet {
+				if _, err := store.Verify(bucket, object); errors.Is(err, st.ErrChecksumMismatch) {
+					// Fail loudly so readers fall back to another replica.
+					log.Printf("corrupt object: %v", err)
+					http.Error(w, "stored object failed checksum verification", http.StatusInternalServerError)
+					return
+				}
+			}
+			f, info, err := store.Open(bucket, object)
 			if err != nil {
-				http.NotFound(w, r)
+				if errors.Is(err, fs.ErrNotExist) {
+					http.NotFound(w, r)
+					return
+				}
+				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			defer rc.Close()
-			if _, err := io.Copy(w, rc); err != nil {
-				log.Printf("stream error: %v", err)
-			}
+			defer f.Close()
+			// ServeContent handles Range, If-Range, If-None-Match and If-Modified-Since
+			// and sets Content-Length, Content-Range, Accept-Ranges and Last-Modified.
+			w.Header().Set("ETag", info.ETag())
+			w.Header().Set("Content-Type", "application/octet-stream")
+			http.ServeContent(w, r, "", info.ModTime, f)
 		default:
 			http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
 		}
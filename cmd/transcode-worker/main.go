@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"tritontube/internal/catalog"
+	"tritontube/internal/chash"
+	"tritontube/internal/metadata"
+	grpc "tritontube/internal/metadata/grpcstub"
+	"tritontube/internal/transcode"
+)
+
+func main() {
+	metadataBase := os.Getenv("METADATA_BASE")
+	if metadataBase == "" {
+		metadataBase = "http://localhost:8082"
+	}
+	webBase := os.Getenv("WEB_BASE")
+	if webBase == "" {
+		webBase = "http://localhost:8080"
+	}
+
+	client := metadata.NewMetadataServiceClient(grpc.NewHTTPConn(metadataBase, nil))
+	queue, err := transcode.NewMetadataQueue(transcode.MetadataQueueConfig{Client: client, Name: os.Getenv("TRANSCODE_QUEUE")})
+	if err != nil {
+		log.Fatalf("failed to init transcode queue: %v", err)
+	}
+
+	var encoder transcode.Encoder
+	switch mode := os.Getenv("TRANSCODE_ENCODER"); mode {
+	case "", "ffmpeg":
+		ring := chash.NewRing(128)
+		for _, node := range loadNodesFromEnv() {
+			ring.AddNode(node)
+		}
+		encoder = &transcode.FFmpegEncoder{
+			Binary: os.Getenv("FFMPEG_BIN"),
+			SourceURL: func(job transcode.Job) string {
+				nodes := ring.Lookup([]byte(job.SourceKey), 1)
+				if len(nodes) == 0 {
+					return ""
+				}
+				return strings.TrimRight(nodes[0], "/") + "/blob/" + job.SourceBucket + "/" + job.SourceKey
+			},
+			Upload:  webUploader(webBase),
+			WorkDir: os.Getenv("TRANSCODE_WORKDIR"),
+		}
+	case "fake":
+		encoder = &transcode.FakeEncoder{}
+	default:
+		log.Fatalf("unknown TRANSCODE_ENCODER %q", mode)
+	}
+
+	videos, err := catalog.NewStore(client)
+	if err != nil {
+		log.Fatalf("failed to init video store: %v", err)
+	}
+	worker := &transcode.Worker{
+		Queue:       queue,
+		Encoder:     encoder,
+		Videos:      videos,
+		MaxAttempts: envInt("TRANSCODE_MAX_ATTEMPTS", 0),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	log.Printf("transcode worker consuming jobs from %s", metadataBase)
+	if err := worker.Run(ctx); err != nil {
+		log.Fatalf("transcode worker stopped: %v", err)
+	}
+}
+
+// webUploader stores segments through the web tier's /upload endpoint, which picks
+// replicas and writes them to storage.
+func webUploader(webBase string) transcode.SegmentUploader {
+	return func(ctx context.Context, videoID, rendition, idx string, body io.Reader) error {
+		q := url.Values{"id": {videoID}, "rend": {rendition}, "idx": {idx}}
+		uctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(uctx, http.MethodPost, strings.TrimRight(webBase, "/")+"/upload?"+q.Encode(), body)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			return fmt.Errorf("upload %s/%s/%s: status %d", videoID, rendition, idx, resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+func envInt(name string, def int) int {
+	if v := os.Getenv(name); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return def
+}
+
+func loadNodesFromEnv() []string {
+	raw := os.Getenv("STORAGE_NODES")
+	if raw == "" {
+		raw = "http://localhost:8081,http://localhost:8083"
+	}
+	var nodes []string
+	for _, s := range strings.Split(raw, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		nodes = append(nodes, s)
+	}
+	return nodes
+}
@@ -4,13 +4,27 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"tritontube/internal/catalog"
+	"tritontube/internal/chash"
+	"tritontube/internal/dash"
+	"tritontube/internal/hls"
+	"tritontube/internal/metadata"
+	grpc "tritontube/internal/metadata/grpcstub"
+	"tritontube/internal/storage"
+	"tritontube/internal/transcode"
+	"tritontube/internal/webapi"
 )
 
 type segLocResp struct {
@@ -18,6 +32,7 @@ type segLocResp struct {
 	Rend     string   `json:"rend"`
 	Idx      int      `json:"idx"`
 	Replicas []string `json:"replicas"`
+	SHA256   string   `json:"sha256,omitempty"`
 }
 
 func main() {
@@ -32,7 +47,41 @@ func main() {
 			writeW = n
 		}
 	}
+	maxUploadBytes := int64(64 << 20)
+	if ms := os.Getenv("UPLOAD_MAX_BYTES"); ms != "" {
+		if n, err := strconv.ParseInt(ms, 10, 64); err == nil && n > 0 {
+			maxUploadBytes = n
+		}
+	}
+	ring := chash.NewRing(128)
+	nodes := loadNodesFromEnv()
+	for _, node := range nodes {
+		ring.AddNode(node)
+	}
+	metadataClient := metadata.NewMetadataServiceClient(grpc.NewHTTPConn(metadataBase, nil))
+	jobs, err := transcode.NewMetadataQueue(transcode.MetadataQueueConfig{Client: metadataClient, Name: os.Getenv("TRANSCODE_QUEUE")})
+	if err != nil {
+		log.Fatalf("failed to init transcode queue: %v", err)
+	}
+	videoSvc, err := webapi.NewService(webapi.ServiceConfig{
+		Metadata:      metadataClient,
+		StorageRing:   ring,
+		UploadBucket:  os.Getenv("UPLOAD_BUCKET"),
+		PublicBaseURL: os.Getenv("PUBLIC_BASE_URL"),
+		Jobs:          jobs,
+	})
+	if err != nil {
+		log.Fatalf("failed to init video service: %v", err)
+	}
+	videos, err := catalog.NewStore(metadataClient)
+	if err != nil {
+		log.Fatalf("failed to init video catalog: %v", err)
+	}
+	repairer := newReadRepairer(ring, len(nodes), videos)
+
 	mux := http.NewServeMux()
+	mux.Handle("/v1/", webapi.NewGateway(videoSvc))
+	mux.Handle("/debug/vars", expvar.Handler())
 
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -51,8 +100,17 @@ func main() {
 			http.Error(w, "Missing id or rend", http.StatusBadRequest)
 			return
 		}
+		if r.ContentLength > maxUploadBytes {
+			// Reject before the segment is registered in metadata.
+			http.Error(w, "Segment too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		// 1) 先让 metadata 挑副本并登记
 		locURL := metadataBase + "/videos/" + id + "/segments?rend=" + rend + "&idx=" + idx
+		if dur := r.URL.Query().Get("dur"); dur != "" {
+			// Segment duration in milliseconds, used for the DASH timeline.
+			locURL += "&dur=" + url.QueryEscape(dur)
+		}
 		reqCreate, _ := http.NewRequestWithContext(r.Context(), "POST", locURL, nil)
 		respCreate, err := http.DefaultClient.Do(reqCreate)
 		if err != nil || respCreate.StatusCode != http.StatusOK {
@@ -74,52 +132,94 @@ func main() {
 			return
 		}
 
-		// 2) 读取请求体（演示用：读入内存；后续会做分块/流式）
-		data, err := io.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, "Failed to read segment", http.StatusServiceUnavailable)
-			return
-		}
-
-		// 3) 依次 PUT 到各 storage，统计成功数
+		// 2) 流式转发：请求体边读边写到各 storage，不在内存里攒整段
 		objectPath := id + "/" + rend + "/" + idx
-		success := 0
 		type putResult struct {
 			Base   string `json:"base"`
 			Status int    `json:"status"`
 			Size   int64  `json:"size"`
 			SHA256 string `json:"sha256"`
 		}
-		results := make([]putResult, 0, len(loc.Replicas))
-
-		for _, base := range loc.Replicas {
-			u := strings.TrimRight(base, "/") + "/blob/videos/" + objectPath
-			sctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
-			reqPut, _ := http.NewRequestWithContext(sctx, "PUT", u, bytes.NewReader(data))
-			respPut, err := http.DefaultClient.Do(reqPut)
-			if err != nil {
-				cancel()
-				results = append(results, putResult{Base: base, Status: 0})
-				continue
-			}
-			var size int64
-			var sum string
-			if respPut.StatusCode == http.StatusCreated {
-				var m map[string]any
-				_ = json.NewDecoder(respPut.Body).Decode(&m)
-				if v, ok := m["size"].(float64); ok {
-					size = int64(v)
+		results := make([]putResult, len(loc.Replicas))
+		fanout := &fanoutWriter{}
+		var wg sync.WaitGroup
+		for i, base := range loc.Replicas {
+			pr, pw := io.Pipe()
+			fanout.writers = append(fanout.writers, pw)
+			wg.Add(1)
+			go func(i int, base string, body *io.PipeReader) {
+				defer wg.Done()
+				results[i] = putResult{Base: base}
+				u := strings.TrimRight(base, "/") + "/blob/videos/" + objectPath
+				sctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+				defer cancel()
+				reqPut, _ := http.NewRequestWithContext(sctx, "PUT", u, body)
+				if r.ContentLength > 0 {
+					reqPut.ContentLength = r.ContentLength
 				}
-				if s, ok := m["sha256"].(string); ok {
-					sum = s
+				if sum := r.Header.Get(storage.ChecksumHeader); sum != "" {
+					// Each replica rejects the segment if it arrives corrupted.
+					reqPut.Header.Set(storage.ChecksumHeader, sum)
 				}
+				respPut, err := http.DefaultClient.Do(reqPut)
+				// Unblock the fan-out if this replica stopped reading early.
+				body.CloseWithError(errReplicaDone)
+				if err != nil {
+					return
+				}
+				defer respPut.Body.Close()
+				results[i].Status = respPut.StatusCode
+				if respPut.StatusCode == http.StatusCreated {
+					var m map[string]any
+					_ = json.NewDecoder(respPut.Body).Decode(&m)
+					if v, ok := m["size"].(float64); ok {
+						results[i].Size = int64(v)
+					}
+					if s, ok := m["sha256"].(string); ok {
+						results[i].SHA256 = s
+					}
+				}
+			}(i, base, pr)
+		}
+		body := http.MaxBytesReader(w, r.Body, maxUploadBytes)
+		_, copyErr := io.Copy(fanout, body)
+		fanout.Close(copyErr)
+		wg.Wait()
+
+		var tooLarge *http.MaxBytesError
+		if errors.As(copyErr, &tooLarge) {
+			http.Error(w, "Segment too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if copyErr != nil && !errors.Is(copyErr, errAllReplicasFailed) {
+			http.Error(w, "Failed to read segment", http.StatusBadRequest)
+			return
+		}
+		success := 0
+		// sum is the checksum every successful replica reported, or "" if they disagree.
+		sum, agreed := "", true
+		for _, res := range results {
+			if res.Status == http.StatusCreated {
+				if success > 0 && res.SHA256 != sum {
+					agreed = false
+				}
+				sum = res.SHA256
 				success++
 			}
-			respPut.Body.Close()
-			cancel()
-			results = append(results, putResult{Base: base, Status: respPut.StatusCode, Size: size, SHA256: sum})
+		}
+		if !agreed {
+			sum = ""
 		}
 		if success >= writeW {
+			if sum != "" {
+				// Record what the replicas stored so reads can tell a stale copy apart.
+				if _, err := videos.UpdateSegment(r.Context(), id, rend, idx, func(seg *catalog.Segment) error {
+					seg.SHA256 = sum
+					return nil
+				}); err != nil {
+					log.Printf("failed to record checksum of %s: %v", objectPath, err)
+				}
+			}
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusCreated)
 			_ = json.NewEncoder(w).Encode(map[string]any{
@@ -144,6 +244,14 @@ func main() {
 	mux.HandleFunc("/v/", func(w http.ResponseWriter, r *http.Request) {
 		trim := strings.TrimPrefix(r.URL.Path, "/v/")
 		parts := strings.Split(trim, "/")
+		if len(parts) == 2 && parts[0] != "" && (parts[1] == "manifest.mpd" || parts[1] == hls.MasterPlaylist) {
+			serveManifest(w, r, videos, parts[0], "", parts[1])
+			return
+		}
+		if len(parts) == 3 && parts[0] != "" && parts[1] != "" && parts[2] == hls.MediaPlaylist {
+			serveManifest(w, r, videos, parts[0], parts[1], parts[2])
+			return
+		}
 		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
 			http.Error(w, "bad path, want /v/{id}/{rend}/{idx}", http.StatusBadRequest)
 			return
@@ -174,22 +282,22 @@ func main() {
 		}
 
 		objectPath := id + "/" + rend + "/" + idx
+		var bad []string
 		for _, base := range loc.Replicas {
 			u := strings.TrimRight(base, "/") + "/blob/videos/" + objectPath
-			sctx, scancel := context.WithTimeout(r.Context(), 5*time.Second)
-			reqS, _ := http.NewRequestWithContext(sctx, http.MethodGet, u, nil)
-			respS, err := http.DefaultClient.Do(reqS)
-			if err != nil || respS.StatusCode != http.StatusOK {
-				if respS != nil {
-					respS.Body.Close()
+			switch proxySegment(w, r, u, loc.SHA256) {
+			case replicaServed:
+				if len(bad) > 0 {
+					repairer.schedule(loc, idx, base, bad)
 				}
-				scancel()
-				continue
+				return
+			case replicaMissing:
+				readRepairStats.Add("missing", 1)
+				bad = append(bad, base)
+			case replicaMismatch:
+				readRepairStats.Add("mismatch", 1)
+				bad = append(bad, base)
 			}
-			defer respS.Body.Close()
-			_, _ = io.Copy(w, respS.Body)
-			scancel()
-			return
 		}
 		http.Error(w, "all replicas failed", http.StatusBadGateway)
 	})
@@ -202,3 +310,165 @@ func main() {
 	log.Printf("Starting server at %s", addr)
 	log.Fatal(http.ListenAndServe(addr, mux))
 }
+
+var (
+	errReplicaDone       = errors.New("replica finished reading")
+	errAllReplicasFailed = errors.New("all replicas failed")
+)
+
+// fanoutWriter copies an upload to every replica's pipe. A replica whose write fails
+// is dropped instead of failing the whole upload; only when none are left does Write
+// return an error.
+type fanoutWriter struct {
+	writers []*io.PipeWriter
+	failed  []bool
+}
+
+func (f *fanoutWriter) Write(p []byte) (int, error) {
+	if f.failed == nil {
+		f.failed = make([]bool, len(f.writers))
+	}
+	alive := 0
+	for i, w := range f.writers {
+		if f.failed[i] {
+			continue
+		}
+		if _, err := w.Write(p); err != nil {
+			f.failed[i] = true
+			continue
+		}
+		alive++
+	}
+	if alive == 0 {
+		return 0, errAllReplicasFailed
+	}
+	return len(p), nil
+}
+
+// Close ends every replica's body; a non-nil err aborts the PUTs so storage discards
+// the partial object.
+func (f *fanoutWriter) Close(err error) {
+	for _, w := range f.writers {
+		_ = w.CloseWithError(err)
+	}
+}
+
+// segmentRequestHeaders are forwarded to storage so it can answer byte ranges and
+// conditional requests itself.
+var segmentRequestHeaders = []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"}
+
+// segmentResponseHeaders are copied back from storage to the player.
+var segmentResponseHeaders = []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "ETag", "Last-Modified"}
+
+// proxySegment relays one replica's answer for a segment read. Unless it reports
+// replicaServed it has written nothing and the next replica should be tried. A replica
+// whose ETag does not match sum, the recorded checksum, is not served.
+func proxySegment(w http.ResponseWriter, r *http.Request, u, sum string) replicaOutcome {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	method := http.MethodGet
+	if r.Method == http.MethodHead {
+		method = http.MethodHead
+	}
+	req, _ := http.NewRequestWithContext(ctx, method, u, nil)
+	for _, h := range segmentRequestHeaders {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return replicaFailed
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusNotModified, http.StatusRequestedRangeNotSatisfiable:
+	case http.StatusNotFound:
+		return replicaMissing
+	default:
+		return replicaFailed
+	}
+	if etag := resp.Header.Get("ETag"); sum != "" && etag != "" && etag != (storage.ObjectInfo{SHA256: sum}).ETag() {
+		return replicaMismatch
+	}
+	for _, h := range segmentResponseHeaders {
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if method == http.MethodGet {
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			log.Printf("segment stream error: %v", err)
+		}
+	}
+	return replicaServed
+}
+
+// serveManifest generates the DASH manifest or an HLS playlist for a video from its
+// segment records. Segment URLs are relative, so /v/{id}/manifest.mpd,
+// /v/{id}/master.m3u8 and /v/{id}/{rend}/playlist.m3u8 all resolve them to
+// /v/{id}/{rend}/{idx}.
+func serveManifest(w http.ResponseWriter, r *http.Request, videos *catalog.Store, id, rend, name string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+	segments, err := videos.ListSegments(ctx, id)
+	if err != nil {
+		http.Error(w, "metadata error", http.StatusBadGateway)
+		return
+	}
+	// The video record is optional: segments uploaded straight through /upload have none.
+	video, err := videos.Get(ctx, id)
+	if err != nil && grpc.CodeOf(err) != grpc.NotFound {
+		http.Error(w, "metadata error", http.StatusBadGateway)
+		return
+	}
+	var body []byte
+	contentType := hls.ContentType
+	switch name {
+	case hls.MasterPlaylist:
+		body, err = hls.Master(video, segments)
+	case hls.MediaPlaylist:
+		body, err = hls.Media(video, segments, rend)
+	default:
+		contentType = dash.ContentType
+		var mpd *dash.MPD
+		if mpd, err = dash.Build(video, segments, dash.Options{}); err == nil {
+			var buf bytes.Buffer
+			err = mpd.Encode(&buf)
+			body = buf.Bytes()
+		}
+	}
+	if errors.Is(err, dash.ErrNoSegments) || errors.Is(err, hls.ErrNoSegments) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	// Manifests grow while segments are still being uploaded.
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write(body)
+}
+
+func loadNodesFromEnv() []string {
+	raw := os.Getenv("STORAGE_NODES")
+	if raw == "" {
+		raw = "http://localhost:8081,http://localhost:8083"
+	}
+	var nodes []string
+	for _, s := range strings.Split(raw, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		nodes = append(nodes, s)
+	}
+	return nodes
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tritontube/internal/catalog"
+	"tritontube/internal/chash"
+	"tritontube/internal/storage"
+)
+
+// readRepairTimeout bounds one background repair of a segment.
+const readRepairTimeout = 30 * time.Second
+
+// readRepairStats counts read repairs; it is served with the other expvars at
+// /debug/vars.
+//
+//	missing    replicas that answered 404 for a segment they are listed for
+//	mismatch   replicas whose ETag differed from the recorded checksum
+//	repaired   bad replicas rewritten in place from a good copy
+//	relocated  bad replicas replaced in the record by another node
+//	failed     bad replicas that could be neither rewritten nor replaced
+var readRepairStats = expvar.NewMap("read_repair")
+
+// replicaOutcome classifies one replica's answer to a segment read.
+type replicaOutcome int
+
+const (
+	// replicaServed means the replica's answer was relayed to the player.
+	replicaServed replicaOutcome = iota
+	// replicaMissing means the replica does not have the segment.
+	replicaMissing
+	// replicaMismatch means the replica holds different data than the record.
+	replicaMismatch
+	// replicaFailed means the replica could not be reached or errored; it may be down
+	// rather than missing the data, so it is not repaired.
+	replicaFailed
+)
+
+// readRepairer re-replicates segments that a read found missing or corrupted on some of
+// their replicas, copying from the replica that served the read.
+type readRepairer struct {
+	ring   *chash.Ring
+	nodes  int
+	videos *catalog.Store
+
+	mu       sync.Mutex
+	inflight map[string]bool
+}
+
+func newReadRepairer(ring *chash.Ring, nodes int, videos *catalog.Store) *readRepairer {
+	return &readRepairer{ring: ring, nodes: nodes, videos: videos, inflight: map[string]bool{}}
+}
+
+// schedule repairs the bad replicas of a segment in the background, unless a repair of
+// the same segment is already running.
+func (rr *readRepairer) schedule(loc segLocResp, idx, good string, bad []string) {
+	objectPath := loc.Video + "/" + loc.Rend + "/" + idx
+	rr.mu.Lock()
+	if rr.inflight[objectPath] {
+		rr.mu.Unlock()
+		return
+	}
+	rr.inflight[objectPath] = true
+	rr.mu.Unlock()
+	go func() {
+		defer func() {
+			rr.mu.Lock()
+			delete(rr.inflight, objectPath)
+			rr.mu.Unlock()
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), readRepairTimeout)
+		defer cancel()
+		if err := rr.repair(ctx, loc, idx, good, bad); err != nil {
+			log.Printf("read repair of %s: %v", objectPath, err)
+		}
+	}()
+}
+
+// repair rewrites every bad replica from good. A replica that cannot take the copy is
+// replaced by the next node on the ring that can, and the segment record is updated to
+// list the replacement.
+func (rr *readRepairer) repair(ctx context.Context, loc segLocResp, idx, good string, bad []string) error {
+	objectPath := loc.Video + "/" + loc.Rend + "/" + idx
+	replaced := map[string]string{}
+	listed := map[string]bool{}
+	for _, base := range loc.Replicas {
+		listed[base] = true
+	}
+	var candidates []string
+	for _, base := range bad {
+		err := copySegment(ctx, good, base, objectPath, loc.SHA256)
+		if err == nil {
+			readRepairStats.Add("repaired", 1)
+			continue
+		}
+		log.Printf("read repair: failed to rewrite %s on %s: %v", objectPath, base, err)
+		if candidates == nil {
+			// The metadata service places segments by their normalised index.
+			key := idx
+			if n, init, err := catalog.ParseSegmentIndex(idx); err == nil && !init {
+				key = strconv.Itoa(n)
+			}
+			candidates = rr.ring.Lookup([]byte(loc.Video+"|"+loc.Rend+"|"+key), rr.nodes)
+		}
+		for _, node := range candidates {
+			if listed[node] {
+				continue
+			}
+			listed[node] = true
+			if err := copySegment(ctx, good, node, objectPath, loc.SHA256); err == nil {
+				replaced[base] = node
+				break
+			}
+		}
+		if _, ok := replaced[base]; !ok {
+			readRepairStats.Add("failed", 1)
+		}
+	}
+	if len(replaced) == 0 {
+		return nil
+	}
+	_, err := rr.videos.UpdateSegment(ctx, loc.Video, loc.Rend, idx, func(seg *catalog.Segment) error {
+		for i, base := range seg.Replicas {
+			if node, ok := replaced[base]; ok {
+				seg.Replicas[i] = node
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		readRepairStats.Add("failed", int64(len(replaced)))
+		return fmt.Errorf("failed to update replicas: %w", err)
+	}
+	readRepairStats.Add("relocated", int64(len(replaced)))
+	return nil
+}
+
+// copySegment streams a segment from one storage node to another. The target verifies
+// the body against sum when it is known.
+func copySegment(ctx context.Context, from, to, objectPath, sum string) error {
+	reqGet, _ := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(from, "/")+"/blob/videos/"+objectPath, nil)
+	respGet, err := http.DefaultClient.Do(reqGet)
+	if err != nil {
+		return err
+	}
+	defer respGet.Body.Close()
+	if respGet.StatusCode != http.StatusOK {
+		return fmt.Errorf("source %s answered %s", from, respGet.Status)
+	}
+	reqPut, _ := http.NewRequestWithContext(ctx, http.MethodPut, strings.TrimRight(to, "/")+"/blob/videos/"+objectPath, respGet.Body)
+	reqPut.ContentLength = respGet.ContentLength
+	if sum != "" {
+		reqPut.Header.Set(storage.ChecksumHeader, sum)
+	}
+	respPut, err := http.DefaultClient.Do(reqPut)
+	if err != nil {
+		return err
+	}
+	defer respPut.Body.Close()
+	if respPut.StatusCode != http.StatusCreated {
+		return errors.New("target answered " + respPut.Status)
+	}
+	return nil
+}
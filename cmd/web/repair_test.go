@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tritontube/internal/catalog"
+	"tritontube/internal/chash"
+	"tritontube/internal/metadata"
+	"tritontube/internal/metadata/etcdsim"
+	grpc "tritontube/internal/metadata/grpcstub"
+	"tritontube/internal/metadata/pgxsim"
+	"tritontube/internal/storage"
+)
+
+// blobNode serves /blob/ from a filesystem the way cmd/storage does. status, when set,
+// answers every request instead, and rejectPuts fails uploads.
+type blobNode struct {
+	*httptest.Server
+	fs         *storage.FS
+	status     int
+	rejectPuts bool
+}
+
+func newBlobNode(t *testing.T) *blobNode {
+	t.Helper()
+	n := &blobNode{fs: storage.NewFS(t.TempDir())}
+	n.Server = httptest.NewServer(http.HandlerFunc(n.serve))
+	t.Cleanup(n.Close)
+	return n
+}
+
+func (n *blobNode) serve(w http.ResponseWriter, r *http.Request) {
+	if n.status != 0 {
+		http.Error(w, http.StatusText(n.status), n.status)
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/blob/"), "/", 2)
+	if len(parts) != 2 {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		if n.rejectPuts {
+			http.Error(w, "disk full", http.StatusInsufficientStorage)
+			return
+		}
+		if _, _, err := n.fs.PutVerified(parts[0], parts[1], r.Body, r.Header.Get(storage.ChecksumHeader)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	default:
+		f, info, err := n.fs.Open(parts[0], parts[1])
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("ETag", info.ETag())
+		http.ServeContent(w, r, "", info.ModTime, f)
+	}
+}
+
+func (n *blobNode) put(t *testing.T, objectPath, data string) string {
+	t.Helper()
+	_, sum, err := n.fs.Put("videos", objectPath, strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to store %s: %v", objectPath, err)
+	}
+	return sum
+}
+
+func (n *blobNode) read(objectPath string) (string, error) {
+	f, err := n.fs.Get("videos", objectPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var b strings.Builder
+	_, err = io.Copy(&b, f)
+	return b.String(), err
+}
+
+func newTestCatalog(t *testing.T) *catalog.Store {
+	t.Helper()
+	etcd, err := etcdsim.New(etcdsim.Config{})
+	if err != nil {
+		t.Fatalf("failed to create etcd sim: %v", err)
+	}
+	meta, err := metadata.NewService(metadata.ServiceConfig{WritePool: pgxsim.NewPool(pgxsim.NewStore()), Etcd: etcd})
+	if err != nil {
+		t.Fatalf("failed to create metadata service: %v", err)
+	}
+	rpc := grpc.NewServer()
+	metadata.RegisterMetadataServiceServer(rpc, meta)
+	videos, err := catalog.NewStore(metadata.NewMetadataServiceClient(rpc.NewInProcessConn()))
+	if err != nil {
+		t.Fatalf("failed to create catalog: %v", err)
+	}
+	return videos
+}
+
+func TestProxySegmentOutcomes(t *testing.T) {
+	const objectPath = "v1/720p/3"
+	good, missing, stale, broken := newBlobNode(t), newBlobNode(t), newBlobNode(t), newBlobNode(t)
+	sum := good.put(t, objectPath, "segment data")
+	stale.put(t, objectPath, "other data")
+	broken.status = http.StatusInternalServerError
+	down := newBlobNode(t)
+	down.Close()
+
+	for _, tc := range []struct {
+		name string
+		node *blobNode
+		want replicaOutcome
+	}{
+		{"served", good, replicaServed},
+		{"missing", missing, replicaMissing},
+		{"mismatch", stale, replicaMismatch},
+		{"failed", broken, replicaFailed},
+		{"unreachable", down, replicaFailed},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/v/"+objectPath, nil)
+		r.Header.Set("Range", "bytes=8-")
+		w := httptest.NewRecorder()
+		if got := proxySegment(w, r, tc.node.URL+"/blob/videos/"+objectPath, sum); got != tc.want {
+			t.Fatalf("%s: got outcome %d, want %d", tc.name, got, tc.want)
+		}
+		if tc.want != replicaServed {
+			// Nothing may reach the player before the next replica is tried.
+			if w.Body.Len() != 0 || len(w.Header()) != 0 {
+				t.Fatalf("%s: wrote %q with headers %v", tc.name, w.Body.String(), w.Header())
+			}
+			continue
+		}
+		if w.Code != http.StatusPartialContent || w.Body.String() != "data" {
+			t.Fatalf("%s: relayed %d %q", tc.name, w.Code, w.Body.String())
+		}
+		if w.Header().Get("ETag") == "" || w.Header().Get("Content-Range") == "" {
+			t.Fatalf("%s: headers not relayed: %v", tc.name, w.Header())
+		}
+	}
+
+	// Without a recorded checksum any copy is served.
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodHead, "/v/"+objectPath, nil)
+	if got := proxySegment(w, r, stale.URL+"/blob/videos/"+objectPath, ""); got != replicaServed || w.Body.Len() != 0 {
+		t.Fatalf("expected an unchecked HEAD to be served without a body, got %d %q", got, w.Body.String())
+	}
+}
+
+func TestReadRepairRewritesInPlace(t *testing.T) {
+	ctx := context.Background()
+	const objectPath = "v1/720p/3"
+	good, missing, stale := newBlobNode(t), newBlobNode(t), newBlobNode(t)
+	sum := good.put(t, objectPath, "segment data")
+	stale.put(t, objectPath, "other data")
+	videos := newTestCatalog(t)
+	replicas := []string{good.URL, missing.URL, stale.URL}
+	recorded := &catalog.Segment{VideoID: "v1", Rendition: "720p", Index: 3, Replicas: replicas, SHA256: sum}
+	if err := videos.PutSegment(ctx, recorded); err != nil {
+		t.Fatalf("failed to record segment: %v", err)
+	}
+	ring := chash.NewRing(16)
+	for _, base := range replicas {
+		ring.AddNode(base)
+	}
+
+	rr := newReadRepairer(ring, len(replicas), videos)
+	loc := segLocResp{Video: "v1", Rend: "720p", Idx: 3, Replicas: replicas, SHA256: sum}
+	if err := rr.repair(ctx, loc, "3", good.URL, []string{missing.URL, stale.URL}); err != nil {
+		t.Fatalf("repair failed: %v", err)
+	}
+	for _, node := range []*blobNode{missing, stale} {
+		if data, err := node.read(objectPath); err != nil || data != "segment data" {
+			t.Fatalf("replica %s not rewritten: %q %v", node.URL, data, err)
+		}
+	}
+	seg, err := videos.GetSegment(ctx, "v1", "720p", "3")
+	if err != nil {
+		t.Fatalf("failed to read segment: %v", err)
+	}
+	if strings.Join(seg.Replicas, ",") != strings.Join(replicas, ",") || seg.Version != recorded.Version {
+		t.Fatalf("expected the record to be left alone, got %+v", seg)
+	}
+}
+
+func TestReadRepairRelocatesReplica(t *testing.T) {
+	ctx := context.Background()
+	const objectPath = "v1/720p/3"
+	good, full, spare := newBlobNode(t), newBlobNode(t), newBlobNode(t)
+	sum := good.put(t, objectPath, "segment data")
+	full.rejectPuts = true
+	videos := newTestCatalog(t)
+	replicas := []string{good.URL, full.URL}
+	if err := videos.PutSegment(ctx, &catalog.Segment{VideoID: "v1", Rendition: "720p", Index: 3, Replicas: replicas, SHA256: sum}); err != nil {
+		t.Fatalf("failed to record segment: %v", err)
+	}
+	ring := chash.NewRing(16)
+	for _, node := range []*blobNode{good, full, spare} {
+		ring.AddNode(node.URL)
+	}
+
+	rr := newReadRepairer(ring, 3, videos)
+	loc := segLocResp{Video: "v1", Rend: "720p", Idx: 3, Replicas: replicas, SHA256: sum}
+	if err := rr.repair(ctx, loc, "3", good.URL, []string{full.URL}); err != nil {
+		t.Fatalf("repair failed: %v", err)
+	}
+	if data, err := spare.read(objectPath); err != nil || data != "segment data" {
+		t.Fatalf("segment not copied to the spare node: %q %v", data, err)
+	}
+	seg, err := videos.GetSegment(ctx, "v1", "720p", "3")
+	if err != nil {
+		t.Fatalf("failed to read segment: %v", err)
+	}
+	if got := strings.Join(seg.Replicas, ","); got != good.URL+","+spare.URL {
+		t.Fatalf("expected %s to replace %s, got %s", spare.URL, full.URL, got)
+	}
+
+	// A copy that no node can take leaves the record alone.
+	spare.rejectPuts = true
+	loc.Replicas = seg.Replicas
+	if err := rr.repair(ctx, loc, "3", good.URL, []string{spare.URL}); err != nil {
+		t.Fatalf("repair failed: %v", err)
+	}
+	after, err := videos.GetSegment(ctx, "v1", "720p", "3")
+	if err != nil || after.Version != seg.Version {
+		t.Fatalf("expected the record to be left alone, got %+v (%v)", after, err)
+	}
+}
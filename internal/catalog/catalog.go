@@ -0,0 +1,183 @@
+package catalog
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"tritontube/internal/metadata"
+	grpc "tritontube/internal/metadata/grpcstub"
+	webapipb "tritontube/internal/webapi/proto"
+)
+
+// VideoKeyPrefix is the metadata key prefix under which video records are stored.
+const VideoKeyPrefix = "video/"
+
+// Video is the JSON document persisted at video/<id> in the metadata service.
+type Video struct {
+	ID              string                     `json:"id"`
+	OwnerID         string                     `json:"owner_id,omitempty"`
+	Title           string                     `json:"title,omitempty"`
+	Description     string                     `json:"description,omitempty"`
+	Tags            []string                   `json:"tags,omitempty"`
+	ThumbnailURL    string                     `json:"thumbnail_url,omitempty"`
+	DurationSeconds int64                      `json:"duration_seconds,omitempty"`
+	Status          webapipb.VideoStatus       `json:"status"`
+	ProgressPercent float64                    `json:"progress_percent,omitempty"`
+	FailureReason   string                     `json:"failure_reason,omitempty"`
+	Renditions      []*webapipb.VideoRendition `json:"renditions,omitempty"`
+	ManifestPath    string                     `json:"manifest_path,omitempty"`
+	HLSManifestPath string                     `json:"hls_manifest_path,omitempty"`
+	SourceBucket    string                     `json:"source_bucket,omitempty"`
+	SourceKey       string                     `json:"source_key,omitempty"`
+	SourceChecksum  string                     `json:"source_checksum,omitempty"`
+	SourceSizeBytes int64                      `json:"source_size_bytes,omitempty"`
+	CreatedAt       time.Time                  `json:"created_at"`
+	UpdatedAt       time.Time                  `json:"updated_at"`
+
+	// Version is the metadata item version the record was read at. It is used as an
+	// If-Match guard on the next write and is not part of the stored document.
+	Version int64 `json:"-"`
+}
+
+// Summary converts the record into the public VideoSummary message.
+func (v *Video) Summary() *webapipb.VideoSummary {
+	return &webapipb.VideoSummary{
+		VideoId:         v.ID,
+		Title:           v.Title,
+		Description:     v.Description,
+		ThumbnailUrl:    v.ThumbnailURL,
+		Status:          v.Status,
+		Tags:            append([]string(nil), v.Tags...),
+		DurationSeconds: v.DurationSeconds,
+		OwnerId:         v.OwnerID,
+	}
+}
+
+// Store reads and writes video records through the metadata service.
+type Store struct {
+	client metadata.MetadataServiceClient
+	clock  func() time.Time
+}
+
+// NewStore constructs a Store backed by the metadata service client.
+func NewStore(client metadata.MetadataServiceClient) (*Store, error) {
+	if client == nil {
+		return nil, errors.New("catalog: metadata client is required")
+	}
+	return &Store{client: client, clock: time.Now}, nil
+}
+
+// VideoKey returns the metadata key for the video.
+func VideoKey(id string) string {
+	return VideoKeyPrefix + id
+}
+
+// Get loads a video record. Missing records surface as grpcstub.NotFound.
+func (s *Store) Get(ctx context.Context, id string) (*Video, error) {
+	if id == "" {
+		return nil, grpc.Errorf(grpc.InvalidArgument, "catalog: video id is required")
+	}
+	resp, err := s.client.GetMetadata(ctx, &metadata.GetMetadataRequest{Key: VideoKey(id)})
+	if err != nil {
+		return nil, err
+	}
+	return decodeVideo(resp.Item)
+}
+
+// Put writes the record. When v.Version is non-zero the write only succeeds if the
+// stored version still matches, mirroring an HTTP If-Match precondition. On success
+// v.Version is advanced to the new version.
+func (s *Store) Put(ctx context.Context, v *Video) error {
+	if v == nil || v.ID == "" {
+		return grpc.Errorf(grpc.InvalidArgument, "catalog: video id is required")
+	}
+	now := s.clock().UTC()
+	if v.CreatedAt.IsZero() {
+		v.CreatedAt = now
+	}
+	v.UpdatedAt = now
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("catalog: failed to encode video %s: %w", v.ID, err)
+	}
+	resp, err := s.client.PutMetadata(ctx, &metadata.PutMetadataRequest{
+		Item:                 &metadata.MetadataItem{Key: VideoKey(v.ID), Value: string(encoded)},
+		ExpectedVersion:      v.Version,
+		ExpectedEtcdRevision: -1,
+	})
+	if err != nil {
+		return err
+	}
+	v.Version = resp.Item.Version
+	return nil
+}
+
+// Update applies fn to the latest copy of the record and writes it back, retrying when
+// a concurrent writer wins the version race. Returning an error from fn aborts the update.
+func (s *Store) Update(ctx context.Context, id string, fn func(*Video) error) (*Video, error) {
+	const attempts = 5
+	var lastErr error
+	for i := 0; i < attempts; i++ {
+		v, err := s.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if err := fn(v); err != nil {
+			return nil, err
+		}
+		err = s.Put(ctx, v)
+		if err == nil {
+			return v, nil
+		}
+		if grpc.CodeOf(err) != grpc.FailedPrecondition {
+			return nil, err
+		}
+		lastErr = err
+	}
+	return nil, grpc.Errorf(grpc.Aborted, "catalog: update of %s kept conflicting: %v", id, lastErr)
+}
+
+// List returns up to limit records after pageToken in key order, along with the token
+// for the following page.
+func (s *Store) List(ctx context.Context, pageToken string, limit int) ([]*Video, string, error) {
+	resp, err := s.client.ListMetadata(ctx, &metadata.ListMetadataRequest{
+		Prefix:    VideoKeyPrefix,
+		Limit:     int32(limit),
+		PageToken: pageToken,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	out := make([]*Video, 0, len(resp.Items))
+	for _, item := range resp.Items {
+		// Only direct children of video/ are records; deeper keys belong to other subsystems.
+		if strings.Contains(strings.TrimPrefix(item.Key, VideoKeyPrefix), "/") {
+			continue
+		}
+		v, err := decodeVideo(item)
+		if err != nil {
+			continue
+		}
+		out = append(out, v)
+	}
+	return out, resp.NextPageToken, nil
+}
+
+func decodeVideo(item *metadata.MetadataItem) (*Video, error) {
+	if item == nil {
+		return nil, grpc.Errorf(grpc.NotFound, "catalog: empty metadata item")
+	}
+	var v Video
+	if err := json.Unmarshal([]byte(item.Value), &v); err != nil {
+		return nil, fmt.Errorf("catalog: failed to decode %s: %w", item.Key, err)
+	}
+	if v.ID == "" {
+		v.ID = strings.TrimPrefix(item.Key, VideoKeyPrefix)
+	}
+	v.Version = item.Version
+	return &v, nil
+}
@@ -0,0 +1,191 @@
+package catalog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"tritontube/internal/metadata"
+	grpc "tritontube/internal/metadata/grpcstub"
+)
+
+// SegmentKeyPrefix is the metadata key prefix under which segment records are stored.
+const SegmentKeyPrefix = "segment/"
+
+// InitSegment is the idx used for a rendition's initialization segment.
+const InitSegment = "init"
+
+// DefaultSegmentMillis is assumed for segments uploaded without a duration.
+const DefaultSegmentMillis = 4000
+
+// Segment is the JSON document persisted at segment/<id>/<rend>/<idx> when a segment
+// is uploaded through cmd/web.
+type Segment struct {
+	VideoID   string `json:"video"`
+	Rendition string `json:"rend"`
+	Index     int    `json:"idx"`
+	// Init marks the initialization segment, stored at idx "init".
+	Init           bool     `json:"init,omitempty"`
+	DurationMillis int64    `json:"duration_ms,omitempty"`
+	Replicas       []string `json:"replicas"`
+	// SHA256 is the hex checksum the replicas acknowledged on upload. Records written
+	// before checksums were kept have none.
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Version is the metadata item version the record was read at, used as an If-Match
+	// guard on the next write. It is not part of the stored document.
+	Version int64 `json:"-"`
+}
+
+// Duration returns the segment duration in milliseconds, falling back to
+// DefaultSegmentMillis for records written without one.
+func (s *Segment) Duration() int64 {
+	if s.DurationMillis > 0 {
+		return s.DurationMillis
+	}
+	return DefaultSegmentMillis
+}
+
+// SegmentKey returns the metadata key for a segment. idx is a decimal segment number
+// or InitSegment.
+func SegmentKey(videoID, rendition, idx string) string {
+	return SegmentKeyPrefix + videoID + "/" + rendition + "/" + idx
+}
+
+// ParseSegmentIndex normalises an idx path element. It reports init for InitSegment
+// and rejects anything that is not a non-negative decimal number.
+func ParseSegmentIndex(idx string) (n int, init bool, err error) {
+	if idx == InitSegment {
+		return 0, true, nil
+	}
+	n, err = strconv.Atoi(idx)
+	if err != nil || n < 0 {
+		return 0, false, grpc.Errorf(grpc.InvalidArgument, "catalog: bad segment index %q", idx)
+	}
+	return n, false, nil
+}
+
+// segmentIndex returns the idx key element for a segment record.
+func segmentIndex(seg *Segment) string {
+	if seg.Init {
+		return InitSegment
+	}
+	return strconv.Itoa(seg.Index)
+}
+
+// GetSegment loads a segment record. idx is a decimal segment number or InitSegment.
+// Missing records surface as grpcstub.NotFound.
+func (s *Store) GetSegment(ctx context.Context, videoID, rendition, idx string) (*Segment, error) {
+	if videoID == "" || rendition == "" {
+		return nil, grpc.Errorf(grpc.InvalidArgument, "catalog: video id and rendition are required")
+	}
+	n, init, err := ParseSegmentIndex(idx)
+	if err != nil {
+		return nil, err
+	}
+	if !init {
+		idx = strconv.Itoa(n)
+	}
+	resp, err := s.client.GetMetadata(ctx, &metadata.GetMetadataRequest{Key: SegmentKey(videoID, rendition, idx)})
+	if err != nil {
+		return nil, err
+	}
+	var seg Segment
+	if err := json.Unmarshal([]byte(resp.Item.Value), &seg); err != nil {
+		return nil, fmt.Errorf("catalog: failed to decode %s: %w", resp.Item.Key, err)
+	}
+	seg.Version = resp.Item.Version
+	return &seg, nil
+}
+
+// PutSegment writes a segment record, guarded by seg.Version like Put. On success
+// seg.Version is advanced to the new version.
+func (s *Store) PutSegment(ctx context.Context, seg *Segment) error {
+	if seg == nil || seg.VideoID == "" || seg.Rendition == "" {
+		return grpc.Errorf(grpc.InvalidArgument, "catalog: video id and rendition are required")
+	}
+	encoded, err := json.Marshal(seg)
+	if err != nil {
+		return fmt.Errorf("catalog: failed to encode segment: %w", err)
+	}
+	resp, err := s.client.PutMetadata(ctx, &metadata.PutMetadataRequest{
+		Item:                 &metadata.MetadataItem{Key: SegmentKey(seg.VideoID, seg.Rendition, segmentIndex(seg)), Value: string(encoded)},
+		ExpectedVersion:      seg.Version,
+		ExpectedEtcdRevision: -1,
+	})
+	if err != nil {
+		return err
+	}
+	seg.Version = resp.Item.Version
+	return nil
+}
+
+// UpdateSegment applies fn to the latest copy of a segment record and writes it back,
+// retrying on version conflicts like Update.
+func (s *Store) UpdateSegment(ctx context.Context, videoID, rendition, idx string, fn func(*Segment) error) (*Segment, error) {
+	const attempts = 5
+	var lastErr error
+	for i := 0; i < attempts; i++ {
+		seg, err := s.GetSegment(ctx, videoID, rendition, idx)
+		if err != nil {
+			return nil, err
+		}
+		if err := fn(seg); err != nil {
+			return nil, err
+		}
+		err = s.PutSegment(ctx, seg)
+		if err == nil {
+			return seg, nil
+		}
+		if grpc.CodeOf(err) != grpc.FailedPrecondition {
+			return nil, err
+		}
+		lastErr = err
+	}
+	return nil, grpc.Errorf(grpc.Aborted, "catalog: update of segment %s/%s/%s kept conflicting: %v", videoID, rendition, idx, lastErr)
+}
+
+// ListSegments returns every segment record of the video ordered by rendition, with the
+// initialization segment first and media segments in numeric order.
+func (s *Store) ListSegments(ctx context.Context, videoID string) ([]*Segment, error) {
+	if videoID == "" {
+		return nil, grpc.Errorf(grpc.InvalidArgument, "catalog: video id is required")
+	}
+	var out []*Segment
+	token := ""
+	for {
+		resp, err := s.client.ListMetadata(ctx, &metadata.ListMetadataRequest{
+			Prefix:    SegmentKeyPrefix + videoID + "/",
+			Limit:     500,
+			PageToken: token,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range resp.Items {
+			var seg Segment
+			if err := json.Unmarshal([]byte(item.Value), &seg); err != nil {
+				continue
+			}
+			out = append(out, &seg)
+		}
+		if resp.NextPageToken == "" {
+			break
+		}
+		token = resp.NextPageToken
+	}
+	// Keys sort lexicographically (10 before 2), so order numerically here.
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if a.Rendition != b.Rendition {
+			return a.Rendition < b.Rendition
+		}
+		if a.Init != b.Init {
+			return a.Init
+		}
+		return a.Index < b.Index
+	})
+	return out, nil
+}
@@ -0,0 +1,145 @@
+package catalog
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"tritontube/internal/metadata"
+	"tritontube/internal/metadata/etcdsim"
+	grpc "tritontube/internal/metadata/grpcstub"
+	"tritontube/internal/metadata/pgxsim"
+)
+
+func newTestClient(t *testing.T) metadata.MetadataServiceClient {
+	t.Helper()
+	etcd, err := etcdsim.New(etcdsim.Config{})
+	if err != nil {
+		t.Fatalf("failed to create etcd sim: %v", err)
+	}
+	meta, err := metadata.NewService(metadata.ServiceConfig{WritePool: pgxsim.NewPool(pgxsim.NewStore()), Etcd: etcd})
+	if err != nil {
+		t.Fatalf("failed to create metadata service: %v", err)
+	}
+	rpc := grpc.NewServer()
+	metadata.RegisterMetadataServiceServer(rpc, meta)
+	return metadata.NewMetadataServiceClient(rpc.NewInProcessConn())
+}
+
+// racingClient lets a competing writer update a segment record just before each of the
+// first races writes through it, so that those writes conflict.
+type racingClient struct {
+	metadata.MetadataServiceClient
+	races int
+	race  func(ctx context.Context)
+}
+
+func (c *racingClient) PutMetadata(ctx context.Context, in *metadata.PutMetadataRequest, opts ...grpc.CallOption) (*metadata.PutMetadataResponse, error) {
+	if c.races > 0 && strings.HasPrefix(in.Item.Key, SegmentKeyPrefix) {
+		c.races--
+		c.race(ctx)
+	}
+	return c.MetadataServiceClient.PutMetadata(ctx, in, opts...)
+}
+
+func TestUpdateSegmentRetriesConflicts(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+	direct, err := NewStore(client)
+	if err != nil {
+		t.Fatalf("failed to create catalog: %v", err)
+	}
+	if err := direct.PutSegment(ctx, &Segment{VideoID: "v1", Rendition: "720p", Index: 3, Replicas: []string{"node-a", "node-b"}}); err != nil {
+		t.Fatalf("failed to create segment: %v", err)
+	}
+	racing := &racingClient{MetadataServiceClient: client, races: 1}
+	racing.race = func(ctx context.Context) {
+		_, err := direct.UpdateSegment(ctx, "v1", "720p", "3", func(seg *Segment) error {
+			seg.SHA256 = "abc"
+			return nil
+		})
+		if err != nil {
+			t.Errorf("competing update failed: %v", err)
+		}
+	}
+	videos, err := NewStore(racing)
+	if err != nil {
+		t.Fatalf("failed to create catalog: %v", err)
+	}
+
+	calls := 0
+	relocate := func(seg *Segment) error {
+		calls++
+		for i, node := range seg.Replicas {
+			if node == "node-b" {
+				seg.Replicas[i] = "node-c"
+			}
+		}
+		return nil
+	}
+	// The idx is normalised, so "03" updates the record written as 3.
+	seg, err := videos.UpdateSegment(ctx, "v1", "720p", "03", relocate)
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("expected the update to be applied again after the conflict, applied %d times", calls)
+	}
+	stored, err := direct.GetSegment(ctx, "v1", "720p", "3")
+	if err != nil {
+		t.Fatalf("failed to read segment: %v", err)
+	}
+	if got := strings.Join(stored.Replicas, ","); got != "node-a,node-c" || stored.SHA256 != "abc" {
+		t.Fatalf("expected both updates to be kept, got %+v", stored)
+	}
+	if seg.Version != stored.Version {
+		t.Fatalf("returned version %d, stored %d", seg.Version, stored.Version)
+	}
+
+	// An update that conflicts on every attempt gives up.
+	racing.races = 10
+	if _, err := videos.UpdateSegment(ctx, "v1", "720p", "3", relocate); grpc.CodeOf(err) != grpc.Aborted {
+		t.Fatalf("expected Aborted after repeated conflicts, got %v", err)
+	}
+	if _, err := videos.UpdateSegment(ctx, "v1", "720p", "4", relocate); grpc.CodeOf(err) != grpc.NotFound {
+		t.Fatalf("expected NotFound for a missing segment, got %v", err)
+	}
+}
+
+func TestListSegmentsOrder(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+	videos, err := NewStore(client)
+	if err != nil {
+		t.Fatalf("failed to create catalog: %v", err)
+	}
+	for _, seg := range []*Segment{
+		{VideoID: "v1", Rendition: "720p", Index: 10},
+		{VideoID: "v1", Rendition: "720p", Index: 2},
+		{VideoID: "v1", Rendition: "720p", Init: true},
+		{VideoID: "v1", Rendition: "360p", Index: 1},
+		{VideoID: "v10", Rendition: "720p", Index: 1},
+	} {
+		if err := videos.PutSegment(ctx, seg); err != nil {
+			t.Fatalf("failed to store segment: %v", err)
+		}
+	}
+	// Undecodable records are skipped.
+	if _, err := client.PutMetadata(ctx, &metadata.PutMetadataRequest{Item: &metadata.MetadataItem{Key: SegmentKey("v1", "720p", "5"), Value: "{"}, ExpectedEtcdRevision: -1}); err != nil {
+		t.Fatalf("failed to store bad record: %v", err)
+	}
+	segments, err := videos.ListSegments(ctx, "v1")
+	if err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	var got []string
+	for _, seg := range segments {
+		got = append(got, seg.Rendition+"/"+segmentIndex(seg))
+	}
+	if strings.Join(got, ",") != "360p/1,720p/init,720p/2,720p/10" {
+		t.Fatalf("unexpected order %v", got)
+	}
+	if _, err := videos.GetSegment(ctx, "v1", "720p", "-1"); grpc.CodeOf(err) != grpc.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for a negative idx, got %v", err)
+	}
+}
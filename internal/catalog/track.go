@@ -0,0 +1,108 @@
+package catalog
+
+import (
+	"regexp"
+	"strconv"
+)
+
+// DefaultCodecs is advertised for renditions produced by the H.264 transcode ladder.
+const DefaultCodecs = "avc1.640028"
+
+// Track is the playable part of one rendition: its initialization segment, if any, and
+// the contiguous run of media segments starting at the lowest index. Segments after a
+// gap are left out until the gap is filled, since a player could not play past it.
+type Track struct {
+	Rendition string
+	Height    int
+	Width     int
+	// Bandwidth is the peak bitrate in bits per second.
+	Bandwidth int64
+	Init      *Segment
+	Segments  []*Segment
+}
+
+// DurationMillis returns the total duration of the track's media segments.
+func (t *Track) DurationMillis() int64 {
+	var total int64
+	for _, seg := range t.Segments {
+		total += seg.Duration()
+	}
+	return total
+}
+
+// Tracks groups segments, sorted as returned by ListSegments, into one Track per
+// rendition that has at least one media segment. video may be nil; when set, the
+// bitrates recorded by the transcoder are preferred over estimates from the height.
+func Tracks(video *Video, segments []*Segment) []*Track {
+	byRendition := map[string]*Track{}
+	var out []*Track
+	for _, seg := range segments {
+		t, ok := byRendition[seg.Rendition]
+		if !ok {
+			t = &Track{Rendition: seg.Rendition}
+			byRendition[seg.Rendition] = t
+			out = append(out, t)
+		}
+		if seg.Init {
+			t.Init = seg
+			continue
+		}
+		if n := len(t.Segments); n > 0 {
+			prev := t.Segments[n-1].Index
+			if seg.Index != prev+1 {
+				continue
+			}
+		}
+		t.Segments = append(t.Segments, seg)
+	}
+
+	playable := out[:0]
+	for _, t := range out {
+		if len(t.Segments) == 0 {
+			continue
+		}
+		t.Height = heightOf(t.Rendition)
+		t.Width = widthFor(t.Height)
+		t.Bandwidth = bandwidthOf(video, t.Rendition, t.Height)
+		playable = append(playable, t)
+	}
+	return playable
+}
+
+var heightPattern = regexp.MustCompile(`^(\d+)p`)
+
+func heightOf(rendition string) int {
+	m := heightPattern.FindStringSubmatch(rendition)
+	if m == nil {
+		return 0
+	}
+	h, _ := strconv.Atoi(m[1])
+	return h
+}
+
+func widthFor(height int) int {
+	w := height * 16 / 9
+	return w + w%2
+}
+
+func bandwidthOf(video *Video, rendition string, height int) int64 {
+	if video != nil {
+		for _, r := range video.Renditions {
+			if r.Quality == rendition && r.BitrateKbps > 0 {
+				return int64(r.BitrateKbps) * 1000
+			}
+		}
+	}
+	switch {
+	case height >= 1080:
+		return 5_000_000
+	case height >= 720:
+		return 2_800_000
+	case height >= 480:
+		return 1_400_000
+	case height > 0:
+		return 800_000
+	default:
+		return 1_000_000
+	}
+}
@@ -0,0 +1,350 @@
+package chash
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Placement maps keys to the nodes that hold their replicas. Every implementation is
+// built from the same weighted tokens, so a node's share of keys follows its number of
+// virtual nodes whichever algorithm places them.
+type Placement interface {
+	// Lookup returns up to replicas distinct nodes for key, primary first.
+	Lookup(key []byte, replicas int) []string
+	// LookupHash is Lookup for a key already hashed with HashKey.
+	LookupHash(h uint64, replicas int) []string
+	// SetFailureDomain labels a node so replicas spread across zones and racks.
+	SetFailureDomain(nodeID string, domain FailureDomain)
+	// Tokens returns the virtual nodes the placement was built from.
+	Tokens() []Token
+}
+
+var (
+	_ Placement = (*Ring)(nil)
+	_ Placement = (*Rendezvous)(nil)
+	_ Placement = (*BoundedLoad)(nil)
+)
+
+// Algorithm names a Placement implementation.
+type Algorithm string
+
+const (
+	// AlgorithmRing walks the consistent hash ring clockwise.
+	AlgorithmRing Algorithm = "ring"
+	// AlgorithmRendezvous ranks nodes by highest random weight (HRW) per key.
+	AlgorithmRendezvous Algorithm = "rendezvous"
+	// AlgorithmBoundedLoad is the ring with each node's primary share capped at
+	// DefaultLoadFactor times its fair share.
+	AlgorithmBoundedLoad Algorithm = "bounded-load"
+)
+
+// DefaultLoadFactor is the bound BoundedLoad places on a node's primary share relative
+// to its fair share.
+const DefaultLoadFactor = 1.25
+
+// Algorithms lists the supported algorithms.
+func Algorithms() []Algorithm {
+	return []Algorithm{AlgorithmRing, AlgorithmRendezvous, AlgorithmBoundedLoad}
+}
+
+// RangeStable reports whether the algorithm's replica sets only change at token
+// boundaries, so that token-range moves describe every change in placement.
+func (a Algorithm) RangeStable() bool {
+	return a != AlgorithmRendezvous
+}
+
+// NewPlacement builds the placement named by alg from tokens. The empty Algorithm is
+// the ring.
+func NewPlacement(alg Algorithm, tokens []Token) (Placement, error) {
+	switch alg {
+	case "", AlgorithmRing:
+		return NewRingFromTokens(tokens), nil
+	case AlgorithmRendezvous:
+		return NewRendezvous(tokens), nil
+	case AlgorithmBoundedLoad:
+		return NewBoundedLoad(tokens, DefaultLoadFactor), nil
+	default:
+		return nil, fmt.Errorf("chash: unknown placement algorithm %q", alg)
+	}
+}
+
+// FailureDomain locates a node for replica placement. Empty labels are unknown, and a
+// node with an unknown zone or rack is treated as the only member of its own.
+type FailureDomain struct {
+	Zone string
+	Rack string
+}
+
+type failureDomains map[string]FailureDomain
+
+func (d failureDomains) with(nodeID string, domain FailureDomain) failureDomains {
+	if d == nil {
+		d = failureDomains{}
+	}
+	d[nodeID] = domain
+	return d
+}
+
+// choose takes replicas from order, a list of distinct nodes in preference order. It
+// passes over order up to three times: first taking nodes in zones not yet used, then
+// nodes in racks not yet used, then any node not yet chosen.
+func (d failureDomains) choose(order []string, replicas int) []string {
+	if len(d) == 0 {
+		if len(order) > replicas {
+			order = order[:replicas]
+		}
+		return order
+	}
+	chosen := make(map[string]struct{}, replicas)
+	zones := map[string]struct{}{}
+	racks := map[string]struct{}{}
+	out := make([]string, 0, replicas)
+	for pass := 0; pass < 3 && len(out) < replicas; pass++ {
+		for _, n := range order {
+			if len(out) == replicas {
+				break
+			}
+			if _, ok := chosen[n]; ok {
+				continue
+			}
+			zone, rack := d.keys(n)
+			if _, ok := zones[zone]; ok && pass == 0 {
+				continue
+			}
+			if _, ok := racks[rack]; ok && pass <= 1 {
+				continue
+			}
+			chosen[n] = struct{}{}
+			zones[zone] = struct{}{}
+			racks[rack] = struct{}{}
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// keys returns the node's zone and rack keys; unknown labels fall back to the node
+// itself so that unlabelled nodes never share a domain.
+func (d failureDomains) keys(nodeID string) (zone, rack string) {
+	domain := d[nodeID]
+	zone, rack = domain.Zone, domain.Zone+"/"+domain.Rack
+	if domain.Zone == "" {
+		zone = "node:" + nodeID
+	}
+	if domain.Rack == "" {
+		rack = "node:" + nodeID
+	}
+	return zone, rack
+}
+
+// Rendezvous is highest-random-weight hashing over virtual nodes: every token scores
+// the key, and nodes are ranked by their best token. A node with k tokens wins a key
+// with probability proportional to k. Adding or removing a node only moves the keys it
+// wins or held, but replica sets change at arbitrary positions rather than at token
+// boundaries, and a lookup costs one hash per token.
+type Rendezvous struct {
+	tokens  []Token
+	domains failureDomains
+}
+
+// NewRendezvous builds a rendezvous placement from tokens.
+func NewRendezvous(tokens []Token) *Rendezvous {
+	p := &Rendezvous{tokens: make([]Token, len(tokens))}
+	copy(p.tokens, tokens)
+	return p
+}
+
+// Lookup implements Placement.
+func (p *Rendezvous) Lookup(key []byte, replicas int) []string {
+	return p.LookupHash(HashKey(key), replicas)
+}
+
+// LookupHash implements Placement.
+func (p *Rendezvous) LookupHash(h uint64, replicas int) []string {
+	if replicas <= 0 || len(p.tokens) == 0 {
+		return nil
+	}
+	best := map[string]uint64{}
+	for _, t := range p.tokens {
+		score := mix64(h ^ t.Hash)
+		if current, ok := best[t.Node]; !ok || score > current {
+			best[t.Node] = score
+		}
+	}
+	order := make([]string, 0, len(best))
+	for node := range best {
+		order = append(order, node)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		if best[order[i]] == best[order[j]] {
+			return order[i] < order[j]
+		}
+		return best[order[i]] > best[order[j]]
+	})
+	return p.domains.choose(order, replicas)
+}
+
+// SetFailureDomain implements Placement.
+func (p *Rendezvous) SetFailureDomain(nodeID string, domain FailureDomain) {
+	p.domains = p.domains.with(nodeID, domain)
+}
+
+// Tokens implements Placement.
+func (p *Rendezvous) Tokens() []Token {
+	out := make([]Token, len(p.tokens))
+	copy(out, p.tokens)
+	return out
+}
+
+// BoundedLoad is consistent hashing with bounded loads applied to ring arcs. Arcs are
+// assigned in token order to the first node clockwise whose primary share of the ring
+// stays within factor times its fair share (its fraction of the tokens); further
+// replicas follow clockwise from the arc as on the plain ring. Placement only changes at
+// token boundaries, and lookups cost the same as on the ring.
+type BoundedLoad struct {
+	ring      *Ring
+	primaries []string // primaries[i] owns the arc ending at ring.tokens[i]
+	domains   failureDomains
+}
+
+// NewBoundedLoad builds a bounded-load placement from tokens. A factor below 1 is
+// treated as 1.
+func NewBoundedLoad(tokens []Token, factor float64) *BoundedLoad {
+	if factor < 1 {
+		factor = 1
+	}
+	ring := NewRingFromTokens(tokens)
+	p := &BoundedLoad{ring: ring, primaries: make([]string, len(ring.tokens))}
+	n := len(ring.tokens)
+	if n == 0 {
+		return p
+	}
+	counts := map[string]int{}
+	for _, t := range ring.tokens {
+		counts[t.Node]++
+	}
+	const ringSize = float64(1 << 64)
+	load := map[string]float64{}
+	for i, t := range ring.tokens {
+		// Unsigned subtraction wraps, so the first arc spans the ring's zero point.
+		arc := float64(t.Hash - ring.tokens[(i+n-1)%n].Hash)
+		if n == 1 {
+			arc = ringSize
+		}
+		owner := t.Node
+		seen := map[string]struct{}{}
+		for k := 0; k < n && len(seen) < len(counts); k++ {
+			node := ring.tokens[(i+k)%n].Node
+			if _, ok := seen[node]; ok {
+				continue
+			}
+			seen[node] = struct{}{}
+			if load[node]+arc <= factor*ringSize*float64(counts[node])/float64(n) {
+				owner = node
+				break
+			}
+		}
+		p.primaries[i] = owner
+		load[owner] += arc
+	}
+	return p
+}
+
+// Lookup implements Placement.
+func (p *BoundedLoad) Lookup(key []byte, replicas int) []string {
+	return p.LookupHash(HashKey(key), replicas)
+}
+
+// LookupHash implements Placement.
+func (p *BoundedLoad) LookupHash(h uint64, replicas int) []string {
+	tokens := p.ring.tokens
+	if replicas <= 0 || len(tokens) == 0 {
+		return nil
+	}
+	i := sort.Search(len(tokens), func(i int) bool { return tokens[i].Hash >= h })
+	if i == len(tokens) {
+		i = 0
+	}
+	primary := p.primaries[i]
+	// The walk may include the primary, so take one extra node; spreading across
+	// failure domains needs every node.
+	limit := replicas + 1
+	if len(p.domains) > 0 {
+		limit = 0
+	}
+	order := []string{primary}
+	for _, node := range p.ring.walk(i, limit) {
+		if node != primary {
+			order = append(order, node)
+		}
+	}
+	return p.domains.choose(order, replicas)
+}
+
+// SetFailureDomain implements Placement.
+func (p *BoundedLoad) SetFailureDomain(nodeID string, domain FailureDomain) {
+	p.domains = p.domains.with(nodeID, domain)
+}
+
+// Tokens implements Placement.
+func (p *BoundedLoad) Tokens() []Token {
+	return p.ring.Tokens()
+}
+
+// mix64 is the splitmix64 finaliser.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// DistributionReport summarises how evenly a placement spreads primary replicas. Loads
+// are relative to each node's fair share, its fraction of the tokens, so 1 is perfect.
+type DistributionReport struct {
+	Nodes int
+	Keys  int
+	// Max and Min are the highest and lowest relative loads; StdDev is their spread.
+	Max    float64
+	Min    float64
+	StdDev float64
+}
+
+func (r DistributionReport) String() string {
+	return fmt.Sprintf("nodes=%d keys=%d max=%.3f min=%.3f stddev=%.3f", r.Nodes, r.Keys, r.Max, r.Min, r.StdDev)
+}
+
+// MeasureDistribution places keys synthetic keys and reports the primary load balance.
+func MeasureDistribution(p Placement, keys int) DistributionReport {
+	tokens := p.Tokens()
+	counts := map[string]int{}
+	for _, t := range tokens {
+		counts[t.Node]++
+	}
+	report := DistributionReport{Nodes: len(counts), Keys: keys}
+	if len(counts) == 0 || keys <= 0 {
+		return report
+	}
+	owned := map[string]int{}
+	for i := 0; i < keys; i++ {
+		if nodes := p.Lookup([]byte(fmt.Sprintf("key-%d", i)), 1); len(nodes) > 0 {
+			owned[nodes[0]]++
+		}
+	}
+	report.Min = math.Inf(1)
+	var sum, sumSquares float64
+	for node, count := range counts {
+		fair := float64(keys) * float64(count) / float64(len(tokens))
+		rel := float64(owned[node]) / fair
+		report.Max = math.Max(report.Max, rel)
+		report.Min = math.Min(report.Min, rel)
+		sum += rel
+		sumSquares += rel * rel
+	}
+	mean := sum / float64(len(counts))
+	report.StdDev = math.Sqrt(math.Max(0, sumSquares/float64(len(counts))-mean*mean))
+	return report
+}
@@ -0,0 +1,102 @@
+package chash
+
+import (
+	"fmt"
+	"testing"
+)
+
+func testTokens(nodes, vnodes int) []Token {
+	r := NewRing(vnodes)
+	for i := 0; i < nodes; i++ {
+		r.AddNode(fmt.Sprintf("node-%d", i))
+	}
+	return r.Tokens()
+}
+
+func TestPlacementDistribution(t *testing.T) {
+	for _, nodes := range []int{3, 5, 10} {
+		tokens := testTokens(nodes, 16)
+		for _, alg := range Algorithms() {
+			p, err := NewPlacement(alg, tokens)
+			if err != nil {
+				t.Fatalf("failed to build %s placement: %v", alg, err)
+			}
+			report := MeasureDistribution(p, 20000)
+			t.Logf("%-12s %s", alg, report)
+			if report.Nodes != nodes {
+				t.Fatalf("%s: expected %d nodes, got %d", alg, nodes, report.Nodes)
+			}
+			// Synthetic keys only sample the arcs, so allow some slack over the bound.
+			if alg == AlgorithmBoundedLoad && report.Max > DefaultLoadFactor+0.1 {
+				t.Fatalf("%s: max load %.3f exceeds bound %.2f", alg, report.Max, DefaultLoadFactor)
+			}
+		}
+	}
+}
+
+func TestPlacementReplicasAreDistinct(t *testing.T) {
+	tokens := testTokens(5, 16)
+	for _, alg := range Algorithms() {
+		p, err := NewPlacement(alg, tokens)
+		if err != nil {
+			t.Fatalf("failed to build %s placement: %v", alg, err)
+		}
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprintf("segment-%d", i))
+			nodes := p.Lookup(key, 3)
+			if len(nodes) != 3 {
+				t.Fatalf("%s: expected 3 replicas for %s, got %v", alg, key, nodes)
+			}
+			seen := map[string]bool{}
+			for _, n := range nodes {
+				if seen[n] {
+					t.Fatalf("%s: duplicate replica in %v", alg, nodes)
+				}
+				seen[n] = true
+			}
+		}
+		if all := p.Lookup([]byte("k"), 10); len(all) != 5 {
+			t.Fatalf("%s: expected every node when replicas exceed nodes, got %v", alg, all)
+		}
+	}
+}
+
+func TestRendezvousMovesOnlyToNewNode(t *testing.T) {
+	before := NewRendezvous(testTokens(4, 16))
+	after := NewRendezvous(testTokens(5, 16))
+	moved := 0
+	for i := 0; i < 5000; i++ {
+		key := []byte(fmt.Sprintf("segment-%d", i))
+		was, now := before.Lookup(key, 1)[0], after.Lookup(key, 1)[0]
+		if was == now {
+			continue
+		}
+		if now != "node-4" {
+			t.Fatalf("key %s moved from %s to %s, expected only moves to node-4", key, was, now)
+		}
+		moved++
+	}
+	if moved == 0 {
+		t.Fatalf("expected some keys to move to node-4")
+	}
+}
+
+func BenchmarkPlacementLookup(b *testing.B) {
+	tokens := testTokens(10, 128)
+	for _, alg := range Algorithms() {
+		p, err := NewPlacement(alg, tokens)
+		if err != nil {
+			b.Fatalf("failed to build %s placement: %v", alg, err)
+		}
+		b.Run(string(alg), func(b *testing.B) {
+			keys := make([][]byte, 1024)
+			for i := range keys {
+				keys[i] = []byte(fmt.Sprintf("segment-%d", i))
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				p.Lookup(keys[i%len(keys)], 3)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package chash
 import (
 	"crypto/sha1"
 	"encoding/binary"
+	"math"
 	"sort"
 	"strconv"
 )
@@ -14,8 +15,11 @@ type Token struct {
 }
 
 type Ring struct {
-	vnodes int     // 每个真实节点对应的虚拟节点数
-	tokens []Token // 排序后的环
+	vnodes    int            // 每个真实节点对应的虚拟节点数
+	minVnodes int            // 加权时每个节点的虚拟节点下限
+	maxVnodes int            // 加权时每个节点的虚拟节点上限（0 表示不限）
+	tokens    []Token        // 排序后的环
+	domains   failureDomains // 节点所在的故障域；非空时 Lookup 跨域放置副本
 }
 
 // vnodes: 每个真实节点的虚拟节点数（建议 100~200 起步）
@@ -26,14 +30,67 @@ func NewRing(vnodes int) *Ring {
 	return &Ring{vnodes: vnodes}
 }
 
-func (r *Ring) hash(b []byte) uint64 {
+// NewWeightedRing returns a ring that gives a node of weight w round(w*vnodes) virtual
+// nodes, clamped to [minVnodes, maxVnodes]. A maxVnodes of 0 means no upper bound.
+func NewWeightedRing(vnodes, minVnodes, maxVnodes int) *Ring {
+	r := NewRing(vnodes)
+	if minVnodes <= 0 {
+		minVnodes = 1
+	}
+	if maxVnodes > 0 && maxVnodes < minVnodes {
+		maxVnodes = minVnodes
+	}
+	r.minVnodes, r.maxVnodes = minVnodes, maxVnodes
+	return r
+}
+
+// NewRingFromTokens rebuilds a ring from previously persisted tokens.
+func NewRingFromTokens(tokens []Token) *Ring {
+	r := &Ring{vnodes: 100, tokens: make([]Token, len(tokens))}
+	copy(r.tokens, tokens)
+	sort.Slice(r.tokens, func(i, j int) bool { return r.tokens[i].Hash < r.tokens[j].Hash })
+	return r
+}
+
+// HashKey returns the ring position of a key.
+func HashKey(b []byte) uint64 {
 	h := sha1.Sum(b)
 	return binary.BigEndian.Uint64(h[:8]) // 取前 8 字节够用了
 }
 
+func (r *Ring) hash(b []byte) uint64 {
+	return HashKey(b)
+}
+
 // AddNode 将一个真实节点映射为多个虚拟节点挂到环上
 func (r *Ring) AddNode(nodeID string) {
-	for i := 0; i < r.vnodes; i++ {
+	r.addTokens(nodeID, r.vnodes)
+}
+
+// AddWeightedNode adds a node with VirtualNodes(weight) virtual nodes. Token i of a node
+// is the same whatever its weight, so changing a node's weight only adds or removes its
+// highest-numbered tokens.
+func (r *Ring) AddWeightedNode(nodeID string, weight float64) {
+	r.addTokens(nodeID, r.VirtualNodes(weight))
+}
+
+// VirtualNodes returns the number of virtual nodes a node of the given weight receives.
+func (r *Ring) VirtualNodes(weight float64) int {
+	n := int(math.Round(weight * float64(r.vnodes)))
+	if n < r.minVnodes {
+		n = r.minVnodes
+	}
+	if r.maxVnodes > 0 && n > r.maxVnodes {
+		n = r.maxVnodes
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+func (r *Ring) addTokens(nodeID string, n int) {
+	for i := 0; i < n; i++ {
 		h := r.hash([]byte(nodeID + "#" + strconv.Itoa(i)))
 		r.tokens = append(r.tokens, Token{Hash: h, Node: nodeID})
 	}
@@ -51,20 +108,42 @@ func (r *Ring) RemoveNode(nodeID string) {
 	// r.tokens 已经保持近似有序（删除不破坏有序性）
 }
 
+// SetFailureDomain labels a node with its zone and rack. Once any node is labelled,
+// Lookup places replicas in distinct zones first, then in distinct racks, and only then
+// on further nodes of racks already used, each pass walking clockwise from the key.
+func (r *Ring) SetFailureDomain(nodeID string, domain FailureDomain) {
+	r.domains = r.domains.with(nodeID, domain)
+}
+
 // Lookup 返回按一致性哈希顺时针找的副本列表（去重，不超过 replicas）
 func (r *Ring) Lookup(key []byte, replicas int) []string {
 	if replicas <= 0 || len(r.tokens) == 0 {
 		return nil
 	}
-	h := r.hash(key)
+	return r.LookupHash(r.hash(key), replicas)
+}
+
+// LookupHash is Lookup for a precomputed ring position.
+func (r *Ring) LookupHash(h uint64, replicas int) []string {
+	if replicas <= 0 || len(r.tokens) == 0 {
+		return nil
+	}
 	// 找到第一个 >= h 的位置
 	i := sort.Search(len(r.tokens), func(i int) bool { return r.tokens[i].Hash >= h })
 	if i == len(r.tokens) {
 		i = 0
 	}
-	seen := make(map[string]struct{}, replicas)
-	out := make([]string, 0, replicas)
-	for k := 0; len(out) < replicas && k < len(r.tokens); k++ {
+	if len(r.domains) > 0 {
+		return r.domains.choose(r.walk(i, 0), replicas)
+	}
+	return r.walk(i, replicas)
+}
+
+// walk returns up to limit distinct nodes clockwise from token i; 0 means every node.
+func (r *Ring) walk(i, limit int) []string {
+	seen := map[string]struct{}{}
+	var out []string
+	for k := 0; (limit == 0 || len(out) < limit) && k < len(r.tokens); k++ {
 		n := r.tokens[(i+k)%len(r.tokens)].Node
 		if _, ok := seen[n]; ok {
 			continue
@@ -0,0 +1,188 @@
+// Package dash builds MPEG-DASH manifests from the segment records kept in the
+// metadata service.
+package dash
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"tritontube/internal/catalog"
+)
+
+// ContentType is the media type of an MPD document.
+const ContentType = "application/dash+xml"
+
+// Timescale is the SegmentTemplate timescale; segment durations are in milliseconds.
+const Timescale = 1000
+
+// ErrNoSegments is returned when a video has no playable media segments yet.
+var ErrNoSegments = errors.New("dash: no media segments")
+
+// MPD is the root of a static, single-period manifest.
+type MPD struct {
+	XMLName                   xml.Name `xml:"urn:mpeg:dash:schema:mpd:2011 MPD"`
+	Profiles                  string   `xml:"profiles,attr"`
+	Type                      string   `xml:"type,attr"`
+	MediaPresentationDuration string   `xml:"mediaPresentationDuration,attr"`
+	MinBufferTime             string   `xml:"minBufferTime,attr"`
+	BaseURL                   string   `xml:"BaseURL,omitempty"`
+	Periods                   []Period `xml:"Period"`
+}
+
+// Period groups the adaptation sets of the presentation.
+type Period struct {
+	ID             string          `xml:"id,attr"`
+	Start          string          `xml:"start,attr"`
+	AdaptationSets []AdaptationSet `xml:"AdaptationSet"`
+}
+
+// AdaptationSet holds interchangeable renditions of one content type.
+type AdaptationSet struct {
+	ContentType      string           `xml:"contentType,attr"`
+	MimeType         string           `xml:"mimeType,attr"`
+	SegmentAlignment bool             `xml:"segmentAlignment,attr"`
+	StartWithSAP     int              `xml:"startWithSAP,attr"`
+	Representations  []Representation `xml:"Representation"`
+}
+
+// Representation is a single rendition.
+type Representation struct {
+	ID              string           `xml:"id,attr"`
+	Bandwidth       int64            `xml:"bandwidth,attr"`
+	Width           int              `xml:"width,attr,omitempty"`
+	Height          int              `xml:"height,attr,omitempty"`
+	Codecs          string           `xml:"codecs,attr,omitempty"`
+	SegmentTemplate *SegmentTemplate `xml:"SegmentTemplate"`
+}
+
+// SegmentTemplate addresses segments as <rendition>/<number> relative to the MPD.
+type SegmentTemplate struct {
+	Timescale       int             `xml:"timescale,attr"`
+	Initialization  string          `xml:"initialization,attr,omitempty"`
+	Media           string          `xml:"media,attr"`
+	StartNumber     int             `xml:"startNumber,attr"`
+	SegmentTimeline SegmentTimeline `xml:"SegmentTimeline"`
+}
+
+// SegmentTimeline lists segment durations, run-length encoded.
+type SegmentTimeline struct {
+	S []S `xml:"S"`
+}
+
+// S is a timeline entry: R+1 consecutive segments of duration D starting at T.
+type S struct {
+	T *int64 `xml:"t,attr,omitempty"`
+	D int64  `xml:"d,attr"`
+	R int    `xml:"r,attr,omitempty"`
+}
+
+// Options tweaks the generated manifest.
+type Options struct {
+	// BaseURL is emitted as the MPD BaseURL. Empty means segment URLs resolve relative
+	// to the manifest, which is how cmd/web serves /v/<id>/manifest.mpd.
+	BaseURL string
+	// MinBufferTime defaults to 2 seconds.
+	MinBufferTime time.Duration
+}
+
+// Build creates the manifest for a video from its segment records, sorted as returned
+// by catalog.Store.ListSegments. video may be nil when only segments are known (e.g.
+// uploads made straight through /upload). Each rendition covers its catalog.Track.
+func Build(video *catalog.Video, segments []*catalog.Segment, opts Options) (*MPD, error) {
+	if opts.MinBufferTime <= 0 {
+		opts.MinBufferTime = 2 * time.Second
+	}
+
+	tracks := catalog.Tracks(video, segments)
+	if len(tracks) == 0 {
+		return nil, ErrNoSegments
+	}
+	var reps []Representation
+	var longest int64
+	for _, t := range tracks {
+		if total := t.DurationMillis(); total > longest {
+			longest = total
+		}
+		reps = append(reps, Representation{
+			ID:              t.Rendition,
+			Bandwidth:       t.Bandwidth,
+			Width:           t.Width,
+			Height:          t.Height,
+			Codecs:          catalog.DefaultCodecs,
+			SegmentTemplate: buildTemplate(t),
+		})
+	}
+	sort.Slice(reps, func(i, j int) bool {
+		if reps[i].Bandwidth != reps[j].Bandwidth {
+			return reps[i].Bandwidth < reps[j].Bandwidth
+		}
+		return reps[i].ID < reps[j].ID
+	})
+
+	return &MPD{
+		Profiles:                  "urn:mpeg:dash:profile:isoff-live:2011",
+		Type:                      "static",
+		MediaPresentationDuration: isoDuration(time.Duration(longest) * time.Millisecond),
+		MinBufferTime:             isoDuration(opts.MinBufferTime),
+		BaseURL:                   opts.BaseURL,
+		Periods: []Period{{
+			ID:    "0",
+			Start: "PT0S",
+			AdaptationSets: []AdaptationSet{{
+				ContentType:      "video",
+				MimeType:         "video/mp4",
+				SegmentAlignment: true,
+				StartWithSAP:     1,
+				Representations:  reps,
+			}},
+		}},
+	}, nil
+}
+
+// Encode writes the manifest as an XML document.
+func (m *MPD) Encode(w io.Writer) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(m); err != nil {
+		return fmt.Errorf("dash: failed to encode manifest: %w", err)
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func buildTemplate(t *catalog.Track) *SegmentTemplate {
+	tmpl := &SegmentTemplate{
+		Timescale:   Timescale,
+		Media:       "$RepresentationID$/$Number$",
+		StartNumber: t.Segments[0].Index,
+	}
+	if t.Init != nil {
+		tmpl.Initialization = "$RepresentationID$/" + catalog.InitSegment
+	}
+	for i, seg := range t.Segments {
+		d := seg.Duration()
+		last := len(tmpl.SegmentTimeline.S) - 1
+		if i > 0 && tmpl.SegmentTimeline.S[last].D == d {
+			tmpl.SegmentTimeline.S[last].R++
+			continue
+		}
+		entry := S{D: d}
+		if i == 0 {
+			start := int64(0)
+			entry.T = &start
+		}
+		tmpl.SegmentTimeline.S = append(tmpl.SegmentTimeline.S, entry)
+	}
+	return tmpl
+}
+
+func isoDuration(d time.Duration) string {
+	return fmt.Sprintf("PT%.3fS", d.Seconds())
+}
@@ -0,0 +1,72 @@
+package dash
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"testing"
+
+	"tritontube/internal/catalog"
+	webapipb "tritontube/internal/webapi/proto"
+)
+
+func TestBuildTimeline(t *testing.T) {
+	var segs []*catalog.Segment
+	segs = append(segs, &catalog.Segment{Rendition: "720p", Init: true})
+	for i := 1; i <= 11; i++ {
+		segs = append(segs, &catalog.Segment{Rendition: "720p", Index: i})
+	}
+	segs[len(segs)-1].DurationMillis = 1500
+	// 480p is missing segment 3, so only 1-2 are published.
+	segs = append(segs,
+		&catalog.Segment{Rendition: "480p", Index: 1},
+		&catalog.Segment{Rendition: "480p", Index: 2},
+		&catalog.Segment{Rendition: "480p", Index: 4},
+	)
+	video := &catalog.Video{Renditions: []*webapipb.VideoRendition{{Quality: "720p", BitrateKbps: 3000}}}
+
+	mpd, err := Build(video, segs, Options{})
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	if mpd.MediaPresentationDuration != "PT41.500S" {
+		t.Fatalf("unexpected duration %s", mpd.MediaPresentationDuration)
+	}
+	reps := mpd.Periods[0].AdaptationSets[0].Representations
+	if len(reps) != 2 || reps[0].ID != "480p" || reps[1].ID != "720p" {
+		t.Fatalf("unexpected representations %+v", reps)
+	}
+	if reps[1].Bandwidth != 3_000_000 || reps[1].Width != 1280 || reps[1].Height != 720 {
+		t.Fatalf("unexpected 720p attributes %+v", reps[1])
+	}
+	hd := reps[1].SegmentTemplate
+	if hd.Initialization != "$RepresentationID$/init" || hd.StartNumber != 1 {
+		t.Fatalf("unexpected 720p template %+v", hd)
+	}
+	if s := hd.SegmentTimeline.S; len(s) != 2 || *s[0].T != 0 || s[0].D != 4000 || s[0].R != 9 || s[1].D != 1500 || s[1].R != 0 {
+		t.Fatalf("unexpected 720p timeline %+v", s)
+	}
+	sd := reps[0].SegmentTemplate
+	if sd.Initialization != "" || len(sd.SegmentTimeline.S) != 1 || sd.SegmentTimeline.S[0].R != 1 {
+		t.Fatalf("unexpected 480p template %+v", sd)
+	}
+
+	var buf bytes.Buffer
+	if err := mpd.Encode(&buf); err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+	if !strings.Contains(buf.String(), `<S t="0" d="4000" r="9"></S>`) {
+		t.Fatalf("unexpected xml:\n%s", buf.String())
+	}
+	var decoded MPD
+	if err := xml.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("manifest is not valid xml: %v", err)
+	}
+}
+
+func TestBuildWithoutSegments(t *testing.T) {
+	if _, err := Build(nil, []*catalog.Segment{{Rendition: "720p", Init: true}}, Options{}); !errors.Is(err, ErrNoSegments) {
+		t.Fatalf("expected ErrNoSegments, got %v", err)
+	}
+}
@@ -0,0 +1,249 @@
+// Package erasure implements systematic Reed-Solomon erasure coding over GF(2^8).
+//
+// A Codec with k data and m parity shards splits a blob into k equal data shards and
+// computes m parity shards from them; the blob can be rebuilt from any k of the k+m
+// shards. The data shards hold the blob itself, so reads that find every data shard
+// need no decoding.
+package erasure
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MaxShards bounds data plus parity shards; every shard needs a distinct field element.
+const MaxShards = 256
+
+var (
+	// ErrTooFewShards is returned when fewer than the data shard count survive.
+	ErrTooFewShards = errors.New("erasure: too few shards to reconstruct")
+	// ErrShardSize is returned when shards are not all the same size.
+	ErrShardSize = errors.New("erasure: shards differ in size")
+)
+
+// Codec encodes and reconstructs shards for one (data, parity) layout. It is safe for
+// concurrent use.
+type Codec struct {
+	data   int
+	parity int
+	// matrix is the (data+parity) x data encoding matrix: the identity over a Cauchy
+	// matrix, so that every data x data submatrix is invertible.
+	matrix [][]byte
+}
+
+// New returns a codec with data data shards and parity parity shards.
+func New(data, parity int) (*Codec, error) {
+	if data <= 0 || parity < 0 {
+		return nil, fmt.Errorf("erasure: invalid layout %d+%d", data, parity)
+	}
+	if data+parity > MaxShards {
+		return nil, fmt.Errorf("erasure: layout %d+%d exceeds %d shards", data, parity, MaxShards)
+	}
+	c := &Codec{data: data, parity: parity, matrix: make([][]byte, data+parity)}
+	for i := range c.matrix {
+		row := make([]byte, data)
+		if i < data {
+			row[i] = 1
+		} else {
+			for j := range row {
+				row[j] = gfInv(byte(i) ^ byte(j))
+			}
+		}
+		c.matrix[i] = row
+	}
+	return c, nil
+}
+
+// DataShards returns the number of data shards.
+func (c *Codec) DataShards() int { return c.data }
+
+// ParityShards returns the number of parity shards.
+func (c *Codec) ParityShards() int { return c.parity }
+
+// Shards returns the total number of shards.
+func (c *Codec) Shards() int { return c.data + c.parity }
+
+// ShardSize returns the size of each shard of a blob of size bytes.
+func (c *Codec) ShardSize(size int) int {
+	return (size + c.data - 1) / c.data
+}
+
+// Split copies blob into data shards, zero padding the last, and allocates the parity
+// shards. Call Encode to fill them in.
+func (c *Codec) Split(blob []byte) [][]byte {
+	size := c.ShardSize(len(blob))
+	buf := make([]byte, size*c.Shards())
+	copy(buf, blob)
+	shards := make([][]byte, c.Shards())
+	for i := range shards {
+		shards[i] = buf[i*size : (i+1)*size : (i+1)*size]
+	}
+	return shards
+}
+
+// Encode computes the parity shards from the data shards. Every shard must be present
+// and the same size.
+func (c *Codec) Encode(shards [][]byte) error {
+	if len(shards) != c.Shards() {
+		return fmt.Errorf("erasure: expected %d shards, got %d", c.Shards(), len(shards))
+	}
+	size, err := shardSize(shards)
+	if err != nil {
+		return err
+	}
+	for i := c.data; i < len(shards); i++ {
+		if len(shards[i]) != size {
+			return ErrShardSize
+		}
+	}
+	c.encodeParity(shards, nil)
+	return nil
+}
+
+// Reconstruct fills in the missing (nil) shards from any DataShards of the others.
+func (c *Codec) Reconstruct(shards [][]byte) error {
+	if len(shards) != c.Shards() {
+		return fmt.Errorf("erasure: expected %d shards, got %d", c.Shards(), len(shards))
+	}
+	size, err := shardSize(shards)
+	if err != nil {
+		return err
+	}
+	present := make([]int, 0, c.data)
+	for i, shard := range shards {
+		if shard != nil && len(present) < c.data {
+			present = append(present, i)
+		}
+	}
+	if len(present) < c.data {
+		return ErrTooFewShards
+	}
+
+	missingData := false
+	for i := 0; i < c.data; i++ {
+		missingData = missingData || shards[i] == nil
+	}
+	if missingData {
+		sub := make([][]byte, c.data)
+		for r, i := range present {
+			sub[r] = c.matrix[i]
+		}
+		decode, err := invert(sub)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < c.data; i++ {
+			if shards[i] != nil {
+				continue
+			}
+			out := make([]byte, size)
+			for r, j := range present {
+				mulAdd(decode[i][r], shards[j], out)
+			}
+			shards[i] = out
+		}
+	}
+	missing := map[int]bool{}
+	for i := c.data; i < len(shards); i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, size)
+			missing[i] = true
+		}
+	}
+	if len(missing) > 0 {
+		c.encodeParity(shards, missing)
+	}
+	return nil
+}
+
+// Join concatenates the data shards and trims the padding off a blob of size bytes.
+func (c *Codec) Join(shards [][]byte, size int) ([]byte, error) {
+	if len(shards) < c.data {
+		return nil, ErrTooFewShards
+	}
+	out := make([]byte, 0, size)
+	for i := 0; i < c.data && len(out) < size; i++ {
+		if shards[i] == nil {
+			return nil, ErrTooFewShards
+		}
+		out = append(out, shards[i]...)
+	}
+	if len(out) < size {
+		return nil, fmt.Errorf("erasure: shards hold %d bytes, need %d", len(out), size)
+	}
+	return out[:size], nil
+}
+
+// encodeParity recomputes the parity shards in only, or all of them when only is nil.
+func (c *Codec) encodeParity(shards [][]byte, only map[int]bool) {
+	for i := c.data; i < len(shards); i++ {
+		if only != nil && !only[i] {
+			continue
+		}
+		out := shards[i]
+		for j := range out {
+			out[j] = 0
+		}
+		for j := 0; j < c.data; j++ {
+			mulAdd(c.matrix[i][j], shards[j], out)
+		}
+	}
+}
+
+// shardSize returns the common size of the present shards.
+func shardSize(shards [][]byte) (int, error) {
+	size := -1
+	for _, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		if size >= 0 && len(shard) != size {
+			return 0, ErrShardSize
+		}
+		size = len(shard)
+	}
+	if size < 0 {
+		return 0, ErrTooFewShards
+	}
+	return size, nil
+}
+
+// invert returns the inverse of a square matrix by Gauss-Jordan elimination.
+func invert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	work := make([][]byte, n)
+	for i := range m {
+		work[i] = make([]byte, 2*n)
+		copy(work[i], m[i])
+		work[i][n+i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("erasure: singular matrix")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+		if scale := gfInv(work[col][col]); scale != 1 {
+			for j := range work[col] {
+				work[col][j] = gfMul(work[col][j], scale)
+			}
+		}
+		for r := 0; r < n; r++ {
+			if r == col || work[r][col] == 0 {
+				continue
+			}
+			factor := work[r][col]
+			for j := range work[r] {
+				work[r][j] ^= gfMul(factor, work[col][j])
+			}
+		}
+	}
+	out := make([][]byte, n)
+	for i := range work {
+		out[i] = work[i][n:]
+	}
+	return out, nil
+}
@@ -0,0 +1,75 @@
+package erasure
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestReconstructFromAnyDataShards(t *testing.T) {
+	for _, layout := range [][2]int{{4, 2}, {6, 3}, {10, 4}} {
+		codec, err := New(layout[0], layout[1])
+		if err != nil {
+			t.Fatalf("failed to build %d+%d codec: %v", layout[0], layout[1], err)
+		}
+		blob := make([]byte, 1000+layout[0]*7+3)
+		rand.New(rand.NewSource(int64(layout[0]))).Read(blob)
+		shards := codec.Split(blob)
+		if err := codec.Encode(shards); err != nil {
+			t.Fatalf("encode failed: %v", err)
+		}
+		// Drop every window of ParityShards consecutive shards in turn.
+		for first := 0; first < codec.Shards(); first++ {
+			damaged := make([][]byte, len(shards))
+			copy(damaged, shards)
+			for k := 0; k < codec.ParityShards(); k++ {
+				damaged[(first+k)%len(damaged)] = nil
+			}
+			if err := codec.Reconstruct(damaged); err != nil {
+				t.Fatalf("%d+%d without shards %d..: %v", layout[0], layout[1], first, err)
+			}
+			for i := range shards {
+				if !bytes.Equal(damaged[i], shards[i]) {
+					t.Fatalf("%d+%d: shard %d rebuilt wrongly", layout[0], layout[1], i)
+				}
+			}
+			joined, err := codec.Join(damaged, len(blob))
+			if err != nil || !bytes.Equal(joined, blob) {
+				t.Fatalf("%d+%d: join after reconstruct failed: %v", layout[0], layout[1], err)
+			}
+		}
+	}
+}
+
+func TestReconstructTooFewShards(t *testing.T) {
+	codec, err := New(4, 2)
+	if err != nil {
+		t.Fatalf("failed to build codec: %v", err)
+	}
+	shards := codec.Split([]byte("not enough left of this"))
+	if err := codec.Encode(shards); err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+	shards[0], shards[3], shards[5] = nil, nil, nil
+	if err := codec.Reconstruct(shards); !errors.Is(err, ErrTooFewShards) {
+		t.Fatalf("expected ErrTooFewShards, got %v", err)
+	}
+	if _, err := New(200, 57); err == nil {
+		t.Fatalf("expected a layout over %d shards to be rejected", MaxShards)
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	for _, layout := range [][2]int{{4, 2}, {10, 4}} {
+		codec, _ := New(layout[0], layout[1])
+		blob := make([]byte, 4<<20)
+		b.Run(fmt.Sprintf("%d+%d", layout[0], layout[1]), func(b *testing.B) {
+			b.SetBytes(int64(len(blob)))
+			for i := 0; i < b.N; i++ {
+				_ = codec.Encode(codec.Split(blob))
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package erasure
+
+// Arithmetic in GF(2^8) with the primitive polynomial x^8 + x^4 + x^3 + x^2 + 1.
+
+var (
+	gfExp [512]byte
+	gfLog [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	// Doubling the table lets gfMul skip the modulo.
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+// gfInv returns the multiplicative inverse of a, which must not be zero.
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// mulAdd adds c times in to out, element-wise.
+func mulAdd(c byte, in, out []byte) {
+	switch c {
+	case 0:
+		return
+	case 1:
+		for i, v := range in {
+			out[i] ^= v
+		}
+		return
+	}
+	var table [256]byte
+	for v := 1; v < 256; v++ {
+		table[v] = gfMul(c, byte(v))
+	}
+	for i, v := range in {
+		out[i] ^= table[v]
+	}
+}
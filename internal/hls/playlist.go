@@ -0,0 +1,102 @@
+// Package hls builds HLS master and media playlists for fMP4 (CMAF) segments from the
+// same segment records used for DASH.
+package hls
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"tritontube/internal/catalog"
+	webapipb "tritontube/internal/webapi/proto"
+)
+
+// ContentType is the media type of an m3u8 playlist.
+const ContentType = "application/vnd.apple.mpegurl"
+
+const (
+	// MasterPlaylist is the file name of the multivariant playlist, served next to the MPD.
+	MasterPlaylist = "master.m3u8"
+	// MediaPlaylist is the file name of a rendition's media playlist, served next to
+	// its segments.
+	MediaPlaylist = "playlist.m3u8"
+)
+
+// version 7 is required for EXT-X-MAP with fMP4 segments.
+const version = 7
+
+// ErrNoSegments is returned when a video, or a rendition, has no playable media segments.
+var ErrNoSegments = errors.New("hls: no media segments")
+
+// Master returns the multivariant playlist listing one variant per rendition. Variant
+// URIs are relative: <rend>/playlist.m3u8.
+func Master(video *catalog.Video, segments []*catalog.Segment) ([]byte, error) {
+	tracks := catalog.Tracks(video, segments)
+	if len(tracks) == 0 {
+		return nil, ErrNoSegments
+	}
+	sort.Slice(tracks, func(i, j int) bool {
+		if tracks[i].Bandwidth != tracks[j].Bandwidth {
+			return tracks[i].Bandwidth < tracks[j].Bandwidth
+		}
+		return tracks[i].Rendition < tracks[j].Rendition
+	})
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:%d\n#EXT-X-INDEPENDENT-SEGMENTS\n", version)
+	for _, t := range tracks {
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d", t.Bandwidth)
+		if t.Height > 0 {
+			fmt.Fprintf(&b, ",RESOLUTION=%dx%d", t.Width, t.Height)
+		}
+		fmt.Fprintf(&b, ",CODECS=%q\n%s/%s\n", catalog.DefaultCodecs, t.Rendition, MediaPlaylist)
+	}
+	return b.Bytes(), nil
+}
+
+// Media returns the media playlist of one rendition. Segment URIs are relative to the
+// playlist (init, 1, 2, ...). Videos that are not READY yet get an EVENT playlist
+// without EXT-X-ENDLIST so players keep polling while segments are still uploaded.
+func Media(video *catalog.Video, segments []*catalog.Segment, rendition string) ([]byte, error) {
+	var track *catalog.Track
+	for _, t := range catalog.Tracks(video, segments) {
+		if t.Rendition == rendition {
+			track = t
+		}
+	}
+	if track == nil {
+		return nil, ErrNoSegments
+	}
+	complete := video != nil && video.Status == webapipb.VideoStatus_VIDEO_STATUS_READY
+
+	var target int64
+	for _, seg := range track.Segments {
+		if d := seg.Duration(); d > target {
+			target = d
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:%d\n", version)
+	// EXT-X-TARGETDURATION must be at least every EXTINF rounded to the nearest second.
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int64(math.Round(float64(target)/1000)))
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", track.Segments[0].Index)
+	if complete {
+		b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	} else {
+		b.WriteString("#EXT-X-PLAYLIST-TYPE:EVENT\n")
+	}
+	b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	if track.Init != nil {
+		fmt.Fprintf(&b, "#EXT-X-MAP:URI=%q\n", catalog.InitSegment)
+	}
+	for _, seg := range track.Segments {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%d\n", float64(seg.Duration())/1000, seg.Index)
+	}
+	if complete {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return b.Bytes(), nil
+}
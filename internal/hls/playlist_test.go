@@ -0,0 +1,78 @@
+package hls
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"tritontube/internal/catalog"
+	webapipb "tritontube/internal/webapi/proto"
+)
+
+func testSegments() []*catalog.Segment {
+	segs := []*catalog.Segment{
+		{Rendition: "1080p", Init: true},
+		{Rendition: "480p", Init: true},
+	}
+	for i := 1; i <= 3; i++ {
+		segs = append(segs, &catalog.Segment{Rendition: "1080p", Index: i})
+		segs = append(segs, &catalog.Segment{Rendition: "480p", Index: i, DurationMillis: 3500})
+	}
+	return segs
+}
+
+func TestMaster(t *testing.T) {
+	got, err := Master(nil, testSegments())
+	if err != nil {
+		t.Fatalf("master failed: %v", err)
+	}
+	want := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-STREAM-INF:BANDWIDTH=1400000,RESOLUTION=854x480,CODECS="avc1.640028"
+480p/playlist.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=5000000,RESOLUTION=1920x1080,CODECS="avc1.640028"
+1080p/playlist.m3u8
+`
+	if string(got) != want {
+		t.Fatalf("unexpected master playlist:\n%s", got)
+	}
+}
+
+func TestMedia(t *testing.T) {
+	video := &catalog.Video{Status: webapipb.VideoStatus_VIDEO_STATUS_READY}
+	got, err := Media(video, testSegments(), "480p")
+	if err != nil {
+		t.Fatalf("media failed: %v", err)
+	}
+	want := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:1
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-MAP:URI="init"
+#EXTINF:3.500,
+1
+#EXTINF:3.500,
+2
+#EXTINF:3.500,
+3
+#EXT-X-ENDLIST
+`
+	if string(got) != want {
+		t.Fatalf("unexpected media playlist:\n%s", got)
+	}
+
+	inProgress, err := Media(nil, testSegments(), "1080p")
+	if err != nil {
+		t.Fatalf("media failed: %v", err)
+	}
+	if !strings.Contains(string(inProgress), "#EXT-X-PLAYLIST-TYPE:EVENT") || strings.Contains(string(inProgress), "#EXT-X-ENDLIST") {
+		t.Fatalf("expected an open EVENT playlist:\n%s", inProgress)
+	}
+
+	if _, err := Media(nil, testSegments(), "720p"); !errors.Is(err, ErrNoSegments) {
+		t.Fatalf("expected ErrNoSegments for unknown rendition, got %v", err)
+	}
+}
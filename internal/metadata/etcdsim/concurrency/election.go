@@ -0,0 +1,224 @@
+package concurrency
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"tritontube/internal/metadata/etcdsim"
+)
+
+var (
+	// ErrElectionNotLeader is returned when the election no longer holds leadership.
+	ErrElectionNotLeader = errors.New("election: not leader")
+	// ErrElectionNoLeader is returned by Leader when nobody is campaigning.
+	ErrElectionNoLeader = errors.New("election: no leader")
+)
+
+// Election is a leader election under a key prefix. Every candidate writes a key
+// attached to its session's lease; the candidate whose key has the lowest create
+// revision leads, and the others wait for the key just ahead of theirs to be deleted.
+type Election struct {
+	session   *Session
+	keyPrefix string
+	leaderKey string
+	leaderRev int64
+}
+
+// NewElection returns an election on prefix pfx using the session's lease.
+func NewElection(s *Session, pfx string) *Election {
+	return &Election{session: s, keyPrefix: pfx + "/"}
+}
+
+// Campaign blocks until the election is won, ctx is cancelled, or the session expires.
+// The candidate's key holds val. If ctx is cancelled the candidacy is withdrawn.
+func (e *Election) Campaign(ctx context.Context, val string) error {
+	client := e.session.Client()
+	key := fmt.Sprintf("%s%x", e.keyPrefix, int64(e.session.Lease()))
+	resp, err := client.Txn(ctx).
+		If(etcdsim.CompareCreateRevision(key, etcdsim.CompareOpEqual, 0)).
+		Then(etcdsim.OpPut(key, val, etcdsim.WithLease(e.session.Lease()))).
+		Commit()
+	if err != nil {
+		return err
+	}
+	rev := resp.Revision
+	if !resp.Succeeded {
+		// A previous campaign on this session left its key behind; keep its place.
+		existing, err := client.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		if len(existing.KVs) == 0 {
+			return ErrSessionExpired
+		}
+		rev = existing.KVs[0].CreateRevision
+		if existing.KVs[0].Value != val {
+			if _, err := client.Put(ctx, key, val, etcdsim.WithLease(e.session.Lease())); err != nil {
+				return err
+			}
+		}
+	}
+	e.leaderKey, e.leaderRev = key, rev
+
+	if err := e.waitPredecessors(ctx); err != nil {
+		if ctx.Err() != nil {
+			_ = e.Resign(context.Background())
+		} else {
+			e.leaderKey, e.leaderRev = "", 0
+		}
+		return err
+	}
+	return nil
+}
+
+// waitPredecessors blocks until no key created before the candidate's remains.
+func (e *Election) waitPredecessors(ctx context.Context) error {
+	client := e.session.Client()
+	for {
+		resp, err := client.Get(ctx, e.keyPrefix, etcdsim.WithPrefix())
+		if err != nil {
+			return err
+		}
+		var own bool
+		var ahead *etcdsim.KeyValue
+		for i := range resp.KVs {
+			kv := &resp.KVs[i]
+			if kv.Key == e.leaderKey && kv.CreateRevision == e.leaderRev {
+				own = true
+			}
+			if kv.CreateRevision < e.leaderRev && (ahead == nil || kv.CreateRevision > ahead.CreateRevision) {
+				ahead = kv
+			}
+		}
+		if !own {
+			return ErrSessionExpired
+		}
+		if ahead == nil {
+			return nil
+		}
+		if err := waitDelete(ctx, client, ahead.Key, ahead.CreateRevision); err != nil {
+			return err
+		}
+	}
+}
+
+// waitDelete blocks until the key created at rev no longer exists.
+func waitDelete(ctx context.Context, client *etcdsim.Client, key string, rev int64) error {
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	events := client.Watch(watchCtx, key)
+	for {
+		// Check after subscribing so a delete between the caller's Get and the Watch is
+		// not missed. The watch may drop events, so every wake-up re-reads the key.
+		resp, err := client.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		if len(resp.KVs) == 0 || resp.KVs[0].CreateRevision != rev {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case _, ok := <-events:
+			if !ok {
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// Proclaim replaces the leader's value without giving up leadership.
+func (e *Election) Proclaim(ctx context.Context, val string) error {
+	if e.leaderKey == "" {
+		return ErrElectionNotLeader
+	}
+	resp, err := e.session.Client().Txn(ctx).
+		If(etcdsim.CompareCreateRevision(e.leaderKey, etcdsim.CompareOpEqual, e.leaderRev)).
+		Then(etcdsim.OpPut(e.leaderKey, val, etcdsim.WithLease(e.session.Lease()))).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		e.leaderKey, e.leaderRev = "", 0
+		return ErrElectionNotLeader
+	}
+	return nil
+}
+
+// Resign gives up leadership, or withdraws the candidacy, letting the next candidate in.
+func (e *Election) Resign(ctx context.Context) error {
+	if e.leaderKey == "" {
+		return nil
+	}
+	_, err := e.session.Client().Txn(ctx).
+		If(etcdsim.CompareCreateRevision(e.leaderKey, etcdsim.CompareOpEqual, e.leaderRev)).
+		Then(etcdsim.OpDelete(e.leaderKey)).
+		Commit()
+	if err != nil {
+		return err
+	}
+	e.leaderKey, e.leaderRev = "", 0
+	return nil
+}
+
+// Leader returns the current leader's key and value.
+func (e *Election) Leader(ctx context.Context) (*etcdsim.GetResponse, error) {
+	resp, err := e.session.Client().Get(ctx, e.keyPrefix, etcdsim.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.KVs) == 0 {
+		return nil, ErrElectionNoLeader
+	}
+	sortByCreateRevision(resp.KVs)
+	resp.KVs = resp.KVs[:1]
+	return resp, nil
+}
+
+// Observe reports the leader every time leadership or the leader's value changes. The
+// channel is closed when ctx is cancelled.
+func (e *Election) Observe(ctx context.Context) <-chan etcdsim.GetResponse {
+	out := make(chan etcdsim.GetResponse)
+	go func() {
+		defer close(out)
+		watchCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		events := e.session.Client().Watch(watchCtx, e.keyPrefix)
+		var last etcdsim.KeyValue
+		for {
+			resp, err := e.Leader(ctx)
+			if err == nil && (resp.KVs[0].Key != last.Key || resp.KVs[0].ModRevision != last.ModRevision) {
+				last = resp.KVs[0]
+				select {
+				case out <- *resp:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-events:
+				if !ok {
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// Key returns the leader key after a successful Campaign, or "".
+func (e *Election) Key() string { return e.leaderKey }
+
+// Rev returns the create revision of the leader key after a successful Campaign. It
+// increases with every new leader, so it serves as a fencing token.
+func (e *Election) Rev() int64 { return e.leaderRev }
+
+func sortByCreateRevision(kvs []etcdsim.KeyValue) {
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].CreateRevision < kvs[j].CreateRevision })
+}
@@ -0,0 +1,158 @@
+package concurrency
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"tritontube/internal/metadata/etcdsim"
+)
+
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestElectionFailover(t *testing.T) {
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	client, err := etcdsim.New(etcdsim.Config{Clock: clock.Now})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer client.Close()
+	ctx := context.Background()
+
+	sessions := make([]*Session, 3)
+	elections := make([]*Election, 3)
+	for i := range sessions {
+		if sessions[i], err = NewSession(client, WithTTL(10)); err != nil {
+			t.Fatalf("failed to create session: %v", err)
+		}
+		defer sessions[i].Close()
+		elections[i] = NewElection(sessions[i], "/election")
+	}
+	if _, err := elections[0].Leader(ctx); !errors.Is(err, ErrElectionNoLeader) {
+		t.Fatalf("expected no leader, got %v", err)
+	}
+
+	if err := elections[0].Campaign(ctx, "a"); err != nil {
+		t.Fatalf("campaign failed: %v", err)
+	}
+	won := make(chan int, 2)
+	for _, i := range []int{1, 2} {
+		i := i
+		go func() {
+			if err := elections[i].Campaign(ctx, string(rune('a'+i))); err != nil {
+				t.Errorf("campaign %d failed: %v", i, err)
+				return
+			}
+			won <- i
+		}()
+	}
+	// Wait for both followers to queue up behind the leader.
+	for {
+		resp, _ := client.Get(ctx, "/election/", etcdsim.WithPrefix())
+		if len(resp.KVs) == 3 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case i := <-won:
+		t.Fatalf("candidate %d won while the leader holds office", i)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	leader, err := elections[2].Leader(ctx)
+	if err != nil || leader.KVs[0].Value != "a" {
+		t.Fatalf("expected a to lead, got %+v, %v", leader, err)
+	}
+	first := elections[0].Rev()
+
+	// The leader's lease expires without a keep-alive; exactly one follower takes over.
+	sessions[0].Orphan()
+	clock.Advance(6 * time.Second)
+	for _, s := range sessions[1:] {
+		if _, err := client.KeepAliveOnce(ctx, s.Lease()); err != nil {
+			t.Fatalf("keepalive failed: %v", err)
+		}
+	}
+	clock.Advance(5 * time.Second)
+	client.ExpireLeases()
+	var next int
+	select {
+	case next = <-won:
+	case <-time.After(time.Second):
+		t.Fatal("no follower took over after the leader's lease expired")
+	}
+	if elections[next].Rev() <= first {
+		t.Fatalf("expected fencing token to grow past %d, got %d", first, elections[next].Rev())
+	}
+	if err := elections[0].Proclaim(ctx, "stale"); !errors.Is(err, ErrElectionNotLeader) {
+		t.Fatalf("expected expired leader to be rejected, got %v", err)
+	}
+
+	if err := elections[next].Resign(ctx); err != nil {
+		t.Fatalf("resign failed: %v", err)
+	}
+	select {
+	case last := <-won:
+		if last == next {
+			t.Fatalf("candidate %d won twice", last)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no follower took over after the leader resigned")
+	}
+}
+
+func TestElectionObserve(t *testing.T) {
+	client, err := etcdsim.New(etcdsim.Config{})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer client.Close()
+	session, err := NewSession(client)
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	defer session.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	election := NewElection(session, "/election")
+	observed := election.Observe(ctx)
+	if err := election.Campaign(ctx, "v1"); err != nil {
+		t.Fatalf("campaign failed: %v", err)
+	}
+	if err := election.Proclaim(ctx, "v2"); err != nil {
+		t.Fatalf("proclaim failed: %v", err)
+	}
+	for _, want := range []string{"v1", "v2"} {
+		select {
+		case resp := <-observed:
+			if got := resp.KVs[0].Value; got != want {
+				// The first leader value may be coalesced with the proclamation.
+				if want == "v1" && got == "v2" {
+					return
+				}
+				t.Fatalf("expected %s, observed %s", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("did not observe %s", want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Package concurrency mirrors go.etcd.io/etcd/client/v3/concurrency on top of etcdsim:
+// lease-backed sessions and leader elections.
+package concurrency
+
+import (
+	"context"
+	"errors"
+
+	"tritontube/internal/metadata/etcdsim"
+)
+
+// defaultSessionTTL matches the real client's default of 60 seconds.
+const defaultSessionTTL = 60
+
+// ErrSessionExpired is returned when the session's lease is gone.
+var ErrSessionExpired = errors.New("concurrency: session expired")
+
+// Session holds a lease that is kept alive until the session is closed or its context
+// is cancelled. Keys written under the session disappear when it ends.
+type Session struct {
+	client *etcdsim.Client
+	id     etcdsim.LeaseID
+	ttl    int64
+	cancel context.CancelFunc
+	donec  chan struct{}
+}
+
+// SessionOption configures a Session.
+type SessionOption func(*sessionOptions)
+
+type sessionOptions struct {
+	ttl   int64
+	lease etcdsim.LeaseID
+	ctx   context.Context
+}
+
+// WithTTL sets the session's lease TTL in seconds.
+func WithTTL(ttl int) SessionOption {
+	return func(o *sessionOptions) {
+		if ttl > 0 {
+			o.ttl = int64(ttl)
+		}
+	}
+}
+
+// WithLease makes the session use an existing lease instead of granting one.
+func WithLease(id etcdsim.LeaseID) SessionOption {
+	return func(o *sessionOptions) { o.lease = id }
+}
+
+// WithContext sets the context that bounds the session's keep-alive.
+func WithContext(ctx context.Context) SessionOption {
+	return func(o *sessionOptions) { o.ctx = ctx }
+}
+
+// NewSession grants a lease (unless WithLease is given) and keeps it alive.
+func NewSession(client *etcdsim.Client, opts ...SessionOption) (*Session, error) {
+	if client == nil {
+		return nil, errors.New("concurrency: etcd client is required")
+	}
+	options := sessionOptions{ttl: defaultSessionTTL, ctx: context.Background()}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	id := options.lease
+	if id == etcdsim.NoLease {
+		resp, err := client.Grant(options.ctx, options.ttl)
+		if err != nil {
+			return nil, err
+		}
+		id = resp.ID
+	}
+	ctx, cancel := context.WithCancel(options.ctx)
+	keepAlive, err := client.KeepAlive(ctx, id)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	s := &Session{client: client, id: id, ttl: options.ttl, cancel: cancel, donec: make(chan struct{})}
+	go func() {
+		defer close(s.donec)
+		for range keepAlive {
+		}
+	}()
+	return s, nil
+}
+
+// Client returns the client the session was created with.
+func (s *Session) Client() *etcdsim.Client { return s.client }
+
+// Lease returns the session's lease.
+func (s *Session) Lease() etcdsim.LeaseID { return s.id }
+
+// TTL returns the lease TTL in seconds the session was created with.
+func (s *Session) TTL() int64 { return s.ttl }
+
+// Done is closed once the session stops keeping its lease alive, either because it was
+// closed or orphaned or because the lease expired.
+func (s *Session) Done() <-chan struct{} { return s.donec }
+
+// Orphan stops keeping the lease alive without revoking it; its keys remain until the
+// lease expires.
+func (s *Session) Orphan() {
+	s.cancel()
+	<-s.donec
+}
+
+// Close orphans the session and revokes its lease, deleting its keys immediately.
+func (s *Session) Close() error {
+	s.Orphan()
+	_, err := s.client.Revoke(context.Background(), s.id)
+	if errors.Is(err, etcdsim.ErrLeaseNotFound) {
+		return nil
+	}
+	return err
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Client simulates the minimal surface of go.etcd.io/etcd/client/v3 used by the metadata service.
@@ -14,30 +15,58 @@ type Client struct {
 	kv       map[string]kvPair
 	watchers map[int64]*watchSubscription
 	nextID   int64
+
+	clock      func() time.Time
+	leases     map[LeaseID]*lease
+	nextLease  LeaseID
+	background bool
+	sweeping   bool
+	closed     chan struct{}
+	closeOnce  sync.Once
 }
 
 type kvPair struct {
-	value       string
-	modRevision int64
+	value          string
+	createRevision int64
+	modRevision    int64
+	lease          LeaseID
 }
 
 // Config matches the structure of clientv3.Config for API compatibility.
 type Config struct {
 	Endpoints []string
+	// Clock drives lease expiry. By default it is time.Now and a background sweeper
+	// expires leases; with a custom clock nothing expires in the background, so tests
+	// call ExpireLeases after moving the clock.
+	Clock func() time.Time
 }
 
 // New constructs a new client using the provided config.
 func New(config Config) (*Client, error) {
-	_ = config
-	return &Client{kv: map[string]kvPair{}, watchers: map[int64]*watchSubscription{}}, nil
+	background := config.Clock == nil
+	if config.Clock == nil {
+		config.Clock = time.Now
+	}
+	return &Client{
+		background: background,
+		kv:         map[string]kvPair{},
+		watchers:   map[int64]*watchSubscription{},
+		clock:      config.Clock,
+		leases:     map[LeaseID]*lease{},
+		closed:     make(chan struct{}),
+	}, nil
 }
 
-// Close satisfies the client API.
-func (c *Client) Close() error { return nil }
+// Close stops the background lease sweeper.
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
 
-// Txn starts a new transaction builder.
+// Txn starts a new transaction builder. Like clientv3, the transaction fails if ctx is
+// done by the time it is committed.
 func (c *Client) Txn(ctx context.Context) *Txn {
-	return &Txn{client: c}
+	return &Txn{client: c, ctx: ctx}
 }
 
 // CompareTarget enumerates supported compare targets.
@@ -45,6 +74,8 @@ type CompareTarget int
 
 const (
 	compareModRevision CompareTarget = iota + 1
+	compareCreateRevision
+	compareValue
 )
 
 // CompareOp enumerates supported operations.
@@ -61,6 +92,8 @@ type Cmp struct {
 	target CompareTarget
 	op     CompareOp
 	value  int64
+	// text is the operand of value compares.
+	text string
 }
 
 // CompareModRevision constructs a comparison on the key's mod revision.
@@ -68,11 +101,24 @@ func CompareModRevision(key string, op CompareOp, value int64) Cmp {
 	return Cmp{key: key, target: compareModRevision, op: op, value: value}
 }
 
+// CompareCreateRevision constructs a comparison on the revision that created the key.
+// A key that does not exist has create revision 0.
+func CompareCreateRevision(key string, op CompareOp, value int64) Cmp {
+	return Cmp{key: key, target: compareCreateRevision, op: op, value: value}
+}
+
+// CompareValue constructs a comparison on the key's value. A key that does not exist has
+// the empty value.
+func CompareValue(key string, op CompareOp, value string) Cmp {
+	return Cmp{key: key, target: compareValue, op: op, text: value}
+}
+
 // Op represents a transactional mutation.
 type Op struct {
 	typ   opType
 	key   string
 	value string
+	lease LeaseID
 }
 
 type opType int
@@ -82,9 +128,22 @@ const (
 	opDelete
 )
 
+// OpOption configures an Op.
+type OpOption func(*Op)
+
+// WithLease attaches the key written by a put to a lease, so it is deleted when the
+// lease expires or is revoked.
+func WithLease(id LeaseID) OpOption {
+	return func(op *Op) { op.lease = id }
+}
+
 // OpPut stores the value.
-func OpPut(key, value string) Op {
-	return Op{typ: opPut, key: key, value: value}
+func OpPut(key, value string, opts ...OpOption) Op {
+	op := Op{typ: opPut, key: key, value: value}
+	for _, opt := range opts {
+		opt(&op)
+	}
+	return op
 }
 
 // OpDelete removes a key.
@@ -101,6 +160,7 @@ type TxnResponse struct {
 // Txn encapsulates a conditional set of operations.
 type Txn struct {
 	client    *Client
+	ctx       context.Context
 	compares  []Cmp
 	onSuccess []Op
 	onFailure []Op
@@ -126,29 +186,38 @@ func (t *Txn) Else(ops ...Op) *Txn {
 
 // Commit executes the transaction atomically.
 func (t *Txn) Commit() (*TxnResponse, error) {
+	if t.ctx != nil {
+		if err := t.ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
 	t.client.mu.Lock()
 	defer t.client.mu.Unlock()
+	t.client.expireLeasesLocked()
 
 	success := true
 	for _, cmp := range t.compares {
+		entry := t.client.kv[cmp.key]
+		var current int64
 		switch cmp.target {
 		case compareModRevision:
-			entry, ok := t.client.kv[cmp.key]
-			switch cmp.op {
-			case CompareOpEqual:
-				var current int64
-				if ok {
-					current = entry.modRevision
-				}
-				if current != cmp.value {
-					success = false
-				}
-			default:
-				return nil, errors.New("etcdsim: unsupported compare op")
-			}
+			current = entry.modRevision
+		case compareCreateRevision:
+			current = entry.createRevision
+		case compareValue:
 		default:
 			return nil, errors.New("etcdsim: unsupported compare target")
 		}
+		switch cmp.op {
+		case CompareOpEqual:
+			if cmp.target == compareValue {
+				success = entry.value == cmp.text
+			} else if current != cmp.value {
+				success = false
+			}
+		default:
+			return nil, errors.New("etcdsim: unsupported compare op")
+		}
 		if !success {
 			break
 		}
@@ -162,22 +231,40 @@ func (t *Txn) Commit() (*TxnResponse, error) {
 	if len(ops) == 0 {
 		return &TxnResponse{Succeeded: success, Revision: t.client.revision}, nil
 	}
+	for _, op := range ops {
+		switch op.typ {
+		case opPut:
+			if op.lease != NoLease && t.client.leases[op.lease] == nil {
+				return nil, ErrLeaseNotFound
+			}
+		case opDelete:
+		default:
+			return nil, errors.New("etcdsim: unsupported op")
+		}
+	}
 
 	var events []WatchEvent
 	for _, op := range ops {
 		switch op.typ {
 		case opPut:
 			t.client.revision++
-			t.client.kv[op.key] = kvPair{value: op.value, modRevision: t.client.revision}
+			t.client.detachLocked(op.key)
+			created := t.client.revision
+			if existing, ok := t.client.kv[op.key]; ok {
+				created = existing.createRevision
+			}
+			t.client.kv[op.key] = kvPair{value: op.value, createRevision: created, modRevision: t.client.revision, lease: op.lease}
+			if l := t.client.leases[op.lease]; l != nil {
+				l.keys[op.key] = struct{}{}
+			}
 			events = append(events, WatchEvent{Type: EventTypePut, Key: op.key, Value: op.value, ModRevision: t.client.revision})
 		case opDelete:
 			if _, ok := t.client.kv[op.key]; ok {
 				t.client.revision++
+				t.client.detachLocked(op.key)
 				delete(t.client.kv, op.key)
 				events = append(events, WatchEvent{Type: EventTypeDelete, Key: op.key, ModRevision: t.client.revision})
 			}
-		default:
-			return nil, errors.New("etcdsim: unsupported op")
 		}
 	}
 
@@ -202,9 +289,12 @@ func WithPrefix() GetOption {
 
 // KeyValue represents a value stored in etcd.
 type KeyValue struct {
-	Key         string
-	Value       string
-	ModRevision int64
+	Key            string
+	Value          string
+	CreateRevision int64
+	ModRevision    int64
+	// Lease is the lease the key is attached to, or NoLease.
+	Lease LeaseID
 }
 
 // GetResponse mirrors the shape of clientv3.GetResponse for the supported fields.
@@ -223,28 +313,29 @@ func (c *Client) Get(ctx context.Context, key string, opts ...GetOption) (*GetRe
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.expireLeasesLocked()
 
 	resp := &GetResponse{Revision: c.revision}
 	if options.prefix {
 		for k, v := range c.kv {
 			if strings.HasPrefix(k, key) {
-				resp.KVs = append(resp.KVs, KeyValue{Key: k, Value: v.value, ModRevision: v.modRevision})
+				resp.KVs = append(resp.KVs, KeyValue{Key: k, Value: v.value, CreateRevision: v.createRevision, ModRevision: v.modRevision, Lease: v.lease})
 			}
 		}
 		return resp, nil
 	}
 
 	if v, ok := c.kv[key]; ok {
-		resp.KVs = append(resp.KVs, KeyValue{Key: key, Value: v.value, ModRevision: v.modRevision})
+		resp.KVs = append(resp.KVs, KeyValue{Key: key, Value: v.value, CreateRevision: v.createRevision, ModRevision: v.modRevision, Lease: v.lease})
 	}
 	return resp, nil
 }
 
 // Put writes a key outside of a transaction. This mirrors the convenience helper
 // available in the real client.
-func (c *Client) Put(ctx context.Context, key, value string) (*TxnResponse, error) {
+func (c *Client) Put(ctx context.Context, key, value string, opts ...OpOption) (*TxnResponse, error) {
 	txn := c.Txn(ctx)
-	txn = txn.Then(OpPut(key, value))
+	txn = txn.Then(OpPut(key, value, opts...))
 	return txn.Commit()
 }
 
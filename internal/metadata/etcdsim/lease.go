@@ -0,0 +1,247 @@
+package etcdsim
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+)
+
+// LeaseID mirrors clientv3.LeaseID.
+type LeaseID int64
+
+// NoLease is the zero LeaseID; keys written with it never expire.
+const NoLease LeaseID = 0
+
+// ErrLeaseNotFound matches the error etcd returns for an unknown or expired lease.
+var ErrLeaseNotFound = errors.New("etcdserver: requested lease not found")
+
+// sweepInterval is how often the background sweeper expires leases. Every client call
+// also expires leases first, so the sweeper only matters to watchers.
+const sweepInterval = 250 * time.Millisecond
+
+type lease struct {
+	id      LeaseID
+	ttl     int64
+	expires time.Time
+	keys    map[string]struct{}
+}
+
+// LeaseGrantResponse mirrors clientv3.LeaseGrantResponse.
+type LeaseGrantResponse struct {
+	ID  LeaseID
+	TTL int64
+}
+
+// LeaseKeepAliveResponse mirrors clientv3.LeaseKeepAliveResponse.
+type LeaseKeepAliveResponse struct {
+	ID  LeaseID
+	TTL int64
+}
+
+// LeaseRevokeResponse mirrors clientv3.LeaseRevokeResponse.
+type LeaseRevokeResponse struct {
+	Revision int64
+}
+
+// LeaseTimeToLiveResponse mirrors clientv3.LeaseTimeToLiveResponse. TTL is the
+// remaining time in seconds, or -1 if the lease has expired or never existed.
+type LeaseTimeToLiveResponse struct {
+	ID         LeaseID
+	TTL        int64
+	GrantedTTL int64
+	Keys       []string
+}
+
+// LeaseOption configures a TimeToLive call.
+type LeaseOption func(*leaseOptions)
+
+type leaseOptions struct {
+	attachedKeys bool
+}
+
+// WithAttachedKeys makes TimeToLive list the keys attached to the lease.
+func WithAttachedKeys() LeaseOption {
+	return func(o *leaseOptions) { o.attachedKeys = true }
+}
+
+// Grant creates a lease that expires ttl seconds from now unless it is kept alive.
+func (c *Client) Grant(ctx context.Context, ttl int64) (*LeaseGrantResponse, error) {
+	_ = ctx
+	if ttl <= 0 {
+		return nil, errors.New("etcdsim: lease TTL must be positive")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expireLeasesLocked()
+	c.nextLease++
+	l := &lease{id: c.nextLease, ttl: ttl, keys: map[string]struct{}{}}
+	l.expires = c.clock().Add(time.Duration(ttl) * time.Second)
+	c.leases[l.id] = l
+	if c.background && !c.sweeping {
+		c.sweeping = true
+		go c.sweep()
+	}
+	return &LeaseGrantResponse{ID: l.id, TTL: ttl}, nil
+}
+
+// KeepAliveOnce renews the lease for its full TTL.
+func (c *Client) KeepAliveOnce(ctx context.Context, id LeaseID) (*LeaseKeepAliveResponse, error) {
+	_ = ctx
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expireLeasesLocked()
+	l := c.leases[id]
+	if l == nil {
+		return nil, ErrLeaseNotFound
+	}
+	l.expires = c.clock().Add(time.Duration(l.ttl) * time.Second)
+	return &LeaseKeepAliveResponse{ID: id, TTL: l.ttl}, nil
+}
+
+// KeepAlive renews the lease every third of its TTL until ctx is cancelled or the lease
+// is gone, sending a response on the returned channel after every renewal. Like the real
+// client, responses are dropped if the channel is full, and the channel is closed when
+// renewals stop.
+func (c *Client) KeepAlive(ctx context.Context, id LeaseID) (<-chan *LeaseKeepAliveResponse, error) {
+	first, err := c.KeepAliveOnce(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan *LeaseKeepAliveResponse, 16)
+	ch <- first
+	interval := time.Duration(first.TTL) * time.Second / 3
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.closed:
+				return
+			case <-ticker.C:
+			}
+			resp, err := c.KeepAliveOnce(ctx, id)
+			if err != nil {
+				return
+			}
+			select {
+			case ch <- resp:
+			default:
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// Revoke deletes the lease and every key attached to it.
+func (c *Client) Revoke(ctx context.Context, id LeaseID) (*LeaseRevokeResponse, error) {
+	_ = ctx
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expireLeasesLocked()
+	l := c.leases[id]
+	if l == nil {
+		return nil, ErrLeaseNotFound
+	}
+	c.dropLeaseLocked(l)
+	return &LeaseRevokeResponse{Revision: c.revision}, nil
+}
+
+// TimeToLive reports the remaining lifetime of a lease.
+func (c *Client) TimeToLive(ctx context.Context, id LeaseID, opts ...LeaseOption) (*LeaseTimeToLiveResponse, error) {
+	_ = ctx
+	options := leaseOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expireLeasesLocked()
+	l := c.leases[id]
+	if l == nil {
+		return &LeaseTimeToLiveResponse{ID: id, TTL: -1}, nil
+	}
+	remaining := l.expires.Sub(c.clock())
+	resp := &LeaseTimeToLiveResponse{ID: id, TTL: int64((remaining + time.Second - 1) / time.Second), GrantedTTL: l.ttl}
+	if options.attachedKeys {
+		for key := range l.keys {
+			resp.Keys = append(resp.Keys, key)
+		}
+		sort.Strings(resp.Keys)
+	}
+	return resp, nil
+}
+
+// ExpireLeases drops every lease whose TTL has elapsed on the client's clock, deleting
+// the attached keys and notifying watchers. It returns the number of leases expired.
+func (c *Client) ExpireLeases() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.expireLeasesLocked()
+}
+
+func (c *Client) expireLeasesLocked() int {
+	if len(c.leases) == 0 {
+		return 0
+	}
+	now := c.clock()
+	var expired []*lease
+	for _, l := range c.leases {
+		if !now.Before(l.expires) {
+			expired = append(expired, l)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].id < expired[j].id })
+	for _, l := range expired {
+		c.dropLeaseLocked(l)
+	}
+	return len(expired)
+}
+
+// dropLeaseLocked forgets the lease and deletes its keys, one revision per key.
+func (c *Client) dropLeaseLocked(l *lease) {
+	delete(c.leases, l.id)
+	keys := make([]string, 0, len(l.keys))
+	for key := range l.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var events []WatchEvent
+	for _, key := range keys {
+		c.revision++
+		delete(c.kv, key)
+		events = append(events, WatchEvent{Type: EventTypeDelete, Key: key, ModRevision: c.revision})
+	}
+	if len(events) > 0 {
+		c.notifyWatchersLocked(events)
+	}
+}
+
+// detachLocked removes key from the lease it is currently attached to, if any.
+func (c *Client) detachLocked(key string) {
+	entry, ok := c.kv[key]
+	if !ok || entry.lease == NoLease {
+		return
+	}
+	if l := c.leases[entry.lease]; l != nil {
+		delete(l.keys, key)
+	}
+}
+
+// sweep expires leases in the background so watchers observe expiry without waiting
+// for another client call.
+func (c *Client) sweep() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+			c.ExpireLeases()
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package etcdsim
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLeaseExpiryDeletesKeys(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	client, err := New(Config{Clock: func() time.Time { return now }})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := client.Watch(ctx, "/nodes/")
+
+	grant, err := client.Grant(ctx, 10)
+	if err != nil {
+		t.Fatalf("grant failed: %v", err)
+	}
+	if _, err := client.Put(ctx, "/nodes/a", "alive", WithLease(grant.ID)); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	if _, err := client.Put(ctx, "/nodes/b", "forever"); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	<-events
+	<-events
+
+	now = now.Add(8 * time.Second)
+	if _, err := client.KeepAliveOnce(ctx, grant.ID); err != nil {
+		t.Fatalf("keepalive failed: %v", err)
+	}
+	now = now.Add(8 * time.Second)
+	ttl, err := client.TimeToLive(ctx, grant.ID, WithAttachedKeys())
+	if err != nil {
+		t.Fatalf("time to live failed: %v", err)
+	}
+	if ttl.TTL != 2 || ttl.GrantedTTL != 10 || len(ttl.Keys) != 1 || ttl.Keys[0] != "/nodes/a" {
+		t.Fatalf("unexpected time to live %+v", ttl)
+	}
+
+	now = now.Add(3 * time.Second)
+	if n := client.ExpireLeases(); n != 1 {
+		t.Fatalf("expected one lease to expire, got %d", n)
+	}
+	select {
+	case resp := <-events:
+		if len(resp.Events) != 1 || resp.Events[0].Type != EventTypeDelete || resp.Events[0].Key != "/nodes/a" {
+			t.Fatalf("unexpected watch response %+v", resp)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected a delete event for the expired key")
+	}
+	resp, err := client.Get(ctx, "/nodes/", WithPrefix())
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if len(resp.KVs) != 1 || resp.KVs[0].Key != "/nodes/b" {
+		t.Fatalf("expected only the unleased key to remain, got %+v", resp.KVs)
+	}
+	if ttl, _ := client.TimeToLive(ctx, grant.ID); ttl.TTL != -1 {
+		t.Fatalf("expected expired lease to report TTL -1, got %d", ttl.TTL)
+	}
+	if _, err := client.KeepAliveOnce(ctx, grant.ID); !errors.Is(err, ErrLeaseNotFound) {
+		t.Fatalf("expected ErrLeaseNotFound, got %v", err)
+	}
+	if _, err := client.Put(ctx, "/nodes/a", "again", WithLease(grant.ID)); !errors.Is(err, ErrLeaseNotFound) {
+		t.Fatalf("expected put on expired lease to fail, got %v", err)
+	}
+}
+
+func TestLeaseRevoke(t *testing.T) {
+	client, err := New(Config{})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer client.Close()
+	ctx := context.Background()
+
+	grant, err := client.Grant(ctx, 60)
+	if err != nil {
+		t.Fatalf("grant failed: %v", err)
+	}
+	if _, err := client.Put(ctx, "/election/a", "1", WithLease(grant.ID)); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	// Rewriting a key without a lease detaches it.
+	if _, err := client.Put(ctx, "/election/b", "1", WithLease(grant.ID)); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	if _, err := client.Put(ctx, "/election/b", "2"); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	if _, err := client.Revoke(ctx, grant.ID); err != nil {
+		t.Fatalf("revoke failed: %v", err)
+	}
+	resp, _ := client.Get(ctx, "/election/", WithPrefix())
+	if len(resp.KVs) != 1 || resp.KVs[0].Key != "/election/b" || resp.KVs[0].Lease != NoLease {
+		t.Fatalf("unexpected keys after revoke: %+v", resp.KVs)
+	}
+	if _, err := client.Revoke(ctx, grant.ID); !errors.Is(err, ErrLeaseNotFound) {
+		t.Fatalf("expected second revoke to fail, got %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package grpcstub
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// The HTTP bridge below carries unary calls as JSON over plain HTTP so that separate
+// processes can talk to each other without the real gRPC runtime. Each call is a
+// POST to /{service}/{method}; failures are returned as a JSON status body.
+
+type httpStatusBody struct {
+	Code    Code   `json:"code"`
+	Message string `json:"message"`
+}
+
+// ServeHTTP dispatches JSON encoded unary calls to the registered services.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeStatus(w, Errorf(Unimplemented, "grpcstub: method %s not allowed", r.Method))
+		return
+	}
+	srvName, mthName, ok := splitMethod(r.URL.Path)
+	if !ok {
+		writeStatus(w, Errorf(NotFound, "grpcstub: malformed method %s", r.URL.Path))
+		return
+	}
+	srv, ok := s.services[srvName]
+	if !ok {
+		writeStatus(w, Errorf(Unimplemented, "grpcstub: unknown service %s", srvName))
+		return
+	}
+	for _, md := range srv.desc.Methods {
+		if md.MethodName != mthName {
+			continue
+		}
+		dec := func(target interface{}) error {
+			if err := json.NewDecoder(r.Body).Decode(target); err != nil {
+				return Errorf(InvalidArgument, "grpcstub: decode request: %v", err)
+			}
+			return nil
+		}
+		out, err := md.Handler(srv.impl, r.Context(), dec, nil)
+		if err != nil {
+			writeStatus(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+		return
+	}
+	writeStatus(w, Errorf(Unimplemented, "grpcstub: unknown method %s", mthName))
+}
+
+func writeStatus(w http.ResponseWriter, err error) {
+	code := CodeOf(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code.HTTPStatus())
+	_ = json.NewEncoder(w).Encode(httpStatusBody{Code: code, Message: err.Error()})
+}
+
+// NewHTTPConn returns a ClientConnInterface that issues calls against a Server exposed
+// over HTTP at baseURL. A nil client falls back to http.DefaultClient.
+func NewHTTPConn(baseURL string, client *http.Client) ClientConnInterface {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &httpConn{base: strings.TrimRight(baseURL, "/"), client: client}
+}
+
+type httpConn struct {
+	base   string
+	client *http.Client
+}
+
+func (c *httpConn) Invoke(ctx context.Context, method string, args any, reply any, opts ...CallOption) error {
+	if _, _, ok := splitMethod(method); !ok {
+		return errors.New("grpcstub: malformed method")
+	}
+	body, err := json.Marshal(args)
+	if err != nil {
+		return Errorf(Internal, "grpcstub: encode request: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.base+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return Errorf(Unavailable, "grpcstub: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var st httpStatusBody
+		if err := json.NewDecoder(resp.Body).Decode(&st); err != nil || st.Code == OK {
+			return Errorf(Unknown, "grpcstub: %s returned %s", method, resp.Status)
+		}
+		return &StatusError{Code: st.Code, Message: st.Message}
+	}
+	if reply == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(reply); err != nil {
+		return Errorf(Internal, "grpcstub: decode %s reply: %v", method, err)
+	}
+	return nil
+}
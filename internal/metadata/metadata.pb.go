@@ -49,6 +49,8 @@ type PutMetadataRequest struct {
 	Item                 *MetadataItem `json:"item,omitempty"`
 	ExpectedVersion      int64         `json:"expected_version,omitempty"`
 	ExpectedEtcdRevision int64         `json:"expected_etcd_revision,omitempty"`
+	// CreateOnly fails the write with AlreadyExists when the key is already stored.
+	CreateOnly bool `json:"create_only,omitempty"`
 }
 
 func (x *PutMetadataRequest) GetItem() *MetadataItem {
@@ -149,12 +149,17 @@ func (tx *Tx) Delete(ctx context.Context, key string) error {
 
 // List returns up to limit records that match the prefix, in lexical order.
 func (tx *Tx) List(ctx context.Context, prefix string, limit int) ([]Record, error) {
+	return tx.ListFrom(ctx, prefix, "", limit)
+}
+
+// ListFrom is List restricted to keys at or after start, like a range scan on the key.
+func (tx *Tx) ListFrom(ctx context.Context, prefix, start string, limit int) ([]Record, error) {
 	tx.mu.Lock()
 	defer tx.mu.Unlock()
 	tx.store.mu.RLock()
 	items := make([]Record, 0, len(tx.store.entries))
 	for k, v := range tx.store.entries {
-		if prefix == "" || hasPrefix(k, prefix) {
+		if (prefix == "" || hasPrefix(k, prefix)) && k >= start {
 			items = append(items, cloneRecord(v))
 			tx.readset[k] = v.Version
 		}
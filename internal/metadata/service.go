@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"tritontube/internal/metadata/etcdsim"
+	grpc "tritontube/internal/metadata/grpcstub"
 	"tritontube/internal/metadata/pgxsim"
 )
 
@@ -67,11 +68,11 @@ func NewService(cfg ServiceConfig) (*Service, error) {
 // PutMetadata performs a conditional upsert guarded by a SERIALIZABLE pgx transaction and an etcd revision compare.
 func (s *Service) PutMetadata(ctx context.Context, req *PutMetadataRequest) (*PutMetadataResponse, error) {
 	if req == nil || req.Item == nil {
-		return nil, errors.New("metadata: item is required")
+		return nil, grpc.Errorf(grpc.InvalidArgument, "metadata: item is required")
 	}
 	item := req.Item.Clone()
 	if item.Key == "" {
-		return nil, errors.New("metadata: key is required")
+		return nil, grpc.Errorf(grpc.InvalidArgument, "metadata: key is required")
 	}
 
 	var newRec pgxsim.Record
@@ -86,12 +87,15 @@ func (s *Service) PutMetadata(ctx context.Context, req *PutMetadataRequest) (*Pu
 		if err != nil {
 			return err
 		}
+		if req.CreateOnly && ok {
+			return grpc.Errorf(grpc.AlreadyExists, "metadata: key %s already exists", item.Key)
+		}
 		if req.ExpectedVersion > 0 {
 			if !ok {
-				return fmt.Errorf("metadata: missing key %s", item.Key)
+				return grpc.Errorf(grpc.NotFound, "metadata: missing key %s", item.Key)
 			}
 			if existing.Version != req.ExpectedVersion {
-				return fmt.Errorf("metadata: version mismatch for %s", item.Key)
+				return grpc.Errorf(grpc.FailedPrecondition, "metadata: version mismatch for %s", item.Key)
 			}
 		}
 		var version int64 = 1
@@ -130,7 +134,7 @@ func (s *Service) PutMetadata(ctx context.Context, req *PutMetadataRequest) (*Pu
 		return nil, err
 	}
 	if !etcdResp.Succeeded {
-		return nil, fmt.Errorf("metadata: etcd revision conflict for %s", item.Key)
+		return nil, grpc.Errorf(grpc.Aborted, "metadata: etcd revision conflict for %s", item.Key)
 	}
 
 	return &PutMetadataResponse{Item: item, EtcdRevision: etcdResp.Revision}, nil
@@ -139,7 +143,7 @@ func (s *Service) PutMetadata(ctx context.Context, req *PutMetadataRequest) (*Pu
 // GetMetadata reads a metadata item using a read-only serializable transaction.
 func (s *Service) GetMetadata(ctx context.Context, req *GetMetadataRequest) (*GetMetadataResponse, error) {
 	if req == nil || req.Key == "" {
-		return nil, errors.New("metadata: key is required")
+		return nil, grpc.Errorf(grpc.InvalidArgument, "metadata: key is required")
 	}
 	tx, err := s.readPool.BeginTx(ctx, pgxsim.TxOptions{IsoLevel: pgxsim.IsoLevelSerializable, AccessMode: pgxsim.ReadOnly})
 	if err != nil {
@@ -152,7 +156,7 @@ func (s *Service) GetMetadata(ctx context.Context, req *GetMetadataRequest) (*Ge
 		return nil, err
 	}
 	if !ok {
-		return nil, fmt.Errorf("metadata: key %s not found", req.Key)
+		return nil, grpc.Errorf(grpc.NotFound, "metadata: key %s not found", req.Key)
 	}
 	_ = tx.Rollback(ctx)
 	return &GetMetadataResponse{Item: recordToItem(rec)}, nil
@@ -161,7 +165,7 @@ func (s *Service) GetMetadata(ctx context.Context, req *GetMetadataRequest) (*Ge
 // DeleteMetadata removes a record using pgx + etcd transactional guards.
 func (s *Service) DeleteMetadata(ctx context.Context, req *DeleteMetadataRequest) (*DeleteMetadataResponse, error) {
 	if req == nil || req.Key == "" {
-		return nil, errors.New("metadata: key is required")
+		return nil, grpc.Errorf(grpc.InvalidArgument, "metadata: key is required")
 	}
 	var deleted bool
 	err := s.retry(ctx, func(ctx context.Context) error {
@@ -176,10 +180,10 @@ func (s *Service) DeleteMetadata(ctx context.Context, req *DeleteMetadataRequest
 			return err
 		}
 		if !ok {
-			return fmt.Errorf("metadata: key %s not found", req.Key)
+			return grpc.Errorf(grpc.NotFound, "metadata: key %s not found", req.Key)
 		}
 		if req.ExpectedVersion > 0 && rec.Version != req.ExpectedVersion {
-			return fmt.Errorf("metadata: version mismatch for %s", req.Key)
+			return grpc.Errorf(grpc.FailedPrecondition, "metadata: version mismatch for %s", req.Key)
 		}
 		if err := tx.Delete(ctx, req.Key); err != nil {
 			return err
@@ -205,7 +209,7 @@ func (s *Service) DeleteMetadata(ctx context.Context, req *DeleteMetadataRequest
 		return nil, err
 	}
 	if !resp.Succeeded {
-		return nil, fmt.Errorf("metadata: etcd revision conflict for %s", req.Key)
+		return nil, grpc.Errorf(grpc.Aborted, "metadata: etcd revision conflict for %s", req.Key)
 	}
 	return &DeleteMetadataResponse{EtcdRevision: resp.Revision}, nil
 }
@@ -222,21 +226,11 @@ func (s *Service) ListMetadata(ctx context.Context, req *ListMetadataRequest) (*
 	}
 	defer tx.Rollback(ctx) // nolint:errcheck
 
-	prefix := req.Prefix
-	items, err := tx.List(ctx, prefix, limit+1)
+	// The page token is the first key of the requested page.
+	items, err := tx.ListFrom(ctx, req.Prefix, req.PageToken, limit+1)
 	if err != nil {
 		return nil, err
 	}
-	startKey := req.PageToken
-	if startKey != "" {
-		filtered := make([]pgxsim.Record, 0, len(items))
-		for _, rec := range items {
-			if rec.Key > startKey {
-				filtered = append(filtered, rec)
-			}
-		}
-		items = filtered
-	}
 	nextToken := ""
 	if len(items) > limit {
 		nextToken = items[limit].Key
@@ -100,3 +100,37 @@ func TestListPagination(t *testing.T) {
 		t.Fatalf("expected more items on second page")
 	}
 }
+
+func TestListPagesThroughPrefix(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+
+	for i := 0; i < 7; i++ {
+		key := fmt.Sprintf("video/%d", i)
+		if _, err := svc.PutMetadata(ctx, &PutMetadataRequest{Item: &MetadataItem{Key: key, Value: "{}"}}); err != nil {
+			t.Fatalf("put %s failed: %v", key, err)
+		}
+	}
+
+	var keys []string
+	token := ""
+	for pages := 0; ; pages++ {
+		if pages > 4 {
+			t.Fatalf("expected 4 pages, got more: %v", keys)
+		}
+		resp, err := svc.ListMetadata(ctx, &ListMetadataRequest{Prefix: "video/", Limit: 2, PageToken: token})
+		if err != nil {
+			t.Fatalf("list failed: %v", err)
+		}
+		for _, item := range resp.Items {
+			keys = append(keys, item.Key)
+		}
+		if resp.NextPageToken == "" {
+			break
+		}
+		token = resp.NextPageToken
+	}
+	if got := fmt.Sprint(keys); got != "[video/0 video/1 video/2 video/3 video/4 video/5 video/6]" {
+		t.Fatalf("expected every key once and in order, got %s", got)
+	}
+}
@@ -0,0 +1,309 @@
+package metadata
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	grpc "tritontube/internal/metadata/grpcstub"
+)
+
+// UploadSessionKeyPrefix is the key prefix under which upload sessions are stored.
+const UploadSessionKeyPrefix = "upload/"
+
+// UploadSessionState enumerates the lifecycle of an upload session.
+type UploadSessionState string
+
+const (
+	UploadSessionOpen      UploadSessionState = "OPEN"
+	UploadSessionCompleted UploadSessionState = "COMPLETED"
+	UploadSessionExpired   UploadSessionState = "EXPIRED"
+)
+
+// UploadSession records a pending direct-to-storage upload. Sessions expire after the
+// store TTL and can be completed exactly once.
+type UploadSession struct {
+	ID          string             `json:"id"`
+	VideoID     string             `json:"video_id"`
+	OwnerID     string             `json:"owner_id,omitempty"`
+	Bucket      string             `json:"bucket"`
+	Key         string             `json:"key"`
+	State       UploadSessionState `json:"state"`
+	Checksum    string             `json:"checksum,omitempty"`
+	SizeBytes   int64              `json:"size_bytes,omitempty"`
+	CreatedAt   time.Time          `json:"created_at"`
+	ExpiresAt   time.Time          `json:"expires_at"`
+	CompletedAt time.Time          `json:"completed_at,omitempty"`
+
+	// Version is the metadata item version the session was read at.
+	Version int64 `json:"-"`
+}
+
+// Expired reports whether the session can no longer be completed at now.
+func (s *UploadSession) Expired(now time.Time) bool {
+	return s.State == UploadSessionExpired || (s.State == UploadSessionOpen && !now.Before(s.ExpiresAt))
+}
+
+// endedAt returns when a terminal session was completed or expired.
+func (s *UploadSession) endedAt() time.Time {
+	if s.State == UploadSessionCompleted && !s.CompletedAt.IsZero() {
+		return s.CompletedAt
+	}
+	return s.ExpiresAt
+}
+
+// CompleteUploadSession carries the data recorded when a session is completed.
+type CompleteUploadSession struct {
+	Checksum  string
+	SizeBytes int64
+	// IfMatch, when non-zero, requires the stored session to still be at this version.
+	IfMatch int64
+}
+
+// UploadSessionStore manages upload sessions through the MetadataService API so it can
+// run either in-process or against a remote metadata server.
+type UploadSessionStore struct {
+	client    MetadataServiceClient
+	ttl       time.Duration
+	retention time.Duration
+	clock     func() time.Time
+}
+
+// UploadSessionStoreConfig configures an UploadSessionStore.
+type UploadSessionStoreConfig struct {
+	Client MetadataServiceClient
+	// TTL is how long a session stays open (default 15 minutes).
+	TTL time.Duration
+	// Retention is how long completed or expired sessions are kept before the reaper
+	// deletes them (default 24 hours). Retained sessions make CompleteUpload idempotent.
+	Retention time.Duration
+	Clock     func() time.Time
+}
+
+// NewUploadSessionStore constructs a session store.
+func NewUploadSessionStore(cfg UploadSessionStoreConfig) (*UploadSessionStore, error) {
+	if cfg.Client == nil {
+		return nil, errors.New("metadata: client is required for upload sessions")
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = 15 * time.Minute
+	}
+	if cfg.Retention <= 0 {
+		cfg.Retention = 24 * time.Hour
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = time.Now
+	}
+	return &UploadSessionStore{client: cfg.Client, ttl: cfg.TTL, retention: cfg.Retention, clock: cfg.Clock}, nil
+}
+
+// TTL returns how long new sessions stay open.
+func (s *UploadSessionStore) TTL() time.Duration {
+	return s.ttl
+}
+
+func uploadSessionKey(id string) string {
+	return UploadSessionKeyPrefix + id
+}
+
+// Create persists a new open session. A random ID is assigned when sess.ID is empty.
+func (s *UploadSessionStore) Create(ctx context.Context, sess *UploadSession) error {
+	if sess == nil || sess.VideoID == "" {
+		return grpc.Errorf(grpc.InvalidArgument, "metadata: upload session requires a video id")
+	}
+	if sess.ID == "" {
+		var b [12]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return grpc.Errorf(grpc.Internal, "metadata: failed to generate session id: %v", err)
+		}
+		sess.ID = hex.EncodeToString(b[:])
+	}
+	now := s.clock().UTC()
+	sess.State = UploadSessionOpen
+	sess.CreatedAt = now
+	sess.ExpiresAt = now.Add(s.ttl)
+	sess.Version = 0
+	return s.put(ctx, sess, true)
+}
+
+// Get loads a session. Missing sessions surface as grpcstub.NotFound.
+func (s *UploadSessionStore) Get(ctx context.Context, id string) (*UploadSession, error) {
+	if id == "" {
+		return nil, grpc.Errorf(grpc.InvalidArgument, "metadata: upload session id is required")
+	}
+	resp, err := s.client.GetMetadata(ctx, &GetMetadataRequest{Key: uploadSessionKey(id)})
+	if err != nil {
+		return nil, err
+	}
+	return decodeUploadSession(resp.Item)
+}
+
+// Complete transitions an open session to COMPLETED. It returns the resulting session
+// and whether this call performed the transition; repeated or concurrent completions
+// observe the already-completed session and report false, so callers can enqueue
+// follow-up work exactly once.
+func (s *UploadSessionStore) Complete(ctx context.Context, id string, in CompleteUploadSession) (*UploadSession, bool, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		sess, err := s.Get(ctx, id)
+		if err != nil {
+			return nil, false, err
+		}
+		if in.IfMatch > 0 && sess.Version != in.IfMatch {
+			return nil, false, grpc.Errorf(grpc.FailedPrecondition, "metadata: upload session %s is at version %d", id, sess.Version)
+		}
+		switch {
+		case sess.State == UploadSessionCompleted:
+			return sess, false, nil
+		case sess.Expired(s.clock()):
+			return nil, false, grpc.Errorf(grpc.FailedPrecondition, "metadata: upload session %s expired", id)
+		}
+		sess.State = UploadSessionCompleted
+		sess.Checksum = in.Checksum
+		sess.SizeBytes = in.SizeBytes
+		sess.CompletedAt = s.clock().UTC()
+		err = s.put(ctx, sess, false)
+		if err == nil {
+			return sess, true, nil
+		}
+		if grpc.CodeOf(err) != grpc.FailedPrecondition {
+			return nil, false, err
+		}
+		// Lost the race: re-read once so a concurrent completion is reported as a no-op.
+		in.IfMatch = 0
+	}
+	return nil, false, grpc.Errorf(grpc.Aborted, "metadata: upload session %s changed concurrently", id)
+}
+
+// Expire marks an open session whose deadline has passed as EXPIRED. It reports whether
+// this call performed the transition.
+func (s *UploadSessionStore) Expire(ctx context.Context, sess *UploadSession) (bool, error) {
+	if sess.State != UploadSessionOpen || !sess.Expired(s.clock()) {
+		return false, nil
+	}
+	next := *sess
+	next.State = UploadSessionExpired
+	if err := s.put(ctx, &next, false); err != nil {
+		if grpc.CodeOf(err) == grpc.FailedPrecondition {
+			// Completed or expired by someone else in the meantime.
+			return false, nil
+		}
+		return false, err
+	}
+	*sess = next
+	return true, nil
+}
+
+// Reap expires overdue sessions and deletes terminal sessions once the retention window
+// has passed since they were completed or expired. It returns the sessions that were
+// expired by this pass.
+func (s *UploadSessionStore) Reap(ctx context.Context) ([]*UploadSession, error) {
+	var expired []*UploadSession
+	now := s.clock()
+	token := ""
+	for {
+		resp, err := s.client.ListMetadata(ctx, &ListMetadataRequest{Prefix: UploadSessionKeyPrefix, Limit: 100, PageToken: token})
+		if err != nil {
+			return expired, err
+		}
+		for _, item := range resp.Items {
+			sess, err := decodeUploadSession(item)
+			if err != nil {
+				continue
+			}
+			if sess.State != UploadSessionOpen {
+				if now.Sub(sess.endedAt()) > s.retention {
+					_, err := s.client.DeleteMetadata(ctx, &DeleteMetadataRequest{Key: item.Key, ExpectedVersion: sess.Version, ExpectedEtcdRevision: -1})
+					if err != nil && grpc.CodeOf(err) != grpc.NotFound && grpc.CodeOf(err) != grpc.FailedPrecondition {
+						return expired, err
+					}
+				}
+				continue
+			}
+			ok, err := s.Expire(ctx, sess)
+			if err != nil {
+				return expired, err
+			}
+			if ok {
+				expired = append(expired, sess)
+			}
+		}
+		if resp.NextPageToken == "" {
+			return expired, nil
+		}
+		token = resp.NextPageToken
+	}
+}
+
+// put writes the session guarded by its version. With create set the write fails with
+// grpcstub.AlreadyExists if the session is already stored.
+func (s *UploadSessionStore) put(ctx context.Context, sess *UploadSession, create bool) error {
+	encoded, err := json.Marshal(sess)
+	if err != nil {
+		return fmt.Errorf("metadata: failed to encode upload session: %w", err)
+	}
+	resp, err := s.client.PutMetadata(ctx, &PutMetadataRequest{
+		Item:                 &MetadataItem{Key: uploadSessionKey(sess.ID), Value: string(encoded)},
+		ExpectedVersion:      sess.Version,
+		ExpectedEtcdRevision: -1,
+		CreateOnly:           create,
+	})
+	if err != nil {
+		return err
+	}
+	sess.Version = resp.Item.Version
+	return nil
+}
+
+func decodeUploadSession(item *MetadataItem) (*UploadSession, error) {
+	if item == nil {
+		return nil, grpc.Errorf(grpc.NotFound, "metadata: empty upload session item")
+	}
+	var sess UploadSession
+	if err := json.Unmarshal([]byte(item.Value), &sess); err != nil {
+		return nil, fmt.Errorf("metadata: failed to decode upload session %s: %w", item.Key, err)
+	}
+	sess.Version = item.Version
+	return &sess, nil
+}
+
+// UploadSessionReaper periodically expires abandoned upload sessions.
+type UploadSessionReaper struct {
+	Store    *UploadSessionStore
+	Interval time.Duration
+	// OnExpire is invoked once for every session expired by the reaper.
+	OnExpire func(ctx context.Context, sess *UploadSession)
+}
+
+// Run blocks until the context is cancelled, reaping every Interval (default 1 minute).
+func (r *UploadSessionReaper) Run(ctx context.Context) error {
+	if r == nil || r.Store == nil {
+		return errors.New("metadata: reaper requires an upload session store")
+	}
+	interval := r.Interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		expired, err := r.Store.Reap(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("metadata: upload session reap failed: %v", err)
+		}
+		if r.OnExpire != nil {
+			for _, sess := range expired {
+				r.OnExpire(ctx, sess)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package metadata
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	grpc "tritontube/internal/metadata/grpcstub"
+)
+
+func newTestSessionStore(t *testing.T, now *time.Time) *UploadSessionStore {
+	t.Helper()
+	rpc := grpc.NewServer()
+	RegisterMetadataServiceServer(rpc, newTestService(t))
+	store, err := NewUploadSessionStore(UploadSessionStoreConfig{
+		Client: NewMetadataServiceClient(rpc.NewInProcessConn()),
+		TTL:    15 * time.Minute,
+		Clock:  func() time.Time { return *now },
+	})
+	if err != nil {
+		t.Fatalf("failed to create session store: %v", err)
+	}
+	return store
+}
+
+func TestUploadSessionCompleteOnce(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := newTestSessionStore(t, &now)
+	ctx := context.Background()
+
+	sess := &UploadSession{VideoID: "v1", Bucket: "uploads", Key: "v1/source"}
+	if err := store.Create(ctx, sess); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if err := store.Create(ctx, &UploadSession{ID: sess.ID, VideoID: "v2"}); grpc.CodeOf(err) != grpc.AlreadyExists {
+		t.Fatalf("expected a second create of %s to fail with AlreadyExists, got %v", sess.ID, err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	transitions := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, completed, err := store.Complete(ctx, sess.ID, CompleteUploadSession{Checksum: "abc"})
+			if err != nil {
+				t.Errorf("complete failed: %v", err)
+				return
+			}
+			if got.State != UploadSessionCompleted {
+				t.Errorf("unexpected state %s", got.State)
+			}
+			if completed {
+				mu.Lock()
+				transitions++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if transitions != 1 {
+		t.Fatalf("expected exactly one transition, got %d", transitions)
+	}
+
+	if _, _, err := store.Complete(ctx, sess.ID, CompleteUploadSession{IfMatch: sess.Version}); grpc.CodeOf(err) != grpc.FailedPrecondition {
+		t.Fatalf("expected stale If-Match to fail, got %v", err)
+	}
+}
+
+func TestUploadSessionExpiry(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := newTestSessionStore(t, &now)
+	ctx := context.Background()
+
+	sess := &UploadSession{VideoID: "v2", Bucket: "uploads", Key: "v2/source"}
+	if err := store.Create(ctx, sess); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+
+	now = now.Add(16 * time.Minute)
+	expired, err := store.Reap(ctx)
+	if err != nil {
+		t.Fatalf("reap failed: %v", err)
+	}
+	if len(expired) != 1 || expired[0].ID != sess.ID {
+		t.Fatalf("expected session to be reaped, got %+v", expired)
+	}
+	if _, _, err := store.Complete(ctx, sess.ID, CompleteUploadSession{}); grpc.CodeOf(err) != grpc.FailedPrecondition {
+		t.Fatalf("expected completing an expired session to fail, got %v", err)
+	}
+
+	now = now.Add(25 * time.Hour)
+	if _, err := store.Reap(ctx); err != nil {
+		t.Fatalf("second reap failed: %v", err)
+	}
+	if _, err := store.Get(ctx, sess.ID); grpc.CodeOf(err) != grpc.NotFound {
+		t.Fatalf("expected retained session to be deleted, got %v", err)
+	}
+}
+
+func TestUploadSessionRetentionFromCompletion(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := newTestSessionStore(t, &now)
+	ctx := context.Background()
+
+	sess := &UploadSession{VideoID: "v3", Bucket: "uploads", Key: "v3/source"}
+	if err := store.Create(ctx, sess); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	now = now.Add(time.Minute)
+	if _, _, err := store.Complete(ctx, sess.ID, CompleteUploadSession{}); err != nil {
+		t.Fatalf("complete failed: %v", err)
+	}
+
+	now = now.Add(23 * time.Hour)
+	if _, err := store.Reap(ctx); err != nil {
+		t.Fatalf("reap failed: %v", err)
+	}
+	if _, err := store.Get(ctx, sess.ID); err != nil {
+		t.Fatalf("expected the session to be retained within the window, got %v", err)
+	}
+
+	// Retention runs from completion, not from the end of the session's TTL.
+	now = now.Add(time.Hour + time.Minute)
+	if _, err := store.Reap(ctx); err != nil {
+		t.Fatalf("reap failed: %v", err)
+	}
+	if _, err := store.Get(ctx, sess.ID); grpc.CodeOf(err) != grpc.NotFound {
+		t.Fatalf("expected the completed session to be deleted, got %v", err)
+	}
+}
@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"time"
+
+	storagepb "tritontube/internal/storage/proto"
+)
+
+// AntiEntropyReport summarises a single anti-entropy pass.
+type AntiEntropyReport struct {
+	StartedAt  time.Time
+	FinishedAt time.Time
+	// Ranges counts the (ring range, peer) pairs compared, Differing those whose trees
+	// differed, and Leaves the differing leaves whose segments were exchanged.
+	Ranges    int
+	Differing int
+	Leaves    int
+	// Pulled lists the segment ids copied from a peer because the local copy was missing
+	// or failed verification.
+	Pulled []string
+	// Conflicts lists segment ids whose checksum differs from a peer's while the local
+	// copy still verifies. Neither copy is overwritten; the scrubber settles them against the
+	// segment record.
+	Conflicts []string
+	// Failed maps the peers and segment ids that could not be synced to the last error
+	// seen.
+	Failed map[string]error
+}
+
+// AntiEntropy periodically compares the recorded segments this node holds with the
+// other replicas of every ring range it replicates, and pulls the segments it is
+// missing. Each pair of replicas exchanges Merkle trees top down, descending only into
+// subtrees whose hashes differ, so ranges in sync cost one root hash and only differing
+// leaves list their segments. Segments only this node holds are left alone; every
+// replica runs the loop, so the peer pulls them on its own pass. Objects without a
+// segment record are not compared.
+type AntiEntropy struct {
+	NodeID     string
+	Ring       *RingManager
+	Filesystem *FS
+	// Segments lists the segment records, which place each segment on the ring by its id.
+	Segments SegmentLister
+	// Transport fetches objects from peers and must implement MerkleTransport.
+	Transport         ReplicationTransport
+	ReplicationFactor int
+	// Depth splits every range into 2^Depth leaves (default DefaultMerkleDepth, at most
+	// MaxMerkleDepth).
+	Depth    int
+	Interval time.Duration
+	// OnReport is invoked after every pass.
+	OnReport func(report *AntiEntropyReport)
+}
+
+// Run blocks until the context is cancelled, syncing every Interval (default 30 minutes).
+func (a *AntiEntropy) Run(ctx context.Context) error {
+	if a == nil || a.Filesystem == nil || a.Ring == nil || a.Segments == nil {
+		return errors.New("storage: anti-entropy requires a filesystem, a ring and a segment lister")
+	}
+	interval := a.Interval
+	if interval <= 0 {
+		interval = 30 * time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		report, err := a.SyncOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("storage: anti-entropy failed: %v", err)
+		}
+		if report != nil && a.OnReport != nil {
+			a.OnReport(report)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// SyncOnce performs a single pass over the ranges this node replicates. Per-peer and
+// per-object failures are recorded in the report; the returned error is reserved for
+// failures that abort the pass. Ranges are only well defined for range-stable
+// placements, so rings using rendezvous hashing are refused.
+func (a *AntiEntropy) SyncOnce(ctx context.Context) (*AntiEntropyReport, error) {
+	report := &AntiEntropyReport{StartedAt: time.Now().UTC(), Failed: map[string]error{}}
+	defer func() { report.FinishedAt = time.Now().UTC() }()
+
+	merkle, ok := a.Transport.(MerkleTransport)
+	if !ok {
+		return report, errors.New("storage: anti-entropy requires a transport that exchanges merkle trees")
+	}
+	snapshot := a.Ring.Snapshot()
+	if !snapshot.Placement.RangeStable() {
+		return report, fmt.Errorf("storage: anti-entropy requires a range-stable placement, ring uses %s", snapshot.Placement)
+	}
+	depth := a.Depth
+	if depth <= 0 {
+		depth = DefaultMerkleDepth
+	}
+	if depth > MaxMerkleDepth {
+		depth = MaxMerkleDepth
+	}
+	replicas := a.ReplicationFactor
+	if replicas <= 0 {
+		replicas = 3
+	}
+	if a.Segments == nil {
+		return report, errors.New("storage: anti-entropy requires a segment lister")
+	}
+	local, err := buildMerkleIndex(ctx, a.Filesystem, a.Segments)
+	if err != nil {
+		return report, err
+	}
+
+	placement, err := placementFor(snapshot)
+	if err != nil {
+		return report, err
+	}
+	bounds := boundaries(snapshot.Assignments, nil)
+	for i, end := range bounds {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		start := bounds[len(bounds)-1]
+		if i > 0 {
+			start = bounds[i-1]
+		}
+		owners := placement.LookupHash(end, replicas)
+		if !containsString(owners, a.NodeID) {
+			continue
+		}
+		r := tokenRange{Start: start, End: end}
+		for _, peer := range owners {
+			if peer == a.NodeID {
+				continue
+			}
+			report.Ranges++
+			if err := a.syncRange(ctx, merkle, local.tree(r, depth), peer, r, report); err != nil {
+				if ctx.Err() != nil {
+					return report, ctx.Err()
+				}
+				report.Failed[peer] = err
+			}
+		}
+	}
+	return report, nil
+}
+
+// syncRange compares the local tree for r with the peer's one level at a time, then
+// exchanges the segments under the leaves that differ.
+func (a *AntiEntropy) syncRange(ctx context.Context, merkle MerkleTransport, tree *merkleTree, peer string, r tokenRange, report *AntiEntropyReport) error {
+	indexes := []uint32{0}
+	for level := 0; level <= tree.depth; level++ {
+		resp, err := merkle.MerkleTree(ctx, peer, &storagepb.MerkleTreeRequest{
+			StartToken:     r.Start,
+			EndToken:       r.End,
+			Depth:          uint32(tree.depth),
+			Level:          uint32(level),
+			Indexes:        indexes,
+			IncludeEntries: level == tree.depth,
+		})
+		if err != nil {
+			return fmt.Errorf("merkle level %d from %s: %w", level, peer, err)
+		}
+		var differing []*storagepb.MerkleNode
+		for _, node := range resp.Nodes {
+			if int(node.Index) >= len(tree.levels[level]) {
+				return fmt.Errorf("%s returned node %d outside level %d", peer, node.Index, level)
+			}
+			// A peer with nothing under a node has nothing to give us.
+			if node.Hash != nil && !bytes.Equal(node.Hash, tree.levels[level][node.Index]) {
+				differing = append(differing, node)
+			}
+		}
+		if len(differing) == 0 {
+			return nil
+		}
+		if level == 0 {
+			report.Differing++
+		}
+		if level == tree.depth {
+			report.Leaves += len(differing)
+			for _, node := range differing {
+				a.syncLeaf(ctx, peer, tree.leaves[node.Index], node.Entries, report)
+			}
+			return nil
+		}
+		indexes = make([]uint32, 0, 2*len(differing))
+		for _, node := range differing {
+			indexes = append(indexes, 2*node.Index, 2*node.Index+1)
+		}
+	}
+	return nil
+}
+
+// syncLeaf pulls the peer's segments that are missing locally, or whose local copy
+// differs and no longer matches its own recorded checksum.
+func (a *AntiEntropy) syncLeaf(ctx context.Context, peer string, local, remote []*storagepb.MerkleEntry, report *AntiEntropyReport) {
+	have := make(map[string]string, len(local))
+	for _, e := range local {
+		have[e.SegmentId] = e.Checksum
+	}
+	for _, e := range remote {
+		name := e.SegmentId
+		sum, ok := have[name]
+		if ok && sum == e.Checksum {
+			continue
+		}
+		if ok {
+			_, err := a.Filesystem.Verify(e.Bucket, e.Object)
+			if err == nil {
+				report.Conflicts = append(report.Conflicts, name)
+				continue
+			}
+			if !errors.Is(err, ErrChecksumMismatch) && !errors.Is(err, fs.ErrNotExist) {
+				report.Failed[name] = err
+				continue
+			}
+		}
+		if err := a.pull(ctx, peer, e); err != nil {
+			report.Failed[name] = err
+			continue
+		}
+		report.Pulled = append(report.Pulled, name)
+	}
+}
+
+// pull copies a segment from peer, refusing data that does not match the checksum the
+// peer advertised for it.
+func (a *AntiEntropy) pull(ctx context.Context, peer string, entry *storagepb.MerkleEntry) error {
+	locator := &storagepb.SegmentLocator{Bucket: entry.Bucket, Object: entry.Object}
+	body, err := a.Transport.FetchSegment(ctx, peer, locator)
+	if err != nil {
+		return fmt.Errorf("fetch from %s: %w", peer, err)
+	}
+	defer body.Close()
+	if _, _, err := a.Filesystem.PutVerified(entry.Bucket, entry.Object, body, entry.Checksum); err != nil {
+		return fmt.Errorf("copy from %s: %w", peer, err)
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"tritontube/internal/metadata/etcdsim"
+	storagepb "tritontube/internal/storage/proto"
+)
+
+// MigrationState tracks how far a plan or one of its moves has progressed.
+type MigrationState string
+
+const (
+	MigrationPending   MigrationState = "pending"
+	MigrationRunning   MigrationState = "running"
+	MigrationCompleted MigrationState = "completed"
+)
+
+// ErrStaleFencingToken is returned for a plan issued by a rebalancer that has since been
+// superseded by a leader with a higher fencing token.
+var ErrStaleFencingToken = errors.New("storage: stale fencing token")
+
+// MoveProgress records how much of a single token range move has been carried out.
+// Segments are processed in id order, so LastSegment is where a resumed move continues.
+type MoveProgress struct {
+	StartToken    uint64         `json:"start_token"`
+	EndToken      uint64         `json:"end_token"`
+	FromNodeID    string         `json:"from_node_id,omitempty"`
+	ToNodeID      string         `json:"to_node_id,omitempty"`
+	State         MigrationState `json:"state"`
+	BytesCopied   int64          `json:"bytes_copied"`
+	SegmentsMoved int            `json:"segments_moved"`
+	LastSegment   string         `json:"last_segment,omitempty"`
+}
+
+// MigrationCheckpoint is the persisted progress of a rebalance plan.
+type MigrationCheckpoint struct {
+	Plan      *storagepb.RebalancePlan `json:"plan"`
+	State     MigrationState           `json:"state"`
+	Moves     []MoveProgress           `json:"moves"`
+	LastError string                   `json:"last_error,omitempty"`
+	CreatedAt time.Time                `json:"created_at"`
+	UpdatedAt time.Time                `json:"updated_at"`
+}
+
+// checkpointStore persists checkpoints under <prefix>/migrations/<plan_id>, or in memory
+// when no etcd client is configured.
+type checkpointStore struct {
+	etcd   *etcdsim.Client
+	prefix string
+
+	mu     sync.Mutex
+	memory map[string][]byte
+	// fenceToken is the highest fencing token seen when there is no etcd client.
+	fenceToken int64
+}
+
+func newCheckpointStore(etcd *etcdsim.Client, prefix string) *checkpointStore {
+	if prefix == "" {
+		prefix = "/storage/cluster"
+	}
+	return &checkpointStore{etcd: etcd, prefix: prefix, memory: map[string][]byte{}}
+}
+
+func (s *checkpointStore) key(planID string) string {
+	return fmt.Sprintf("%s/migrations/%s", s.prefix, planID)
+}
+
+func (s *checkpointStore) fenceKey() string {
+	return fmt.Sprintf("%s/migration-fence", s.prefix)
+}
+
+// fence admits work carrying token. The highest token seen is recorded, and tokens below
+// it are rejected with ErrStaleFencingToken. Token 0 means the plan is unfenced.
+func (s *checkpointStore) fence(ctx context.Context, token int64) error {
+	if token == 0 {
+		return nil
+	}
+	if s.etcd == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if token < s.fenceToken {
+			return fmt.Errorf("%w: %d is below %d", ErrStaleFencingToken, token, s.fenceToken)
+		}
+		s.fenceToken = token
+		return nil
+	}
+	for {
+		resp, err := s.etcd.Get(ctx, s.fenceKey())
+		if err != nil {
+			return err
+		}
+		var current, revision int64
+		if len(resp.KVs) > 0 {
+			revision = resp.KVs[0].ModRevision
+			if current, err = strconv.ParseInt(resp.KVs[0].Value, 10, 64); err != nil {
+				return fmt.Errorf("storage: failed to decode fencing token: %w", err)
+			}
+		}
+		if token < current {
+			return fmt.Errorf("%w: %d is below %d", ErrStaleFencingToken, token, current)
+		}
+		if token == current {
+			return nil
+		}
+		txn, err := s.etcd.Txn(ctx).
+			If(etcdsim.CompareModRevision(s.fenceKey(), etcdsim.CompareOpEqual, revision)).
+			Then(etcdsim.OpPut(s.fenceKey(), strconv.FormatInt(token, 10))).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if txn.Succeeded {
+			return nil
+		}
+	}
+}
+
+func (s *checkpointStore) get(ctx context.Context, planID string) (*MigrationCheckpoint, error) {
+	var raw []byte
+	if s.etcd == nil {
+		s.mu.Lock()
+		raw = s.memory[s.key(planID)]
+		s.mu.Unlock()
+	} else {
+		resp, err := s.etcd.Get(ctx, s.key(planID))
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.KVs) > 0 {
+			raw = []byte(resp.KVs[0].Value)
+		}
+	}
+	if raw == nil {
+		return nil, nil
+	}
+	return decodeCheckpoint(s.key(planID), raw)
+}
+
+// put saves cp. A fenced plan's checkpoint is only written while the recorded fencing
+// token is still the plan's, so a superseded rebalancer cannot overwrite the progress of
+// the leader that replaced it; it gets ErrStaleFencingToken instead.
+func (s *checkpointStore) put(ctx context.Context, cp *MigrationCheckpoint) error {
+	cp.UpdatedAt = time.Now().UTC()
+	encoded, err := json.Marshal(cp)
+	if err != nil {
+		return fmt.Errorf("storage: failed to encode checkpoint: %w", err)
+	}
+	token := cp.Plan.FencingToken
+	if s.etcd == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if token != 0 && token != s.fenceToken {
+			return fmt.Errorf("%w: %d is not the current token %d", ErrStaleFencingToken, token, s.fenceToken)
+		}
+		s.memory[s.key(cp.Plan.PlanId)] = encoded
+		return nil
+	}
+	txn := s.etcd.Txn(ctx)
+	if token != 0 {
+		txn = txn.If(etcdsim.CompareValue(s.fenceKey(), etcdsim.CompareOpEqual, strconv.FormatInt(token, 10)))
+	}
+	resp, err := txn.Then(etcdsim.OpPut(s.key(cp.Plan.PlanId), string(encoded))).Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return fmt.Errorf("%w: %d is no longer the current token", ErrStaleFencingToken, token)
+	}
+	return nil
+}
+
+// unfinished returns the checkpoints that have not completed, oldest ring version first.
+func (s *checkpointStore) unfinished(ctx context.Context) ([]*MigrationCheckpoint, error) {
+	raw := map[string][]byte{}
+	if s.etcd == nil {
+		s.mu.Lock()
+		for k, v := range s.memory {
+			raw[k] = v
+		}
+		s.mu.Unlock()
+	} else {
+		resp, err := s.etcd.Get(ctx, s.prefix+"/migrations/", etcdsim.WithPrefix())
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range resp.KVs {
+			raw[kv.Key] = []byte(kv.Value)
+		}
+	}
+	var out []*MigrationCheckpoint
+	for key, value := range raw {
+		cp, err := decodeCheckpoint(key, value)
+		if err != nil {
+			return nil, err
+		}
+		if cp.State != MigrationCompleted {
+			out = append(out, cp)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Plan.RingVersion == out[j].Plan.RingVersion {
+			return out[i].CreatedAt.Before(out[j].CreatedAt)
+		}
+		return out[i].Plan.RingVersion < out[j].Plan.RingVersion
+	})
+	return out, nil
+}
+
+func decodeCheckpoint(key string, raw []byte) (*MigrationCheckpoint, error) {
+	var cp MigrationCheckpoint
+	if err := json.Unmarshal(raw, &cp); err != nil {
+		return nil, fmt.Errorf("storage: failed to decode checkpoint %s: %w", key, err)
+	}
+	if cp.Plan == nil {
+		return nil, fmt.Errorf("storage: checkpoint %s has no plan", key)
+	}
+	return &cp, nil
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"tritontube/internal/metadata/etcdsim"
+)
+
+// testCluster is a set of storage nodes sharing one etcd: a ring manager, a segment
+// store, and an in-process transport serving every node's filesystem.
+type testCluster struct {
+	etcd      *etcdsim.Client
+	ring      *RingManager
+	segments  *EtcdMetadataStore
+	transport *InProcessReplicationTransport
+	nodes     map[string]*FS
+}
+
+// newTestCluster creates a cluster whose ring manager is configured by ringCfg, with
+// Etcd filled in, and adds the given nodes to it.
+func newTestCluster(t *testing.T, ringCfg RingManagerConfig, nodes ...string) *testCluster {
+	t.Helper()
+	etcd, err := etcdsim.New(etcdsim.Config{})
+	if err != nil {
+		t.Fatalf("failed to create etcd sim: %v", err)
+	}
+	ringCfg.Etcd = etcd
+	ring, err := NewRingManager(ringCfg)
+	if err != nil {
+		t.Fatalf("failed to create ring manager: %v", err)
+	}
+	segments, err := NewEtcdMetadataStore(EtcdMetadataStoreConfig{Etcd: etcd})
+	if err != nil {
+		t.Fatalf("failed to create metadata store: %v", err)
+	}
+	c := &testCluster{etcd: etcd, ring: ring, segments: segments, transport: NewInProcessReplicationTransport(), nodes: map[string]*FS{}}
+	for _, id := range nodes {
+		c.addNode(t, id)
+	}
+	return c
+}
+
+func (c *testCluster) addNode(t *testing.T, id string) {
+	t.Helper()
+	c.nodes[id] = NewFS(t.TempDir())
+	c.transport.RegisterFS(id, c.nodes[id])
+	if _, err := c.ring.UpsertNode(context.Background(), NodeDescriptor{ID: id}); err != nil {
+		t.Fatalf("failed to add node %s: %v", id, err)
+	}
+}
+
+// service creates the Service of node id. Fields of cfg left unset default to the
+// cluster's ring, the node's filesystem, the transport and the segment store.
+func (c *testCluster) service(t *testing.T, id string, cfg ServiceConfig) *Service {
+	t.Helper()
+	cfg.NodeID = id
+	if cfg.Ring == nil {
+		cfg.Ring = c.ring
+	}
+	if cfg.Filesystem == nil {
+		cfg.Filesystem = c.nodes[id]
+	}
+	if cfg.Transport == nil {
+		cfg.Transport = c.transport
+	}
+	if cfg.Metadata == nil {
+		cfg.Metadata = c.segments
+	}
+	svc, err := NewService(cfg)
+	if err != nil {
+		t.Fatalf("failed to create service for %s: %v", id, err)
+	}
+	return svc
+}
+
+func (c *testCluster) records(t *testing.T) map[string]SegmentRecord {
+	t.Helper()
+	list, err := c.segments.ListSegments(context.Background())
+	if err != nil {
+		t.Fatalf("failed to list segments: %v", err)
+	}
+	out := map[string]SegmentRecord{}
+	for _, r := range list {
+		out[r.SegmentID] = r
+	}
+	return out
+}
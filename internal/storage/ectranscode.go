@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// ErasureTranscodeReport summarises a single transcoding pass.
+type ErasureTranscodeReport struct {
+	StartedAt  time.Time
+	FinishedAt time.Time
+	// Transcoded lists the segment ids converted to erasure coding, and BytesFreed the
+	// replicated bytes released net of the parity added.
+	Transcoded []string
+	BytesFreed int64
+	// Oversized lists the selected segments left replicated because they exceed
+	// MaxSegmentBytes.
+	Oversized []string
+	// Failed maps the segments that could not be converted to the error seen. A segment
+	// whose record was already converted but whose old copies could not all be deleted
+	// is listed in both.
+	Failed map[string]error
+}
+
+// ErasureTranscoder converts replicated segments to erasure coding: it reads a full
+// copy, stores its shards on the ring, points the segment record at them, and deletes
+// the replicas. Each segment is converted by the node recorded as its primary, so
+// transcoders can run on every node. Copies in S3 are kept. Segments are encoded in
+// memory, so only those up to MaxSegmentBytes are converted.
+type ErasureTranscoder struct {
+	NodeID     string
+	Ring       *RingManager
+	Filesystem *FS
+	Transport  ReplicationTransport
+	Segments   SegmentLister
+	Metadata   MetadataStore
+	// Buckets and the StorageClassAttribute of each record select the segments to
+	// convert, as they do for uploads. Select, when set, is consulted for the segments
+	// neither covers, e.g. to pick renditions that have gone cold.
+	Buckets map[string]ErasureProfile
+	Select  func(record SegmentRecord) (ErasureProfile, bool)
+	// MaxSegmentBytes is the largest segment converted (default
+	// DefaultMaxErasureSegmentBytes).
+	MaxSegmentBytes int64
+	Interval        time.Duration
+	// OnReport is invoked after every pass.
+	OnReport func(report *ErasureTranscodeReport)
+}
+
+// Run blocks until the context is cancelled, converting every Interval (default 6 hours).
+func (t *ErasureTranscoder) Run(ctx context.Context) error {
+	if t == nil || t.Ring == nil || t.Filesystem == nil || t.Segments == nil || t.Metadata == nil {
+		return errors.New("storage: erasure transcoder requires a ring, filesystem, segment lister and metadata store")
+	}
+	interval := t.Interval
+	if interval <= 0 {
+		interval = 6 * time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		report, err := t.TranscodeOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("storage: erasure transcoding failed: %v", err)
+		}
+		if report != nil && t.OnReport != nil {
+			t.OnReport(report)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// TranscodeOnce converts every selected replicated segment this node is primary for.
+// Per-segment failures are recorded in the report; the returned error is reserved for
+// failures that abort the pass.
+func (t *ErasureTranscoder) TranscodeOnce(ctx context.Context) (*ErasureTranscodeReport, error) {
+	report := &ErasureTranscodeReport{StartedAt: time.Now().UTC(), Failed: map[string]error{}}
+	defer func() { report.FinishedAt = time.Now().UTC() }()
+
+	records, err := t.Segments.ListSegments(ctx)
+	if err != nil {
+		return report, fmt.Errorf("storage: failed to list segments: %w", err)
+	}
+	for _, record := range records {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if record.Erasure != nil || record.PrimaryNode != t.NodeID {
+			continue
+		}
+		profile, ok, err := selectErasure(t.Buckets, record.Locator.Bucket, record.Attributes)
+		if err != nil {
+			report.Failed[record.SegmentID] = err
+			continue
+		}
+		if !ok && t.Select != nil {
+			if _, explicit := record.Attributes[StorageClassAttribute]; !explicit {
+				profile, ok = t.Select(record)
+			}
+		}
+		if !ok {
+			continue
+		}
+		if record.SizeBytes > t.maxSegmentBytes() {
+			report.Oversized = append(report.Oversized, record.SegmentID)
+			continue
+		}
+		converted, freed, err := t.transcode(ctx, record, profile)
+		if converted {
+			report.Transcoded = append(report.Transcoded, record.SegmentID)
+			report.BytesFreed += freed
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return report, ctx.Err()
+			}
+			report.Failed[record.SegmentID] = err
+		}
+	}
+	return report, nil
+}
+
+func (t *ErasureTranscoder) maxSegmentBytes() int64 {
+	if t.MaxSegmentBytes > 0 {
+		return t.MaxSegmentBytes
+	}
+	return DefaultMaxErasureSegmentBytes
+}
+
+// transcode converts one segment, reporting whether the record now points at the shards
+// and the bytes freed. Shards are only committed if every one of them is stored.
+func (t *ErasureTranscoder) transcode(ctx context.Context, record SegmentRecord, profile ErasureProfile) (bool, int64, error) {
+	holders, external := recordHolders(record)
+	blob, err := t.read(ctx, record, holders)
+	if err != nil {
+		return false, 0, err
+	}
+	transport := t.Transport
+	if transport == nil {
+		transport = NoopReplicationTransport{}
+	}
+	st := shardStore{nodeID: t.NodeID, ring: t.Ring, fs: t.Filesystem, transport: transport}
+	layout, errs, err := st.put(ctx, record.SegmentID, record.Locator, blob, profile)
+	if err != nil {
+		return false, 0, err
+	}
+	for i, err := range errs {
+		if err != nil {
+			st.deleteShards(ctx, record.Locator, layout, errs)
+			return false, 0, fmt.Errorf("store shard %d on %s: %w", i, layout.Shards[i], err)
+		}
+	}
+
+	updated := record
+	updated.PrimaryNode = t.NodeID
+	updated.Replicas = external
+	updated.Erasure = layout
+	updated.Attributes = map[string]string{}
+	for k, v := range record.Attributes {
+		updated.Attributes[k] = v
+	}
+	updated.Attributes[StorageClassAttribute] = profile.String()
+	if err := t.Metadata.PutSegment(ctx, updated); err != nil {
+		st.deleteShards(ctx, record.Locator, layout, errs)
+		return false, 0, fmt.Errorf("update metadata: %w", err)
+	}
+
+	freed := record.SizeBytes*int64(len(holders)) - layout.ShardSize*int64(len(layout.Shards))
+	locator := record.Locator
+	for _, node := range holders {
+		if node == t.NodeID {
+			err = t.Filesystem.Delete(locator.Bucket, locator.Object)
+		} else {
+			err = transport.DeleteSegment(ctx, node, &locator)
+		}
+		if err != nil {
+			return true, freed, fmt.Errorf("delete replica from %s: %w", node, err)
+		}
+	}
+	return true, freed, nil
+}
+
+// read returns a full copy of the segment, preferring the local one, that matches the
+// recorded checksum. Copies longer than the recorded size are refused, so a wrong record
+// cannot make it buffer more than MaxSegmentBytes.
+func (t *ErasureTranscoder) read(ctx context.Context, record SegmentRecord, holders []string) ([]byte, error) {
+	expected := NormalizeChecksum(record.Checksum)
+	lastErr := errors.New("storage: no node holds a copy")
+	for _, node := range holders {
+		var body io.ReadCloser
+		var err error
+		locator := record.Locator
+		if node == t.NodeID {
+			body, err = t.Filesystem.Get(locator.Bucket, locator.Object)
+		} else if t.Transport != nil {
+			body, err = t.Transport.FetchSegment(ctx, node, &locator)
+		} else {
+			continue
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("fetch from %s: %w", node, err)
+			continue
+		}
+		blob, err := io.ReadAll(io.LimitReader(body, record.SizeBytes+1))
+		body.Close()
+		if err != nil {
+			lastErr = fmt.Errorf("fetch from %s: %w", node, err)
+			continue
+		}
+		if int64(len(blob)) > record.SizeBytes {
+			lastErr = fmt.Errorf("copy on %s is longer than the recorded %d bytes", node, record.SizeBytes)
+			continue
+		}
+		sum := sha256.Sum256(blob)
+		if actual := hex.EncodeToString(sum[:]); expected != "" && actual != expected {
+			lastErr = fmt.Errorf("%w: copy on %s hashes to %s, recorded %s", ErrChecksumMismatch, node, actual, expected)
+			continue
+		}
+		return blob, nil
+	}
+	return nil, lastErr
+}
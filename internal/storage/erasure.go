@@ -0,0 +1,476 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"strings"
+
+	"tritontube/internal/erasure"
+	grpc "tritontube/internal/metadata/grpcstub"
+	storagepb "tritontube/internal/storage/proto"
+)
+
+// StorageClassAttribute names the upload attribute that selects a segment's storage
+// class, overriding the class of its bucket: StorageClassReplicated, or "ec:<k>+<m>" for
+// Reed-Solomon coding with k data and m parity shards.
+const StorageClassAttribute = "storage_class"
+
+// StorageClassReplicated stores full copies on the segment's ring replicas.
+const StorageClassReplicated = "replicated"
+
+// erasureBucket holds the shards of erasure-coded segments, under
+// <bucket>/<object>/<shard>. S3 bucket names cannot start with a dot, so it never
+// collides with a real bucket.
+const erasureBucket = ".erasure"
+
+// ErasureProfile is a Reed-Solomon layout: a segment is split into DataShards shards,
+// ParityShards more are computed from them, and any DataShards of the shards rebuild it.
+type ErasureProfile struct {
+	DataShards   int
+	ParityShards int
+}
+
+// String returns the profile's storage class, e.g. "ec:4+2".
+func (p ErasureProfile) String() string {
+	return fmt.Sprintf("ec:%d+%d", p.DataShards, p.ParityShards)
+}
+
+func (p ErasureProfile) codec() (*erasure.Codec, error) {
+	if p.ParityShards <= 0 {
+		return nil, fmt.Errorf("storage: storage class %s has no parity shards", p)
+	}
+	codec, err := erasure.New(p.DataShards, p.ParityShards)
+	if err != nil {
+		return nil, fmt.Errorf("storage: storage class %s: %w", p, err)
+	}
+	return codec, nil
+}
+
+// ParseStorageClass parses a storage class attribute. It reports whether the class is
+// erasure coded; the empty class is replicated.
+func ParseStorageClass(class string) (ErasureProfile, bool, error) {
+	class = strings.ToLower(strings.TrimSpace(class))
+	if class == "" || class == StorageClassReplicated {
+		return ErasureProfile{}, false, nil
+	}
+	var p ErasureProfile
+	if _, err := fmt.Sscanf(class, "ec:%d+%d", &p.DataShards, &p.ParityShards); err != nil || p.String() != class {
+		return ErasureProfile{}, false, fmt.Errorf("storage: unknown storage class %q", class)
+	}
+	if _, err := p.codec(); err != nil {
+		return ErasureProfile{}, false, err
+	}
+	return p, true, nil
+}
+
+// selectErasure returns the erasure profile for a segment in bucket with attrs: the
+// storage class attribute when present, otherwise the bucket's profile, if any.
+func selectErasure(buckets map[string]ErasureProfile, bucket string, attrs map[string]string) (ErasureProfile, bool, error) {
+	if class, ok := attrs[StorageClassAttribute]; ok {
+		return ParseStorageClass(class)
+	}
+	p, ok := buckets[bucket]
+	if !ok {
+		return ErasureProfile{}, false, nil
+	}
+	if _, err := p.codec(); err != nil {
+		return ErasureProfile{}, false, err
+	}
+	return p, true, nil
+}
+
+// shardQuorum returns how many shards level requires: ONE needs enough to rebuild the
+// segment, QUORUM half the parity shards more, and ALL every shard.
+func shardQuorum(level storagepb.ConsistencyLevel, p ErasureProfile) int {
+	switch level {
+	case storagepb.ConsistencyLevel_CONSISTENCY_LEVEL_ONE:
+		return p.DataShards
+	case storagepb.ConsistencyLevel_CONSISTENCY_LEVEL_QUORUM:
+		return p.DataShards + (p.ParityShards+1)/2
+	default:
+		return p.DataShards + p.ParityShards
+	}
+}
+
+// ErasureLayout records where the shards of an erasure-coded segment live.
+type ErasureLayout struct {
+	DataShards   int   `json:"data_shards"`
+	ParityShards int   `json:"parity_shards"`
+	ShardSize    int64 `json:"shard_size"`
+	// Shards names the node holding each shard, in shard order; "" marks a shard that
+	// was never stored. Checksums holds each shard's hex sha256.
+	Shards    []string `json:"shards"`
+	Checksums []string `json:"checksums"`
+}
+
+func (l *ErasureLayout) profile() ErasureProfile {
+	return ErasureProfile{DataShards: l.DataShards, ParityShards: l.ParityShards}
+}
+
+// holders returns the distinct nodes holding shards, in shard order.
+func (l *ErasureLayout) holders() []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, node := range l.Shards {
+		if node != "" && !seen[node] {
+			seen[node] = true
+			out = append(out, node)
+		}
+	}
+	return out
+}
+
+// shardLocator locates shard i of the segment stored at locator.
+func shardLocator(locator storagepb.SegmentLocator, i int) *storagepb.SegmentLocator {
+	return &storagepb.SegmentLocator{Bucket: erasureBucket, Object: locator.Bucket + "/" + locator.Object + "/" + strconv.Itoa(i)}
+}
+
+// shardStore reads and writes the shards of erasure-coded segments from one node's
+// point of view: its own shards through fs, everyone else's through transport.
+type shardStore struct {
+	nodeID    string
+	ring      *RingManager
+	fs        *FS
+	transport ReplicationTransport
+}
+
+// put encodes blob and writes shard i to the i-th node the ring lists for the segment,
+// wrapping around when there are fewer nodes than shards. The returned layout names the
+// intended holder of every shard; errs[i] reports whether shard i was stored.
+func (st shardStore) put(ctx context.Context, segmentID string, locator storagepb.SegmentLocator, blob []byte, p ErasureProfile) (*ErasureLayout, []error, error) {
+	codec, err := p.codec()
+	if err != nil {
+		return nil, nil, err
+	}
+	shards := codec.Split(blob)
+	if err := codec.Encode(shards); err != nil {
+		return nil, nil, fmt.Errorf("storage: failed to encode %s: %w", segmentID, err)
+	}
+	targets := st.ring.Lookup([]byte(segmentID), len(shards))
+	if len(targets) == 0 {
+		targets = []string{st.nodeID}
+	}
+	layout := &ErasureLayout{
+		DataShards:   p.DataShards,
+		ParityShards: p.ParityShards,
+		ShardSize:    int64(codec.ShardSize(len(blob))),
+		Shards:       make([]string, len(shards)),
+		Checksums:    make([]string, len(shards)),
+	}
+	type result struct {
+		i   int
+		err error
+	}
+	done := make(chan result, len(shards))
+	for i, shard := range shards {
+		sum := sha256.Sum256(shard)
+		layout.Checksums[i] = hex.EncodeToString(sum[:])
+		layout.Shards[i] = targets[i%len(targets)]
+		go func(i int, shard []byte) {
+			done <- result{i: i, err: st.putShard(ctx, layout.Shards[i], segmentID, shardLocator(locator, i), shard, layout.Checksums[i])}
+		}(i, shard)
+	}
+	errs := make([]error, len(shards))
+	for range shards {
+		r := <-done
+		errs[r.i] = r.err
+	}
+	return layout, errs, nil
+}
+
+func (st shardStore) putShard(ctx context.Context, nodeID, segmentID string, locator *storagepb.SegmentLocator, shard []byte, checksum string) error {
+	if nodeID == st.nodeID {
+		_, _, err := st.fs.PutVerified(locator.Bucket, locator.Object, bytes.NewReader(shard), checksum)
+		return err
+	}
+	header := &storagepb.UploadSegmentHeader{
+		SegmentId: segmentID,
+		Locator:   locator,
+		SizeBytes: int64(len(shard)),
+		Checksum:  checksum,
+	}
+	return st.transport.ReplicateSegment(ctx, nodeID, header, bytes.NewReader(shard))
+}
+
+// deleteShards removes the shards of layout that errs reports stored, ignoring failures.
+func (st shardStore) deleteShards(ctx context.Context, locator storagepb.SegmentLocator, layout *ErasureLayout, errs []error) {
+	for i, nodeID := range layout.Shards {
+		if nodeID == "" || errs[i] != nil {
+			continue
+		}
+		shard := shardLocator(locator, i)
+		if nodeID == st.nodeID {
+			_ = st.fs.Delete(shard.Bucket, shard.Object)
+		} else {
+			_ = st.transport.DeleteSegment(ctx, nodeID, shard)
+		}
+	}
+}
+
+// fetch reads shard i and checks it against its recorded checksum.
+func (st shardStore) fetch(ctx context.Context, record SegmentRecord, i int) ([]byte, error) {
+	layout := record.Erasure
+	nodeID := layout.Shards[i]
+	if nodeID == "" {
+		return nil, fmt.Errorf("storage: shard %d of %s was never stored", i, record.SegmentID)
+	}
+	locator := shardLocator(record.Locator, i)
+	var body io.ReadCloser
+	var err error
+	if nodeID == st.nodeID {
+		body, err = st.fs.Get(locator.Bucket, locator.Object)
+	} else {
+		body, err = st.transport.FetchSegment(ctx, nodeID, locator)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("shard %d from %s: %w", i, nodeID, err)
+	}
+	defer body.Close()
+	shard, err := io.ReadAll(io.LimitReader(body, layout.ShardSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("shard %d from %s: %w", i, nodeID, err)
+	}
+	sum := sha256.Sum256(shard)
+	if actual := hex.EncodeToString(sum[:]); actual != layout.Checksums[i] {
+		return nil, fmt.Errorf("%w: shard %d of %s on %s hashes to %s", ErrChecksumMismatch, i, record.SegmentID, nodeID, actual)
+	}
+	return shard, nil
+}
+
+// gather reads shards until DataShards of them are intact, data shards first so that a
+// healthy segment needs no decoding, then parity shards in place of any that fail. Shard
+// skip is never read. It returns the shards, nil where missing, and the nodes read from.
+func (st shardStore) gather(ctx context.Context, record SegmentRecord, skip int) ([][]byte, []string, error) {
+	layout := record.Erasure
+	total := layout.DataShards + layout.ParityShards
+	if len(layout.Shards) != total || len(layout.Checksums) != total {
+		return nil, nil, fmt.Errorf("storage: malformed erasure layout for %s", record.SegmentID)
+	}
+	type result struct {
+		i     int
+		shard []byte
+		err   error
+	}
+	shards := make([][]byte, total)
+	var used []string
+	var lastErr error
+	good, next := 0, 0
+	for good < layout.DataShards && next < total {
+		done := make(chan result, layout.DataShards-good)
+		batch := 0
+		for ; batch < layout.DataShards-good && next < total; next++ {
+			if next == skip {
+				continue
+			}
+			batch++
+			go func(i int) {
+				shard, err := st.fetch(ctx, record, i)
+				done <- result{i: i, shard: shard, err: err}
+			}(next)
+		}
+		for ; batch > 0; batch-- {
+			r := <-done
+			if r.err != nil {
+				lastErr = r.err
+				continue
+			}
+			shards[r.i] = r.shard
+			good++
+			if !containsString(used, layout.Shards[r.i]) {
+				used = append(used, layout.Shards[r.i])
+			}
+		}
+	}
+	if good < layout.DataShards {
+		return nil, used, fmt.Errorf("%w: %d of %d shards of %s readable, last error: %v", erasure.ErrTooFewShards, good, layout.DataShards, record.SegmentID, lastErr)
+	}
+	return shards, used, nil
+}
+
+// decode rebuilds an erasure-coded segment from any DataShards of its shards and
+// returns it with the nodes read from.
+func (st shardStore) decode(ctx context.Context, record SegmentRecord) ([]byte, []string, error) {
+	codec, err := record.Erasure.profile().codec()
+	if err != nil {
+		return nil, nil, err
+	}
+	shards, used, err := st.gather(ctx, record, -1)
+	if err != nil {
+		return nil, used, err
+	}
+	if err := codec.Reconstruct(shards); err != nil {
+		return nil, used, fmt.Errorf("storage: failed to reconstruct %s: %w", record.SegmentID, err)
+	}
+	blob, err := codec.Join(shards, int(record.SizeBytes))
+	if err != nil {
+		return nil, used, fmt.Errorf("storage: failed to reconstruct %s: %w", record.SegmentID, err)
+	}
+	if expected := NormalizeChecksum(record.Checksum); expected != "" {
+		sum := sha256.Sum256(blob)
+		if actual := hex.EncodeToString(sum[:]); actual != expected {
+			return nil, used, fmt.Errorf("%w: %s reconstructed to %s, recorded %s", ErrChecksumMismatch, record.SegmentID, actual, expected)
+		}
+	}
+	return blob, used, nil
+}
+
+// rebuild recomputes shard i from the others.
+func (st shardStore) rebuild(ctx context.Context, record SegmentRecord, i int) ([]byte, error) {
+	codec, err := record.Erasure.profile().codec()
+	if err != nil {
+		return nil, err
+	}
+	shards, _, err := st.gather(ctx, record, i)
+	if err != nil {
+		return nil, err
+	}
+	if err := codec.Reconstruct(shards); err != nil {
+		return nil, fmt.Errorf("storage: failed to rebuild shard %d of %s: %w", i, record.SegmentID, err)
+	}
+	return shards[i], nil
+}
+
+func (s *Service) shardStore() shardStore {
+	return shardStore{nodeID: s.nodeID, ring: s.ring, fs: s.fs, transport: s.transport}
+}
+
+// storageClass returns the erasure profile an upload selects, if any. Erasure-coded
+// segments can only be read back through their record, so they need a store that can
+// look records up.
+func (s *Service) storageClass(header *storagepb.UploadSegmentHeader) (ErasureProfile, bool, error) {
+	p, ok, err := selectErasure(s.erasureBuckets, header.Locator.Bucket, header.Attributes)
+	if err != nil || !ok {
+		return p, ok, err
+	}
+	if _, readable := s.metadata.(SegmentReader); !readable {
+		return p, false, fmt.Errorf("storage: storage class %s requires a metadata store that can read segments back", p)
+	}
+	return p, true, nil
+}
+
+// uploadErasureCoded replaces the committed local copy of an upload with its shards.
+// The header's consistency level sets how many shards must be stored (see shardQuorum);
+// below that the stored shards are removed again and the RPC fails with Unavailable.
+// The full copy is kept until the segment record lists the shards. The segment is
+// encoded in memory; UploadSegment holds it to MaxErasureSegmentBytes.
+func (s *Service) uploadErasureCoded(stream storagepb.StorageService_UploadSegmentServer, header *storagepb.UploadSegmentHeader, size int64, checksum string, p ErasureProfile) error {
+	ctx := stream.Context()
+	locator := *header.Locator
+	f, err := s.fs.Get(locator.Bucket, locator.Object)
+	if err != nil {
+		return fmt.Errorf("storage: failed to reopen segment for encoding: %w", err)
+	}
+	blob, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("storage: failed to reopen segment for encoding: %w", err)
+	}
+
+	st := s.shardStore()
+	layout, errs, err := st.put(ctx, header.SegmentId, locator, blob, p)
+	if err != nil {
+		return grpc.Errorf(grpc.InvalidArgument, "%v", err)
+	}
+	var acks []*storagepb.ReplicaAck
+	stored := 0
+	for i, nodeID := range layout.Shards {
+		ack := &storagepb.ReplicaAck{NodeId: nodeID, Success: errs[i] == nil}
+		if errs[i] != nil {
+			ack.ErrorMessage = fmt.Sprintf("shard %d: %v", i, errs[i])
+		} else {
+			stored++
+		}
+		acks = append(acks, ack)
+	}
+	required := shardQuorum(levelOr(header.Consistency, s.writeConsistency), p)
+	if stored < required {
+		st.deleteShards(ctx, locator, layout, errs)
+		return grpc.Errorf(grpc.Unavailable, "storage: write quorum not met for %s: %d of %d shards stored", header.SegmentId, stored, required)
+	}
+	for i := range layout.Shards {
+		if errs[i] != nil {
+			layout.Shards[i] = ""
+		}
+	}
+
+	record := SegmentRecord{
+		SegmentID:   header.SegmentId,
+		Locator:     locator,
+		PrimaryNode: s.nodeID,
+		Checksum:    checksum,
+		SizeBytes:   size,
+		Attributes:  map[string]string{},
+		Erasure:     layout,
+	}
+	for k, v := range header.Attributes {
+		record.Attributes[k] = v
+	}
+	record.Attributes[StorageClassAttribute] = p.String()
+	if header.S3Bucket != "" && header.S3Key != "" {
+		key := fmt.Sprintf("s3:%s/%s", header.S3Bucket, header.S3Key)
+		if err := s.s3.UploadSegment(ctx, header.S3Bucket, header.S3Key, bytes.NewReader(blob)); err != nil {
+			acks = append(acks, &storagepb.ReplicaAck{NodeId: key, Success: false, ErrorMessage: err.Error()})
+		} else {
+			acks = append(acks, &storagepb.ReplicaAck{NodeId: key, Success: true})
+			record.Replicas = append(record.Replicas, key)
+		}
+	}
+	if err := s.metadata.PutSegment(ctx, record); err != nil {
+		st.deleteShards(ctx, locator, layout, errs)
+		return grpc.Errorf(grpc.Unavailable, "storage: failed to record %s: %v", header.SegmentId, err)
+	}
+	acks = append(acks, &storagepb.ReplicaAck{NodeId: "metadata", Success: true})
+	if err := s.fs.Delete(locator.Bucket, locator.Object); err != nil {
+		acks = append(acks, &storagepb.ReplicaAck{NodeId: s.nodeID, Success: false, ErrorMessage: "failed to drop full copy: " + err.Error()})
+	}
+	return stream.SendAndClose(&storagepb.UploadSegmentResponse{
+		SizeCommitted:  size,
+		Checksum:       checksum,
+		ReplicaStatus:  acks,
+		QuorumReplicas: layout.holders(),
+	})
+}
+
+// erasureRecord returns the record of the segment a read asks for when the segment is
+// erasure coded and so has no full local copy.
+func (s *Service) erasureRecord(ctx context.Context, req *storagepb.GetSegmentRequest) (SegmentRecord, bool) {
+	reader, ok := s.metadata.(SegmentReader)
+	if !ok || req.SegmentId == "" {
+		return SegmentRecord{}, false
+	}
+	if _, err := s.fs.Stat(req.Locator.Bucket, req.Locator.Object); !errors.Is(err, fs.ErrNotExist) {
+		return SegmentRecord{}, false
+	}
+	record, err := reader.Segment(ctx, req.SegmentId)
+	if err != nil || record.Erasure == nil {
+		return SegmentRecord{}, false
+	}
+	return record, true
+}
+
+// getErasureCoded serves a read of an erasure-coded segment, rebuilding it from the
+// first DataShards intact shards. The first message lists the nodes read from. The
+// segment is rebuilt in memory, which uploads and the ErasureTranscoder bound by
+// capping the size of the segments they encode.
+func (s *Service) getErasureCoded(req *storagepb.GetSegmentRequest, stream storagepb.StorageService_GetSegmentServer, record SegmentRecord) error {
+	if req.Offset > record.SizeBytes {
+		return grpc.Errorf(grpc.OutOfRange, "storage: offset %d beyond segment size %d", req.Offset, record.SizeBytes)
+	}
+	blob, used, err := s.shardStore().decode(stream.Context(), record)
+	switch {
+	case errors.Is(err, erasure.ErrTooFewShards):
+		return grpc.Errorf(grpc.Unavailable, "%v", err)
+	case errors.Is(err, ErrChecksumMismatch):
+		return grpc.Errorf(grpc.DataLoss, "%v", err)
+	case err != nil:
+		return grpc.Errorf(grpc.Internal, "%v", err)
+	}
+	return sendRange(stream, req, bytes.NewReader(blob[req.Offset:]), int64(len(blob)), used)
+}
@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	grpc "tritontube/internal/metadata/grpcstub"
+	storagepb "tritontube/internal/storage/proto"
+)
+
+func TestErasureCodedStorageClass(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCluster(t, RingManagerConfig{}, "node-a", "node-b", "node-c", "node-d", "node-e", "node-f")
+	svc := c.service(t, "node-a", ServiceConfig{
+		ErasureBuckets: map[string]ErasureProfile{"cold": {DataShards: 4, ParityShards: 2}},
+		// Erasure-coded segments are encoded in memory and capped below other segments.
+		MaxErasureSegmentBytes: 4096,
+	})
+	payload := strings.Repeat("0123456789abcdef", 100) + "tail"
+	read := func(id string, locator *storagepb.SegmentLocator, offset int64) (string, error) {
+		t.Helper()
+		stream := &getSegmentStream{ctx: ctx}
+		err := svc.GetSegment(&storagepb.GetSegmentRequest{Locator: locator, SegmentId: id, Offset: offset}, stream)
+		data, _ := stream.result()
+		return string(data), err
+	}
+	dropShard := func(record SegmentRecord, i int) {
+		t.Helper()
+		shard := shardLocator(record.Locator, i)
+		if err := c.nodes[record.Erasure.Shards[i]].Delete(shard.Bucket, shard.Object); err != nil {
+			t.Fatalf("failed to drop shard %d: %v", i, err)
+		}
+	}
+
+	locator := &storagepb.SegmentLocator{Bucket: "cold", Object: "v1/240p/1"}
+	stream := newUploadStream(&storagepb.UploadSegmentHeader{SegmentId: "v1/240p/1", Locator: locator}, payload)
+	if err := svc.UploadSegment(stream); err != nil {
+		t.Fatalf("erasure-coded upload failed: %v", err)
+	}
+	if got := len(stream.resp.QuorumReplicas); got != 6 {
+		t.Fatalf("expected shards on 6 nodes, got %v", stream.resp.QuorumReplicas)
+	}
+	if _, err := svc.fs.Stat("cold", "v1/240p/1"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the full local copy to be dropped, got %v", err)
+	}
+	record, err := c.segments.Segment(ctx, "v1/240p/1")
+	if err != nil || record.Erasure == nil || record.Attributes[StorageClassAttribute] != "ec:4+2" {
+		t.Fatalf("expected an ec:4+2 record, got %+v (%v)", record, err)
+	}
+	if data, err := read("v1/240p/1", locator, 0); err != nil || data != payload {
+		t.Fatalf("unexpected read %q: %v", data, err)
+	}
+
+	// Any four shards rebuild the segment.
+	dropShard(record, 0)
+	dropShard(record, 3)
+	if data, err := read("v1/240p/1", locator, 10); err != nil || data != payload[10:] {
+		t.Fatalf("unexpected degraded read %q: %v", data, err)
+	}
+	dropShard(record, 5)
+	if _, err := read("v1/240p/1", locator, 0); grpc.CodeOf(err) != grpc.Unavailable {
+		t.Fatalf("expected Unavailable with three shards lost, got %v", err)
+	}
+
+	// The attribute overrides the bucket, and unknown classes are rejected.
+	attrs := map[string]string{StorageClassAttribute: "ec:3+1"}
+	other := &storagepb.SegmentLocator{Bucket: "videos", Object: "v1/240p/2"}
+	if err := svc.UploadSegment(newUploadStream(&storagepb.UploadSegmentHeader{SegmentId: "v1/240p/2", Locator: other, Attributes: attrs}, payload)); err != nil {
+		t.Fatalf("upload with storage class attribute failed: %v", err)
+	}
+	if record, err := c.segments.Segment(ctx, "v1/240p/2"); err != nil || record.Erasure == nil || len(record.Erasure.Shards) != 4 {
+		t.Fatalf("expected an ec:3+1 record, got %+v (%v)", record, err)
+	}
+	attrs = map[string]string{StorageClassAttribute: "raid5"}
+	if err := svc.UploadSegment(newUploadStream(&storagepb.UploadSegmentHeader{SegmentId: "v1/240p/3", Locator: other, Attributes: attrs}, payload)); grpc.CodeOf(err) != grpc.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for an unknown storage class, got %v", err)
+	}
+
+	// Segments over the erasure-coding cap are refused, whether or not they declare
+	// their size, while replicated ones of the same size are not.
+	large := strings.Repeat(payload, 3)
+	big := &storagepb.SegmentLocator{Bucket: "cold", Object: "v1/1080p/1"}
+	if err := svc.UploadSegment(newUploadStream(&storagepb.UploadSegmentHeader{SegmentId: "v1/1080p/1", Locator: big}, large)); grpc.CodeOf(err) != grpc.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for an oversized erasure-coded segment, got %v", err)
+	}
+	header := &storagepb.UploadSegmentHeader{SegmentId: "v1/1080p/1", Locator: big, SizeBytes: int64(len(large))}
+	if err := svc.UploadSegment(newUploadStream(header, large)); grpc.CodeOf(err) != grpc.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for a declared oversized erasure-coded segment, got %v", err)
+	}
+	if err := svc.UploadSegment(newUploadStream(&storagepb.UploadSegmentHeader{SegmentId: "v1/1080p/2", Locator: &storagepb.SegmentLocator{Bucket: "videos", Object: "v1/1080p/2"}}, large)); err != nil {
+		t.Fatalf("replicated upload over the erasure-coding cap failed: %v", err)
+	}
+
+	// The scrubber rebuilds lost shards held by its node.
+	record, _ = c.segments.Segment(ctx, "v1/240p/2")
+	local := -1
+	for i, holder := range record.Erasure.Shards {
+		if holder == "node-a" {
+			local = i
+		}
+	}
+	if local < 0 {
+		t.Fatalf("expected node-a to hold a shard of %v", record.Erasure.Shards)
+	}
+	dropShard(record, local)
+	scrubber := &Scrubber{NodeID: "node-a", Filesystem: svc.fs, Segments: c.segments, Transport: c.transport, BytesPerSecond: -1}
+	scrub, err := scrubber.ScrubOnce(ctx)
+	if err != nil {
+		t.Fatalf("scrub failed: %v", err)
+	}
+	if want := fmt.Sprintf("v1/240p/2#%d", local); !containsString(scrub.Repaired, want) {
+		t.Fatalf("expected %s to be repaired, got %+v", want, scrub)
+	}
+
+	// Replicated segments are converted by the transcoder.
+	var id string
+	for i := 4; id == ""; i++ {
+		candidate := fmt.Sprintf("v1/240p/%d", i)
+		if containsString(c.ring.Lookup([]byte(candidate), 3), "node-a") {
+			id = candidate
+		}
+	}
+	warm := &storagepb.SegmentLocator{Bucket: "videos", Object: id}
+	if err := svc.UploadSegment(newUploadStream(&storagepb.UploadSegmentHeader{SegmentId: id, Locator: warm}, payload)); err != nil {
+		t.Fatalf("replicated upload failed: %v", err)
+	}
+	before, err := c.segments.Segment(ctx, id)
+	if err != nil || before.Erasure != nil {
+		t.Fatalf("expected a replicated record, got %+v (%v)", before, err)
+	}
+	transcoder := &ErasureTranscoder{
+		NodeID:     "node-a",
+		Ring:       c.ring,
+		Filesystem: svc.fs,
+		Transport:  c.transport,
+		Segments:   c.segments,
+		Metadata:   c.segments,
+		Select: func(record SegmentRecord) (ErasureProfile, bool) {
+			return ErasureProfile{DataShards: 4, ParityShards: 2}, record.SegmentID == id || record.SegmentID == "v1/1080p/2"
+		},
+		MaxSegmentBytes: 4096,
+	}
+	report, err := transcoder.TranscodeOnce(ctx)
+	if err != nil {
+		t.Fatalf("transcode failed: %v", err)
+	}
+	if got := strings.Join(report.Transcoded, ","); got != id || len(report.Failed) != 0 || report.BytesFreed <= 0 {
+		t.Fatalf("unexpected transcode report %+v", report)
+	}
+	if got := strings.Join(report.Oversized, ","); got != "v1/1080p/2" {
+		t.Fatalf("expected the segment over the cap to be skipped, got %q", got)
+	}
+	for _, node := range append([]string{before.PrimaryNode}, before.Replicas...) {
+		if _, err := c.nodes[node].Stat("videos", id); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected the replica on %s to be deleted, got %v", node, err)
+		}
+	}
+	if data, err := read(id, warm, 0); err != nil || data != payload {
+		t.Fatalf("unexpected read after transcoding %q: %v", data, err)
+	}
+}
+
+func TestDrainPlanMovesErasureShards(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCluster(t, RingManagerConfig{VirtualNodes: 16}, "node-a", "node-b", "node-c", "node-d")
+	svc := c.service(t, "node-a", ServiceConfig{
+		ReplicationFactor: 2,
+		ErasureBuckets:    map[string]ErasureProfile{"cold": {DataShards: 2, ParityShards: 1}},
+	})
+	payload := strings.Repeat("0123456789abcdef", 64)
+	ids := []string{"v1/240p/1", "v1/240p/2"}
+	for _, id := range ids {
+		header := &storagepb.UploadSegmentHeader{SegmentId: id, Locator: &storagepb.SegmentLocator{Bucket: "cold", Object: id}}
+		if err := svc.UploadSegment(newUploadStream(header, payload)); err != nil {
+			t.Fatalf("erasure-coded upload of %s failed: %v", id, err)
+		}
+	}
+	before := c.records(t)
+	// Drain a node other than the service's that holds a shard of the first segment, and
+	// lose its copy of that shard so that it has to be rebuilt from the others.
+	drained, lost := "", -1
+	for i, holder := range before[ids[0]].Erasure.Shards {
+		if holder != "node-a" {
+			drained, lost = holder, i
+			break
+		}
+	}
+	shard := shardLocator(before[ids[0]].Locator, lost)
+	if err := c.nodes[drained].Delete(shard.Bucket, shard.Object); err != nil {
+		t.Fatalf("failed to drop shard %d: %v", lost, err)
+	}
+
+	resp, err := svc.Rebalance(ctx, &storagepb.RebalanceRequest{Drain: true, NodeId: drained})
+	if err != nil {
+		t.Fatalf("drain failed: %v", err)
+	}
+	migrator, err := NewMigrator(MigratorConfig{Segments: c.segments, Transport: c.transport, ReplicationFactor: 2})
+	if err != nil {
+		t.Fatalf("failed to create migrator: %v", err)
+	}
+	if err := migrator.ExecutePlan(ctx, resp.Plan); err != nil {
+		t.Fatalf("drain plan failed: %v", err)
+	}
+	after := c.records(t)
+	for _, id := range ids {
+		layout := after[id].Erasure
+		for i, holder := range layout.Shards {
+			shard := shardLocator(after[id].Locator, i)
+			if holder == drained {
+				t.Fatalf("shard %d of %s still recorded on %s", i, id, drained)
+			}
+			if _, err := c.nodes[holder].Verify(shard.Bucket, shard.Object); err != nil {
+				t.Fatalf("shard %d of %s missing on %s: %v", i, id, holder, err)
+			}
+			if before[id].Erasure.Shards[i] == drained {
+				if _, err := c.nodes[drained].Stat(shard.Bucket, shard.Object); !os.IsNotExist(err) {
+					t.Fatalf("shard %d of %s not removed from %s: %v", i, id, drained, err)
+				}
+			}
+		}
+		locator := after[id].Locator
+		stream := &getSegmentStream{ctx: ctx}
+		if err := svc.GetSegment(&storagepb.GetSegmentRequest{Locator: &locator, SegmentId: id}, stream); err != nil {
+			t.Fatalf("read of %s after drain failed: %v", id, err)
+		}
+		if data, _ := stream.result(); string(data) != payload {
+			t.Fatalf("unexpected read of %s after drain", id)
+		}
+	}
+}
@@ -3,16 +3,63 @@ package storage
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
-type FS struct{ root string }
+// checksumSuffix names the sidecar file holding an object's hex sha256.
+const checksumSuffix = ".sha256"
+
+// tempPrefix starts the names of files being written. Objects may not use it, so that
+// Walk can tell files left behind by an interrupted write from committed objects.
+const tempPrefix = ".tmp-"
+
+// ErrReservedName reports an object name that would collide with a temp file or a
+// checksum sidecar.
+var ErrReservedName = errors.New("storage: reserved object name")
+
+// ChecksumHeader carries the hex sha256 a client declares for a /blob/ PUT.
+const ChecksumHeader = "X-Checksum-Sha256"
+
+// ErrChecksumMismatch reports that data does not hash to the expected sha256, either
+// because an upload was corrupted in transit or because the stored copy rotted.
+var ErrChecksumMismatch = errors.New("storage: checksum mismatch")
+
+// NormalizeChecksum lower-cases a hex sha256 and strips an optional "sha256:" prefix.
+func NormalizeChecksum(sum string) string {
+	sum = strings.ToLower(strings.TrimSpace(sum))
+	return strings.TrimPrefix(sum, "sha256:")
+}
+
+type FS struct {
+	root string
+	// commit serialises swapping an object and its sidecar into place, so concurrent
+	// writers of one object cannot pair one writer's data with another's checksum.
+	commit sync.Mutex
+}
 
 func NewFS(root string) *FS {
-	return &FS{root}
+	return &FS{root: root}
+
+}
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Size    int64
+	SHA256  string
+	ModTime time.Time
+}
 
+// ETag returns the strong entity tag derived from the object's sha256.
+func (o ObjectInfo) ETag() string {
+	return `"` + o.SHA256 + `"`
 }
 
 func (f *FS) fullPath(bucket, object string) string {
@@ -21,21 +68,34 @@ func (f *FS) fullPath(bucket, object string) string {
 }
 
 func (f *FS) Put(bucket, object string, r io.Reader) (int64, string, error) {
+	return f.PutVerified(bucket, object, r, "")
+}
+
+// PutVerified is Put that refuses to commit the object unless its sha256 equals
+// expected. An empty expected checksum skips the comparison. Names reserved for temp
+// files and checksum sidecars are rejected with ErrReservedName.
+func (f *FS) PutVerified(bucket, object string, r io.Reader, expected string) (int64, string, error) {
+	if strings.HasPrefix(filepath.Base(object), tempPrefix) {
+		return 0, "", fmt.Errorf("%w: %s uses the prefix %s", ErrReservedName, object, tempPrefix)
+	}
+	if strings.HasSuffix(object, checksumSuffix) {
+		return 0, "", fmt.Errorf("%w: %s uses the suffix %s", ErrReservedName, object, checksumSuffix)
+	}
 	path := f.fullPath(bucket, object)
 	if err := os.MkdirAll(filepath.Dir(path), 0o775); err != nil {
 		return 0, "", err
 	}
-	tmp := path + ".tmp"
-	fp, err := os.Create(tmp)
+	fp, err := createTemp(path)
 	if err != nil {
 		return 0, "", err
 	}
+	tmp := fp.Name()
 	defer fp.Close()
 	h := sha256.New()
 	n, copyErr := io.Copy(io.MultiWriter(fp, h), r)
 	if copyErr != nil {
 		_ = os.Remove(tmp)
-		return 0, "", err
+		return 0, "", copyErr
 	}
 	if err := fp.Sync(); err != nil {
 		_ = os.Remove(tmp)
@@ -45,14 +105,187 @@ func (f *FS) Put(bucket, object string, r io.Reader) (int64, string, error) {
 		_ = os.Remove(tmp)
 		return 0, "", err
 	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if expected != "" && NormalizeChecksum(expected) != sum {
+		_ = os.Remove(tmp)
+		return 0, "", fmt.Errorf("%w: declared %s, received %s", ErrChecksumMismatch, expected, sum)
+	}
+	f.commit.Lock()
+	defer f.commit.Unlock()
+	// Drop the old checksum first so a crash before the new one is written leaves the
+	// object to be re-hashed lazily instead of paired with a stale sidecar.
+	_ = os.Remove(path + checksumSuffix)
 	if err := os.Rename(tmp, path); err != nil {
 		_ = os.Remove(tmp)
 		return 0, "", err
 	}
-	return int64(n), hex.EncodeToString(h.Sum(nil)), nil
+	if err := writeChecksum(path, sum); err != nil {
+		return 0, "", err
+	}
+	return int64(n), sum, nil
 }
 
 func (f *FS) Get(bucket, object string) (io.ReadCloser, error) {
 	path := f.fullPath(bucket, object)
 	return os.Open(path)
 }
+
+// Open returns the object as a seekable file together with its size, sha256 and
+// modification time, for serving byte ranges and conditional requests.
+func (f *FS) Open(bucket, object string) (*os.File, ObjectInfo, error) {
+	path := f.fullPath(bucket, object)
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	info, err := f.stat(path, fp)
+	if err != nil {
+		fp.Close()
+		return nil, ObjectInfo{}, err
+	}
+	return fp, info, nil
+}
+
+// Stat returns the object's metadata without keeping it open.
+func (f *FS) Stat(bucket, object string) (ObjectInfo, error) {
+	fp, info, err := f.Open(bucket, object)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	fp.Close()
+	return info, nil
+}
+
+// Verify re-hashes the stored object and compares it with the checksum recorded when it
+// was written. A mismatch wraps ErrChecksumMismatch.
+func (f *FS) Verify(bucket, object string) (ObjectInfo, error) {
+	fp, info, err := f.Open(bucket, object)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer fp.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fp); err != nil {
+		return ObjectInfo{}, err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != info.SHA256 {
+		return info, fmt.Errorf("%w: %s/%s recorded %s, stored data hashes to %s", ErrChecksumMismatch, bucket, object, info.SHA256, actual)
+	}
+	return info, nil
+}
+
+// Delete removes the object and its checksum sidecar. Deleting a missing object is not
+// an error.
+func (f *FS) Delete(bucket, object string) error {
+	path := f.fullPath(bucket, object)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(path + checksumSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Walk calls fn for every stored object in lexical order, skipping checksum sidecars and
+// uncommitted temp files. The first path element is the bucket. Objects removed while
+// the walk runs are skipped; an error from fn stops the walk and is returned.
+func (f *FS) Walk(fn func(bucket, object string, info ObjectInfo) error) error {
+	return filepath.WalkDir(f.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(path, checksumSuffix) || strings.HasPrefix(d.Name(), tempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(f.root, path)
+		if err != nil {
+			return err
+		}
+		bucket, object, ok := strings.Cut(filepath.ToSlash(rel), "/")
+		if !ok {
+			return nil
+		}
+		info, err := f.Stat(bucket, object)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(bucket, object, info)
+	})
+}
+
+func (f *FS) stat(path string, fp *os.File) (ObjectInfo, error) {
+	fi, err := fp.Stat()
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if fi.IsDir() {
+		return ObjectInfo{}, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	info := ObjectInfo{Size: fi.Size(), ModTime: fi.ModTime()}
+	raw, err := os.ReadFile(path + checksumSuffix)
+	if err == nil {
+		info.SHA256 = strings.TrimSpace(string(raw))
+		return info, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return ObjectInfo{}, err
+	}
+	// Objects written before checksums were recorded are hashed once on first access.
+	h := sha256.New()
+	if _, err := io.Copy(h, fp); err != nil {
+		return ObjectInfo{}, err
+	}
+	if _, err := fp.Seek(0, io.SeekStart); err != nil {
+		return ObjectInfo{}, err
+	}
+	info.SHA256 = hex.EncodeToString(h.Sum(nil))
+	f.commit.Lock()
+	defer f.commit.Unlock()
+	// Only record the checksum if the object was not replaced while it was hashed.
+	if current, err := os.Stat(path); err == nil && os.SameFile(current, fi) {
+		_ = writeChecksum(path, info.SHA256)
+	}
+	return info, nil
+}
+
+func writeChecksum(path, sum string) error {
+	fp, err := createTemp(path + checksumSuffix)
+	if err != nil {
+		return err
+	}
+	tmp := fp.Name()
+	_, err = fp.WriteString(sum + "\n")
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+checksumSuffix)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// createTemp creates a uniquely named temp file next to path, so that concurrent writers
+// of the same object never share one and the final rename stays within a directory.
+func createTemp(path string) (*os.File, error) {
+	fp, err := os.CreateTemp(filepath.Dir(path), tempPrefix+filepath.Base(path)+"-*")
+	if err != nil {
+		return nil, err
+	}
+	if err := fp.Chmod(0o664); err != nil {
+		fp.Close()
+		_ = os.Remove(fp.Name())
+		return nil, err
+	}
+	return fp, nil
+}
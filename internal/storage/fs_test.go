@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFSChecksumSidecar(t *testing.T) {
+	fs := NewFS(t.TempDir())
+	n, sum, err := fs.Put("videos", "v1/720p/1", strings.NewReader("segment-bytes"))
+	if err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	want := sha256.Sum256([]byte("segment-bytes"))
+	if n != 13 || sum != hex.EncodeToString(want[:]) {
+		t.Fatalf("unexpected put result %d %s", n, sum)
+	}
+
+	f, info, err := fs.Open("videos", "v1/720p/1")
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer f.Close()
+	if info.Size != 13 || info.SHA256 != sum || info.ETag() != `"`+sum+`"` {
+		t.Fatalf("unexpected info %+v", info)
+	}
+	if _, err := f.Seek(8, io.SeekStart); err != nil {
+		t.Fatalf("seek failed: %v", err)
+	}
+	rest, _ := io.ReadAll(f)
+	if string(rest) != "bytes" {
+		t.Fatalf("unexpected tail %q", rest)
+	}
+
+	// Objects without a sidecar are hashed on first access.
+	if err := os.Remove(filepath.Join(fs.root, "videos", "v1/720p/1"+checksumSuffix)); err != nil {
+		t.Fatalf("remove sidecar failed: %v", err)
+	}
+	info, err = fs.Stat("videos", "v1/720p/1")
+	if err != nil || info.SHA256 != sum {
+		t.Fatalf("expected lazily computed checksum, got %+v, %v", info, err)
+	}
+
+	if _, err := fs.Stat("videos", "v1/720p/2"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected not-exist, got %v", err)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errors.New("connection reset") }
+
+func TestFSPutReportsCopyError(t *testing.T) {
+	fs := NewFS(t.TempDir())
+	if _, _, err := fs.Put("videos", "v1/720p/1", failingReader{}); err == nil || !strings.Contains(err.Error(), "connection reset") {
+		t.Fatalf("expected copy error, got %v", err)
+	}
+	if _, err := fs.Stat("videos", "v1/720p/1"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("failed put must not leave an object, got %v", err)
+	}
+}
+
+func TestFSVerify(t *testing.T) {
+	fs := NewFS(t.TempDir())
+	want := sha256.Sum256([]byte("segment-bytes"))
+	if _, _, err := fs.PutVerified("videos", "v1/720p/1", strings.NewReader("segment-bytez"), hex.EncodeToString(want[:])); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+	if _, err := fs.Stat("videos", "v1/720p/1"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("mismatched upload must not be committed, got %v", err)
+	}
+	if _, _, err := fs.PutVerified("videos", "v1/720p/1", strings.NewReader("segment-bytes"), "SHA256:"+strings.ToUpper(hex.EncodeToString(want[:]))); err != nil {
+		t.Fatalf("put with matching checksum failed: %v", err)
+	}
+	if _, err := fs.Verify("videos", "v1/720p/1"); err != nil {
+		t.Fatalf("verify of intact object failed: %v", err)
+	}
+
+	// Flip a byte behind the store's back.
+	if err := os.WriteFile(filepath.Join(fs.root, "videos", "v1/720p/1"), []byte("segment-bytez"), 0o664); err != nil {
+		t.Fatalf("corrupt failed: %v", err)
+	}
+	if _, err := fs.Verify("videos", "v1/720p/1"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected corruption to be detected, got %v", err)
+	}
+}
+
+func TestFSTempFiles(t *testing.T) {
+	fs := NewFS(t.TempDir())
+	// Concurrent writers of one object each get their own temp file.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, _, err := fs.Put("videos", "v1/720p/1", strings.NewReader(fmt.Sprintf("segment-%d", i))); err != nil {
+				t.Errorf("put #%d failed: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if _, err := fs.Verify("videos", "v1/720p/1"); err != nil {
+		t.Fatalf("expected the last writer's object and sidecar to match: %v", err)
+	}
+
+	// A temp file left by a crash is not an object, but a name ending in .tmp is.
+	if err := os.WriteFile(filepath.Join(fs.root, "videos", "v1", tempPrefix+"crashed"), []byte("partial"), 0o664); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if _, _, err := fs.Put("videos", "v1/notes.tmp", strings.NewReader("kept")); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	if _, _, err := fs.Put("videos", "v1/"+tempPrefix+"x", strings.NewReader("reserved")); !errors.Is(err, ErrReservedName) {
+		t.Fatalf("expected the reserved prefix to be rejected, got %v", err)
+	}
+	// A name ending in the sidecar suffix would overwrite another object's checksum.
+	if _, _, err := fs.Put("videos", "v1/720p/1"+checksumSuffix, strings.NewReader("reserved")); !errors.Is(err, ErrReservedName) {
+		t.Fatalf("expected the checksum suffix to be rejected, got %v", err)
+	}
+	if _, err := fs.Verify("videos", "v1/720p/1"); err != nil {
+		t.Fatalf("expected the sidecar to be left alone: %v", err)
+	}
+	var objects []string
+	if err := fs.Walk(func(bucket, object string, info ObjectInfo) error {
+		objects = append(objects, bucket+"/"+object)
+		return nil
+	}); err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if strings.Join(objects, ",") != "videos/v1/720p/1,videos/v1/notes.tmp" {
+		t.Fatalf("unexpected objects %v", objects)
+	}
+}
@@ -0,0 +1,277 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"time"
+
+	"tritontube/internal/metadata/etcdsim"
+	storagepb "tritontube/internal/storage/proto"
+)
+
+// hintReplayTimeout bounds a replay started by a heartbeat.
+const hintReplayTimeout = 5 * time.Minute
+
+// Hint records a segment copy written to a fallback node because the node that owns it
+// on the ring could not be reached during the upload. Once the owner heartbeats again
+// the copy is replayed to it, the SegmentRecord is pointed back at the owner, and the
+// fallback copy is deleted.
+type Hint struct {
+	SegmentID string                   `json:"segment_id"`
+	Locator   storagepb.SegmentLocator `json:"locator"`
+	Checksum  string                   `json:"checksum"`
+	SizeBytes int64                    `json:"size_bytes"`
+	// Owner is the node the copy belongs on; Holder is the fallback node holding it.
+	Owner     string    `json:"owner"`
+	Holder    string    `json:"holder"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// HintStore persists hints until they are replayed.
+type HintStore interface {
+	PutHint(ctx context.Context, hint Hint) error
+	// Hints returns the hints held for owner, ordered by segment id.
+	Hints(ctx context.Context, owner string) ([]Hint, error)
+	DeleteHint(ctx context.Context, hint Hint) error
+}
+
+// EtcdHintStore stores hints in etcd under <prefix>/<owner>/<segment_id>, so any node
+// that sees the owner heartbeat can replay them.
+type EtcdHintStore struct {
+	etcd   *etcdsim.Client
+	prefix string
+}
+
+// EtcdHintStoreConfig configures the hint store.
+type EtcdHintStoreConfig struct {
+	Etcd   *etcdsim.Client
+	Prefix string
+}
+
+// NewEtcdHintStore constructs a hint store backed by etcd.
+func NewEtcdHintStore(cfg EtcdHintStoreConfig) (*EtcdHintStore, error) {
+	if cfg.Etcd == nil {
+		return nil, errors.New("storage: etcd client is required for hint store")
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = "/storage/hints"
+	}
+	return &EtcdHintStore{etcd: cfg.Etcd, prefix: cfg.Prefix}, nil
+}
+
+func (s *EtcdHintStore) key(owner, segmentID string) string {
+	return fmt.Sprintf("%s/%s/%s", s.prefix, owner, segmentID)
+}
+
+// PutHint stores a hint, replacing any earlier hint for the same owner and segment.
+func (s *EtcdHintStore) PutHint(ctx context.Context, hint Hint) error {
+	if hint.SegmentID == "" || hint.Owner == "" || hint.Holder == "" {
+		return errors.New("storage: hint requires a segment id, owner and holder")
+	}
+	if hint.CreatedAt.IsZero() {
+		hint.CreatedAt = time.Now().UTC()
+	}
+	encoded, err := json.Marshal(hint)
+	if err != nil {
+		return fmt.Errorf("storage: failed to encode hint: %w", err)
+	}
+	_, err = s.etcd.Put(ctx, s.key(hint.Owner, hint.SegmentID), string(encoded))
+	return err
+}
+
+// Hints implements HintStore.
+func (s *EtcdHintStore) Hints(ctx context.Context, owner string) ([]Hint, error) {
+	resp, err := s.etcd.Get(ctx, fmt.Sprintf("%s/%s/", s.prefix, owner), etcdsim.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	hints := make([]Hint, 0, len(resp.KVs))
+	for _, kv := range resp.KVs {
+		var hint Hint
+		if err := json.Unmarshal([]byte(kv.Value), &hint); err != nil {
+			return nil, fmt.Errorf("storage: failed to decode %s: %w", kv.Key, err)
+		}
+		hints = append(hints, hint)
+	}
+	sort.Slice(hints, func(i, j int) bool { return hints[i].SegmentID < hints[j].SegmentID })
+	return hints, nil
+}
+
+// DeleteHint implements HintStore.
+func (s *EtcdHintStore) DeleteHint(ctx context.Context, hint Hint) error {
+	_, err := s.etcd.Delete(ctx, s.key(hint.Owner, hint.SegmentID))
+	return err
+}
+
+var _ HintStore = (*EtcdHintStore)(nil)
+
+// handOff writes a copy of the segment for every ring target in failed to a fallback
+// node, the next node on the ring outside the replica set that accepts it, and records a
+// hint naming the target. It returns the fallback chosen for each target it covered.
+func (s *Service) handOff(ctx context.Context, header *storagepb.UploadSegmentHeader, size int64, checksum string, targets, failed []string) map[string]string {
+	fallbacks := map[string]string{}
+	if len(failed) == 0 {
+		return fallbacks
+	}
+	used := map[string]bool{}
+	for _, nodeID := range targets {
+		used[nodeID] = true
+	}
+	candidates := s.ring.Lookup([]byte(header.SegmentId), len(s.ring.Nodes()))
+	for _, owner := range failed {
+		for _, candidate := range candidates {
+			if used[candidate] {
+				continue
+			}
+			used[candidate] = true
+			hinted := *header
+			hinted.HintedFor = owner
+			err := s.replicateFromDisk(ctx, header, func(body io.Reader) error {
+				return s.transport.ReplicateSegment(ctx, candidate, &hinted, body)
+			})
+			if err != nil {
+				continue
+			}
+			hint := Hint{
+				SegmentID: header.SegmentId,
+				Locator:   *header.Locator,
+				Checksum:  checksum,
+				SizeBytes: size,
+				Owner:     owner,
+				Holder:    candidate,
+			}
+			if err := s.hints.PutHint(ctx, hint); err != nil {
+				// Without a hint the copy would never reach its owner.
+				_ = s.transport.DeleteSegment(ctx, candidate, header.Locator)
+				break
+			}
+			fallbacks[owner] = candidate
+			break
+		}
+	}
+	return fallbacks
+}
+
+// ReplayHints copies every segment held on behalf of owner back to it, points the
+// segment records at owner, and deletes the fallback copies. It stops at the first
+// failure, leaving that hint and the ones after it for the next replay, and returns the
+// number of hints replayed.
+func (s *Service) ReplayHints(ctx context.Context, owner string) (int, error) {
+	if s.hints == nil {
+		return 0, nil
+	}
+	hints, err := s.hints.Hints(ctx, owner)
+	if err != nil {
+		return 0, err
+	}
+	for i, hint := range hints {
+		if err := s.replayHint(ctx, hint); err != nil {
+			return i, fmt.Errorf("storage: failed to replay hint for %s to %s: %w", hint.SegmentID, owner, err)
+		}
+	}
+	return len(hints), nil
+}
+
+func (s *Service) replayHint(ctx context.Context, hint Hint) error {
+	locator := hint.Locator
+	var body io.ReadCloser
+	var err error
+	if hint.Holder == s.nodeID {
+		body, err = s.fs.Get(locator.Bucket, locator.Object)
+	} else {
+		body, err = s.transport.FetchSegment(ctx, hint.Holder, &locator)
+	}
+	if err != nil {
+		return err
+	}
+	header := &storagepb.UploadSegmentHeader{
+		SegmentId: hint.SegmentID,
+		Locator:   &locator,
+		SizeBytes: hint.SizeBytes,
+		Checksum:  hint.Checksum,
+	}
+	err = s.transport.ReplicateSegment(ctx, hint.Owner, header, body)
+	body.Close()
+	if err != nil {
+		return err
+	}
+	if err := s.repointRecord(ctx, hint); err != nil {
+		return err
+	}
+	if hint.Holder == s.nodeID {
+		err = s.fs.Delete(locator.Bucket, locator.Object)
+	} else {
+		err = s.transport.DeleteSegment(ctx, hint.Holder, &locator)
+	}
+	if err != nil {
+		return err
+	}
+	return s.hints.DeleteHint(ctx, hint)
+}
+
+// repointRecord replaces the hint's holder with its owner in the segment record. Records
+// can only be read back from a SegmentReader; other stores are left as they are.
+func (s *Service) repointRecord(ctx context.Context, hint Hint) error {
+	reader, ok := s.metadata.(SegmentReader)
+	if !ok {
+		return nil
+	}
+	record, err := reader.Segment(ctx, hint.SegmentID)
+	if errors.Is(err, ErrSegmentNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	replicas := make([]string, 0, len(record.Replicas))
+	hasOwner := record.PrimaryNode == hint.Owner
+	for _, nodeID := range record.Replicas {
+		if nodeID == hint.Owner {
+			hasOwner = true
+		}
+	}
+	for _, nodeID := range record.Replicas {
+		switch {
+		case nodeID == hint.Holder && !hasOwner:
+			replicas = append(replicas, hint.Owner)
+			hasOwner = true
+		case nodeID == hint.Holder:
+		default:
+			replicas = append(replicas, nodeID)
+		}
+	}
+	if !hasOwner {
+		replicas = append(replicas, hint.Owner)
+	}
+	record.Replicas = replicas
+	return s.metadata.PutSegment(ctx, record)
+}
+
+// replayHintsAsync replays owner's hints in the background unless a replay for owner is
+// already running.
+func (s *Service) replayHintsAsync(owner string) {
+	s.replayMu.Lock()
+	if s.replaying[owner] {
+		s.replayMu.Unlock()
+		return
+	}
+	s.replaying[owner] = true
+	s.replayMu.Unlock()
+	go func() {
+		defer func() {
+			s.replayMu.Lock()
+			delete(s.replaying, owner)
+			s.replayMu.Unlock()
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), hintReplayTimeout)
+		defer cancel()
+		if _, err := s.ReplayHints(ctx, owner); err != nil {
+			log.Printf("%v", err)
+		}
+	}()
+}
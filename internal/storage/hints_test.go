@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	grpc "tritontube/internal/metadata/grpcstub"
+	storagepb "tritontube/internal/storage/proto"
+)
+
+func TestHintedHandoff(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCluster(t, RingManagerConfig{}, "node-a", "node-b", "node-c")
+	hints, err := NewEtcdHintStore(EtcdHintStoreConfig{Etcd: c.etcd})
+	if err != nil {
+		t.Fatalf("failed to create hint store: %v", err)
+	}
+
+	// Pick a segment that node-a replicates to exactly one peer; the other is the fallback.
+	var id, owner, fallback string
+	for i := 0; id == ""; i++ {
+		candidate := fmt.Sprintf("v1/720p/%d", i)
+		if targets := c.ring.Lookup([]byte(candidate), 2); targets[0] == "node-a" || targets[1] == "node-a" {
+			id, owner = candidate, targets[0]
+			if owner == "node-a" {
+				owner = targets[1]
+			}
+		}
+	}
+	fallback = "node-b"
+	if owner == "node-b" {
+		fallback = "node-c"
+	}
+
+	c.transport.Register(owner, func(ctx context.Context, header *storagepb.UploadSegmentHeader, body io.Reader) error {
+		return errors.New("connection refused")
+	})
+	svc := c.service(t, "node-a", ServiceConfig{Hints: hints, ReplicationFactor: 2})
+
+	locator := &storagepb.SegmentLocator{Bucket: "videos", Object: id}
+	stream := newUploadStream(&storagepb.UploadSegmentHeader{SegmentId: id, Locator: locator}, "segment")
+	if err := svc.UploadSegment(stream); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	var handedOff bool
+	for _, ack := range stream.resp.ReplicaStatus {
+		if ack.NodeId == "replication" || (ack.NodeId == "metadata" && !ack.Success) {
+			t.Fatalf("upload should succeed through the fallback, got %+v", ack)
+		}
+		if ack.NodeId == fallback && ack.Success && ack.HintedFor == owner {
+			handedOff = true
+		}
+	}
+	if !handedOff {
+		t.Fatalf("expected a hinted ack from %s, got %+v", fallback, stream.resp.ReplicaStatus)
+	}
+	record, err := c.segments.Segment(ctx, id)
+	if err != nil || strings.Join(record.Replicas, ",") != fallback {
+		t.Fatalf("expected record to point at %s, got %+v, %v", fallback, record, err)
+	}
+	if _, err := c.nodes[fallback].Verify("videos", id); err != nil {
+		t.Fatalf("fallback copy missing: %v", err)
+	}
+	if _, err := c.nodes[owner].Stat("videos", id); !os.IsNotExist(err) {
+		t.Fatalf("expected no copy on the unreachable owner, got %v", err)
+	}
+
+	// The owner comes back; its heartbeat replays the hint.
+	c.transport.RegisterFS(owner, c.nodes[owner])
+	if _, err := svc.Heartbeat(ctx, &storagepb.HeartbeatRequest{NodeId: owner}); err != nil {
+		t.Fatalf("heartbeat failed: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		pending, err := hints.Hints(ctx, owner)
+		if err != nil {
+			t.Fatalf("failed to list hints: %v", err)
+		}
+		if len(pending) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("hints not replayed: %+v", pending)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := c.nodes[owner].Verify("videos", id); err != nil {
+		t.Fatalf("owner copy missing after replay: %v", err)
+	}
+	if _, err := c.nodes[fallback].Stat("videos", id); !os.IsNotExist(err) {
+		t.Fatalf("expected fallback copy to be deleted, got %v", err)
+	}
+	record, err = c.segments.Segment(ctx, id)
+	if err != nil || strings.Join(record.Replicas, ",") != owner {
+		t.Fatalf("expected record to point at %s, got %+v, %v", owner, record, err)
+	}
+}
+
+func TestMissedQuorumDiscardsHintedCopies(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCluster(t, RingManagerConfig{}, "node-a", "node-b", "node-c", "node-d")
+	hints, err := NewEtcdHintStore(EtcdHintStoreConfig{Etcd: c.etcd})
+	if err != nil {
+		t.Fatalf("failed to create hint store: %v", err)
+	}
+
+	// Pick a segment node-a replicates to two peers that are both down. Only the node
+	// outside the replica set can take a hinted copy, so ALL cannot be met.
+	var id string
+	var targets []string
+	for i := 0; id == ""; i++ {
+		candidate := fmt.Sprintf("v1/720p/%d", i)
+		if targets = c.ring.Lookup([]byte(candidate), 3); targets[0] == "node-a" {
+			id = candidate
+		}
+	}
+	for _, owner := range targets[1:] {
+		c.transport.Register(owner, func(ctx context.Context, header *storagepb.UploadSegmentHeader, body io.Reader) error {
+			return errors.New("connection refused")
+		})
+	}
+	fallback := "node-b"
+	for _, node := range []string{"node-b", "node-c", "node-d"} {
+		if node != targets[1] && node != targets[2] {
+			fallback = node
+		}
+	}
+	hinted := false
+	c.transport.Register(fallback, func(ctx context.Context, header *storagepb.UploadSegmentHeader, body io.Reader) error {
+		hinted = hinted || header.HintedFor != ""
+		return ReceiveIntoFS(c.nodes[fallback])(ctx, header, body)
+	})
+	svc := c.service(t, "node-a", ServiceConfig{Hints: hints, ReplicationFactor: 3})
+
+	locator := &storagepb.SegmentLocator{Bucket: "videos", Object: id}
+	header := &storagepb.UploadSegmentHeader{SegmentId: id, Locator: locator, Consistency: storagepb.ConsistencyLevel_CONSISTENCY_LEVEL_ALL}
+	if err := svc.UploadSegment(newUploadStream(header, "segment")); grpc.CodeOf(err) != grpc.Unavailable {
+		t.Fatalf("expected Unavailable when ALL cannot be met, got %v", err)
+	}
+	if !hinted {
+		t.Fatalf("expected %s to take a hinted copy before the quorum was missed", fallback)
+	}
+	for _, owner := range targets[1:] {
+		if pending, err := hints.Hints(ctx, owner); err != nil || len(pending) != 0 {
+			t.Fatalf("expected no hints left for %s, got %+v, %v", owner, pending, err)
+		}
+	}
+	for node, fs := range c.nodes {
+		if _, err := fs.Stat("videos", id); !os.IsNotExist(err) {
+			t.Fatalf("failed upload must not leave a copy on %s, got %v", node, err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"time"
+)
+
+// ExpireNodes applies lease expiry at now. Nodes whose last heartbeat is older than ttl
+// are marked suspect; suspects that stay silent for a further grace period are removed
+// from the ring, which rolls the ring's previous tokens forward and so triggers a
+// rebalance. It returns the ids of the nodes that became suspect and that were removed.
+func (m *RingManager) ExpireNodes(ctx context.Context, now time.Time, ttl, grace time.Duration) (suspect, removed []string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err = m.updateLocked(ctx, func() (bool, error) {
+		suspect, removed = nil, nil
+		ids := make([]string, 0, len(m.state.Nodes))
+		for id := range m.state.Nodes {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			node := m.state.Nodes[id]
+			if now.Sub(node.UpdatedAt) <= ttl {
+				continue
+			}
+			if !node.Suspect() {
+				node.SuspectSince = now
+				m.state.Nodes[id] = node
+				suspect = append(suspect, id)
+				continue
+			}
+			if now.Sub(node.SuspectSince) > grace {
+				delete(m.state.Nodes, id)
+				removed = append(removed, id)
+			}
+		}
+		if len(removed) > 0 {
+			if err := m.rebuildAndRollLocked(); err != nil {
+				return false, err
+			}
+		}
+		return len(suspect) > 0 || len(removed) > 0, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return suspect, removed, nil
+}
+
+// NodeSweeper periodically expires storage nodes that stopped heartbeating.
+type NodeSweeper struct {
+	Manager *RingManager
+	// LeaseTTL is how long a node may go without a heartbeat before it is suspect
+	// (default 15 seconds, matching the service's heartbeat lease).
+	LeaseTTL time.Duration
+	// GracePeriod is how long a node stays suspect before it is removed (default 1 minute).
+	GracePeriod time.Duration
+	Interval    time.Duration
+	// Now overrides the clock, for tests.
+	Now func() time.Time
+}
+
+// Run blocks until the context is cancelled, sweeping every Interval (default LeaseTTL/3).
+func (s *NodeSweeper) Run(ctx context.Context) error {
+	if s == nil || s.Manager == nil {
+		return errors.New("storage: node sweeper requires a ring manager")
+	}
+	ttl := s.LeaseTTL
+	if ttl <= 0 {
+		ttl = 15 * time.Second
+	}
+	grace := s.GracePeriod
+	if grace <= 0 {
+		grace = time.Minute
+	}
+	interval := s.Interval
+	if interval <= 0 {
+		interval = ttl / 3
+	}
+	now := s.Now
+	if now == nil {
+		now = time.Now
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		suspect, removed, err := s.Manager.ExpireNodes(ctx, now().UTC(), ttl, grace)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("storage: node sweep failed: %v", err)
+		}
+		for _, id := range suspect {
+			log.Printf("storage: node %s missed its lease and is suspect", id)
+		}
+		for _, id := range removed {
+			log.Printf("storage: node %s removed from the ring after %s", id, grace)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
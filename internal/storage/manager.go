@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"sort"
 	"sync"
 	"time"
@@ -20,6 +21,18 @@ type NodeDescriptor struct {
 	CapacityBytes  int64     `json:"capacity_bytes"`
 	AvailableBytes int64     `json:"available_bytes"`
 	UpdatedAt      time.Time `json:"updated_at"`
+	// Zone and Rack are the node's failure domain, used by zone-aware placement.
+	Zone string `json:"zone,omitempty"`
+	Rack string `json:"rack,omitempty"`
+	// RingVersion is the ring version returned to the node's last heartbeat.
+	RingVersion int64 `json:"ring_version,omitempty"`
+	// SuspectSince is set once the node's lease expires and cleared by its next heartbeat.
+	SuspectSince time.Time `json:"suspect_since,omitempty"`
+}
+
+// Suspect reports whether the node missed its lease and is pending removal.
+func (n NodeDescriptor) Suspect() bool {
+	return !n.SuspectSince.IsZero()
 }
 
 // VirtualNodeAssignment represents the ownership of a token on the consistent hash ring.
@@ -27,23 +40,58 @@ type VirtualNodeAssignment struct {
 	ID     string `json:"id"`
 	Token  uint64 `json:"token"`
 	NodeID string `json:"node_id"`
+	// Zone and Rack copy the owner's failure domain when the ring is zone aware, so
+	// that plans place replicas the same way the ring does.
+	Zone string `json:"zone,omitempty"`
+	Rack string `json:"rack,omitempty"`
 }
 
 type ringState struct {
 	Version int64                     `json:"version"`
 	Nodes   map[string]NodeDescriptor `json:"nodes"`
 	Tokens  []VirtualNodeAssignment   `json:"tokens"`
+	// PreviousVersion and PreviousTokens describe the ring before the last change to
+	// Tokens. Heartbeats that leave the tokens untouched do not roll them forward.
+	PreviousVersion int64                   `json:"previous_version,omitempty"`
+	PreviousTokens  []VirtualNodeAssignment `json:"previous_tokens,omitempty"`
+	// Placement is the algorithm that maps keys onto Tokens; PreviousPlacement is the
+	// one in effect for PreviousTokens. Empty means the plain ring.
+	Placement         chash.Algorithm `json:"placement,omitempty"`
+	PreviousPlacement chash.Algorithm `json:"previous_placement,omitempty"`
 }
 
-// RingManager persists and watches the consistent hash ring in etcd.
+// RingSnapshot is the token assignment of one ring version and the algorithm that
+// places keys on it.
+type RingSnapshot struct {
+	Version     int64
+	Assignments []VirtualNodeAssignment
+	Placement   chash.Algorithm
+}
+
+// ErrRingConflict is returned when a ring update keeps losing the compare-and-swap on
+// the ring key to other managers.
+var ErrRingConflict = errors.New("storage: ring update conflict")
+
+// RingManager persists and watches the consistent hash ring in etcd. Several managers,
+// one per storage node, may share a ring: every update is a compare-and-swap on the ring
+// key's ModRevision, and an update that loses the race is reapplied to the latest state.
 type RingManager struct {
-	mu           sync.RWMutex
-	ring         *chash.Ring
+	mu   sync.RWMutex
+	ring chash.Placement
+	// algorithm is the placement a ring created by this manager starts with. Once the
+	// ring exists its stored Placement is authoritative.
+	algorithm    chash.Algorithm
 	state        ringState
 	etcd         *etcdsim.Client
 	prefix       string
 	vnodes       int
+	minVnodes    int
+	maxVnodes    int
+	capacityUnit int64
+	zoneAware    bool
+	maxAttempts  int
 	lastRevision int64
+	conflicts    int64
 }
 
 // RingManagerConfig controls the behaviour of the ring manager.
@@ -51,6 +99,26 @@ type RingManagerConfig struct {
 	Etcd         *etcdsim.Client
 	Prefix       string
 	VirtualNodes int
+	// ReferenceCapacityBytes, when set, weights the ring by capacity: a node reporting
+	// CapacityBytes gets VirtualNodes per ReferenceCapacityBytes, clamped to
+	// [MinVirtualNodes, MaxVirtualNodes]. Nodes that report no capacity get VirtualNodes.
+	// AvailableBytes is ignored so that filling a disk does not move tokens. Every
+	// manager sharing a ring must use the same weighting.
+	ReferenceCapacityBytes int64
+	// MinVirtualNodes defaults to 1; MaxVirtualNodes defaults to 16 * VirtualNodes.
+	MinVirtualNodes int
+	MaxVirtualNodes int
+	// Placement selects the algorithm that maps keys onto the weighted virtual nodes when
+	// this manager creates the ring (default chash.AlgorithmRing). The algorithm is then
+	// part of the ring state: a manager left unset adopts it, and one set to a different
+	// algorithm fails to start. SetPlacement switches it.
+	Placement chash.Algorithm
+	// ZoneAware makes Lookup spread replicas across the zones, then racks, that nodes
+	// report, falling back to clockwise placement when there are too few of them.
+	ZoneAware bool
+	// MaxAttempts bounds how often an update is retried after losing a compare-and-swap
+	// before it fails with ErrRingConflict (default 8).
+	MaxAttempts int
 }
 
 // NewRingManager constructs a manager backed by etcd.
@@ -64,15 +132,38 @@ func NewRingManager(cfg RingManagerConfig) (*RingManager, error) {
 	if cfg.VirtualNodes <= 0 {
 		cfg.VirtualNodes = 128
 	}
+	if cfg.MinVirtualNodes <= 0 {
+		cfg.MinVirtualNodes = 1
+	}
+	if cfg.MaxVirtualNodes <= 0 {
+		cfg.MaxVirtualNodes = 16 * cfg.VirtualNodes
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 8
+	}
+	if _, err := chash.NewPlacement(cfg.Placement, nil); err != nil {
+		return nil, fmt.Errorf("storage: %w", err)
+	}
 	m := &RingManager{
-		etcd:   cfg.Etcd,
-		prefix: cfg.Prefix,
-		vnodes: cfg.VirtualNodes,
+		etcd:         cfg.Etcd,
+		prefix:       cfg.Prefix,
+		vnodes:       cfg.VirtualNodes,
+		minVnodes:    cfg.MinVirtualNodes,
+		maxVnodes:    cfg.MaxVirtualNodes,
+		capacityUnit: cfg.ReferenceCapacityBytes,
+		zoneAware:    cfg.ZoneAware,
+		algorithm:    cfg.Placement,
+		maxAttempts:  cfg.MaxAttempts,
 	}
-	m.state = ringState{Nodes: map[string]NodeDescriptor{}}
-	if err := m.bootstrap(context.Background()); err != nil {
+	if m.algorithm == "" {
+		m.algorithm = chash.AlgorithmRing
+	}
+	if err := m.reloadLocked(context.Background()); err != nil {
 		return nil, err
 	}
+	if cfg.Placement != "" && m.lastRevision > 0 && m.state.placement() != cfg.Placement {
+		return nil, fmt.Errorf("storage: ring uses placement %s, not the configured %s", m.state.placement(), cfg.Placement)
+	}
 	return m, nil
 }
 
@@ -80,26 +171,89 @@ func (m *RingManager) ringKey() string {
 	return fmt.Sprintf("%s/ring", m.prefix)
 }
 
-func (m *RingManager) bootstrap(ctx context.Context) error {
+// reloadLocked replaces the local state with the ring stored in etcd. Before the ring
+// exists the state carries this manager's algorithm, so that the first write sets it.
+func (m *RingManager) reloadLocked(ctx context.Context) error {
 	resp, err := m.etcd.Get(ctx, m.ringKey())
 	if err != nil {
 		return err
 	}
-	if len(resp.KVs) == 0 {
-		m.ring = chash.NewRing(m.vnodes)
-		return nil
+	state := ringState{Nodes: map[string]NodeDescriptor{}, Placement: m.algorithm}
+	var revision int64
+	if len(resp.KVs) > 0 {
+		state, err = decodeRingState(resp.KVs[0].Value)
+		if err != nil {
+			return err
+		}
+		revision = resp.KVs[0].ModRevision
 	}
+	m.state = state
+	m.lastRevision = revision
+	return m.rebuildLocked()
+}
+
+// decodeRingState decodes a stored ring and checks that its placements are known.
+func decodeRingState(value string) (ringState, error) {
 	var state ringState
-	if err := json.Unmarshal([]byte(resp.KVs[0].Value), &state); err != nil {
-		return fmt.Errorf("storage: failed to decode ring state: %w", err)
+	if err := json.Unmarshal([]byte(value), &state); err != nil {
+		return state, fmt.Errorf("storage: failed to decode ring state: %w", err)
 	}
 	if state.Nodes == nil {
 		state.Nodes = map[string]NodeDescriptor{}
 	}
-	m.state = state
-	m.lastRevision = resp.KVs[0].ModRevision
-	m.rebuildLocked()
-	return nil
+	for _, alg := range []chash.Algorithm{state.Placement, state.PreviousPlacement} {
+		if _, err := chash.NewPlacement(alg, nil); err != nil {
+			return state, fmt.Errorf("storage: ring state version %d: %w", state.Version, err)
+		}
+	}
+	return state, nil
+}
+
+// updateLocked applies mutate to the ring state and persists it. When another manager
+// wrote the ring since this one last saw it, the latest state is re-read and mutate runs
+// again. mutate returns false to leave the ring as it is. If mutate or the write fails,
+// the local state is reloaded from etcd, so the ring served is never one etcd lacks.
+func (m *RingManager) updateLocked(ctx context.Context, mutate func() (bool, error)) error {
+	for attempt := 0; attempt < m.maxAttempts; attempt++ {
+		changed, err := mutate()
+		if err != nil {
+			m.discardLocked()
+			return err
+		}
+		if !changed {
+			return nil
+		}
+		ok, err := m.persistLocked(ctx)
+		if err != nil {
+			m.discardLocked()
+			return err
+		}
+		if ok {
+			return nil
+		}
+		m.conflicts++
+		if err := m.reloadLocked(ctx); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("%w: gave up after %d attempts", ErrRingConflict, m.maxAttempts)
+}
+
+// discardLocked drops an update that was not persisted by reloading the state from etcd.
+// The reload does not use the update's context, which may be why the update failed.
+func (m *RingManager) discardLocked() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.reloadLocked(ctx); err != nil {
+		log.Printf("storage: failed to reload ring state: %v", err)
+	}
+}
+
+// Conflicts returns how many updates lost the compare-and-swap and had to be reapplied.
+func (m *RingManager) Conflicts() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.conflicts
 }
 
 // UpsertNode registers or updates information about a physical node. It rebuilds the
@@ -109,21 +263,30 @@ func (m *RingManager) UpsertNode(ctx context.Context, node NodeDescriptor) (int6
 		return 0, errors.New("storage: node ID is required")
 	}
 	node.UpdatedAt = time.Now().UTC()
+	node.SuspectSince = time.Time{}
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if m.state.Nodes == nil {
-		m.state.Nodes = map[string]NodeDescriptor{}
-	}
-	m.state.Nodes[node.ID] = node
-	m.rebuildLocked()
-	if err := m.persistLocked(ctx); err != nil {
+	err := m.updateLocked(ctx, func() (bool, error) {
+		node.RingVersion = m.state.Version + 1
+		m.state.Nodes[node.ID] = node
+		return true, m.rebuildAndRollLocked()
+	})
+	if err != nil {
 		return 0, err
 	}
 	return m.state.Version, nil
 }
 
+// Node returns the descriptor registered for nodeID.
+func (m *RingManager) Node(nodeID string) (NodeDescriptor, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	node, ok := m.state.Nodes[nodeID]
+	return node, ok
+}
+
 // RemoveNode removes a node from the ring.
 func (m *RingManager) RemoveNode(ctx context.Context, nodeID string) (int64, error) {
 	if nodeID == "" {
@@ -132,45 +295,141 @@ func (m *RingManager) RemoveNode(ctx context.Context, nodeID string) (int64, err
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	if m.state.Nodes == nil {
-		return m.state.Version, nil
-	}
-	if _, ok := m.state.Nodes[nodeID]; !ok {
-		return m.state.Version, nil
-	}
-	delete(m.state.Nodes, nodeID)
-	m.rebuildLocked()
-	if err := m.persistLocked(ctx); err != nil {
+	err := m.updateLocked(ctx, func() (bool, error) {
+		if _, ok := m.state.Nodes[nodeID]; !ok {
+			return false, nil
+		}
+		delete(m.state.Nodes, nodeID)
+		return true, m.rebuildAndRollLocked()
+	})
+	if err != nil {
 		return 0, err
 	}
 	return m.state.Version, nil
 }
 
-func (m *RingManager) persistLocked(ctx context.Context) error {
+// persistLocked writes the state if the ring key is still at lastRevision and reports
+// whether it was written.
+func (m *RingManager) persistLocked(ctx context.Context) (bool, error) {
 	m.state.Version++
 	encoded, err := json.Marshal(m.state)
 	if err != nil {
-		return err
+		return false, err
 	}
-	resp, err := m.etcd.Put(ctx, m.ringKey(), string(encoded))
+	resp, err := m.etcd.Txn(ctx).
+		If(etcdsim.CompareModRevision(m.ringKey(), etcdsim.CompareOpEqual, m.lastRevision)).
+		Then(etcdsim.OpPut(m.ringKey(), string(encoded))).
+		Commit()
 	if err != nil {
-		return err
+		return false, err
+	}
+	if !resp.Succeeded {
+		return false, nil
 	}
 	m.lastRevision = resp.Revision
+	return true, nil
+}
+
+// rebuildAndRollLocked rebuilds the ring after a membership change, remembering the
+// previous tokens and placement if the change moved any token.
+func (m *RingManager) rebuildAndRollLocked() error {
+	previous, version, placement := m.state.Tokens, m.state.Version, m.state.placement()
+	if err := m.rebuildLocked(); err != nil {
+		return err
+	}
+	if !sameAssignments(previous, m.state.Tokens) {
+		m.state.PreviousTokens = previous
+		m.state.PreviousVersion = version
+		m.state.PreviousPlacement = placement
+	}
 	return nil
 }
 
-func (m *RingManager) rebuildLocked() {
-	ring := chash.NewRing(m.vnodes)
+// SetPlacement switches the placement algorithm of the shared ring. Switching rebalances
+// the cluster like any other ring change: the previous tokens and placement are kept so
+// that a plan can be built from the old placement to the new one.
+func (m *RingManager) SetPlacement(ctx context.Context, alg chash.Algorithm) (int64, error) {
+	if alg == "" {
+		alg = chash.AlgorithmRing
+	}
+	if _, err := chash.NewPlacement(alg, nil); err != nil {
+		return 0, fmt.Errorf("storage: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err := m.updateLocked(ctx, func() (bool, error) {
+		placement := m.state.placement()
+		if placement == alg {
+			return false, nil
+		}
+		previous, version := m.state.Tokens, m.state.Version
+		m.state.Placement = alg
+		if err := m.rebuildLocked(); err != nil {
+			return false, err
+		}
+		m.state.PreviousTokens = previous
+		m.state.PreviousVersion = version
+		m.state.PreviousPlacement = placement
+		return true, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return m.state.Version, nil
+}
+
+// placement returns the state's algorithm, treating states written before placements
+// were configurable as the ring.
+func (s *ringState) placement() chash.Algorithm {
+	if s.Placement == "" {
+		return chash.AlgorithmRing
+	}
+	return s.Placement
+}
+
+func (s *ringState) previousPlacement() chash.Algorithm {
+	if s.PreviousPlacement == "" {
+		return chash.AlgorithmRing
+	}
+	return s.PreviousPlacement
+}
+
+func (m *RingManager) rebuildLocked() error {
 	ids := make([]string, 0, len(m.state.Nodes))
 	for id := range m.state.Nodes {
 		ids = append(ids, id)
 	}
+	ring, tokens, err := m.buildRing(ids)
+	if err != nil {
+		return err
+	}
+	m.ring, m.state.Tokens = ring, tokens
+	return nil
+}
+
+// buildRing places the given nodes on fresh weighted tokens and returns the state's
+// placement over them along with the assignments.
+func (m *RingManager) buildRing(ids []string) (chash.Placement, []VirtualNodeAssignment, error) {
+	ring := chash.NewWeightedRing(m.vnodes, m.minVnodes, m.maxVnodes)
 	sort.Strings(ids)
 	for _, id := range ids {
-		ring.AddNode(id)
+		ring.AddWeightedNode(id, m.weightLocked(id))
 	}
 	tokens := ring.Tokens()
+	placement := chash.Placement(ring)
+	if alg := m.state.placement(); alg != chash.AlgorithmRing {
+		var err error
+		if placement, err = chash.NewPlacement(alg, tokens); err != nil {
+			return nil, nil, fmt.Errorf("storage: %w", err)
+		}
+	}
+	if m.zoneAware {
+		for _, id := range ids {
+			node := m.state.Nodes[id]
+			placement.SetFailureDomain(id, chash.FailureDomain{Zone: node.Zone, Rack: node.Rack})
+		}
+	}
 	assignments := make([]VirtualNodeAssignment, len(tokens))
 	counter := map[string]int{}
 	for i, tok := range tokens {
@@ -181,6 +440,10 @@ func (m *RingManager) rebuildLocked() {
 			Token:  tok.Hash,
 			NodeID: tok.Node,
 		}
+		if m.zoneAware {
+			node := m.state.Nodes[tok.Node]
+			assignments[i].Zone, assignments[i].Rack = node.Zone, node.Rack
+		}
 	}
 	sort.Slice(assignments, func(i, j int) bool {
 		if assignments[i].Token == assignments[j].Token {
@@ -188,8 +451,29 @@ func (m *RingManager) rebuildLocked() {
 		}
 		return assignments[i].Token < assignments[j].Token
 	})
-	m.state.Tokens = assignments
-	m.ring = ring
+	return placement, assignments, nil
+}
+
+// weightLocked returns the node's capacity relative to the reference capacity, or 1 when
+// the ring is not weighted or the node reports no capacity.
+func (m *RingManager) weightLocked(id string) float64 {
+	capacity := m.state.Nodes[id].CapacityBytes
+	if m.capacityUnit <= 0 || capacity <= 0 {
+		return 1
+	}
+	return float64(capacity) / float64(m.capacityUnit)
+}
+
+func sameAssignments(a, b []VirtualNodeAssignment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
 
 // Lookup resolves the replica set for the provided key.
@@ -211,17 +495,81 @@ func (m *RingManager) Assignments() ([]VirtualNodeAssignment, int64) {
 	return out, m.state.Version
 }
 
-// RingEvent describes a change observed via etcd watch.
+// Snapshot returns the current ring version's assignment and placement algorithm.
+func (m *RingManager) Snapshot() RingSnapshot {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return RingSnapshot{
+		Version:     m.state.Version,
+		Assignments: append([]VirtualNodeAssignment(nil), m.state.Tokens...),
+		Placement:   m.state.placement(),
+	}
+}
+
+// PreviousSnapshot returns the ring as it was before the last change to its tokens or
+// placement algorithm. Its assignments are empty until the ring first changes.
+func (m *RingManager) PreviousSnapshot() RingSnapshot {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return RingSnapshot{
+		Version:     m.state.PreviousVersion,
+		Assignments: append([]VirtualNodeAssignment(nil), m.state.PreviousTokens...),
+		Placement:   m.state.previousPlacement(),
+	}
+}
+
+// PreviousAssignments returns the token assignment in effect before the last change to
+// the ring's tokens, along with its version. It is empty until the tokens first change.
+func (m *RingManager) PreviousAssignments() ([]VirtualNodeAssignment, int64) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make([]VirtualNodeAssignment, len(m.state.PreviousTokens))
+	copy(out, m.state.PreviousTokens)
+	return out, m.state.PreviousVersion
+}
+
+// AssignmentsWithout returns the token assignment the ring would have if nodeID were
+// removed, without changing the ring.
+func (m *RingManager) AssignmentsWithout(nodeID string) ([]VirtualNodeAssignment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if _, ok := m.state.Nodes[nodeID]; !ok {
+		return nil, fmt.Errorf("storage: unknown node %s", nodeID)
+	}
+	ids := make([]string, 0, len(m.state.Nodes))
+	for id := range m.state.Nodes {
+		if id != nodeID {
+			ids = append(ids, id)
+		}
+	}
+	_, assignments, err := m.buildRing(ids)
+	return assignments, err
+}
+
+// RingEvent describes a change observed via etcd watch. Previous holds the assignments
+// before the most recent change to the tokens, at PreviousVersion.
 type RingEvent struct {
-	Version     int64
-	Assignments []VirtualNodeAssignment
+	Version           int64
+	Assignments       []VirtualNodeAssignment
+	Placement         chash.Algorithm
+	PreviousVersion   int64
+	Previous          []VirtualNodeAssignment
+	PreviousPlacement chash.Algorithm
+}
+
+// Snapshots returns the ring before and after the change the event reports.
+func (e RingEvent) Snapshots() (previous, next RingSnapshot) {
+	return RingSnapshot{Version: e.PreviousVersion, Assignments: e.Previous, Placement: e.PreviousPlacement},
+		RingSnapshot{Version: e.Version, Assignments: e.Assignments, Placement: e.Placement}
 }
 
 // Watch emits ring events whenever the underlying etcd key changes. The latest state is
 // also applied locally so callers may rely on Lookup after receiving an event.
 func (m *RingManager) Watch(ctx context.Context) (<-chan RingEvent, error) {
 	events := make(chan RingEvent, 8)
-	watchCh := m.etcd.Watch(ctx, m.prefix)
+	// Watch the ring key alone so migration checkpoints under the same prefix do not
+	// crowd ring changes out of the watch buffer.
+	watchCh := m.etcd.Watch(ctx, m.ringKey())
 
 	go func() {
 		defer close(events)
@@ -240,18 +588,25 @@ func (m *RingManager) Watch(ctx context.Context) (<-chan RingEvent, error) {
 					if evt.Type == etcdsim.EventTypeDelete {
 						continue
 					}
-					var state ringState
-					if err := json.Unmarshal([]byte(evt.Value), &state); err != nil {
+					state, err := decodeRingState(evt.Value)
+					if err != nil {
+						log.Printf("storage: ignoring ring update: %v", err)
+						continue
+					}
+					if err := m.applyState(&state, evt.ModRevision); err != nil {
+						log.Printf("storage: ignoring ring update: %v", err)
 						continue
 					}
-					if state.Nodes == nil {
-						state.Nodes = map[string]NodeDescriptor{}
+					ringEvt := RingEvent{
+						Version:           state.Version,
+						Assignments:       append([]VirtualNodeAssignment(nil), state.Tokens...),
+						Placement:         state.placement(),
+						PreviousVersion:   state.PreviousVersion,
+						Previous:          append([]VirtualNodeAssignment(nil), state.PreviousTokens...),
+						PreviousPlacement: state.previousPlacement(),
 					}
-					m.applyState(&state)
-					assignments := make([]VirtualNodeAssignment, len(state.Tokens))
-					copy(assignments, state.Tokens)
 					select {
-					case events <- RingEvent{Version: state.Version, Assignments: assignments}:
+					case events <- ringEvt:
 					case <-ctx.Done():
 						return
 					}
@@ -263,11 +618,22 @@ func (m *RingManager) Watch(ctx context.Context) (<-chan RingEvent, error) {
 	return events, nil
 }
 
-func (m *RingManager) applyState(state *ringState) {
+// applyState adopts a ring state observed at revision, unless this manager has already
+// seen a newer one. A state whose ring cannot be built is not adopted.
+func (m *RingManager) applyState(state *ringState, revision int64) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if revision <= m.lastRevision {
+		return nil
+	}
+	previous := m.state
 	m.state = *state
-	m.rebuildLocked()
+	if err := m.rebuildLocked(); err != nil {
+		m.state = previous
+		return err
+	}
+	m.lastRevision = revision
+	return nil
 }
 
 // Nodes returns all currently registered nodes.
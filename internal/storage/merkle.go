@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	iofs "io/fs"
+	"sort"
+	"time"
+
+	"tritontube/internal/chash"
+	grpc "tritontube/internal/metadata/grpcstub"
+	storagepb "tritontube/internal/storage/proto"
+)
+
+// DefaultMerkleDepth gives each ring range 2^6 = 64 leaves.
+const DefaultMerkleDepth = 6
+
+// MaxMerkleDepth bounds the trees a peer may ask for.
+const MaxMerkleDepth = 16
+
+// merkleIndexTTL is how long MerkleTree answers from one index of the node's segments,
+// so that a peer descending a tree level by level does not trigger a rebuild per level.
+const merkleIndexTTL = 10 * time.Second
+
+// emptyMerkleHash stands in for an empty subtree when hashing its parent.
+var emptyMerkleHash = make([]byte, sha256.Size)
+
+type indexedObject struct {
+	pos   uint64
+	entry storagepb.MerkleEntry
+}
+
+// merkleIndex is a snapshot of the recorded segments a filesystem holds, ordered by ring
+// position. Segments are placed by their id, as the ring places them, whatever their
+// locator. Erasure-coded segments are left out: every shard is different, so replicas
+// have none in common to compare.
+type merkleIndex struct {
+	objects []indexedObject
+	builtAt time.Time
+}
+
+func buildMerkleIndex(ctx context.Context, fs *FS, segments SegmentLister) (*merkleIndex, error) {
+	records, err := segments.ListSegments(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("storage: failed to list segments: %w", err)
+	}
+	idx := &merkleIndex{builtAt: time.Now()}
+	for _, record := range records {
+		if record.Erasure != nil {
+			continue
+		}
+		info, err := fs.Stat(record.Locator.Bucket, record.Locator.Object)
+		if errors.Is(err, iofs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("storage: failed to index %s: %w", record.SegmentID, err)
+		}
+		idx.objects = append(idx.objects, indexedObject{
+			pos: chash.HashKey([]byte(record.SegmentID)),
+			entry: storagepb.MerkleEntry{
+				SegmentId: record.SegmentID,
+				Bucket:    record.Locator.Bucket,
+				Object:    record.Locator.Object,
+				Checksum:  info.SHA256,
+			},
+		})
+	}
+	sort.Slice(idx.objects, func(i, j int) bool {
+		a, b := idx.objects[i], idx.objects[j]
+		if a.pos != b.pos {
+			return a.pos < b.pos
+		}
+		return a.entry.SegmentId < b.entry.SegmentId
+	})
+	return idx, nil
+}
+
+// within returns the objects in r in ring order, starting after r.Start.
+func (idx *merkleIndex) within(r tokenRange) []indexedObject {
+	objects := idx.objects
+	after := sort.Search(len(objects), func(i int) bool { return objects[i].pos > r.Start })
+	end := sort.Search(len(objects), func(i int) bool { return objects[i].pos > r.End })
+	if r.Start < r.End {
+		return objects[after:end]
+	}
+	// The range wraps past zero.
+	out := append([]indexedObject(nil), objects[after:]...)
+	return append(out, objects[:end]...)
+}
+
+// merkleTree is a complete binary tree over the segments in one ring range. The range is
+// split evenly into 2^depth leaves; a leaf hashes the ids, locators and checksums of its
+// segments and an inner node hashes its two children. Empty subtrees hash to nil.
+type merkleTree struct {
+	depth int
+	// levels[0] holds the root and levels[depth] the leaves.
+	levels [][][]byte
+	leaves [][]*storagepb.MerkleEntry
+}
+
+func (idx *merkleIndex) tree(r tokenRange, depth int) *merkleTree {
+	n := 1 << depth
+	t := &merkleTree{depth: depth, levels: make([][][]byte, depth+1), leaves: make([][]*storagepb.MerkleEntry, n)}
+	for _, obj := range idx.within(r) {
+		leaf := leafIndex(r, depth, obj.pos)
+		entry := obj.entry
+		t.leaves[leaf] = append(t.leaves[leaf], &entry)
+	}
+	t.levels[depth] = make([][]byte, n)
+	for i, entries := range t.leaves {
+		t.levels[depth][i] = leafHash(entries)
+	}
+	for level := depth - 1; level >= 0; level-- {
+		below := t.levels[level+1]
+		t.levels[level] = make([][]byte, len(below)/2)
+		for i := range t.levels[level] {
+			t.levels[level][i] = nodeHash(below[2*i], below[2*i+1])
+		}
+	}
+	return t
+}
+
+// nodes returns the requested nodes of a level; no indexes means the whole level.
+// Leaves carry their entries when withEntries is set.
+func (t *merkleTree) nodes(level int, indexes []uint32, withEntries bool) ([]*storagepb.MerkleNode, error) {
+	hashes := t.levels[level]
+	if len(indexes) == 0 {
+		indexes = make([]uint32, len(hashes))
+		for i := range indexes {
+			indexes[i] = uint32(i)
+		}
+	}
+	out := make([]*storagepb.MerkleNode, 0, len(indexes))
+	for _, i := range indexes {
+		if int(i) >= len(hashes) {
+			return nil, fmt.Errorf("node %d outside level %d of %d nodes", i, level, len(hashes))
+		}
+		node := &storagepb.MerkleNode{Index: i, Hash: hashes[i]}
+		if withEntries && level == t.depth {
+			node.Entries = t.leaves[i]
+		}
+		out = append(out, node)
+	}
+	return out, nil
+}
+
+// leafIndex returns which of the 2^depth equal parts of r holds pos.
+func leafIndex(r tokenRange, depth int, pos uint64) int {
+	if depth == 0 {
+		return 0
+	}
+	// Unsigned subtraction wraps, so offsets count from the first position in r.
+	offset := pos - r.Start - 1
+	if r.Start == r.End {
+		return int(offset >> (64 - depth))
+	}
+	width := r.End - r.Start
+	step := (width-1)>>depth + 1
+	return int(offset / step)
+}
+
+func leafHash(entries []*storagepb.MerkleEntry) []byte {
+	if len(entries) == 0 {
+		return nil
+	}
+	h := sha256.New()
+	for _, e := range entries {
+		fmt.Fprintf(h, "%s\x00%s/%s\x00%s\n", e.SegmentId, e.Bucket, e.Object, e.Checksum)
+	}
+	return h.Sum(nil)
+}
+
+func nodeHash(left, right []byte) []byte {
+	if left == nil && right == nil {
+		return nil
+	}
+	if left == nil {
+		left = emptyMerkleHash
+	}
+	if right == nil {
+		right = emptyMerkleHash
+	}
+	h := sha256.New()
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// MerkleTree returns one level of the Merkle tree over the recorded segments this node
+// holds in the requested ring range, for anti-entropy between replicas. Answers may lag
+// writes by up to merkleIndexTTL. It needs a Metadata store that lists segments.
+func (s *Service) MerkleTree(ctx context.Context, req *storagepb.MerkleTreeRequest) (*storagepb.MerkleTreeResponse, error) {
+	if req.Depth > MaxMerkleDepth {
+		return nil, grpc.Errorf(grpc.InvalidArgument, "storage: merkle depth %d exceeds limit %d", req.Depth, MaxMerkleDepth)
+	}
+	if req.Level > req.Depth {
+		return nil, grpc.Errorf(grpc.InvalidArgument, "storage: merkle level %d below leaves at depth %d", req.Level, req.Depth)
+	}
+	segments, ok := s.metadata.(SegmentLister)
+	if !ok {
+		return nil, grpc.Errorf(grpc.FailedPrecondition, "storage: merkle trees require a metadata store that lists segments")
+	}
+	idx, err := s.merkleSnapshot(ctx, segments)
+	if err != nil {
+		return nil, grpc.Errorf(grpc.Internal, "%v", err)
+	}
+	tree := idx.tree(tokenRange{Start: req.StartToken, End: req.EndToken}, int(req.Depth))
+	nodes, err := tree.nodes(int(req.Level), req.Indexes, req.IncludeEntries)
+	if err != nil {
+		return nil, grpc.Errorf(grpc.InvalidArgument, "storage: %v", err)
+	}
+	return &storagepb.MerkleTreeResponse{Nodes: nodes}, nil
+}
+
+func (s *Service) merkleSnapshot(ctx context.Context, segments SegmentLister) (*merkleIndex, error) {
+	s.merkleMu.Lock()
+	defer s.merkleMu.Unlock()
+	if s.merkle != nil && time.Since(s.merkle.builtAt) < merkleIndexTTL {
+		return s.merkle, nil
+	}
+	idx, err := buildMerkleIndex(ctx, s.fs, segments)
+	if err != nil {
+		return nil, err
+	}
+	s.merkle = idx
+	return idx, nil
+}
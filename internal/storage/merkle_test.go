@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	storagepb "tritontube/internal/storage/proto"
+)
+
+func TestAntiEntropySyncsDifferingRanges(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCluster(t, RingManagerConfig{VirtualNodes: 8}, "node-a", "node-b")
+	local, remote := c.nodes["node-a"], c.nodes["node-b"]
+	peer := c.service(t, "node-b", ServiceConfig{ReplicationFactor: 2})
+	c.transport.RegisterMerkle("node-b", peer.MerkleTree)
+
+	// Segments are recorded under ids that differ from their object names, so the trees
+	// only agree if both sides place them by id.
+	record := func(name string) {
+		t.Helper()
+		err := c.segments.PutSegment(ctx, SegmentRecord{
+			SegmentID: "seg-" + name,
+			Locator:   storagepb.SegmentLocator{Bucket: "videos", Object: "v1/720p/" + name},
+		})
+		if err != nil {
+			t.Fatalf("failed to record %s: %v", name, err)
+		}
+	}
+	put := func(node *FS, name, data string) {
+		t.Helper()
+		if _, _, err := node.Put("videos", "v1/720p/"+name, strings.NewReader(data)); err != nil {
+			t.Fatalf("failed to store %s: %v", name, err)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprint(i)
+		record(name)
+		put(local, name, name)
+		put(remote, name, name)
+	}
+	for _, name := range []string{"missing", "local-only", "diverged", "rotted"} {
+		record(name)
+	}
+	put(remote, "missing", "missing")
+	put(local, "local-only", "local only")
+	put(local, "diverged", "ours")
+	put(remote, "diverged", "theirs")
+	put(local, "rotted", "rotted")
+	put(remote, "rotted", "healthy")
+	// Objects without a record are not compared.
+	put(remote, "unrecorded", "unrecorded")
+	sum := sha256.Sum256([]byte("something else"))
+	if err := os.WriteFile(filepath.Join(local.root, "videos", "v1/720p/rotted"+checksumSuffix), []byte(hex.EncodeToString(sum[:])), 0o644); err != nil {
+		t.Fatalf("failed to corrupt checksum: %v", err)
+	}
+
+	ae := &AntiEntropy{NodeID: "node-a", Ring: c.ring, Filesystem: local, Segments: c.segments, Transport: c.transport, ReplicationFactor: 2}
+	report, err := ae.SyncOnce(ctx)
+	if err != nil {
+		t.Fatalf("anti-entropy failed: %v", err)
+	}
+	if report.Ranges != 16 || report.Differing == 0 || report.Differing == report.Ranges {
+		t.Fatalf("expected only some of 16 ranges to differ, got %d of %d", report.Differing, report.Ranges)
+	}
+	sort.Strings(report.Pulled)
+	if got := strings.Join(report.Pulled, ","); got != "seg-missing,seg-rotted" {
+		t.Fatalf("unexpected pulled segments %q", got)
+	}
+	if got := strings.Join(report.Conflicts, ","); got != "seg-diverged" {
+		t.Fatalf("unexpected conflicts %q", got)
+	}
+	if len(report.Failed) != 0 {
+		t.Fatalf("unexpected failures %v", report.Failed)
+	}
+	for object, want := range map[string]string{"v1/720p/missing": "missing", "v1/720p/rotted": "healthy", "v1/720p/local-only": "local only"} {
+		info, err := local.Verify("videos", object)
+		if err != nil {
+			t.Fatalf("%s does not verify after sync: %v", object, err)
+		}
+		if sum := sha256.Sum256([]byte(want)); info.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Fatalf("%s holds the wrong data after sync", object)
+		}
+	}
+
+	report, err = ae.SyncOnce(ctx)
+	if err != nil {
+		t.Fatalf("second anti-entropy pass failed: %v", err)
+	}
+	if len(report.Pulled) != 0 || len(report.Conflicts) != 1 || len(report.Failed) != 0 {
+		t.Fatalf("expected only the conflict to remain, got %+v", report)
+	}
+	if _, err := local.Stat("videos", "v1/720p/unrecorded"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected the unrecorded object to be left alone, got %v", err)
+	}
+}
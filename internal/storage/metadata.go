@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	"tritontube/internal/metadata/etcdsim"
@@ -21,6 +22,9 @@ type SegmentRecord struct {
 	SizeBytes   int64                    `json:"size_bytes"`
 	Attributes  map[string]string        `json:"attributes"`
 	UpdatedAt   time.Time                `json:"updated_at"`
+	// Erasure is set for erasure-coded segments, which are stored as shards rather than
+	// as copies on PrimaryNode and Replicas; Replicas then lists only external copies.
+	Erasure *ErasureLayout `json:"erasure,omitempty"`
 }
 
 // MetadataStore persists segment metadata after successful replication.
@@ -28,6 +32,16 @@ type MetadataStore interface {
 	PutSegment(ctx context.Context, record SegmentRecord) error
 }
 
+// ErrSegmentNotFound is returned when no record exists for a segment id.
+var ErrSegmentNotFound = errors.New("storage: segment not found")
+
+// SegmentReader looks up the record of a single segment.
+type SegmentReader interface {
+	Segment(ctx context.Context, segmentID string) (SegmentRecord, error)
+}
+
+var _ SegmentReader = (*EtcdMetadataStore)(nil)
+
 // EtcdMetadataStore stores segment metadata in etcd under a configurable prefix.
 type EtcdMetadataStore struct {
 	etcd   *etcdsim.Client
@@ -69,3 +83,37 @@ func (s *EtcdMetadataStore) PutSegment(ctx context.Context, record SegmentRecord
 	_, err = s.etcd.Put(ctx, s.key(record.SegmentID), string(encoded))
 	return err
 }
+
+// Segment returns the record for segmentID, or ErrSegmentNotFound.
+func (s *EtcdMetadataStore) Segment(ctx context.Context, segmentID string) (SegmentRecord, error) {
+	resp, err := s.etcd.Get(ctx, s.key(segmentID))
+	if err != nil {
+		return SegmentRecord{}, err
+	}
+	if len(resp.KVs) == 0 {
+		return SegmentRecord{}, ErrSegmentNotFound
+	}
+	var record SegmentRecord
+	if err := json.Unmarshal([]byte(resp.KVs[0].Value), &record); err != nil {
+		return SegmentRecord{}, fmt.Errorf("storage: failed to decode %s: %w", resp.KVs[0].Key, err)
+	}
+	return record, nil
+}
+
+// ListSegments returns every segment record under the prefix, ordered by segment id.
+func (s *EtcdMetadataStore) ListSegments(ctx context.Context) ([]SegmentRecord, error) {
+	resp, err := s.etcd.Get(ctx, s.prefix+"/", etcdsim.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	records := make([]SegmentRecord, 0, len(resp.KVs))
+	for _, kv := range resp.KVs {
+		var record SegmentRecord
+		if err := json.Unmarshal([]byte(kv.Value), &record); err != nil {
+			return nil, fmt.Errorf("storage: failed to decode %s: %w", kv.Key, err)
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].SegmentID < records[j].SegmentID })
+	return records, nil
+}
@@ -0,0 +1,548 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"tritontube/internal/chash"
+	"tritontube/internal/metadata/etcdsim"
+	storagepb "tritontube/internal/storage/proto"
+)
+
+// SegmentStore is the metadata a migration reads and rewrites.
+type SegmentStore interface {
+	MetadataStore
+	SegmentLister
+}
+
+var _ SegmentStore = (*EtcdMetadataStore)(nil)
+
+// Migrator is a MigrationExecutor that moves segment copies onto the nodes that own them
+// after a ring change. For every token range in the plan's Moves (or, for plans without
+// moves, every range whose replica set changed since the previous plan) it copies
+// affected segments to their new owners, points the SegmentRecord at them, and only then
+// deletes the copies on nodes that no longer own the range. Shards of erasure-coded
+// segments held by nodes the plan drops are moved onto current nodes. Progress is
+// checkpointed under <prefix>/migrations/<plan_id> so an interrupted plan resumes where
+// it stopped.
+type Migrator struct {
+	segments          SegmentStore
+	transport         ReplicationTransport
+	replicationFactor int
+	checkpoints       *checkpointStore
+
+	mu       sync.Mutex
+	previous []VirtualNodeAssignment
+}
+
+// MigratorConfig configures a Migrator.
+type MigratorConfig struct {
+	Segments          SegmentStore
+	Transport         ReplicationTransport
+	ReplicationFactor int
+	// Previous is the assignment set in effect before the first plan. When empty the
+	// first plan without moves reconciles every segment rather than only changed ranges.
+	Previous []VirtualNodeAssignment
+	// Etcd and Prefix locate the checkpoints; Prefix defaults to the ring prefix
+	// "/storage/cluster". Without Etcd, checkpoints only live as long as the Migrator.
+	Etcd   *etcdsim.Client
+	Prefix string
+}
+
+// NewMigrator constructs a Migrator.
+func NewMigrator(cfg MigratorConfig) (*Migrator, error) {
+	if cfg.Segments == nil {
+		return nil, errors.New("storage: migrator requires a segment store")
+	}
+	if cfg.Transport == nil {
+		return nil, errors.New("storage: migrator requires a replication transport")
+	}
+	if cfg.ReplicationFactor <= 0 {
+		cfg.ReplicationFactor = 3
+	}
+	m := &Migrator{
+		segments:          cfg.Segments,
+		transport:         cfg.Transport,
+		replicationFactor: cfg.ReplicationFactor,
+		checkpoints:       newCheckpointStore(cfg.Etcd, cfg.Prefix),
+		previous:          append([]VirtualNodeAssignment(nil), cfg.Previous...),
+	}
+	return m, nil
+}
+
+var _ ResumableExecutor = (*Migrator)(nil)
+
+// StartPlan records a checkpoint for the plan without moving any data.
+func (m *Migrator) StartPlan(ctx context.Context, plan *storagepb.RebalancePlan) error {
+	if plan == nil {
+		return errors.New("storage: rebalance plan is required")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkpoints.fence(ctx, plan.FencingToken); err != nil {
+		return err
+	}
+	_, err := m.checkpointLocked(ctx, plan)
+	return err
+}
+
+// PendingPlans returns the plans with an unfinished checkpoint, oldest ring version first.
+func (m *Migrator) PendingPlans(ctx context.Context) ([]*storagepb.RebalancePlan, error) {
+	checkpoints, err := m.checkpoints.unfinished(ctx)
+	if err != nil {
+		return nil, err
+	}
+	plans := make([]*storagepb.RebalancePlan, 0, len(checkpoints))
+	for _, cp := range checkpoints {
+		plans = append(plans, cp.Plan)
+	}
+	return plans, nil
+}
+
+// Checkpoint returns the persisted progress of a plan, or nil if it was never started.
+func (m *Migrator) Checkpoint(ctx context.Context, planID string) (*MigrationCheckpoint, error) {
+	return m.checkpoints.get(ctx, planID)
+}
+
+// ExecutePlan implements MigrationExecutor. It starts the plan if needed and carries out
+// its remaining moves, checkpointing after every segment that moved. The first segment
+// that cannot be moved stops the plan; executing it again resumes from that segment.
+// Executing a completed plan is a no-op. A plan whose FencingToken is below one already
+// seen fails with ErrStaleFencingToken before moving another segment.
+func (m *Migrator) ExecutePlan(ctx context.Context, plan *storagepb.RebalancePlan) error {
+	if plan == nil {
+		return errors.New("storage: rebalance plan is required")
+	}
+	if _, err := chash.NewPlacement(chash.Algorithm(plan.Placement), nil); err != nil {
+		return fmt.Errorf("storage: plan %s: %w", plan.PlanId, err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkpoints.fence(ctx, plan.FencingToken); err != nil {
+		return err
+	}
+
+	cp, err := m.checkpointLocked(ctx, plan)
+	if err != nil {
+		return err
+	}
+	next := assignmentsFromPlan(cp.Plan)
+	if cp.State == MigrationCompleted {
+		m.previous = next
+		return nil
+	}
+	cp.State = MigrationRunning
+	cp.LastError = ""
+
+	records, err := m.segments.ListSegments(ctx)
+	if err != nil {
+		return fmt.Errorf("storage: failed to list segments: %w", err)
+	}
+	nextRing, err := placementFor(snapshotFromPlan(cp.Plan))
+	if err != nil {
+		return err
+	}
+	for i := range cp.Moves {
+		move := &cp.Moves[i]
+		if move.State == MigrationCompleted {
+			continue
+		}
+		move.State = MigrationRunning
+		r := tokenRange{Start: move.StartToken, End: move.EndToken}
+		for _, record := range records {
+			if err := ctx.Err(); err != nil {
+				return m.interrupt(cp, err)
+			}
+			if move.LastSegment != "" && record.SegmentID <= move.LastSegment {
+				continue
+			}
+			pos := chash.HashKey([]byte(record.SegmentID))
+			if !r.contains(pos) {
+				continue
+			}
+			if record.Erasure != nil {
+				// Shards stay on the nodes that were current when they were written, unless
+				// their holder leaves the ring; see replaceShards.
+				continue
+			}
+			if err := m.checkpoints.fence(ctx, plan.FencingToken); err != nil {
+				return err
+			}
+			copied, err := m.moveSegment(ctx, record, nextRing.LookupHash(pos, m.replicationFactor))
+			if err != nil {
+				return m.interrupt(cp, fmt.Errorf("storage: plan %s: segment %s: %w", cp.Plan.PlanId, record.SegmentID, err))
+			}
+			move.LastSegment = record.SegmentID
+			if copied > 0 {
+				move.BytesCopied += copied
+				move.SegmentsMoved++
+				if err := m.checkpoints.put(ctx, cp); err != nil {
+					return err
+				}
+			}
+		}
+		move.State = MigrationCompleted
+		if err := m.checkpoints.put(ctx, cp); err != nil {
+			return err
+		}
+	}
+	if err := m.replaceShards(ctx, cp.Plan, records, nextRing); err != nil {
+		return m.interrupt(cp, fmt.Errorf("storage: plan %s: %w", cp.Plan.PlanId, err))
+	}
+	cp.State = MigrationCompleted
+	if err := m.checkpoints.put(ctx, cp); err != nil {
+		return err
+	}
+	m.previous = next
+	return nil
+}
+
+// interrupt records why a plan stopped and returns cause. The checkpoint is written even
+// if ctx was cancelled, so a restart resumes from the last segment that moved.
+func (m *Migrator) interrupt(cp *MigrationCheckpoint, cause error) error {
+	cp.LastError = cause.Error()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.checkpoints.put(ctx, cp); err != nil {
+		return fmt.Errorf("%w (checkpoint failed: %v)", cause, err)
+	}
+	return cause
+}
+
+// checkpointLocked loads the plan's checkpoint, creating it on first use. A loaded
+// checkpoint takes the caller's fencing token, so a leader can resume a plan its
+// predecessor started.
+func (m *Migrator) checkpointLocked(ctx context.Context, plan *storagepb.RebalancePlan) (*MigrationCheckpoint, error) {
+	cp, err := m.checkpoints.get(ctx, plan.PlanId)
+	if err != nil {
+		return nil, err
+	}
+	if cp != nil {
+		cp.Plan.FencingToken = plan.FencingToken
+		return cp, nil
+	}
+	now := time.Now().UTC()
+	cp = &MigrationCheckpoint{Plan: plan, State: MigrationPending, CreatedAt: now}
+	moves, err := m.movesFor(plan)
+	if err != nil {
+		return nil, err
+	}
+	for _, move := range moves {
+		cp.Moves = append(cp.Moves, MoveProgress{
+			StartToken: move.StartToken,
+			EndToken:   move.EndToken,
+			FromNodeID: move.FromNodeId,
+			ToNodeID:   move.ToNodeId,
+			State:      MigrationPending,
+		})
+	}
+	if len(cp.Moves) == 0 {
+		cp.State = MigrationCompleted
+	}
+	if err := m.checkpoints.put(ctx, cp); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// movesFor returns the moves a plan needs: its own, a diff against the previous plan, or
+// a single move spanning the whole ring when there is nothing to diff against.
+func (m *Migrator) movesFor(plan *storagepb.RebalancePlan) ([]*storagepb.TokenRangeMove, error) {
+	if len(plan.Moves) > 0 {
+		return plan.Moves, nil
+	}
+	if len(m.previous) > 0 {
+		next := snapshotFromPlan(plan)
+		previous := RingSnapshot{Assignments: m.previous, Placement: next.Placement}
+		return planMoves(previous, next, m.replicationFactor)
+	}
+	if plan.PreviousRingVersion > 0 {
+		return nil, nil
+	}
+	return []*storagepb.TokenRangeMove{{}}, nil
+}
+
+// moveSegment brings a segment's copies in line with owners and returns the number of
+// bytes copied.
+func (m *Migrator) moveSegment(ctx context.Context, record SegmentRecord, owners []string) (int64, error) {
+	if len(owners) == 0 {
+		return 0, nil
+	}
+	holders, external := recordHolders(record)
+	if equalStrings(holders, owners) {
+		return 0, nil
+	}
+	held := map[string]bool{}
+	for _, node := range holders {
+		held[node] = true
+	}
+	var copied int64
+	for _, target := range owners {
+		if held[target] {
+			continue
+		}
+		if err := m.copySegment(ctx, record, holders, target); err != nil {
+			return copied, err
+		}
+		copied += record.SizeBytes
+	}
+
+	updated := record
+	updated.PrimaryNode = owners[0]
+	updated.Replicas = append(append([]string(nil), owners[1:]...), external...)
+	if err := m.segments.PutSegment(ctx, updated); err != nil {
+		return copied, fmt.Errorf("update metadata: %w", err)
+	}
+
+	owned := map[string]bool{}
+	for _, node := range owners {
+		owned[node] = true
+	}
+	for _, node := range holders {
+		if owned[node] {
+			continue
+		}
+		locator := record.Locator
+		if err := m.transport.DeleteSegment(ctx, node, &locator); err != nil {
+			return copied, fmt.Errorf("delete from %s: %w", node, err)
+		}
+	}
+	return copied, nil
+}
+
+// copySegment streams the segment from the first holder that can serve it to target.
+// The receiving node verifies the body against the recorded checksum.
+func (m *Migrator) copySegment(ctx context.Context, record SegmentRecord, holders []string, target string) error {
+	locator := record.Locator
+	header := &storagepb.UploadSegmentHeader{
+		SegmentId:  record.SegmentID,
+		Locator:    &locator,
+		SizeBytes:  record.SizeBytes,
+		Checksum:   record.Checksum,
+		Attributes: record.Attributes,
+	}
+	lastErr := errors.New("storage: no node holds a copy")
+	for _, source := range holders {
+		body, err := m.transport.FetchSegment(ctx, source, &locator)
+		if err != nil {
+			lastErr = fmt.Errorf("fetch from %s: %w", source, err)
+			continue
+		}
+		err = m.transport.ReplicateSegment(ctx, target, header, body)
+		body.Close()
+		if err != nil {
+			lastErr = fmt.Errorf("copy %s to %s: %w", source, target, err)
+			continue
+		}
+		return nil
+	}
+	return lastErr
+}
+
+// replaceShards moves the shards of erasure-coded segments off nodes the plan no longer
+// assigns tokens to. Shards are not placed by token range, so a holder can leave without
+// any range in the plan changing; every erasure-coded record is checked.
+func (m *Migrator) replaceShards(ctx context.Context, plan *storagepb.RebalancePlan, records []SegmentRecord, placement chash.Placement) error {
+	current := map[string]bool{}
+	for _, vn := range plan.Assignments {
+		current[vn.OwnerNodeId] = true
+	}
+	for _, record := range records {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if record.Erasure == nil {
+			continue
+		}
+		var departed []int
+		for i, holder := range record.Erasure.Shards {
+			if holder != "" && !current[holder] {
+				departed = append(departed, i)
+			}
+		}
+		if len(departed) == 0 {
+			continue
+		}
+		if err := m.checkpoints.fence(ctx, plan.FencingToken); err != nil {
+			return err
+		}
+		if err := m.moveShards(ctx, record, departed, placement); err != nil {
+			return fmt.Errorf("segment %s: %w", record.SegmentID, err)
+		}
+	}
+	return nil
+}
+
+// moveShards stores the listed shards of an erasure-coded segment on the nodes placement
+// now picks for them, as shardStore.put would, and points the record at them. A shard is
+// copied from its old holder when that node still serves it and rebuilt from the other
+// shards otherwise. The old copies are deleted on a best-effort basis, since their
+// holders may be gone.
+func (m *Migrator) moveShards(ctx context.Context, record SegmentRecord, shards []int, placement chash.Placement) error {
+	layout := *record.Erasure
+	if len(layout.Checksums) != len(layout.Shards) {
+		return errors.New("storage: malformed erasure layout")
+	}
+	layout.Shards = append([]string(nil), layout.Shards...)
+	targets := placement.LookupHash(chash.HashKey([]byte(record.SegmentID)), len(layout.Shards))
+	if len(targets) == 0 {
+		return errors.New("storage: no nodes to place shards on")
+	}
+	st := shardStore{transport: m.transport}
+	for _, i := range shards {
+		shard, err := st.fetch(ctx, record, i)
+		if err != nil {
+			if shard, err = st.rebuild(ctx, record, i); err != nil {
+				return err
+			}
+		}
+		target := targets[i%len(targets)]
+		if err := st.putShard(ctx, target, record.SegmentID, shardLocator(record.Locator, i), shard, layout.Checksums[i]); err != nil {
+			return fmt.Errorf("copy shard %d to %s: %w", i, target, err)
+		}
+		layout.Shards[i] = target
+	}
+
+	updated := record
+	updated.Erasure = &layout
+	if err := m.segments.PutSegment(ctx, updated); err != nil {
+		return fmt.Errorf("update metadata: %w", err)
+	}
+	for _, i := range shards {
+		node := record.Erasure.Shards[i]
+		if err := m.transport.DeleteSegment(ctx, node, shardLocator(record.Locator, i)); err != nil {
+			log.Printf("storage: failed to delete shard %d of %s from %s: %v", i, record.SegmentID, node, err)
+		}
+	}
+	return nil
+}
+
+// recordHolders splits a record's locations into storage nodes, primary first, and
+// external copies such as "s3:" replicas that migrations leave alone.
+func recordHolders(record SegmentRecord) (nodes, external []string) {
+	seen := map[string]bool{}
+	for _, loc := range append([]string{record.PrimaryNode}, record.Replicas...) {
+		if loc == "" || seen[loc] {
+			continue
+		}
+		seen[loc] = true
+		if strings.HasPrefix(loc, "s3:") {
+			external = append(external, loc)
+			continue
+		}
+		nodes = append(nodes, loc)
+	}
+	return nodes, external
+}
+
+// tokenRange is the half-open ring interval (Start, End]. It wraps past zero when
+// Start >= End; Start == End covers the whole ring.
+type tokenRange struct {
+	Start uint64
+	End   uint64
+}
+
+func (r tokenRange) contains(pos uint64) bool {
+	if r.Start < r.End {
+		return pos > r.Start && pos <= r.End
+	}
+	return pos > r.Start || pos <= r.End
+}
+
+func rangesContain(ranges []tokenRange, pos uint64) bool {
+	for _, r := range ranges {
+		if r.contains(pos) {
+			return true
+		}
+	}
+	return false
+}
+
+// boundaries returns the sorted, de-duplicated tokens of both assignment sets. No
+// replica set can change inside the interval between two adjacent boundaries.
+func boundaries(prev, next []VirtualNodeAssignment) []uint64 {
+	seen := map[uint64]bool{}
+	var out []uint64
+	for _, set := range [][]VirtualNodeAssignment{prev, next} {
+		for _, a := range set {
+			if !seen[a.Token] {
+				seen[a.Token] = true
+				out = append(out, a.Token)
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+// changedRanges returns the intervals whose replica set differs between prev and next.
+func changedRanges(prev, next chash.Placement, bounds []uint64, replicas int) []tokenRange {
+	var out []tokenRange
+	for i, end := range bounds {
+		start := bounds[len(bounds)-1]
+		if i > 0 {
+			start = bounds[i-1]
+		}
+		if !equalStrings(prev.LookupHash(end, replicas), next.LookupHash(end, replicas)) {
+			out = append(out, tokenRange{Start: start, End: end})
+		}
+	}
+	return out
+}
+
+// snapshotFromPlan returns the ring a plan moves data onto.
+func snapshotFromPlan(plan *storagepb.RebalancePlan) RingSnapshot {
+	return RingSnapshot{
+		Version:     plan.RingVersion,
+		Assignments: assignmentsFromPlan(plan),
+		Placement:   chash.Algorithm(plan.Placement),
+	}
+}
+
+func assignmentsFromPlan(plan *storagepb.RebalancePlan) []VirtualNodeAssignment {
+	out := make([]VirtualNodeAssignment, 0, len(plan.Assignments))
+	for _, vn := range plan.Assignments {
+		if vn == nil {
+			continue
+		}
+		out = append(out, VirtualNodeAssignment{ID: vn.Id, Token: vn.Token, NodeID: vn.OwnerNodeId, Zone: vn.Zone, Rack: vn.Rack})
+	}
+	return out
+}
+
+// placementFor rebuilds a snapshot's placement, including failure domains for
+// zone-aware rings.
+func placementFor(snapshot RingSnapshot) (chash.Placement, error) {
+	tokens := make([]chash.Token, len(snapshot.Assignments))
+	for i, a := range snapshot.Assignments {
+		tokens[i] = chash.Token{Hash: a.Token, Node: a.NodeID}
+	}
+	placement, err := chash.NewPlacement(snapshot.Placement, tokens)
+	if err != nil {
+		return nil, fmt.Errorf("storage: ring version %d: %w", snapshot.Version, err)
+	}
+	for _, a := range snapshot.Assignments {
+		if a.Zone != "" || a.Rack != "" {
+			placement.SetFailureDomain(a.NodeID, chash.FailureDomain{Zone: a.Zone, Rack: a.Rack})
+		}
+	}
+	return placement, nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,551 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"tritontube/internal/chash"
+	"tritontube/internal/metadata/etcdsim"
+	"tritontube/internal/metadata/etcdsim/concurrency"
+	grpc "tritontube/internal/metadata/grpcstub"
+	storagepb "tritontube/internal/storage/proto"
+)
+
+// seed stores n segments on their current owners, as UploadSegment would.
+func (c *testCluster) seed(t *testing.T, n, replicas int) []string {
+	t.Helper()
+	var ids []string
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("video-%d/720p/%d", i/4, i%4)
+		data := "segment " + id
+		owners := c.ring.Lookup([]byte(id), replicas)
+		for _, node := range owners {
+			if _, _, err := c.nodes[node].Put("segments", id, strings.NewReader(data)); err != nil {
+				t.Fatalf("failed to store %s on %s: %v", id, node, err)
+			}
+		}
+		sum := sha256.Sum256([]byte(data))
+		record := SegmentRecord{
+			SegmentID:   id,
+			Locator:     storagepb.SegmentLocator{Bucket: "segments", Object: id},
+			PrimaryNode: owners[0],
+			Replicas:    append(owners[1:], "s3:archive/"+id),
+			Checksum:    hex.EncodeToString(sum[:]),
+			SizeBytes:   int64(len(data)),
+		}
+		if err := c.segments.PutSegment(context.Background(), record); err != nil {
+			t.Fatalf("failed to record %s: %v", id, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (c *testCluster) plan() *storagepb.RebalancePlan {
+	assignments, version := c.ring.Assignments()
+	plan := &storagepb.RebalancePlan{PlanId: fmt.Sprintf("test-%d", version), RingVersion: version}
+	for _, a := range assignments {
+		plan.Assignments = append(plan.Assignments, &storagepb.VirtualNode{Id: a.ID, Token: a.Token, OwnerNodeId: a.NodeID})
+	}
+	return plan
+}
+
+func mustPlan(t *testing.T, ring *RingManager, replicas int) *storagepb.RebalancePlan {
+	t.Helper()
+	plan, err := ring.Plan(replicas)
+	if err != nil {
+		t.Fatalf("failed to plan: %v", err)
+	}
+	return plan
+}
+
+func TestMigratorMovesSegmentsToNewNode(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCluster(t, RingManagerConfig{VirtualNodes: 16}, "node-a", "node-b", "node-c")
+	ids := c.seed(t, 40, 2)
+	before := c.records(t)
+	previous, _ := c.ring.Assignments()
+
+	migrator, err := NewMigrator(MigratorConfig{Segments: c.segments, Transport: c.transport, ReplicationFactor: 2, Previous: previous})
+	if err != nil {
+		t.Fatalf("failed to create migrator: %v", err)
+	}
+
+	// The new node rejects every copy: nothing may be deleted or repointed.
+	c.addNode(t, "node-d")
+	c.transport.Register("node-d", func(ctx context.Context, header *storagepb.UploadSegmentHeader, body io.Reader) error {
+		return errors.New("disk full")
+	})
+	if err := migrator.ExecutePlan(ctx, c.plan()); err == nil {
+		t.Fatalf("expected plan to fail while node-d rejects copies")
+	}
+	after := c.records(t)
+	for _, id := range ids {
+		for _, node := range append([]string{before[id].PrimaryNode}, before[id].Replicas[:1]...) {
+			if _, err := c.nodes[node].Verify("segments", id); err != nil {
+				t.Fatalf("source copy of %s on %s lost after failed plan: %v", id, node, err)
+			}
+		}
+		if after[id].PrimaryNode != before[id].PrimaryNode || strings.Join(after[id].Replicas, ",") != strings.Join(before[id].Replicas, ",") {
+			t.Fatalf("record for %s changed after failed plan: %+v", id, after[id])
+		}
+	}
+
+	c.transport.Register("node-d", ReceiveIntoFS(c.nodes["node-d"]))
+	if err := migrator.ExecutePlan(ctx, c.plan()); err != nil {
+		t.Fatalf("plan failed: %v", err)
+	}
+
+	after = c.records(t)
+	moved := 0
+	for _, id := range ids {
+		owners := c.ring.Lookup([]byte(id), 2)
+		record := after[id]
+		want := strings.Join(append(owners[1:], "s3:archive/"+id), ",")
+		if record.PrimaryNode != owners[0] || strings.Join(record.Replicas, ",") != want {
+			t.Fatalf("record for %s = %s %v, want %v", id, record.PrimaryNode, record.Replicas, owners)
+		}
+		owned := map[string]bool{}
+		for _, node := range owners {
+			owned[node] = true
+			if _, err := c.nodes[node].Verify("segments", id); err != nil {
+				t.Fatalf("owner %s missing %s: %v", node, id, err)
+			}
+		}
+		for node, fs := range c.nodes {
+			if owned[node] {
+				continue
+			}
+			if _, err := fs.Stat("segments", id); !os.IsNotExist(err) {
+				t.Fatalf("expected %s to be deleted from %s, got %v", id, node, err)
+			}
+		}
+		if owned["node-d"] {
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Fatalf("expected some segments to move to node-d")
+	}
+
+	// Re-running the same plan is a no-op.
+	if err := migrator.ExecutePlan(ctx, c.plan()); err != nil {
+		t.Fatalf("repeated plan failed: %v", err)
+	}
+}
+
+func TestRebalancePlanMoves(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCluster(t, RingManagerConfig{VirtualNodes: 16}, "node-a", "node-b", "node-c")
+	ids := c.seed(t, 40, 2)
+	c.addNode(t, "node-d")
+
+	plan := mustPlan(t, c.ring, 2)
+	if plan.PreviousRingVersion == 0 || plan.PreviousRingVersion >= plan.RingVersion {
+		t.Fatalf("unexpected versions previous=%d current=%d", plan.PreviousRingVersion, plan.RingVersion)
+	}
+	if len(plan.Moves) == 0 {
+		t.Fatalf("expected moves after adding a node")
+	}
+	var ranges []tokenRange
+	for _, move := range plan.Moves {
+		if move.ToNodeId != "node-d" || move.FromNodeId == "" || move.FromNodeId == "node-d" {
+			t.Fatalf("unexpected move %+v", move)
+		}
+		ranges = append(ranges, tokenRange{Start: move.StartToken, End: move.EndToken})
+	}
+	records := c.records(t)
+	for _, id := range ids {
+		owners := c.ring.Lookup([]byte(id), 2)
+		holders, _ := recordHolders(records[id])
+		changed := len(subtract(owners, holders)) > 0
+		if moved := rangesContain(ranges, chash.HashKey([]byte(id))); moved != changed {
+			t.Fatalf("segment %s: in moved range %v, owners changed %v", id, moved, changed)
+		}
+	}
+
+	// A heartbeat rewrites the ring without moving tokens and must not reset the diff.
+	if _, err := c.ring.UpsertNode(ctx, NodeDescriptor{ID: "node-d", CapacityBytes: 1 << 30}); err != nil {
+		t.Fatalf("heartbeat failed: %v", err)
+	}
+	again := mustPlan(t, c.ring, 2)
+	if again.PreviousRingVersion != plan.PreviousRingVersion || len(again.Moves) != len(plan.Moves) {
+		t.Fatalf("heartbeat changed the plan: previous %d -> %d, %d -> %d moves", plan.PreviousRingVersion, again.PreviousRingVersion, len(plan.Moves), len(again.Moves))
+	}
+}
+
+func TestDrainPlanEvacuatesNode(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCluster(t, RingManagerConfig{VirtualNodes: 16}, "node-a", "node-b", "node-c")
+	ids := c.seed(t, 40, 2)
+	svc, err := NewService(ServiceConfig{NodeID: "node-a", Ring: c.ring, Filesystem: c.nodes["node-a"], ReplicationFactor: 2})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	if _, err := svc.Rebalance(ctx, &storagepb.RebalanceRequest{Drain: true}); grpc.CodeOf(err) != grpc.InvalidArgument {
+		t.Fatalf("expected InvalidArgument without node id, got %v", err)
+	}
+	if _, err := svc.Rebalance(ctx, &storagepb.RebalanceRequest{Drain: true, NodeId: "node-z"}); grpc.CodeOf(err) != grpc.NotFound {
+		t.Fatalf("expected NotFound for unknown node, got %v", err)
+	}
+	resp, err := svc.Rebalance(ctx, &storagepb.RebalanceRequest{Drain: true, NodeId: "node-b"})
+	if err != nil {
+		t.Fatalf("drain failed: %v", err)
+	}
+	if len(resp.Plan.Moves) == 0 {
+		t.Fatalf("expected drain plan to move ranges")
+	}
+	for _, move := range resp.Plan.Moves {
+		if move.FromNodeId != "node-b" || move.ToNodeId == "" || move.ToNodeId == "node-b" {
+			t.Fatalf("unexpected drain move %+v", move)
+		}
+	}
+	for _, vn := range resp.Plan.Assignments {
+		if vn.OwnerNodeId == "node-b" {
+			t.Fatalf("drain plan still assigns token %d to node-b", vn.Token)
+		}
+	}
+
+	migrator, err := NewMigrator(MigratorConfig{Segments: c.segments, Transport: c.transport, ReplicationFactor: 2})
+	if err != nil {
+		t.Fatalf("failed to create migrator: %v", err)
+	}
+	if err := migrator.ExecutePlan(ctx, resp.Plan); err != nil {
+		t.Fatalf("drain plan failed: %v", err)
+	}
+	records := c.records(t)
+	for _, id := range ids {
+		holders, _ := recordHolders(records[id])
+		if len(holders) != 2 {
+			t.Fatalf("segment %s lost a replica: %v", id, holders)
+		}
+		for _, node := range holders {
+			if node == "node-b" {
+				t.Fatalf("segment %s still recorded on node-b", id)
+			}
+			if _, err := c.nodes[node].Verify("segments", id); err != nil {
+				t.Fatalf("segment %s missing on %s: %v", id, node, err)
+			}
+		}
+		if _, err := c.nodes["node-b"].Stat("segments", id); !os.IsNotExist(err) {
+			t.Fatalf("segment %s not removed from node-b: %v", id, err)
+		}
+	}
+}
+
+// countingTransport counts copies to each node and fails them once a node's budget is
+// spent.
+type countingTransport struct {
+	*InProcessReplicationTransport
+	mu     sync.Mutex
+	copies map[string]int
+	budget map[string]int
+	delay  time.Duration
+}
+
+func (t *countingTransport) ReplicateSegment(ctx context.Context, nodeID string, header *storagepb.UploadSegmentHeader, body io.Reader) error {
+	t.mu.Lock()
+	if budget, ok := t.budget[nodeID]; ok && t.copies[nodeID] >= budget {
+		t.mu.Unlock()
+		return errors.New("node unavailable")
+	}
+	t.copies[nodeID]++
+	t.mu.Unlock()
+	time.Sleep(t.delay)
+	return t.InProcessReplicationTransport.ReplicateSegment(ctx, nodeID, header, body)
+}
+
+func TestMigratorResumesFromCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCluster(t, RingManagerConfig{VirtualNodes: 16}, "node-a", "node-b", "node-c")
+	ids := c.seed(t, 40, 2)
+	c.addNode(t, "node-d")
+	plan := mustPlan(t, c.ring, 2)
+	transport := &countingTransport{InProcessReplicationTransport: c.transport, copies: map[string]int{}, budget: map[string]int{"node-d": 3}}
+
+	first, err := NewMigrator(MigratorConfig{Segments: c.segments, Transport: transport, ReplicationFactor: 2, Etcd: c.etcd})
+	if err != nil {
+		t.Fatalf("failed to create migrator: %v", err)
+	}
+	if err := first.ExecutePlan(ctx, plan); err == nil {
+		t.Fatalf("expected plan to stop when node-d becomes unavailable")
+	}
+	cp, err := first.Checkpoint(ctx, plan.PlanId)
+	if err != nil || cp == nil {
+		t.Fatalf("expected checkpoint, got %v, %v", cp, err)
+	}
+	var copied int64
+	moved := 0
+	for _, move := range cp.Moves {
+		copied += move.BytesCopied
+		moved += move.SegmentsMoved
+	}
+	if cp.State != MigrationRunning || cp.LastError == "" || moved != 3 || copied == 0 {
+		t.Fatalf("unexpected checkpoint after failure: state=%s moved=%d copied=%d err=%q", cp.State, moved, copied, cp.LastError)
+	}
+
+	// A new process picks the plan up from etcd and finishes it without redoing copies.
+	delete(transport.budget, "node-d")
+	second, err := NewMigrator(MigratorConfig{Segments: c.segments, Transport: transport, ReplicationFactor: 2, Etcd: c.etcd})
+	if err != nil {
+		t.Fatalf("failed to create migrator: %v", err)
+	}
+	pending, err := second.PendingPlans(ctx)
+	if err != nil || len(pending) != 1 || pending[0].PlanId != plan.PlanId {
+		t.Fatalf("expected %s to be pending, got %v, %v", plan.PlanId, pending, err)
+	}
+	if err := second.ExecutePlan(ctx, pending[0]); err != nil {
+		t.Fatalf("resumed plan failed: %v", err)
+	}
+	gained := 0
+	for _, id := range ids {
+		for _, node := range c.ring.Lookup([]byte(id), 2) {
+			if node == "node-d" {
+				gained++
+			}
+		}
+	}
+	if transport.copies["node-d"] != gained {
+		t.Fatalf("expected %d copies to node-d across both runs, got %d", gained, transport.copies["node-d"])
+	}
+	if pending, _ := second.PendingPlans(ctx); len(pending) != 0 {
+		t.Fatalf("expected no pending plans, got %d", len(pending))
+	}
+	cp, _ = second.Checkpoint(ctx, plan.PlanId)
+	if cp.State != MigrationCompleted {
+		t.Fatalf("expected completed checkpoint, got %s", cp.State)
+	}
+}
+
+func TestRebalancerCompletesStartedPlansPastDeadline(t *testing.T) {
+	c := newTestCluster(t, RingManagerConfig{VirtualNodes: 16}, "node-a", "node-b", "node-c")
+	c.seed(t, 40, 2)
+	c.addNode(t, "node-d")
+	plan := mustPlan(t, c.ring, 2)
+	transport := &countingTransport{InProcessReplicationTransport: c.transport, copies: map[string]int{}, delay: 10 * time.Millisecond}
+	migrator, err := NewMigrator(MigratorConfig{Segments: c.segments, Transport: transport, ReplicationFactor: 2, Etcd: c.etcd})
+	if err != nil {
+		t.Fatalf("failed to create migrator: %v", err)
+	}
+	// A previous run started the plan and died before moving anything.
+	if err := migrator.StartPlan(context.Background(), plan); err != nil {
+		t.Fatalf("failed to start plan: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	rebalancer := &Rebalancer{Manager: c.ring, Executor: migrator, Deadline: 20 * time.Millisecond, ReplicationFactor: 2}
+	go func() { done <- rebalancer.Run(ctx) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cp, err := migrator.Checkpoint(context.Background(), plan.PlanId)
+		if err != nil {
+			t.Fatalf("failed to read checkpoint: %v", err)
+		}
+		if cp.State == MigrationCompleted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("plan did not complete, checkpoint %+v", cp)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if copies := transport.copies["node-d"]; copies < 3 {
+		t.Fatalf("expected the plan to outlast the deadline, only %d copies", copies)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("rebalancer failed: %v", err)
+	}
+}
+
+func TestRebalancerLeaderElection(t *testing.T) {
+	c := newTestCluster(t, RingManagerConfig{VirtualNodes: 16}, "node-a", "node-b")
+	var mu sync.Mutex
+	executed := map[string][]int64{}
+	record := func(id string) MigrationExecutor {
+		return MigrationFunc(func(_ context.Context, plan *storagepb.RebalancePlan) error {
+			mu.Lock()
+			defer mu.Unlock()
+			executed[id] = append(executed[id], plan.FencingToken)
+			return nil
+		})
+	}
+	total := func() (int, map[string][]int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		n, out := 0, map[string][]int64{}
+		for id, tokens := range executed {
+			n += len(tokens)
+			out[id] = append([]int64(nil), tokens...)
+		}
+		return n, out
+	}
+	waitFor := func(n int) map[string][]int64 {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			got, out := total()
+			if got >= n {
+				time.Sleep(20 * time.Millisecond)
+				if got, out = total(); got != n {
+					t.Fatalf("expected %d plan executions, got %v", n, out)
+				}
+				return out
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d plan executions, got %v", n, out)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	cancels := map[string]context.CancelFunc{}
+	done := make(chan error, 2)
+	for _, id := range []string{"admin-1", "admin-2"} {
+		session, err := concurrency.NewSession(c.etcd)
+		if err != nil {
+			t.Fatalf("failed to create session: %v", err)
+		}
+		defer session.Close()
+		manager, err := NewRingManager(RingManagerConfig{Etcd: c.etcd, VirtualNodes: 16})
+		if err != nil {
+			t.Fatalf("failed to create ring manager: %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancels[id] = cancel
+		defer cancel()
+		rebalancer := &Rebalancer{Manager: manager, Executor: record(id), ReplicationFactor: 2, Session: session, ID: id}
+		go func() { done <- rebalancer.Run(ctx) }()
+	}
+	var leader string
+	for deadline := time.Now().Add(5 * time.Second); leader == ""; {
+		resp, _ := c.etcd.Get(context.Background(), "/storage/cluster/rebalancer/", etcdsim.WithPrefix())
+		if len(resp.KVs) == 2 {
+			if resp.KVs[0].CreateRevision > resp.KVs[1].CreateRevision {
+				resp.KVs[0] = resp.KVs[1]
+			}
+			leader = resp.KVs[0].Value
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("rebalancers did not campaign")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Give the leader time to subscribe to ring changes.
+	time.Sleep(20 * time.Millisecond)
+
+	c.addNode(t, "node-c")
+	first := waitFor(1)
+	if len(first[leader]) != 1 || first[leader][0] <= 0 {
+		t.Fatalf("expected only %s to execute a fenced plan, got %v", leader, first)
+	}
+
+	// The leader steps down; the follower takes over with a higher fencing token.
+	cancels[leader]()
+	if err := <-done; err != nil {
+		t.Fatalf("rebalancer failed: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	c.addNode(t, "node-d")
+	second := waitFor(2)
+	for id, tokens := range second {
+		if id != leader && (len(tokens) != 1 || tokens[0] <= first[leader][0]) {
+			t.Fatalf("expected the new leader to execute with a higher token, got %v", second)
+		}
+	}
+}
+
+func TestMigratorResumesPlanUnderNewToken(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCluster(t, RingManagerConfig{VirtualNodes: 16}, "node-a", "node-b", "node-c")
+	ids := c.seed(t, 8, 2)
+	c.addNode(t, "node-d")
+	first, err := NewMigrator(MigratorConfig{Segments: c.segments, Transport: c.transport, ReplicationFactor: 2, Etcd: c.etcd})
+	if err != nil {
+		t.Fatalf("failed to create migrator: %v", err)
+	}
+	plan := mustPlan(t, c.ring, 2)
+	plan.FencingToken = 7
+	if err := first.StartPlan(ctx, plan); err != nil {
+		t.Fatalf("failed to start plan: %v", err)
+	}
+
+	// The leader that took over resumes the plan under its own term.
+	second, err := NewMigrator(MigratorConfig{Segments: c.segments, Transport: c.transport, ReplicationFactor: 2, Etcd: c.etcd})
+	if err != nil {
+		t.Fatalf("failed to create migrator: %v", err)
+	}
+	resumed := mustPlan(t, c.ring, 2)
+	resumed.FencingToken = 9
+	if err := second.StartPlan(ctx, resumed); err != nil {
+		t.Fatalf("failed to restart plan under a new token: %v", err)
+	}
+	if err := second.ExecutePlan(ctx, resumed); err != nil {
+		t.Fatalf("failed to resume plan under a new token: %v", err)
+	}
+	cp, err := second.Checkpoint(ctx, plan.PlanId)
+	if err != nil || cp.State != MigrationCompleted || cp.Plan.FencingToken != 9 {
+		t.Fatalf("expected a completed checkpoint under token 9, got %+v, %v", cp, err)
+	}
+	for _, id := range ids {
+		for _, node := range c.ring.Lookup([]byte(id), 2) {
+			if _, err := c.nodes[node].Stat("segments", id); err != nil {
+				t.Fatalf("%s missing from %s: %v", id, node, err)
+			}
+		}
+	}
+	// The old leader is fenced off.
+	if err := first.ExecutePlan(ctx, plan); !errors.Is(err, ErrStaleFencingToken) {
+		t.Fatalf("expected ErrStaleFencingToken, got %v", err)
+	}
+}
+
+func TestMigratorRejectsStaleFencingToken(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCluster(t, RingManagerConfig{VirtualNodes: 16}, "node-a", "node-b", "node-c")
+	c.seed(t, 8, 2)
+	c.addNode(t, "node-d")
+	migrator, err := NewMigrator(MigratorConfig{Segments: c.segments, Transport: c.transport, ReplicationFactor: 2, Etcd: c.etcd})
+	if err != nil {
+		t.Fatalf("failed to create migrator: %v", err)
+	}
+	plan := mustPlan(t, c.ring, 2)
+	plan.FencingToken = 7
+	if err := migrator.StartPlan(ctx, plan); err != nil {
+		t.Fatalf("failed to start plan: %v", err)
+	}
+	stale := mustPlan(t, c.ring, 2)
+	stale.FencingToken = 3
+	if err := migrator.ExecutePlan(ctx, stale); !errors.Is(err, ErrStaleFencingToken) {
+		t.Fatalf("expected ErrStaleFencingToken, got %v", err)
+	}
+	// The fence lives in etcd, so another process is held to it too.
+	other, err := NewMigrator(MigratorConfig{Segments: c.segments, Transport: c.transport, ReplicationFactor: 2, Etcd: c.etcd})
+	if err != nil {
+		t.Fatalf("failed to create migrator: %v", err)
+	}
+	if err := other.StartPlan(ctx, stale); !errors.Is(err, ErrStaleFencingToken) {
+		t.Fatalf("expected ErrStaleFencingToken, got %v", err)
+	}
+	if err := other.ExecutePlan(ctx, plan); err != nil {
+		t.Fatalf("plan with current token failed: %v", err)
+	}
+	// A rebalancer that passed the fence before it was raised still cannot record
+	// progress afterwards.
+	checkpoints := newCheckpointStore(c.etcd, "")
+	if err := checkpoints.put(ctx, &MigrationCheckpoint{Plan: stale, State: MigrationRunning}); !errors.Is(err, ErrStaleFencingToken) {
+		t.Fatalf("expected the stale checkpoint write to be fenced off, got %v", err)
+	}
+}
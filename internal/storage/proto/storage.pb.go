@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strconv"
 	"sync"
 )
 
@@ -12,6 +13,39 @@ import (
 // vendored in the repository so that the storage service can be implemented without
 // relying on an external code generator in the execution environment.
 
+// ConsistencyLevel mirrors storage.v1.ConsistencyLevel.
+type ConsistencyLevel int32
+
+const (
+	ConsistencyLevel_CONSISTENCY_LEVEL_UNSPECIFIED ConsistencyLevel = 0
+	ConsistencyLevel_CONSISTENCY_LEVEL_ONE         ConsistencyLevel = 1
+	ConsistencyLevel_CONSISTENCY_LEVEL_QUORUM      ConsistencyLevel = 2
+	ConsistencyLevel_CONSISTENCY_LEVEL_ALL         ConsistencyLevel = 3
+)
+
+// ConsistencyLevel_name maps enum values to their proto names.
+var ConsistencyLevel_name = map[int32]string{
+	0: "CONSISTENCY_LEVEL_UNSPECIFIED",
+	1: "CONSISTENCY_LEVEL_ONE",
+	2: "CONSISTENCY_LEVEL_QUORUM",
+	3: "CONSISTENCY_LEVEL_ALL",
+}
+
+// ConsistencyLevel_value maps proto names to enum values.
+var ConsistencyLevel_value = map[string]int32{
+	"CONSISTENCY_LEVEL_UNSPECIFIED": 0,
+	"CONSISTENCY_LEVEL_ONE":         1,
+	"CONSISTENCY_LEVEL_QUORUM":      2,
+	"CONSISTENCY_LEVEL_ALL":         3,
+}
+
+func (x ConsistencyLevel) String() string {
+	if name, ok := ConsistencyLevel_name[int32(x)]; ok {
+		return name
+	}
+	return strconv.Itoa(int(x))
+}
+
 // SegmentLocator describes the bucket/object pair used to address a DASH segment.
 type SegmentLocator struct {
 	Bucket string
@@ -25,9 +59,15 @@ type UploadSegmentHeader struct {
 	ContentType string
 	SizeBytes   int64
 	Checksum    string
-	Attributes  map[string]string
-	S3Bucket    string
-	S3Key       string
+	// Attributes["storage_class"] selects "replicated" or Reed-Solomon "ec:<k>+<m>"
+	// storage, overriding the bucket's class.
+	Attributes map[string]string
+	S3Bucket   string
+	S3Key      string
+	// HintedFor names the node that owns the segment when this copy is a hinted
+	// handoff written to a fallback node.
+	HintedFor   string
+	Consistency ConsistencyLevel
 }
 
 // ReplicaAck summarises the replication result for a single node.
@@ -35,6 +75,8 @@ type ReplicaAck struct {
 	NodeId       string
 	Success      bool
 	ErrorMessage string
+	// HintedFor is set when NodeId holds the copy on behalf of an unreachable owner.
+	HintedFor string
 }
 
 // UploadSegmentRequest represents either the metadata header or a data chunk.
@@ -115,19 +157,29 @@ type UploadSegmentResponse struct {
 	SizeCommitted int64
 	Checksum      string
 	ReplicaStatus []*ReplicaAck
+	// QuorumReplicas lists the nodes whose acknowledgements satisfied the write
+	// consistency level.
+	QuorumReplicas []string
 }
 
 // GetSegmentRequest requests a segment from the store.
 type GetSegmentRequest struct {
-	Locator *SegmentLocator
-	Offset  int64
-	Length  int64
+	Locator     *SegmentLocator
+	Offset      int64
+	Length      int64
+	Consistency ConsistencyLevel
+	// SegmentId locates the replica set on the ring; it is required for reads above
+	// CONSISTENCY_LEVEL_ONE.
+	SegmentId string
 }
 
 // GetSegmentResponse streams the requested data.
 type GetSegmentResponse struct {
 	Chunk []byte
 	Eof   bool
+	// QuorumReplicas lists the nodes that agreed on the segment's checksum. It is set on
+	// the first message only.
+	QuorumReplicas []string
 }
 
 // VirtualNode describes the mapping between a token and a physical node.
@@ -135,6 +187,8 @@ type VirtualNode struct {
 	Id          string
 	Token       uint64
 	OwnerNodeId string
+	Zone        string
+	Rack        string
 }
 
 // HeartbeatRequest contains node health information sent periodically.
@@ -145,6 +199,8 @@ type HeartbeatRequest struct {
 	AvailableBytes   int64
 	VirtualNodes     []*VirtualNode
 	SegmentsServing  int64
+	Zone             string
+	Rack             string
 }
 
 // HeartbeatResponse acknowledges a heartbeat and communicates cluster directives.
@@ -161,11 +217,26 @@ type RebalanceRequest struct {
 	Drain        bool
 }
 
+// TokenRangeMove hands the ring interval (StartToken, EndToken] from one node to another.
+type TokenRangeMove struct {
+	StartToken uint64
+	EndToken   uint64
+	FromNodeId string
+	ToNodeId   string
+}
+
 // RebalancePlan captures a re-assignment of virtual nodes.
 type RebalancePlan struct {
-	PlanId      string
-	RingVersion int64
-	Assignments []*VirtualNode
+	PlanId              string
+	RingVersion         int64
+	Assignments         []*VirtualNode
+	PreviousRingVersion int64
+	Moves               []*TokenRangeMove
+	// FencingToken identifies the leadership term that issued the plan; executors
+	// refuse plans carrying a lower token than one they have already seen.
+	FencingToken int64
+	// Placement names the chash algorithm that maps keys onto Assignments.
+	Placement string
 }
 
 // RebalanceResponse is returned after a node applies a plan.
@@ -173,12 +244,61 @@ type RebalanceResponse struct {
 	Plan *RebalancePlan
 }
 
+// MerkleTreeRequest asks for one level of the Merkle tree over the objects a node holds
+// in the ring interval (StartToken, EndToken]. The interval is split evenly into 2^Depth
+// leaves; level 0 is the root and level Depth the leaves.
+type MerkleTreeRequest struct {
+	StartToken uint64
+	EndToken   uint64
+	Depth      uint32
+	Level      uint32
+	// Indexes selects the tree nodes wanted at Level; empty means all of them.
+	Indexes []uint32
+	// IncludeEntries lists the segments under each requested leaf at the leaf level.
+	IncludeEntries bool
+}
+
+// MerkleEntry is one segment contributing to a leaf hash, placed on the ring by its id.
+type MerkleEntry struct {
+	Bucket    string
+	Object    string
+	Checksum  string
+	SegmentId string
+}
+
+// MerkleNode is one node of a Merkle tree level.
+type MerkleNode struct {
+	Index   uint32
+	Hash    []byte
+	Entries []*MerkleEntry
+}
+
+// MerkleTreeResponse carries the requested tree nodes.
+type MerkleTreeResponse struct {
+	Nodes []*MerkleNode
+}
+
+// StatSegmentRequest asks a node for the size and checksum of its copy of a segment,
+// which quorum reads compare without transferring the copies.
+type StatSegmentRequest struct {
+	Locator *SegmentLocator
+}
+
+// StatSegmentResponse describes a node's copy of a segment.
+type StatSegmentResponse struct {
+	SizeBytes int64
+	// Checksum is the hex sha256 of the copy, re-hashed when the node verifies reads.
+	Checksum string
+}
+
 // StorageServiceClient mirrors the generated client interface.
 type StorageServiceClient interface {
 	UploadSegment(ctx context.Context, opts ...CallOption) (StorageService_UploadSegmentClient, error)
 	GetSegment(ctx context.Context, in *GetSegmentRequest, opts ...CallOption) (StorageService_GetSegmentClient, error)
 	Heartbeat(ctx context.Context, in *HeartbeatRequest, opts ...CallOption) (*HeartbeatResponse, error)
 	Rebalance(ctx context.Context, in *RebalanceRequest, opts ...CallOption) (*RebalanceResponse, error)
+	MerkleTree(ctx context.Context, in *MerkleTreeRequest, opts ...CallOption) (*MerkleTreeResponse, error)
+	StatSegment(ctx context.Context, in *StatSegmentRequest, opts ...CallOption) (*StatSegmentResponse, error)
 }
 
 // CallOption mirrors grpc.CallOption but is intentionally empty so the storage
@@ -191,6 +311,8 @@ type StorageServiceServer interface {
 	GetSegment(*GetSegmentRequest, StorageService_GetSegmentServer) error
 	Heartbeat(context.Context, *HeartbeatRequest) (*HeartbeatResponse, error)
 	Rebalance(context.Context, *RebalanceRequest) (*RebalanceResponse, error)
+	MerkleTree(context.Context, *MerkleTreeRequest) (*MerkleTreeResponse, error)
+	StatSegment(context.Context, *StatSegmentRequest) (*StatSegmentResponse, error)
 }
 
 // StorageService_UploadSegmentClient represents the client stream used to upload segments.
@@ -238,6 +360,14 @@ func (UnimplementedStorageServiceServer) Rebalance(context.Context, *RebalanceRe
 	return nil, errors.New("storagepb: Rebalance not implemented")
 }
 
+func (UnimplementedStorageServiceServer) MerkleTree(context.Context, *MerkleTreeRequest) (*MerkleTreeResponse, error) {
+	return nil, errors.New("storagepb: MerkleTree not implemented")
+}
+
+func (UnimplementedStorageServiceServer) StatSegment(context.Context, *StatSegmentRequest) (*StatSegmentResponse, error) {
+	return nil, errors.New("storagepb: StatSegment not implemented")
+}
+
 // Below lies a very small in-process transport used primarily in tests. It avoids
 // pulling in the full gRPC dependency while still letting the service be exercised.
 
@@ -0,0 +1,243 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+
+	grpc "tritontube/internal/metadata/grpcstub"
+	storagepb "tritontube/internal/storage/proto"
+)
+
+// quorumSize returns how many of n replicas level requires. Unknown levels require all.
+func quorumSize(level storagepb.ConsistencyLevel, n int) int {
+	switch level {
+	case storagepb.ConsistencyLevel_CONSISTENCY_LEVEL_ONE:
+		return 1
+	case storagepb.ConsistencyLevel_CONSISTENCY_LEVEL_QUORUM:
+		return n/2 + 1
+	default:
+		return n
+	}
+}
+
+// levelOr returns level, or fallback when level is unspecified.
+func levelOr(level, fallback storagepb.ConsistencyLevel) storagepb.ConsistencyLevel {
+	if level == storagepb.ConsistencyLevel_CONSISTENCY_LEVEL_UNSPECIFIED {
+		return fallback
+	}
+	return level
+}
+
+// replicaResult is the outcome of copying an upload to one node or to S3.
+type replicaResult struct {
+	id  string
+	err error
+}
+
+// pendingUpload collects the replica results of an upload as they arrive. It is owned
+// by one goroutine at a time: the RPC until it responds, then whoever settles it.
+type pendingUpload struct {
+	header   *storagepb.UploadSegmentHeader
+	size     int64
+	checksum string
+	targets  []string
+	required int
+
+	done    chan replicaResult
+	pending int
+	results map[string]error
+	// acked lists the ring targets that hold the segment, local node first, then in the
+	// order their acknowledgements arrived.
+	acked []string
+}
+
+// wait records the next replica result.
+func (u *pendingUpload) wait() {
+	r := <-u.done
+	u.pending--
+	u.results[r.id] = r.err
+	if r.err != nil {
+		return
+	}
+	for _, nodeID := range u.targets {
+		if nodeID == r.id {
+			u.acked = append(u.acked, r.id)
+			return
+		}
+	}
+}
+
+// quorate reports whether enough replicas acknowledged the write.
+func (u *pendingUpload) quorate() bool {
+	return len(u.acked) >= u.required
+}
+
+// acks reports the results received so far, skipping the local node.
+func (u *pendingUpload) acks(local string) []*storagepb.ReplicaAck {
+	var out []*storagepb.ReplicaAck
+	for nodeID, err := range u.results {
+		if nodeID == local {
+			continue
+		}
+		ack := &storagepb.ReplicaAck{NodeId: nodeID, Success: err == nil}
+		if err != nil {
+			ack.ErrorMessage = err.Error()
+		}
+		out = append(out, ack)
+	}
+	return out
+}
+
+func (u *pendingUpload) quorumError() error {
+	return grpc.Errorf(grpc.Unavailable, "storage: write quorum not met for %s: %d of %d replicas acknowledged", u.header.SegmentId, len(u.acked), u.required)
+}
+
+// discardUpload deletes the copies of an upload that missed its quorum from the local
+// node, the ring targets that acknowledged it and the fallbacks that took a hinted copy,
+// so that a failed upload does not leave unrecorded copies for anti-entropy or hint
+// replay to spread. An upload that replaced a recorded segment is left alone, since its
+// copies are the segment's.
+func (s *Service) discardUpload(ctx context.Context, u *pendingUpload, fallbacks map[string]string) {
+	locator := u.header.Locator
+	if reader, ok := s.metadata.(SegmentReader); ok {
+		if _, err := reader.Segment(ctx, u.header.SegmentId); !errors.Is(err, ErrSegmentNotFound) {
+			return
+		}
+	}
+	// The hints go first, so that a replay never looks for a copy that is already gone.
+	for owner, holder := range fallbacks {
+		hint := Hint{SegmentID: u.header.SegmentId, Locator: *locator, Owner: owner, Holder: holder}
+		if err := s.hints.DeleteHint(ctx, hint); err != nil {
+			log.Printf("storage: failed to discard the hint for %s on %s after a missed quorum: %v", u.header.SegmentId, owner, err)
+		}
+	}
+	for _, nodeID := range u.acked {
+		var err error
+		if nodeID == s.nodeID {
+			err = s.fs.Delete(locator.Bucket, locator.Object)
+		} else {
+			err = s.transport.DeleteSegment(ctx, nodeID, locator)
+		}
+		if err != nil {
+			log.Printf("storage: failed to discard %s from %s after a missed quorum: %v", u.header.SegmentId, nodeID, err)
+		}
+	}
+}
+
+// checksumVote is one replica's answer to a quorum read.
+type checksumVote struct {
+	node     string
+	checksum string
+	size     int64
+	err      error
+}
+
+// readQuorum asks the segment's replica set for its checksum in parallel and returns as
+// soon as level is satisfied by replicas that agree, together with the checksum and size
+// they agree on. Every replica answers from its recorded checksum, re-hashed if it
+// verifies reads; peers are asked through the transport's StatSegment.
+func (s *Service) readQuorum(ctx context.Context, req *storagepb.GetSegmentRequest, level storagepb.ConsistencyLevel) ([]string, string, int64, error) {
+	if req.SegmentId == "" {
+		return nil, "", 0, grpc.Errorf(grpc.InvalidArgument, "storage: segment id is required for %v reads", level)
+	}
+	targets := s.ring.Lookup([]byte(req.SegmentId), s.replicationFactor)
+	if len(targets) == 0 {
+		targets = []string{s.nodeID}
+	}
+	required := quorumSize(level, len(targets))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	votes := make(chan checksumVote, len(targets))
+	for _, nodeID := range targets {
+		go func(nodeID string) {
+			vote := checksumVote{node: nodeID}
+			if nodeID == s.nodeID {
+				vote.checksum, vote.size, vote.err = s.localChecksum(req.Locator)
+			} else {
+				var stat *storagepb.StatSegmentResponse
+				if stat, vote.err = s.transport.StatSegment(ctx, nodeID, req.Locator); vote.err == nil {
+					vote.checksum, vote.size = stat.Checksum, stat.SizeBytes
+				}
+			}
+			votes <- vote
+		}(nodeID)
+	}
+
+	agree := map[string][]string{}
+	var lastErr error
+	best := 0
+	for range targets {
+		vote := <-votes
+		if vote.err != nil {
+			lastErr = vote.err
+			continue
+		}
+		key := fmt.Sprintf("%s/%d", vote.checksum, vote.size)
+		agree[key] = append(agree[key], vote.node)
+		if n := len(agree[key]); n > best {
+			best = n
+		}
+		if len(agree[key]) >= required {
+			return agree[key], vote.checksum, vote.size, nil
+		}
+	}
+	if best == 0 && lastErr != nil {
+		return nil, "", 0, grpc.Errorf(grpc.Unavailable, "storage: read quorum not met for %s: %v", req.SegmentId, lastErr)
+	}
+	return nil, "", 0, grpc.Errorf(grpc.Unavailable, "storage: read quorum not met for %s: %d of %d replicas agree", req.SegmentId, best, required)
+}
+
+func (s *Service) localChecksum(locator *storagepb.SegmentLocator) (string, int64, error) {
+	var info ObjectInfo
+	var err error
+	if s.verifyOnRead {
+		info, err = s.fs.Verify(locator.Bucket, locator.Object)
+	} else {
+		info, err = s.fs.Stat(locator.Bucket, locator.Object)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return info.SHA256, info.Size, nil
+}
+
+// StatSegment reports the size and checksum of this node's copy of a segment, for peers
+// serving quorum reads.
+func (s *Service) StatSegment(ctx context.Context, req *storagepb.StatSegmentRequest) (*storagepb.StatSegmentResponse, error) {
+	if req == nil || req.Locator == nil {
+		return nil, grpc.Errorf(grpc.InvalidArgument, "storage: locator is required")
+	}
+	checksum, size, err := s.localChecksum(req.Locator)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, grpc.Errorf(grpc.NotFound, "storage: segment %s/%s not found", req.Locator.Bucket, req.Locator.Object)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &storagepb.StatSegmentResponse{SizeBytes: size, Checksum: checksum}, nil
+}
+
+// getFromPeer serves a quorum read from a peer in the quorum when the local copy is not
+// part of it.
+func (s *Service) getFromPeer(req *storagepb.GetSegmentRequest, stream storagepb.StorageService_GetSegmentServer, nodeID string, size int64, quorum []string) error {
+	if req.Offset > size {
+		return grpc.Errorf(grpc.OutOfRange, "storage: offset %d beyond segment size %d", req.Offset, size)
+	}
+	body, err := s.transport.FetchSegment(stream.Context(), nodeID, req.Locator)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return grpc.Errorf(grpc.NotFound, "storage: segment %s/%s not found", req.Locator.Bucket, req.Locator.Object)
+		}
+		return grpc.Errorf(grpc.Unavailable, "storage: failed to read segment from %s: %v", nodeID, err)
+	}
+	defer body.Close()
+	if _, err := io.CopyN(io.Discard, body, req.Offset); err != nil {
+		return grpc.Errorf(grpc.DataLoss, "storage: segment truncated while reading: %v", err)
+	}
+	return sendRange(stream, req, body, size, quorum)
+}
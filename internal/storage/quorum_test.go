@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	grpc "tritontube/internal/metadata/grpcstub"
+	storagepb "tritontube/internal/storage/proto"
+)
+
+func TestConsistencyLevels(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCluster(t, RingManagerConfig{}, "node-a", "node-b", "node-c")
+	release := make(chan struct{})
+	c.transport.Register("node-b", func(ctx context.Context, header *storagepb.UploadSegmentHeader, body io.Reader) error {
+		<-release
+		return ReceiveIntoFS(c.nodes["node-b"])(ctx, header, body)
+	})
+	svc := c.service(t, "node-a", ServiceConfig{ReplicationFactor: 3})
+
+	// QUORUM returns once node-a and node-c hold the segment, while node-b still blocks.
+	locator := &storagepb.SegmentLocator{Bucket: "videos", Object: "v1/720p/1"}
+	header := &storagepb.UploadSegmentHeader{SegmentId: "v1/720p/1", Locator: locator, Consistency: storagepb.ConsistencyLevel_CONSISTENCY_LEVEL_QUORUM}
+	stream := newUploadStream(header, "segment")
+	if err := svc.UploadSegment(stream); err != nil {
+		t.Fatalf("quorum upload failed: %v", err)
+	}
+	if got := strings.Join(stream.resp.QuorumReplicas, ","); got != "node-a,node-c" {
+		t.Fatalf("expected quorum node-a,node-c, got %s", got)
+	}
+	if _, err := c.segments.Segment(ctx, "v1/720p/1"); !errors.Is(err, ErrSegmentNotFound) {
+		t.Fatalf("record must wait for the remaining replica, got %v", err)
+	}
+	close(release)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		record, err := c.segments.Segment(ctx, "v1/720p/1")
+		if err == nil {
+			sort.Strings(record.Replicas)
+			if got := strings.Join(record.Replicas, ","); got != "node-b,node-c" {
+				t.Fatalf("expected record replicas node-b,node-c, got %s", got)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("record not written after the remaining replica settled: %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// ALL fails when a replica rejects the copy, and nothing is recorded.
+	c.transport.Register("node-b", func(ctx context.Context, header *storagepb.UploadSegmentHeader, body io.Reader) error {
+		return errors.New("disk full")
+	})
+	other := &storagepb.SegmentLocator{Bucket: "videos", Object: "v1/720p/2"}
+	header = &storagepb.UploadSegmentHeader{SegmentId: "v1/720p/2", Locator: other, Consistency: storagepb.ConsistencyLevel_CONSISTENCY_LEVEL_ALL}
+	if err := svc.UploadSegment(newUploadStream(header, "segment")); grpc.CodeOf(err) != grpc.Unavailable {
+		t.Fatalf("expected Unavailable when ALL cannot be met, got %v", err)
+	}
+	if _, err := c.segments.Segment(ctx, "v1/720p/2"); !errors.Is(err, ErrSegmentNotFound) {
+		t.Fatalf("failed upload must not be recorded, got %v", err)
+	}
+	for _, id := range []string{"node-a", "node-c"} {
+		if _, err := c.nodes[id].Stat("videos", "v1/720p/2"); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("failed upload must not leave a copy on %s, got %v", id, err)
+		}
+	}
+
+	// A quorum read is served by agreeing peers even when the local copy is gone. Peers
+	// are compared by checksum, so only the copy that is served is transferred.
+	if err := svc.fs.Delete("videos", "v1/720p/1"); err != nil {
+		t.Fatalf("failed to delete local copy: %v", err)
+	}
+	var fetches int32
+	for _, id := range []string{"node-b", "node-c"} {
+		fetch := FetchFromFS(c.nodes[id])
+		c.transport.RegisterFetch(id, func(ctx context.Context, locator *storagepb.SegmentLocator) (io.ReadCloser, error) {
+			atomic.AddInt32(&fetches, 1)
+			return fetch(ctx, locator)
+		})
+	}
+	read := &getSegmentStream{ctx: ctx}
+	req := &storagepb.GetSegmentRequest{Locator: locator, SegmentId: "v1/720p/1", Consistency: storagepb.ConsistencyLevel_CONSISTENCY_LEVEL_QUORUM}
+	if err := svc.GetSegment(req, read); err != nil {
+		t.Fatalf("quorum read failed: %v", err)
+	}
+	if data, eof := read.result(); string(data) != "segment" || !eof {
+		t.Fatalf("unexpected quorum read %q eof=%v", data, eof)
+	}
+	quorum := append([]string(nil), read.msgs[0].QuorumReplicas...)
+	sort.Strings(quorum)
+	if got := strings.Join(quorum, ","); got != "node-b,node-c" {
+		t.Fatalf("expected read quorum node-b,node-c, got %s", got)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Fatalf("expected a single copy to be fetched, got %d", n)
+	}
+	req.Consistency = storagepb.ConsistencyLevel_CONSISTENCY_LEVEL_ALL
+	if err := svc.GetSegment(req, &getSegmentStream{ctx: ctx}); grpc.CodeOf(err) != grpc.Unavailable {
+		t.Fatalf("expected Unavailable when ALL cannot agree, got %v", err)
+	}
+}
@@ -2,9 +2,14 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"sort"
+	"sync"
 	"time"
 
+	"tritontube/internal/metadata/etcdsim/concurrency"
 	storagepb "tritontube/internal/storage/proto"
 )
 
@@ -24,16 +29,218 @@ func (f MigrationFunc) ExecutePlan(ctx context.Context, plan *storagepb.Rebalanc
 	return f(ctx, plan)
 }
 
+// NewRebalancePlan builds the plan that takes the ring from the previous snapshot to the
+// next one. Assignments lists every token of the next ring; Moves lists only the token
+// ranges whose replicas change, each handing one replica from one node to another.
+func NewRebalancePlan(planID string, previous, next RingSnapshot, replicas int) (*storagepb.RebalancePlan, error) {
+	moves, err := planMoves(previous, next, replicas)
+	if err != nil {
+		return nil, err
+	}
+	plan := &storagepb.RebalancePlan{
+		PlanId:              planID,
+		RingVersion:         next.Version,
+		PreviousRingVersion: previous.Version,
+		Moves:               moves,
+		Placement:           string(next.Placement),
+	}
+	for _, assignment := range next.Assignments {
+		plan.Assignments = append(plan.Assignments, &storagepb.VirtualNode{
+			Id:          assignment.ID,
+			Token:       assignment.Token,
+			OwnerNodeId: assignment.NodeID,
+			Zone:        assignment.Zone,
+			Rack:        assignment.Rack,
+		})
+	}
+	return plan, nil
+}
+
+// planMoves diffs two assignment sets into per-range moves. Within a changed range every
+// node that loses a replica is paired with one that gains it; unpaired gains have no
+// FromNodeId and unpaired losses have no ToNodeId. Adjacent ranges with the same move are
+// merged. Placements whose replica sets do not follow token ranges get node moves.
+func planMoves(previous, next RingSnapshot, replicas int) ([]*storagepb.TokenRangeMove, error) {
+	if len(previous.Assignments) == 0 || len(next.Assignments) == 0 {
+		return nil, nil
+	}
+	if !previous.Placement.RangeStable() || !next.Placement.RangeStable() {
+		return nodeMoves(previous, next), nil
+	}
+	prevRing, err := placementFor(previous)
+	if err != nil {
+		return nil, err
+	}
+	nextRing, err := placementFor(next)
+	if err != nil {
+		return nil, err
+	}
+	var moves []*storagepb.TokenRangeMove
+	for _, r := range changedRanges(prevRing, nextRing, boundaries(previous.Assignments, next.Assignments), replicas) {
+		from, to := prevRing.LookupHash(r.End, replicas), nextRing.LookupHash(r.End, replicas)
+		lost, gained := subtract(from, to), subtract(to, from)
+		for i := 0; i < len(lost) || i < len(gained); i++ {
+			move := &storagepb.TokenRangeMove{StartToken: r.Start, EndToken: r.End}
+			if i < len(lost) {
+				move.FromNodeId = lost[i]
+			}
+			if i < len(gained) {
+				move.ToNodeId = gained[i]
+			}
+			if n := len(moves); n > 0 {
+				last := moves[n-1]
+				if last.EndToken == move.StartToken && last.FromNodeId == move.FromNodeId && last.ToNodeId == move.ToNodeId {
+					last.EndToken = move.EndToken
+					continue
+				}
+			}
+			moves = append(moves, move)
+		}
+	}
+	return moves, nil
+}
+
+// nodeMoves plans a change for a placement such as rendezvous hashing, where a node's
+// keys are scattered rather than held in token ranges. Every move spans the whole ring
+// and names a node that may give data to another: each node that gained tokens may take
+// keys from every previous node, and each node that lost tokens may give keys to every
+// next node. Other changes, such as a new algorithm or new failure domains, may move
+// keys between any two nodes. The migrator reconciles segments against the new
+// placement, so over-approximating the pairs only costs extra scans.
+func nodeMoves(previous, next RingSnapshot) []*storagepb.TokenRangeMove {
+	before, after := tokenCounts(previous.Assignments), tokenCounts(next.Assignments)
+	var gained, lost []string
+	for node, n := range after {
+		if n > before[node] {
+			gained = append(gained, node)
+		}
+	}
+	for node, n := range before {
+		if n > after[node] {
+			lost = append(lost, node)
+		}
+	}
+	if previous.Placement != next.Placement || (len(gained) == 0 && len(lost) == 0 && !sameAssignments(previous.Assignments, next.Assignments)) {
+		gained, lost = sortedKeys(after), sortedKeys(before)
+	}
+	sort.Strings(gained)
+	sort.Strings(lost)
+
+	seen := map[[2]string]bool{}
+	var moves []*storagepb.TokenRangeMove
+	add := func(from, to string) {
+		if from == to || seen[[2]string{from, to}] {
+			return
+		}
+		seen[[2]string{from, to}] = true
+		moves = append(moves, &storagepb.TokenRangeMove{FromNodeId: from, ToNodeId: to})
+	}
+	for _, to := range gained {
+		for _, from := range sortedKeys(before) {
+			add(from, to)
+		}
+	}
+	for _, from := range lost {
+		for _, to := range sortedKeys(after) {
+			add(from, to)
+		}
+	}
+	return moves
+}
+
+func tokenCounts(assignments []VirtualNodeAssignment) map[string]int {
+	out := map[string]int{}
+	for _, a := range assignments {
+		out[a.NodeID]++
+	}
+	return out
+}
+
+func sortedKeys(m map[string]int) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// subtract returns the elements of a missing from b, preserving order.
+func subtract(a, b []string) []string {
+	var out []string
+	for _, x := range a {
+		found := false
+		for _, y := range b {
+			if x == y {
+				found = true
+				break
+			}
+		}
+		if !found {
+			out = append(out, x)
+		}
+	}
+	return out
+}
+
+// Plan returns the incremental plan for the most recent change to the ring's tokens.
+func (m *RingManager) Plan(replicas int) (*storagepb.RebalancePlan, error) {
+	previous := m.PreviousSnapshot()
+	return NewRebalancePlan(rebalancePlanID(previous.Version), previous, m.Snapshot(), replicas)
+}
+
+// DrainPlan returns a plan that moves every replica held by nodeID onto the nodes that
+// would own it if nodeID left the ring. The ring itself is not changed, so the node keeps
+// serving reads until it is removed.
+func (m *RingManager) DrainPlan(nodeID string, replicas int) (*storagepb.RebalancePlan, error) {
+	assignments, err := m.AssignmentsWithout(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	current := m.Snapshot()
+	next := RingSnapshot{Version: current.Version, Assignments: assignments, Placement: current.Placement}
+	return NewRebalancePlan(fmt.Sprintf("drain-%s-%d", nodeID, current.Version), current, next, replicas)
+}
+
+// ResumableExecutor is a MigrationExecutor whose progress survives restarts. The
+// Rebalancer only waits for StartPlan and completes the plan in the background.
+type ResumableExecutor interface {
+	MigrationExecutor
+	// StartPlan durably records the plan so it can be carried out later, possibly by
+	// another process.
+	StartPlan(ctx context.Context, plan *storagepb.RebalancePlan) error
+	// PendingPlans returns the plans that were started but not completed, oldest first.
+	PendingPlans(ctx context.Context) ([]*storagepb.RebalancePlan, error)
+}
+
 // Rebalancer watches ring changes and triggers data migrations.
 type Rebalancer struct {
 	Manager  *RingManager
 	Executor MigrationExecutor
 	Deadline time.Duration
+	// ReplicationFactor is the number of replicas per token range (default 3).
+	ReplicationFactor int
+	// RetryInterval is the pause before a failed plan is resumed (default 30 seconds).
+	RetryInterval time.Duration
+	// Session, when set, makes Run campaign for leadership under ElectionPrefix (default
+	// "<ring prefix>/rebalancer") and only start or execute plans while it leads, so that
+	// one of several rebalancers coordinates the cluster. Plans then carry the election's
+	// revision as their FencingToken.
+	Session        *concurrency.Session
+	ElectionPrefix string
+	// ID is the value this rebalancer campaigns with (default "rebalancer").
+	ID string
 }
 
 // Run blocks until the context is cancelled, applying rebalance plans as changes are
-// observed in etcd. The executor is invoked with a context that is automatically
-// bounded by Deadline (default 5 seconds) to ensure migrations start promptly.
+// observed in etcd. Every plan must start within Deadline (default 5 seconds). A
+// ResumableExecutor is then left to complete it without a deadline: plans run one at a
+// time in the background, failed plans are retried every RetryInterval, and plans left
+// unfinished by a previous run are resumed first. Other executors must finish within
+// Deadline.
+//
+// With a Session, Run first waits to be elected and stops applying plans as soon as its
+// leadership key disappears, then campaigns again. It returns once the session expires.
 func (r *Rebalancer) Run(ctx context.Context) error {
 	if r == nil || r.Manager == nil {
 		return fmt.Errorf("storage: rebalancer requires a ring manager")
@@ -41,16 +248,149 @@ func (r *Rebalancer) Run(ctx context.Context) error {
 	if r.Executor == nil {
 		r.Executor = MigrationFunc(func(context.Context, *storagepb.RebalancePlan) error { return nil })
 	}
+	if r.Session == nil {
+		return r.lead(ctx, 0)
+	}
+	prefix := r.ElectionPrefix
+	if prefix == "" {
+		prefix = r.Manager.prefix + "/rebalancer"
+	}
+	id := r.ID
+	if id == "" {
+		id = "rebalancer"
+	}
+	election := concurrency.NewElection(r.Session, prefix)
+	for {
+		if err := election.Campaign(ctx, id); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("storage: rebalancer %s campaign: %w", id, err)
+		}
+		token := election.Rev()
+		log.Printf("storage: rebalancer %s elected with fencing token %d", id, token)
+		leaderCtx, cancel := context.WithCancel(ctx)
+		go func() {
+			defer cancel()
+			holdLeadership(leaderCtx, r.Session, election.Key(), token)
+		}()
+		err := r.lead(leaderCtx, token)
+		cancel()
+		if ctx.Err() != nil {
+			resignCtx, cancelResign := context.WithTimeout(context.Background(), 5*time.Second)
+			_ = election.Resign(resignCtx)
+			cancelResign()
+			return nil
+		}
+		if err != nil && !errors.Is(err, ErrStaleFencingToken) {
+			_ = election.Resign(ctx)
+			return err
+		}
+		log.Printf("storage: rebalancer %s lost leadership (fencing token %d)", id, token)
+	}
+}
+
+// holdLeadership blocks until ctx is cancelled, the session ends, or the leader key
+// created at rev is deleted, for example because the session's lease expired.
+func holdLeadership(ctx context.Context, session *concurrency.Session, key string, rev int64) {
+	client := session.Client()
+	events := client.Watch(ctx, key)
+	for {
+		resp, err := client.Get(ctx, key)
+		if err == nil && (len(resp.KVs) == 0 || resp.KVs[0].CreateRevision != rev) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-session.Done():
+			return
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		}
+	}
+}
+
+// lead applies plans until ctx is cancelled, stamping each with fencingToken.
+func (r *Rebalancer) lead(ctx context.Context, fencingToken int64) error {
 	deadline := r.Deadline
 	if deadline <= 0 {
 		deadline = 5 * time.Second
 	}
+	replicas := r.ReplicationFactor
+	if replicas <= 0 {
+		replicas = 3
+	}
+
+	// The worker is cancelled before Run waits for it to return.
+	var worker sync.WaitGroup
+	defer worker.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resumable, _ := r.Executor.(ResumableExecutor)
+	var queue *planQueue
+	if resumable != nil {
+		pending, err := resumable.PendingPlans(ctx)
+		if err != nil {
+			return err
+		}
+		queue = newPlanQueue()
+		for _, plan := range pending {
+			plan.FencingToken = fencingToken
+			queue.push(plan)
+		}
+		worker.Add(1)
+		go func() {
+			defer worker.Done()
+			r.complete(ctx, resumable, queue)
+		}()
+	}
 
 	events, err := r.Manager.Watch(ctx)
 	if err != nil {
 		return err
 	}
 
+	apply := func(plan *storagepb.RebalancePlan) error {
+		plan.FencingToken = fencingToken
+		startCtx, cancelStart := context.WithTimeout(ctx, deadline)
+		defer cancelStart()
+		var err error
+		if resumable != nil {
+			err = resumable.StartPlan(startCtx, plan)
+		} else {
+			err = r.Executor.ExecutePlan(startCtx, plan)
+		}
+		if err != nil {
+			return fmt.Errorf("storage: plan %s: %w", plan.PlanId, err)
+		}
+		if queue != nil {
+			queue.push(plan)
+		}
+		return nil
+	}
+
+	// Heartbeats rewrite the ring without moving tokens; only a new PreviousVersion
+	// means there is data to move.
+	lastPrevious := int64(-1)
+	if fencingToken > 0 && resumable != nil {
+		// A newly elected leader also starts the plan for the ring's last change, which
+		// the previous leader may have died before starting. Starting a plan twice is
+		// harmless because its checkpoint already exists.
+		if previous := r.Manager.PreviousSnapshot(); len(previous.Assignments) > 0 {
+			plan, err := NewRebalancePlan(rebalancePlanID(previous.Version), previous, r.Manager.Snapshot(), replicas)
+			if err != nil {
+				return err
+			}
+			if err := apply(plan); err != nil {
+				return err
+			}
+			lastPrevious = previous.Version
+		}
+	}
 	for {
 		select {
 		case <-ctx.Done():
@@ -59,23 +399,102 @@ func (r *Rebalancer) Run(ctx context.Context) error {
 			if !ok {
 				return nil
 			}
-			plan := &storagepb.RebalancePlan{
-				PlanId:      fmt.Sprintf("rebalance-%d", evt.Version),
-				RingVersion: evt.Version,
-			}
-			for _, assignment := range evt.Assignments {
-				plan.Assignments = append(plan.Assignments, &storagepb.VirtualNode{
-					Id:          assignment.ID,
-					Token:       assignment.Token,
-					OwnerNodeId: assignment.NodeID,
-				})
+			if evt.PreviousVersion == lastPrevious {
+				continue
 			}
-			execCtx, cancel := context.WithTimeout(ctx, deadline)
-			err := r.Executor.ExecutePlan(execCtx, plan)
-			cancel()
+			previous, next := evt.Snapshots()
+			plan, err := NewRebalancePlan(rebalancePlanID(evt.PreviousVersion), previous, next, replicas)
 			if err != nil {
 				return err
 			}
+			if err := apply(plan); err != nil {
+				return err
+			}
+			lastPrevious = evt.PreviousVersion
+		}
+	}
+}
+
+// complete executes queued plans in order until ctx is cancelled.
+func (r *Rebalancer) complete(ctx context.Context, executor ResumableExecutor, queue *planQueue) {
+	retry := r.RetryInterval
+	if retry <= 0 {
+		retry = 30 * time.Second
+	}
+	for {
+		plan, ok := queue.pop(ctx)
+		if !ok {
+			return
+		}
+		for {
+			err := executor.ExecutePlan(ctx, plan)
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if errors.Is(err, ErrStaleFencingToken) {
+				log.Printf("storage: migration %s abandoned: %v", plan.PlanId, err)
+				break
+			}
+			log.Printf("storage: migration %s failed, retrying in %s: %v", plan.PlanId, retry, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retry):
+			}
+		}
+	}
+}
+
+// rebalancePlanID names the plan for the token change made after previousVersion. It
+// stays the same across heartbeats so a restarted Rebalancer finds the plan's checkpoint.
+func rebalancePlanID(previousVersion int64) string {
+	return fmt.Sprintf("rebalance-from-%d", previousVersion)
+}
+
+// planQueue is an unbounded FIFO of plans that ignores plans already queued.
+type planQueue struct {
+	mu     sync.Mutex
+	plans  []*storagepb.RebalancePlan
+	queued map[string]bool
+	signal chan struct{}
+}
+
+func newPlanQueue() *planQueue {
+	return &planQueue{queued: map[string]bool{}, signal: make(chan struct{}, 1)}
+}
+
+func (q *planQueue) push(plan *storagepb.RebalancePlan) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.queued[plan.PlanId] {
+		return
+	}
+	q.queued[plan.PlanId] = true
+	q.plans = append(q.plans, plan)
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (q *planQueue) pop(ctx context.Context) (*storagepb.RebalancePlan, bool) {
+	for {
+		q.mu.Lock()
+		if len(q.plans) > 0 {
+			plan := q.plans[0]
+			q.plans = q.plans[1:]
+			delete(q.queued, plan.PlanId)
+			q.mu.Unlock()
+			return plan, true
+		}
+		q.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case <-q.signal:
 		}
 	}
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"sync"
 
 	storagepb "tritontube/internal/storage/proto"
@@ -11,35 +12,99 @@ import (
 
 // ReplicationTransport abstracts the streaming RPC used to replicate a segment to
 // another node. It enables the service to be tested without requiring a full gRPC stack.
+// The body is read from the committed local copy and is closed by the caller.
 type ReplicationTransport interface {
-	ReplicateSegment(ctx context.Context, nodeID string, header *storagepb.UploadSegmentHeader, payload []byte) error
+	ReplicateSegment(ctx context.Context, nodeID string, header *storagepb.UploadSegmentHeader, body io.Reader) error
+	// FetchSegment reads a segment back from another node, e.g. to repair a local copy.
+	FetchSegment(ctx context.Context, nodeID string, locator *storagepb.SegmentLocator) (io.ReadCloser, error)
+	// DeleteSegment removes a node's copy, e.g. once a migration has moved it elsewhere.
+	DeleteSegment(ctx context.Context, nodeID string, locator *storagepb.SegmentLocator) error
+	// StatSegment returns the size and checksum of a node's copy without transferring it.
+	StatSegment(ctx context.Context, nodeID string, locator *storagepb.SegmentLocator) (*storagepb.StatSegmentResponse, error)
 }
 
+// MerkleTransport is implemented by transports that can ask a peer for its Merkle trees,
+// which anti-entropy compares to find the ranges two replicas disagree on.
+type MerkleTransport interface {
+	MerkleTree(ctx context.Context, nodeID string, req *storagepb.MerkleTreeRequest) (*storagepb.MerkleTreeResponse, error)
+}
+
+// ErrFetchUnsupported is returned by transports that cannot read from peers.
+var ErrFetchUnsupported = errors.New("storage: transport does not support fetching segments")
+
 // NoopReplicationTransport is a drop-in transport used in tests or single node setups.
 type NoopReplicationTransport struct{}
 
 // ReplicateSegment implements the ReplicationTransport interface.
-func (NoopReplicationTransport) ReplicateSegment(ctx context.Context, nodeID string, header *storagepb.UploadSegmentHeader, payload []byte) error {
+func (NoopReplicationTransport) ReplicateSegment(ctx context.Context, nodeID string, header *storagepb.UploadSegmentHeader, body io.Reader) error {
 	_ = ctx
 	_ = nodeID
 	_ = header
-	_ = payload
+	if body != nil {
+		_, _ = io.Copy(io.Discard, body)
+	}
+	return nil
+}
+
+// FetchSegment implements the ReplicationTransport interface.
+func (NoopReplicationTransport) FetchSegment(ctx context.Context, nodeID string, locator *storagepb.SegmentLocator) (io.ReadCloser, error) {
+	return nil, ErrFetchUnsupported
+}
+
+// DeleteSegment implements the ReplicationTransport interface.
+func (NoopReplicationTransport) DeleteSegment(ctx context.Context, nodeID string, locator *storagepb.SegmentLocator) error {
 	return nil
 }
 
+// StatSegment implements the ReplicationTransport interface.
+func (NoopReplicationTransport) StatSegment(ctx context.Context, nodeID string, locator *storagepb.SegmentLocator) (*storagepb.StatSegmentResponse, error) {
+	return nil, ErrFetchUnsupported
+}
+
 // InProcessReplicationTransport dispatches to handlers registered in memory. It is
 // primarily useful for unit tests.
 type InProcessReplicationTransport struct {
 	mu       sync.RWMutex
 	handlers map[string]ReplicaHandler
+	fetchers map[string]FetchHandler
+	deleters map[string]DeleteHandler
+	staters  map[string]StatHandler
+	merklers map[string]MerkleHandler
 }
 
 // ReplicaHandler handles replication requests for a given node.
-type ReplicaHandler func(ctx context.Context, header *storagepb.UploadSegmentHeader, payload []byte) error
+type ReplicaHandler func(ctx context.Context, header *storagepb.UploadSegmentHeader, body io.Reader) error
+
+// FetchHandler serves segment reads for a given node.
+type FetchHandler func(ctx context.Context, locator *storagepb.SegmentLocator) (io.ReadCloser, error)
+
+// DeleteHandler removes a segment copy held by a given node.
+type DeleteHandler func(ctx context.Context, locator *storagepb.SegmentLocator) error
+
+// StatHandler describes a segment copy held by a given node.
+type StatHandler func(ctx context.Context, locator *storagepb.SegmentLocator) (*storagepb.StatSegmentResponse, error)
+
+// MerkleHandler answers Merkle tree requests for a given node.
+type MerkleHandler func(ctx context.Context, req *storagepb.MerkleTreeRequest) (*storagepb.MerkleTreeResponse, error)
 
 // NewInProcessReplicationTransport constructs a new transport.
 func NewInProcessReplicationTransport() *InProcessReplicationTransport {
-	return &InProcessReplicationTransport{handlers: map[string]ReplicaHandler{}}
+	return &InProcessReplicationTransport{
+		handlers: map[string]ReplicaHandler{},
+		fetchers: map[string]FetchHandler{},
+		deleters: map[string]DeleteHandler{},
+		staters:  map[string]StatHandler{},
+		merklers: map[string]MerkleHandler{},
+	}
+}
+
+// RegisterFS registers replicate, fetch, delete and stat handlers backed by a node's
+// filesystem.
+func (t *InProcessReplicationTransport) RegisterFS(nodeID string, fs *FS) {
+	t.Register(nodeID, ReceiveIntoFS(fs))
+	t.RegisterFetch(nodeID, FetchFromFS(fs))
+	t.RegisterDelete(nodeID, DeleteFromFS(fs))
+	t.RegisterStat(nodeID, StatFromFS(fs))
 }
 
 // Register registers a handler for the given node ID.
@@ -49,20 +114,141 @@ func (t *InProcessReplicationTransport) Register(nodeID string, handler ReplicaH
 	t.handlers[nodeID] = handler
 }
 
+// RegisterFetch registers a read handler for the given node ID.
+func (t *InProcessReplicationTransport) RegisterFetch(nodeID string, handler FetchHandler) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.fetchers[nodeID] = handler
+}
+
+// FetchSegment dispatches to the registered read handler.
+func (t *InProcessReplicationTransport) FetchSegment(ctx context.Context, nodeID string, locator *storagepb.SegmentLocator) (io.ReadCloser, error) {
+	t.mu.RLock()
+	handler, ok := t.fetchers[nodeID]
+	t.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("storage: no fetch handler for node %s", nodeID)
+	}
+	return handler(ctx, locator)
+}
+
+// RegisterDelete registers a delete handler for the given node ID.
+func (t *InProcessReplicationTransport) RegisterDelete(nodeID string, handler DeleteHandler) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.deleters[nodeID] = handler
+}
+
+// DeleteSegment dispatches to the registered delete handler.
+func (t *InProcessReplicationTransport) DeleteSegment(ctx context.Context, nodeID string, locator *storagepb.SegmentLocator) error {
+	t.mu.RLock()
+	handler, ok := t.deleters[nodeID]
+	t.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("storage: no delete handler for node %s", nodeID)
+	}
+	return handler(ctx, locator)
+}
+
+// RegisterStat registers a stat handler for the given node ID.
+func (t *InProcessReplicationTransport) RegisterStat(nodeID string, handler StatHandler) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.staters[nodeID] = handler
+}
+
+// StatSegment dispatches to the registered stat handler.
+func (t *InProcessReplicationTransport) StatSegment(ctx context.Context, nodeID string, locator *storagepb.SegmentLocator) (*storagepb.StatSegmentResponse, error) {
+	t.mu.RLock()
+	handler, ok := t.staters[nodeID]
+	t.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("storage: no stat handler for node %s", nodeID)
+	}
+	return handler(ctx, locator)
+}
+
+// RegisterMerkle registers a Merkle tree handler for the given node ID, usually the
+// node's Service.MerkleTree.
+func (t *InProcessReplicationTransport) RegisterMerkle(nodeID string, handler MerkleHandler) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.merklers[nodeID] = handler
+}
+
+// MerkleTree dispatches to the registered Merkle tree handler.
+func (t *InProcessReplicationTransport) MerkleTree(ctx context.Context, nodeID string, req *storagepb.MerkleTreeRequest) (*storagepb.MerkleTreeResponse, error) {
+	t.mu.RLock()
+	handler, ok := t.merklers[nodeID]
+	t.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("storage: no merkle handler for node %s", nodeID)
+	}
+	return handler(ctx, req)
+}
+
 // ReplicateSegment dispatches to the registered handler.
-func (t *InProcessReplicationTransport) ReplicateSegment(ctx context.Context, nodeID string, header *storagepb.UploadSegmentHeader, payload []byte) error {
+func (t *InProcessReplicationTransport) ReplicateSegment(ctx context.Context, nodeID string, header *storagepb.UploadSegmentHeader, body io.Reader) error {
 	t.mu.RLock()
 	handler, ok := t.handlers[nodeID]
 	t.mu.RUnlock()
 	if !ok {
 		return fmt.Errorf("storage: no replication handler for node %s", nodeID)
 	}
-	return handler(ctx, header, payload)
+	return handler(ctx, header, body)
+}
+
+// ReceiveIntoFS returns a ReplicaHandler that stores replicated segments in fs, rejecting
+// bodies that do not match the header's checksum.
+func ReceiveIntoFS(fs *FS) ReplicaHandler {
+	return func(ctx context.Context, header *storagepb.UploadSegmentHeader, body io.Reader) error {
+		if header == nil || header.Locator == nil {
+			return errors.New("storage: replication requires a locator")
+		}
+		_, _, err := fs.PutVerified(header.Locator.Bucket, header.Locator.Object, body, header.Checksum)
+		return err
+	}
+}
+
+// FetchFromFS returns a FetchHandler that serves segments from a node's filesystem.
+func FetchFromFS(fs *FS) FetchHandler {
+	return func(ctx context.Context, locator *storagepb.SegmentLocator) (io.ReadCloser, error) {
+		if locator == nil {
+			return nil, errors.New("storage: fetch requires a locator")
+		}
+		return fs.Get(locator.Bucket, locator.Object)
+	}
+}
+
+// DeleteFromFS returns a DeleteHandler that removes segments from fs.
+func DeleteFromFS(fs *FS) DeleteHandler {
+	return func(ctx context.Context, locator *storagepb.SegmentLocator) error {
+		if locator == nil {
+			return errors.New("storage: delete requires a locator")
+		}
+		return fs.Delete(locator.Bucket, locator.Object)
+	}
+}
+
+// StatFromFS returns a StatHandler that describes segments from a node's filesystem using
+// their recorded checksums.
+func StatFromFS(fs *FS) StatHandler {
+	return func(ctx context.Context, locator *storagepb.SegmentLocator) (*storagepb.StatSegmentResponse, error) {
+		if locator == nil {
+			return nil, errors.New("storage: stat requires a locator")
+		}
+		info, err := fs.Stat(locator.Bucket, locator.Object)
+		if err != nil {
+			return nil, err
+		}
+		return &storagepb.StatSegmentResponse{SizeBytes: info.Size, Checksum: info.SHA256}, nil
+	}
 }
 
 // Ensure interface satisfaction at compile time.
 var _ ReplicationTransport = NoopReplicationTransport{}
 var _ ReplicationTransport = (*InProcessReplicationTransport)(nil)
+var _ MerkleTransport = (*InProcessReplicationTransport)(nil)
 
 // ErrReplicationFailed aggregates replication errors when multiple replicas fail.
 type ErrReplicationFailed struct {
@@ -0,0 +1,304 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	storagepb "tritontube/internal/storage/proto"
+)
+
+// DefaultScrubBytesPerSecond bounds how fast the scrubber reads local blobs so that a
+// pass does not starve segment reads of disk bandwidth.
+const DefaultScrubBytesPerSecond = 32 << 20
+
+// SegmentLister enumerates the segment records a scrubber should check.
+type SegmentLister interface {
+	ListSegments(ctx context.Context) ([]SegmentRecord, error)
+}
+
+var _ SegmentLister = (*EtcdMetadataStore)(nil)
+
+// ScrubReport summarises a single scrub pass.
+type ScrubReport struct {
+	StartedAt     time.Time
+	FinishedAt    time.Time
+	Checked       int
+	BytesVerified int64
+	// Missing and Corrupted list the segment ids whose local copy was absent or did not
+	// hash to the recorded checksum.
+	Missing   []string
+	Corrupted []string
+	// Repaired lists the segment ids restored from a peer, and Unrepaired maps the ones
+	// that could not be restored to the last error seen.
+	Repaired   []string
+	Unrepaired map[string]error
+}
+
+// Scrubber periodically verifies the local copy of every segment this node is
+// responsible for against the checksum recorded in metadata, and re-fetches missing or
+// corrupted copies from a healthy replica.
+type Scrubber struct {
+	NodeID     string
+	Filesystem *FS
+	Segments   SegmentLister
+	Transport  ReplicationTransport
+	Interval   time.Duration
+	// BytesPerSecond limits local read throughput (default DefaultScrubBytesPerSecond);
+	// a negative value disables the limit.
+	BytesPerSecond int64
+	// OnReport is invoked after every pass.
+	OnReport func(report *ScrubReport)
+}
+
+// Run blocks until the context is cancelled, scrubbing every Interval (default 1 hour).
+func (s *Scrubber) Run(ctx context.Context) error {
+	if s == nil || s.Filesystem == nil || s.Segments == nil {
+		return errors.New("storage: scrubber requires a filesystem and a segment lister")
+	}
+	interval := s.Interval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		report, err := s.ScrubOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("storage: scrub failed: %v", err)
+		}
+		if report != nil && s.OnReport != nil {
+			s.OnReport(report)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// ScrubOnce performs a single pass over the segments held by this node. Per-segment
+// failures are recorded in the report; the returned error is reserved for failures that
+// abort the pass, such as the segment listing or context cancellation.
+func (s *Scrubber) ScrubOnce(ctx context.Context) (*ScrubReport, error) {
+	report := &ScrubReport{StartedAt: time.Now().UTC(), Unrepaired: map[string]error{}}
+	defer func() { report.FinishedAt = time.Now().UTC() }()
+
+	records, err := s.Segments.ListSegments(ctx)
+	if err != nil {
+		return report, fmt.Errorf("storage: failed to list segments: %w", err)
+	}
+	limiter := newScrubLimiter(s.BytesPerSecond)
+	for _, record := range records {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if record.Erasure != nil {
+			if err := s.scrubShards(ctx, limiter, record, report); err != nil {
+				return report, err
+			}
+			continue
+		}
+		if !s.holds(record) {
+			continue
+		}
+		report.Checked++
+		n, err := s.verify(ctx, limiter, record.Locator, record.Checksum, record.SegmentID)
+		report.BytesVerified += n
+		switch {
+		case err == nil:
+			continue
+		case errors.Is(err, os.ErrNotExist):
+			report.Missing = append(report.Missing, record.SegmentID)
+		case errors.Is(err, ErrChecksumMismatch):
+			report.Corrupted = append(report.Corrupted, record.SegmentID)
+		default:
+			if ctx.Err() != nil {
+				return report, ctx.Err()
+			}
+			report.Unrepaired[record.SegmentID] = err
+			continue
+		}
+		if err := s.repair(ctx, record); err != nil {
+			report.Unrepaired[record.SegmentID] = err
+			continue
+		}
+		report.Repaired = append(report.Repaired, record.SegmentID)
+	}
+	return report, nil
+}
+
+// holds reports whether this node is expected to store a copy of the segment.
+func (s *Scrubber) holds(record SegmentRecord) bool {
+	if record.PrimaryNode == s.NodeID {
+		return true
+	}
+	for _, replica := range record.Replicas {
+		if replica == s.NodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// scrubShards verifies the shards of an erasure-coded segment held by this node and
+// rebuilds missing or corrupted ones from the other shards. Shards are reported as
+// "<segment id>#<shard>". Only context cancellation aborts the pass.
+func (s *Scrubber) scrubShards(ctx context.Context, limiter *scrubLimiter, record SegmentRecord, report *ScrubReport) error {
+	for i, holder := range record.Erasure.Shards {
+		if holder != s.NodeID {
+			continue
+		}
+		if i >= len(record.Erasure.Checksums) {
+			break
+		}
+		name := fmt.Sprintf("%s#%d", record.SegmentID, i)
+		locator := shardLocator(record.Locator, i)
+		report.Checked++
+		n, err := s.verify(ctx, limiter, *locator, record.Erasure.Checksums[i], name)
+		report.BytesVerified += n
+		switch {
+		case err == nil:
+			continue
+		case errors.Is(err, os.ErrNotExist):
+			report.Missing = append(report.Missing, name)
+		case errors.Is(err, ErrChecksumMismatch):
+			report.Corrupted = append(report.Corrupted, name)
+		default:
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			report.Unrepaired[name] = err
+			continue
+		}
+		st := shardStore{nodeID: s.NodeID, fs: s.Filesystem, transport: s.Transport}
+		if s.Transport == nil {
+			st.transport = NoopReplicationTransport{}
+		}
+		shard, err := st.rebuild(ctx, record, i)
+		if err == nil {
+			_, _, err = s.Filesystem.PutVerified(locator.Bucket, locator.Object, bytes.NewReader(shard), record.Erasure.Checksums[i])
+		}
+		if err != nil {
+			report.Unrepaired[name] = err
+			continue
+		}
+		report.Repaired = append(report.Repaired, name)
+	}
+	return nil
+}
+
+// verify hashes the local copy of the object at locator and compares it with the
+// checksum in metadata rather than the sidecar, which may itself have been computed
+// from corrupted data.
+func (s *Scrubber) verify(ctx context.Context, limiter *scrubLimiter, locator storagepb.SegmentLocator, checksum, name string) (int64, error) {
+	f, err := s.Filesystem.Get(locator.Bucket, locator.Object)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, &scrubReader{ctx: ctx, r: f, limiter: limiter})
+	if err != nil {
+		return n, err
+	}
+	expected := NormalizeChecksum(checksum)
+	if expected == "" {
+		return n, nil
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+		return n, fmt.Errorf("%w: %s recorded %s, stored data hashes to %s", ErrChecksumMismatch, name, expected, actual)
+	}
+	return n, nil
+}
+
+// repair re-fetches the segment from the first peer whose copy matches the recorded
+// checksum. Object-store replicas ("s3:" entries) are not read back.
+func (s *Scrubber) repair(ctx context.Context, record SegmentRecord) error {
+	if s.Transport == nil {
+		return errors.New("storage: no transport to repair from")
+	}
+	peers := append([]string{record.PrimaryNode}, record.Replicas...)
+	var lastErr error
+	for _, peer := range peers {
+		if peer == "" || peer == s.NodeID || strings.HasPrefix(peer, "s3:") {
+			continue
+		}
+		locator := record.Locator
+		body, err := s.Transport.FetchSegment(ctx, peer, &locator)
+		if err != nil {
+			lastErr = fmt.Errorf("fetch from %s: %w", peer, err)
+			continue
+		}
+		_, _, err = s.Filesystem.PutVerified(record.Locator.Bucket, record.Locator.Object, body, record.Checksum)
+		body.Close()
+		if err != nil {
+			lastErr = fmt.Errorf("copy from %s: %w", peer, err)
+			continue
+		}
+		return nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("storage: no healthy replica to repair from")
+	}
+	return lastErr
+}
+
+// scrubLimiter paces reads so that the pass as a whole stays under a byte rate.
+type scrubLimiter struct {
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+func newScrubLimiter(rate int64) *scrubLimiter {
+	if rate == 0 {
+		rate = DefaultScrubBytesPerSecond
+	}
+	return &scrubLimiter{rate: rate, start: time.Now()}
+}
+
+func (l *scrubLimiter) wait(ctx context.Context, n int) error {
+	if l.rate < 0 {
+		return nil
+	}
+	l.read += int64(n)
+	due := l.start.Add(time.Duration(float64(l.read) / float64(l.rate) * float64(time.Second)))
+	delay := time.Until(due)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type scrubReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *scrubLimiter
+}
+
+func (r *scrubReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.limiter.wait(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -1,14 +1,16 @@
 package storage
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"log"
 	"sync"
 	"time"
 
+	grpc "tritontube/internal/metadata/grpcstub"
 	storagepb "tritontube/internal/storage/proto"
 )
 
@@ -24,6 +26,19 @@ type Service struct {
 	metadata          MetadataStore
 	replicationFactor int
 	leaseTTL          time.Duration
+	maxSegmentBytes   int64
+	maxErasureBytes   int64
+	verifyOnRead      bool
+	hints             HintStore
+	writeConsistency  storagepb.ConsistencyLevel
+	readConsistency   storagepb.ConsistencyLevel
+	erasureBuckets    map[string]ErasureProfile
+
+	replayMu  sync.Mutex
+	replaying map[string]bool
+
+	merkleMu sync.Mutex
+	merkle   *merkleIndex
 }
 
 // ServiceConfig configures a new storage service instance.
@@ -36,8 +51,36 @@ type ServiceConfig struct {
 	Metadata          MetadataStore
 	ReplicationFactor int
 	LeaseTTL          time.Duration
+	// MaxSegmentBytes caps a single uploaded segment (default DefaultMaxSegmentBytes).
+	MaxSegmentBytes int64
+	// VerifyOnRead re-hashes a segment before GetSegment streams it, so corruption is
+	// reported as DataLoss rather than served.
+	VerifyOnRead bool
+	// Hints enables hinted handoff: a copy that cannot reach a ring target is written to
+	// the next node on the ring instead, and replayed once the target heartbeats again.
+	Hints HintStore
+	// WriteConsistency and ReadConsistency apply to requests that leave the level
+	// unspecified. Writes default to ALL and reads to ONE, the local copy.
+	WriteConsistency storagepb.ConsistencyLevel
+	ReadConsistency  storagepb.ConsistencyLevel
+	// ErasureBuckets stores the segments of the listed buckets as Reed-Solomon shards
+	// instead of full replicas. An upload's StorageClassAttribute overrides its bucket.
+	// Erasure coding needs a Metadata store that implements SegmentReader.
+	ErasureBuckets map[string]ErasureProfile
+	// MaxErasureSegmentBytes caps a single erasure-coded upload (default
+	// DefaultMaxErasureSegmentBytes, at most MaxSegmentBytes). Erasure-coded segments
+	// are encoded and rebuilt in memory, so the cap bounds what each upload or read
+	// holds.
+	MaxErasureSegmentBytes int64
 }
 
+// DefaultMaxSegmentBytes is the default upper bound for a single segment upload.
+const DefaultMaxSegmentBytes = 64 << 20
+
+// DefaultMaxErasureSegmentBytes is the default upper bound for a single erasure-coded
+// segment.
+const DefaultMaxErasureSegmentBytes = 16 << 20
+
 // NewService constructs a Service with sane defaults.
 func NewService(cfg ServiceConfig) (*Service, error) {
 	if cfg.NodeID == "" {
@@ -58,6 +101,14 @@ func NewService(cfg ServiceConfig) (*Service, error) {
 		metadata:          cfg.Metadata,
 		replicationFactor: cfg.ReplicationFactor,
 		leaseTTL:          cfg.LeaseTTL,
+		maxSegmentBytes:   cfg.MaxSegmentBytes,
+		maxErasureBytes:   cfg.MaxErasureSegmentBytes,
+		verifyOnRead:      cfg.VerifyOnRead,
+		hints:             cfg.Hints,
+		writeConsistency:  levelOr(cfg.WriteConsistency, storagepb.ConsistencyLevel_CONSISTENCY_LEVEL_ALL),
+		readConsistency:   levelOr(cfg.ReadConsistency, storagepb.ConsistencyLevel_CONSISTENCY_LEVEL_ONE),
+		erasureBuckets:    cfg.ErasureBuckets,
+		replaying:         map[string]bool{},
 	}
 	if svc.replicationFactor <= 0 {
 		svc.replicationFactor = 3
@@ -71,11 +122,35 @@ func NewService(cfg ServiceConfig) (*Service, error) {
 	if svc.leaseTTL <= 0 {
 		svc.leaseTTL = 15 * time.Second
 	}
+	if svc.maxSegmentBytes <= 0 {
+		svc.maxSegmentBytes = DefaultMaxSegmentBytes
+	}
+	if svc.maxErasureBytes <= 0 {
+		svc.maxErasureBytes = DefaultMaxErasureSegmentBytes
+	}
+	if svc.maxErasureBytes > svc.maxSegmentBytes {
+		svc.maxErasureBytes = svc.maxSegmentBytes
+	}
 	return svc, nil
 }
 
 // UploadSegment receives a client-streamed DASH segment, persists it locally, and
-// asynchronously replicates to additional storage nodes and S3.
+// asynchronously replicates to additional storage nodes and S3. Chunks are written
+// straight to a temp file while hashing, and the fan-out reads back the committed file,
+// so memory use does not grow with the segment size.
+//
+// The header's consistency level sets how many of the segment's ring replicas, the
+// local copy included, must acknowledge the write. Copies are sent in parallel and the
+// RPC returns as soon as that many succeed, listing them in QuorumReplicas; the rest
+// finish in the background, after which the segment record is written. If the level
+// cannot be met the RPC fails with Unavailable, no record is written and the copies the
+// upload made on the ring are deleted again; see discardUpload. With a
+// HintStore configured, a ring target that cannot be reached is covered by a hinted copy
+// on a fallback node, which counts toward the level once every other copy has settled.
+//
+// Segments whose bucket or StorageClassAttribute selects erasure coding are instead
+// split into shards placed on the ring, and are limited to MaxErasureSegmentBytes; see
+// uploadErasureCoded.
 func (s *Service) UploadSegment(stream storagepb.StorageService_UploadSegmentServer) error {
 	ctx := stream.Context()
 	first, err := stream.Recv()
@@ -84,42 +159,46 @@ func (s *Service) UploadSegment(stream storagepb.StorageService_UploadSegmentSer
 	}
 	header := first.GetHeader()
 	if header == nil {
-		return errors.New("storage: upload stream missing header")
+		return grpc.Errorf(grpc.InvalidArgument, "storage: upload stream missing header")
 	}
 	if header.Locator == nil {
-		return errors.New("storage: upload header missing locator")
+		return grpc.Errorf(grpc.InvalidArgument, "storage: upload header missing locator")
 	}
 	if header.SegmentId == "" {
-		return errors.New("storage: segment id is required")
+		return grpc.Errorf(grpc.InvalidArgument, "storage: segment id is required")
 	}
-	var payload bytes.Buffer
-	for {
-		msg, err := stream.Recv()
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				break
-			}
-			return err
-		}
-		if chunk := msg.GetChunk(); len(chunk) > 0 {
-			if _, err := payload.Write(chunk); err != nil {
-				return err
-			}
-		}
-		if msg.GetCommit() {
-			break
-		}
+	if header.SizeBytes < 0 {
+		return grpc.Errorf(grpc.InvalidArgument, "storage: negative segment size %d", header.SizeBytes)
+	}
+	profile, erasureCoded, err := s.storageClass(header)
+	if err != nil {
+		return grpc.Errorf(grpc.InvalidArgument, "%v", err)
+	}
+	limit := s.maxSegmentBytes
+	if erasureCoded {
+		limit = s.maxErasureBytes
+	}
+	if header.SizeBytes > limit {
+		return grpc.Errorf(grpc.InvalidArgument, "storage: segment size %d exceeds limit %d", header.SizeBytes, limit)
 	}
 
-	data := payload.Bytes()
-	size, checksum, err := s.fs.Put(header.Locator.Bucket, header.Locator.Object, bytes.NewReader(data))
+	if header.SizeBytes > 0 {
+		limit = header.SizeBytes
+	}
+	body := &uploadStreamReader{stream: stream, limit: limit, expected: header.SizeBytes}
+	size, checksum, err := s.fs.PutVerified(header.Locator.Bucket, header.Locator.Object, body, header.Checksum)
 	if err != nil {
+		if grpc.CodeOf(err) != grpc.Unknown {
+			return err
+		}
+		if errors.Is(err, ErrChecksumMismatch) || errors.Is(err, ErrReservedName) {
+			return grpc.Errorf(grpc.InvalidArgument, "storage: rejected segment %s: %v", header.SegmentId, err)
+		}
 		return fmt.Errorf("storage: failed to persist segment: %w", err)
 	}
-
-	replicaStatus := []*storagepb.ReplicaAck{{NodeId: s.nodeID, Success: true}}
-	results := map[string]error{s.nodeID: nil}
-
+	if erasureCoded {
+		return s.uploadErasureCoded(stream, header, size, checksum, profile)
+	}
 	targets := s.ring.Lookup([]byte(header.SegmentId), s.replicationFactor)
 	if len(targets) == 0 {
 		targets = []string{s.nodeID}
@@ -128,121 +207,318 @@ func (s *Service) UploadSegment(stream storagepb.StorageService_UploadSegmentSer
 		return err
 	}
 
-	var wg sync.WaitGroup
-	var mu sync.Mutex
-
+	u := &pendingUpload{
+		header:   header,
+		size:     size,
+		checksum: checksum,
+		targets:  targets,
+		required: quorumSize(levelOr(header.Consistency, s.writeConsistency), len(targets)),
+		done:     make(chan replicaResult, len(targets)+1),
+		results:  map[string]error{s.nodeID: nil},
+		acked:    []string{s.nodeID},
+	}
+	// Copies still in flight when the quorum is met finish after the RPC returns, so they
+	// must not be cancelled with the stream.
+	bg := context.WithoutCancel(ctx)
 	for _, nodeID := range targets {
 		if nodeID == s.nodeID {
 			continue
 		}
-		wg.Add(1)
+		u.pending++
 		go func(target string) {
-			defer wg.Done()
-			err := s.transport.ReplicateSegment(ctx, target, header, data)
-			mu.Lock()
-			results[target] = err
-			mu.Unlock()
+			err := s.replicateFromDisk(bg, header, func(body io.Reader) error {
+				return s.transport.ReplicateSegment(bg, target, header, body)
+			})
+			u.done <- replicaResult{id: target, err: err}
 		}(nodeID)
 	}
-
 	if header.S3Bucket != "" && header.S3Key != "" {
-		wg.Add(1)
+		u.pending++
 		go func(bucket, key string) {
-			defer wg.Done()
-			err := s.s3.UploadSegment(ctx, bucket, key, bytes.NewReader(data))
-			mu.Lock()
-			results[fmt.Sprintf("s3:%s/%s", bucket, key)] = err
-			mu.Unlock()
+			err := s.replicateFromDisk(bg, header, func(body io.Reader) error {
+				return s.s3.UploadSegment(bg, bucket, key, body)
+			})
+			u.done <- replicaResult{id: fmt.Sprintf("s3:%s/%s", bucket, key), err: err}
 		}(header.S3Bucket, header.S3Key)
 	}
 
-	wg.Wait()
+	for u.pending > 0 && !u.quorate() {
+		u.wait()
+	}
+	if u.pending > 0 {
+		// The quorum is met: answer now and settle the remaining copies, hints and the
+		// segment record in the background.
+		resp := &storagepb.UploadSegmentResponse{
+			SizeCommitted:  size,
+			Checksum:       checksum,
+			ReplicaStatus:  append([]*storagepb.ReplicaAck{{NodeId: s.nodeID, Success: true}}, u.acks(s.nodeID)...),
+			QuorumReplicas: append([]string(nil), u.acked...),
+		}
+		go func() {
+			for u.pending > 0 {
+				u.wait()
+			}
+			if _, err := s.settleUpload(bg, u); err != nil {
+				log.Printf("storage: failed to settle upload of %s: %v", header.SegmentId, err)
+			}
+		}()
+		return stream.SendAndClose(resp)
+	}
+
+	replicaStatus, _ := s.settleUpload(ctx, u)
+	if !u.quorate() {
+		return u.quorumError()
+	}
+	resp := &storagepb.UploadSegmentResponse{
+		SizeCommitted:  size,
+		Checksum:       checksum,
+		ReplicaStatus:  replicaStatus,
+		QuorumReplicas: u.acked,
+	}
+	if err := stream.SendAndClose(resp); err != nil {
+		return err
+	}
+	return nil
+}
+
+// settleUpload runs once every replica result is in. It covers failed ring targets with
+// hinted copies, which count toward the quorum, and records the segment if the quorum
+// was met. It returns the acknowledgements for the response and the error, if any, that
+// kept the segment from being recorded.
+func (s *Service) settleUpload(ctx context.Context, u *pendingUpload) ([]*storagepb.ReplicaAck, error) {
+	header := u.header
+	fallbacks := map[string]string{}
+	if s.hints != nil {
+		var failed []string
+		for _, nodeID := range u.targets {
+			if nodeID != s.nodeID && u.results[nodeID] != nil {
+				failed = append(failed, nodeID)
+			}
+		}
+		// Hints only help if covering every failed target would meet the quorum.
+		if len(u.acked)+len(failed) >= u.required {
+			fallbacks = s.handOff(ctx, header, u.size, u.checksum, u.targets, failed)
+		}
+	}
+
+	replicaStatus := append([]*storagepb.ReplicaAck{{NodeId: s.nodeID, Success: true}}, u.acks(s.nodeID)...)
+	for _, nodeID := range u.targets {
+		if fallback, ok := fallbacks[nodeID]; ok {
+			replicaStatus = append(replicaStatus, &storagepb.ReplicaAck{NodeId: fallback, Success: true, HintedFor: nodeID})
+			u.acked = append(u.acked, fallback)
+		}
+	}
+
+	// Targets covered by a hint do not count as failures.
+	unhinted := map[string]error{}
+	for nodeID, err := range u.results {
+		if _, ok := fallbacks[nodeID]; !ok {
+			unhinted[nodeID] = err
+		}
+	}
+	aggregateErr := MergeReplicationErrors(unhinted)
+	finish := func(err error) ([]*storagepb.ReplicaAck, error) {
+		if aggregateErr != nil {
+			replicaStatus = append(replicaStatus, &storagepb.ReplicaAck{NodeId: "replication", Success: false, ErrorMessage: aggregateErr.Error()})
+		}
+		return replicaStatus, err
+	}
 
-	for nodeID, err := range results {
+	if !u.quorate() {
+		err := u.quorumError()
+		if s.metadata != nil {
+			replicaStatus = append(replicaStatus, &storagepb.ReplicaAck{NodeId: "metadata", Success: false, ErrorMessage: err.Error()})
+		}
+		s.discardUpload(ctx, u, fallbacks)
+		return finish(err)
+	}
+	if s.metadata == nil {
+		return finish(nil)
+	}
+	record := SegmentRecord{
+		SegmentID:   header.SegmentId,
+		Locator:     *header.Locator,
+		PrimaryNode: s.nodeID,
+		Checksum:    u.checksum,
+		SizeBytes:   u.size,
+		Attributes:  header.Attributes,
+	}
+	for _, nodeID := range u.targets {
 		if nodeID == s.nodeID {
 			continue
 		}
-		ack := &storagepb.ReplicaAck{NodeId: nodeID, Success: err == nil}
-		if err != nil {
-			ack.ErrorMessage = err.Error()
+		if err := u.results[nodeID]; err == nil {
+			record.Replicas = append(record.Replicas, nodeID)
+		} else if fallback, ok := fallbacks[nodeID]; ok {
+			record.Replicas = append(record.Replicas, fallback)
 		}
-		replicaStatus = append(replicaStatus, ack)
 	}
-
-	aggregateErr := MergeReplicationErrors(results)
-	if s.metadata != nil {
-		if aggregateErr == nil {
-			record := SegmentRecord{
-				SegmentID:   header.SegmentId,
-				Locator:     *header.Locator,
-				PrimaryNode: s.nodeID,
-				Checksum:    checksum,
-				SizeBytes:   size,
-				Attributes:  header.Attributes,
-			}
-			for _, nodeID := range targets {
-				if nodeID == s.nodeID {
-					continue
-				}
-				if err := results[nodeID]; err == nil {
-					record.Replicas = append(record.Replicas, nodeID)
-				}
-			}
-			if header.S3Bucket != "" && header.S3Key != "" {
-				key := fmt.Sprintf("s3:%s/%s", header.S3Bucket, header.S3Key)
-				if err := results[key]; err == nil {
-					record.Replicas = append(record.Replicas, key)
-				}
-			}
-			if err := s.metadata.PutSegment(ctx, record); err != nil {
-				replicaStatus = append(replicaStatus, &storagepb.ReplicaAck{NodeId: "metadata", Success: false, ErrorMessage: err.Error()})
-			} else {
-				replicaStatus = append(replicaStatus, &storagepb.ReplicaAck{NodeId: "metadata", Success: true})
-			}
-		} else {
-			replicaStatus = append(replicaStatus, &storagepb.ReplicaAck{NodeId: "metadata", Success: false, ErrorMessage: aggregateErr.Error()})
+	if header.S3Bucket != "" && header.S3Key != "" {
+		key := fmt.Sprintf("s3:%s/%s", header.S3Bucket, header.S3Key)
+		if err := u.results[key]; err == nil {
+			record.Replicas = append(record.Replicas, key)
 		}
 	}
+	if err := s.metadata.PutSegment(ctx, record); err != nil {
+		replicaStatus = append(replicaStatus, &storagepb.ReplicaAck{NodeId: "metadata", Success: false, ErrorMessage: err.Error()})
+		return finish(err)
+	}
+	replicaStatus = append(replicaStatus, &storagepb.ReplicaAck{NodeId: "metadata", Success: true})
+	return finish(nil)
+}
 
-	if aggregateErr != nil {
-		replicaStatus = append(replicaStatus, &storagepb.ReplicaAck{NodeId: "replication", Success: false, ErrorMessage: aggregateErr.Error()})
+// replicateFromDisk hands a fresh reader over the committed local copy to send.
+func (s *Service) replicateFromDisk(ctx context.Context, header *storagepb.UploadSegmentHeader, send func(io.Reader) error) error {
+	_ = ctx
+	f, err := s.fs.Get(header.Locator.Bucket, header.Locator.Object)
+	if err != nil {
+		return fmt.Errorf("storage: failed to reopen segment for replication: %w", err)
 	}
+	defer f.Close()
+	return send(f)
+}
 
-	resp := &storagepb.UploadSegmentResponse{SizeCommitted: size, Checksum: checksum, ReplicaStatus: replicaStatus}
-	if err := stream.SendAndClose(resp); err != nil {
-		return err
+// uploadStreamReader exposes the chunks of an UploadSegment stream as an io.Reader,
+// failing once more than limit bytes arrive or, when expected is set, if the stream
+// ends short of it. Failing the read keeps FS.Put from committing the object.
+type uploadStreamReader struct {
+	stream   storagepb.StorageService_UploadSegmentServer
+	limit    int64
+	expected int64
+	read     int64
+	buf      []byte
+	done     bool
+}
+
+func (r *uploadStreamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			if r.expected > 0 && r.read != r.expected {
+				return 0, grpc.Errorf(grpc.InvalidArgument, "storage: received %d bytes, header declared %d", r.read, r.expected)
+			}
+			return 0, io.EOF
+		}
+		msg, err := r.stream.Recv()
+		if errors.Is(err, io.EOF) {
+			r.done = true
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		r.buf = msg.GetChunk()
+		r.read += int64(len(r.buf))
+		if r.read > r.limit {
+			return 0, grpc.Errorf(grpc.InvalidArgument, "storage: segment exceeds %d bytes", r.limit)
+		}
+		if msg.GetCommit() {
+			r.done = true
+		}
 	}
-	return nil
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
 }
 
-// GetSegment streams a stored segment back to the caller.
+// getSegmentChunkSize bounds the payload of each GetSegmentResponse.
+const getSegmentChunkSize = 128 * 1024
+
+// GetSegment streams a stored segment back to the caller. Offset and Length select a
+// byte range; a zero Length reads to the end of the object. Eof is set on the final
+// message only when the end of the object was reached, so a bounded read that stops
+// short of it can be told apart from one that returned the tail.
+//
+// Above CONSISTENCY_LEVEL_ONE the segment's replicas must agree on its checksum before
+// any data is sent, and the first message lists the ones that did. The local copy is
+// served when it is among them; otherwise the data comes from an agreeing peer.
+//
+// Erasure-coded segments, found through req.SegmentId, are rebuilt from their shards
+// whatever the level; each shard is checked against its recorded checksum, and the first
+// message lists the nodes whose shards were used.
 func (s *Service) GetSegment(req *storagepb.GetSegmentRequest, stream storagepb.StorageService_GetSegmentServer) error {
 	if req == nil || req.Locator == nil {
-		return errors.New("storage: locator required")
+		return grpc.Errorf(grpc.InvalidArgument, "storage: locator required")
+	}
+	if req.Offset < 0 || req.Length < 0 {
+		return grpc.Errorf(grpc.InvalidArgument, "storage: offset and length must not be negative")
+	}
+	if record, ok := s.erasureRecord(stream.Context(), req); ok {
+		return s.getErasureCoded(req, stream, record)
 	}
-	reader, err := s.fs.Get(req.Locator.Bucket, req.Locator.Object)
+	quorum := []string{s.nodeID}
+	if level := levelOr(req.Consistency, s.readConsistency); level != storagepb.ConsistencyLevel_CONSISTENCY_LEVEL_ONE {
+		agreed, _, size, err := s.readQuorum(stream.Context(), req, level)
+		if err != nil {
+			return err
+		}
+		local := false
+		for _, nodeID := range agreed {
+			local = local || nodeID == s.nodeID
+		}
+		if !local {
+			return s.getFromPeer(req, stream, agreed[0], size, agreed)
+		}
+		quorum = agreed
+	} else if s.verifyOnRead {
+		if _, err := s.fs.Verify(req.Locator.Bucket, req.Locator.Object); errors.Is(err, ErrChecksumMismatch) {
+			return grpc.Errorf(grpc.DataLoss, "%v", err)
+		}
+	}
+	f, info, err := s.fs.Open(req.Locator.Bucket, req.Locator.Object)
 	if err != nil {
-		return err
+		if errors.Is(err, fs.ErrNotExist) {
+			return grpc.Errorf(grpc.NotFound, "storage: segment %s/%s not found", req.Locator.Bucket, req.Locator.Object)
+		}
+		return grpc.Errorf(grpc.Internal, "storage: failed to open segment: %v", err)
+	}
+	defer f.Close()
+	if req.Offset > info.Size {
+		return grpc.Errorf(grpc.OutOfRange, "storage: offset %d beyond segment size %d", req.Offset, info.Size)
 	}
-	defer reader.Close()
+	if _, err := f.Seek(req.Offset, io.SeekStart); err != nil {
+		return grpc.Errorf(grpc.Internal, "storage: failed to seek segment: %v", err)
+	}
+	return sendRange(stream, req, f, info.Size, quorum)
+}
 
-	buf := make([]byte, 128*1024)
-	for {
-		n, readErr := reader.Read(buf)
+// sendRange streams the byte range req selects from a segment of the given size, reading
+// from r, which must be positioned at req.Offset. quorum is reported on the first message.
+func sendRange(stream storagepb.StorageService_GetSegmentServer, req *storagepb.GetSegmentRequest, r io.Reader, size int64, quorum []string) error {
+	remaining := size - req.Offset
+	if req.Length > 0 && req.Length < remaining {
+		remaining = req.Length
+	}
+	reachesEnd := req.Offset+remaining == size
+	if remaining == 0 {
+		return stream.Send(&storagepb.GetSegmentResponse{Eof: reachesEnd, QuorumReplicas: quorum})
+	}
+
+	buf := make([]byte, getSegmentChunkSize)
+	for remaining > 0 {
+		if err := stream.Context().Err(); err != nil {
+			return err
+		}
+		want := int64(len(buf))
+		if remaining < want {
+			want = remaining
+		}
+		n, readErr := io.ReadFull(r, buf[:want])
 		if n > 0 {
+			remaining -= int64(n)
 			chunk := make([]byte, n)
 			copy(chunk, buf[:n])
-			if err := stream.Send(&storagepb.GetSegmentResponse{Chunk: chunk}); err != nil {
+			msg := &storagepb.GetSegmentResponse{Chunk: chunk, Eof: remaining == 0 && reachesEnd, QuorumReplicas: quorum}
+			if err := stream.Send(msg); err != nil {
 				return err
 			}
+			quorum = nil
 		}
-		if readErr != nil {
-			if errors.Is(readErr, io.EOF) {
-				return stream.Send(&storagepb.GetSegmentResponse{Eof: true})
-			}
-			return readErr
+		if readErr != nil && remaining > 0 {
+			// The file shrank underneath us (e.g. a concurrent rewrite).
+			return grpc.Errorf(grpc.DataLoss, "storage: segment truncated while reading: %v", readErr)
 		}
 	}
+	return nil
 }
 
 // Heartbeat records the node's availability and returns the current ring version.
@@ -258,33 +534,95 @@ func (s *Service) Heartbeat(ctx context.Context, req *storagepb.HeartbeatRequest
 		Address:        req.AdvertiseAddress,
 		CapacityBytes:  req.CapacityBytes,
 		AvailableBytes: req.AvailableBytes,
+		Zone:           req.Zone,
+		Rack:           req.Rack,
 	}
+	previous, known := s.ring.Node(req.NodeId)
 	version, err := s.ring.UpsertNode(ctx, descriptor)
+	if errors.Is(err, ErrRingConflict) {
+		return nil, grpc.Errorf(grpc.Aborted, "%v", err)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if s.hints != nil {
+		s.replayHintsAsync(req.NodeId)
+	}
+	rebalance, err := s.requiresRebalance(req, previous, known)
+	if err != nil {
+		return nil, grpc.Errorf(grpc.Internal, "%v", err)
+	}
 	return &storagepb.HeartbeatResponse{
 		LeaseTtlSeconds:  int64(s.leaseTTL.Seconds()),
-		RequireRebalance: false,
+		RequireRebalance: rebalance,
 		RingVersion:      version,
 	}, nil
 }
 
-// Rebalance returns the most recent ring assignments. Callers can use this to orchestrate
-// data migration when nodes are added or removed.
+// requiresRebalance reports whether the heartbeating node has data to move: either the
+// last token change, made since the node's previous heartbeat, moved ranges onto or off
+// it, or the virtual nodes it reports differ from the ring's.
+func (s *Service) requiresRebalance(req *storagepb.HeartbeatRequest, previous NodeDescriptor, known bool) (bool, error) {
+	plan, err := s.ring.Plan(s.replicationFactor)
+	if err != nil {
+		return false, err
+	}
+	if !known || plan.PreviousRingVersion >= previous.RingVersion {
+		for _, move := range plan.Moves {
+			if move.FromNodeId == req.NodeId || move.ToNodeId == req.NodeId {
+				return true, nil
+			}
+		}
+	}
+	if len(req.VirtualNodes) == 0 {
+		return false, nil
+	}
+	owned := map[uint64]bool{}
+	for _, vn := range plan.Assignments {
+		if vn.OwnerNodeId == req.NodeId {
+			owned[vn.Token] = true
+		}
+	}
+	if len(owned) != len(req.VirtualNodes) {
+		return true, nil
+	}
+	for _, vn := range req.VirtualNodes {
+		if vn == nil || !owned[vn.Token] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Rebalance returns the plan for the most recent ring change, restricted to the moves
+// touching req.NodeId when it is set. With req.Drain it instead returns a plan that
+// evacuates req.NodeId so the host can be taken down for maintenance.
 func (s *Service) Rebalance(ctx context.Context, req *storagepb.RebalanceRequest) (*storagepb.RebalanceResponse, error) {
-	_ = req
-	assignments, version := s.ring.Assignments()
-	plan := &storagepb.RebalancePlan{
-		PlanId:      fmt.Sprintf("plan-%d", time.Now().UnixNano()),
-		RingVersion: version,
-	}
-	for _, assignment := range assignments {
-		plan.Assignments = append(plan.Assignments, &storagepb.VirtualNode{
-			Id:          assignment.ID,
-			Token:       assignment.Token,
-			OwnerNodeId: assignment.NodeID,
-		})
+	if req == nil {
+		return nil, grpc.Errorf(grpc.InvalidArgument, "storage: rebalance request required")
+	}
+	if req.Drain {
+		if req.NodeId == "" {
+			return nil, grpc.Errorf(grpc.InvalidArgument, "storage: drain requires a node id")
+		}
+		plan, err := s.ring.DrainPlan(req.NodeId, s.replicationFactor)
+		if err != nil {
+			return nil, grpc.Errorf(grpc.NotFound, "%v", err)
+		}
+		return &storagepb.RebalanceResponse{Plan: plan}, nil
+	}
+	plan, err := s.ring.Plan(s.replicationFactor)
+	if err != nil {
+		return nil, grpc.Errorf(grpc.Internal, "%v", err)
+	}
+	if req.NodeId != "" {
+		var moves []*storagepb.TokenRangeMove
+		for _, move := range plan.Moves {
+			if move.FromNodeId == req.NodeId || move.ToNodeId == req.NodeId {
+				moves = append(moves, move)
+			}
+		}
+		plan.Moves = moves
 	}
 	return &storagepb.RebalanceResponse{Plan: plan}, nil
 }
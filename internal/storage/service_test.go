@@ -0,0 +1,650 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"tritontube/internal/chash"
+	"tritontube/internal/metadata/etcdsim"
+	grpc "tritontube/internal/metadata/grpcstub"
+	storagepb "tritontube/internal/storage/proto"
+)
+
+// newTestService returns the service of node-a in a two-node cluster.
+func newTestService(t *testing.T, cfg ServiceConfig) *Service {
+	t.Helper()
+	return newTestCluster(t, RingManagerConfig{}, "node-a", "node-b").service(t, "node-a", cfg)
+}
+
+type getSegmentStream struct {
+	ctx  context.Context
+	msgs []*storagepb.GetSegmentResponse
+}
+
+func (s *getSegmentStream) Send(msg *storagepb.GetSegmentResponse) error {
+	s.msgs = append(s.msgs, msg)
+	return nil
+}
+
+func (s *getSegmentStream) Context() context.Context { return s.ctx }
+
+func (s *getSegmentStream) result() ([]byte, bool) {
+	var buf bytes.Buffer
+	eof := false
+	for _, msg := range s.msgs {
+		buf.Write(msg.Chunk)
+		eof = msg.Eof
+	}
+	return buf.Bytes(), eof
+}
+
+func TestGetSegmentRanges(t *testing.T) {
+	svc := newTestService(t, ServiceConfig{})
+	payload := strings.Repeat("0123456789", 30000) // spans several chunks
+	if _, _, err := svc.fs.Put("videos", "v1/720p/1", strings.NewReader(payload)); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	locator := &storagepb.SegmentLocator{Bucket: "videos", Object: "v1/720p/1"}
+
+	cases := []struct {
+		name           string
+		offset, length int64
+		want           string
+		eof            bool
+	}{
+		{name: "whole", want: payload, eof: true},
+		{name: "bounded", offset: 5, length: 10, want: payload[5:15], eof: false},
+		{name: "tail", offset: 299990, want: payload[299990:], eof: true},
+		{name: "length past end", offset: 299995, length: 100, want: payload[299995:], eof: true},
+		{name: "at end", offset: int64(len(payload)), want: "", eof: true},
+		{name: "large bounded", offset: 1, length: 200000, want: payload[1:200001], eof: false},
+	}
+	for _, tc := range cases {
+		stream := &getSegmentStream{ctx: context.Background()}
+		err := svc.GetSegment(&storagepb.GetSegmentRequest{Locator: locator, Offset: tc.offset, Length: tc.length}, stream)
+		if err != nil {
+			t.Fatalf("%s: get failed: %v", tc.name, err)
+		}
+		got, eof := stream.result()
+		if string(got) != tc.want || eof != tc.eof {
+			t.Fatalf("%s: got %d bytes eof=%v, want %d bytes eof=%v", tc.name, len(got), eof, len(tc.want), tc.eof)
+		}
+	}
+
+	errCases := []struct {
+		req  *storagepb.GetSegmentRequest
+		code grpc.Code
+	}{
+		{&storagepb.GetSegmentRequest{}, grpc.InvalidArgument},
+		{&storagepb.GetSegmentRequest{Locator: locator, Offset: -1}, grpc.InvalidArgument},
+		{&storagepb.GetSegmentRequest{Locator: locator, Offset: int64(len(payload)) + 1}, grpc.OutOfRange},
+		{&storagepb.GetSegmentRequest{Locator: &storagepb.SegmentLocator{Bucket: "videos", Object: "missing"}}, grpc.NotFound},
+	}
+	for _, tc := range errCases {
+		err := svc.GetSegment(tc.req, &getSegmentStream{ctx: context.Background()})
+		if grpc.CodeOf(err) != tc.code {
+			t.Fatalf("request %+v: expected %s, got %v", tc.req, tc.code, err)
+		}
+	}
+}
+
+type uploadSegmentStream struct {
+	ctx  context.Context
+	msgs []*storagepb.UploadSegmentRequest
+	resp *storagepb.UploadSegmentResponse
+}
+
+func (s *uploadSegmentStream) Recv() (*storagepb.UploadSegmentRequest, error) {
+	if len(s.msgs) == 0 {
+		return nil, io.EOF
+	}
+	msg := s.msgs[0]
+	s.msgs = s.msgs[1:]
+	return msg, nil
+}
+
+func (s *uploadSegmentStream) SendAndClose(resp *storagepb.UploadSegmentResponse) error {
+	s.resp = resp
+	return nil
+}
+
+func (s *uploadSegmentStream) Context() context.Context { return s.ctx }
+
+func newUploadStream(header *storagepb.UploadSegmentHeader, chunks ...string) *uploadSegmentStream {
+	stream := &uploadSegmentStream{ctx: context.Background()}
+	stream.msgs = append(stream.msgs, storagepb.NewUploadSegmentRequestHeader(header))
+	for _, c := range chunks {
+		stream.msgs = append(stream.msgs, storagepb.NewUploadSegmentRequestChunk([]byte(c)))
+	}
+	stream.msgs = append(stream.msgs, storagepb.NewUploadSegmentRequestCommit())
+	return stream
+}
+
+func TestUploadSegmentStreams(t *testing.T) {
+	transport := NewInProcessReplicationTransport()
+	var replicated bytes.Buffer
+	transport.Register("node-b", func(ctx context.Context, header *storagepb.UploadSegmentHeader, body io.Reader) error {
+		_, err := io.Copy(&replicated, body)
+		return err
+	})
+	svc := newTestService(t, ServiceConfig{Transport: transport, MaxSegmentBytes: 16})
+	locator := &storagepb.SegmentLocator{Bucket: "videos", Object: "v1/720p/1"}
+
+	stream := newUploadStream(&storagepb.UploadSegmentHeader{SegmentId: "v1/720p/1", Locator: locator, SizeBytes: 10}, "01234", "56789")
+	if err := svc.UploadSegment(stream); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	if stream.resp.SizeCommitted != 10 || replicated.String() != "0123456789" {
+		t.Fatalf("unexpected result %+v, replica got %q", stream.resp, replicated.String())
+	}
+
+	other := &storagepb.SegmentLocator{Bucket: "videos", Object: "v1/720p/2"}
+	errCases := []struct {
+		name   string
+		stream *uploadSegmentStream
+	}{
+		{"declared too large", newUploadStream(&storagepb.UploadSegmentHeader{SegmentId: "v1/720p/2", Locator: other, SizeBytes: 17})},
+		{"stream exceeds limit", newUploadStream(&storagepb.UploadSegmentHeader{SegmentId: "v1/720p/2", Locator: other}, "0123456789", "0123456789")},
+		{"stream exceeds declared size", newUploadStream(&storagepb.UploadSegmentHeader{SegmentId: "v1/720p/2", Locator: other, SizeBytes: 4}, "0123456789")},
+		{"stream shorter than declared", newUploadStream(&storagepb.UploadSegmentHeader{SegmentId: "v1/720p/2", Locator: other, SizeBytes: 12}, "0123456789")},
+	}
+	for _, tc := range errCases {
+		if err := svc.UploadSegment(tc.stream); grpc.CodeOf(err) != grpc.InvalidArgument {
+			t.Fatalf("%s: expected InvalidArgument, got %v", tc.name, err)
+		}
+	}
+	if _, err := svc.fs.Stat("videos", "v1/720p/2"); err == nil {
+		t.Fatalf("rejected uploads must not commit an object")
+	}
+}
+
+func TestSegmentChecksums(t *testing.T) {
+	svc := newTestService(t, ServiceConfig{VerifyOnRead: true})
+	locator := &storagepb.SegmentLocator{Bucket: "videos", Object: "v1/720p/1"}
+
+	bad := newUploadStream(&storagepb.UploadSegmentHeader{SegmentId: "v1/720p/1", Locator: locator, Checksum: strings.Repeat("0", 64)}, "payload")
+	if err := svc.UploadSegment(bad); grpc.CodeOf(err) != grpc.InvalidArgument {
+		t.Fatalf("expected mismatched checksum to be rejected, got %v", err)
+	}
+	good := newUploadStream(&storagepb.UploadSegmentHeader{SegmentId: "v1/720p/1", Locator: locator}, "payload")
+	if err := svc.UploadSegment(good); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(svc.fs.root, "videos", "v1/720p/1"), []byte("paylaod"), 0o664); err != nil {
+		t.Fatalf("corrupt failed: %v", err)
+	}
+	stream := &getSegmentStream{ctx: context.Background()}
+	if err := svc.GetSegment(&storagepb.GetSegmentRequest{Locator: locator}, stream); grpc.CodeOf(err) != grpc.DataLoss {
+		t.Fatalf("expected DataLoss for corrupted segment, got %v", err)
+	}
+	if len(stream.msgs) != 0 {
+		t.Fatalf("corrupted data must not be streamed")
+	}
+}
+
+func TestScrubberRepairsFromReplica(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCluster(t, RingManagerConfig{}, "node-a", "node-b")
+	local, peer := c.nodes["node-a"], c.nodes["node-b"]
+
+	put := func(id, primary string, replicas []string, data string) {
+		t.Helper()
+		for _, fs := range []*FS{local, peer} {
+			if _, _, err := fs.Put("segments", id, strings.NewReader(data)); err != nil {
+				t.Fatalf("failed to store %s: %v", id, err)
+			}
+		}
+		sum := sha256.Sum256([]byte(data))
+		record := SegmentRecord{
+			SegmentID:   id,
+			Locator:     storagepb.SegmentLocator{Bucket: "segments", Object: id},
+			PrimaryNode: primary,
+			Replicas:    replicas,
+			Checksum:    hex.EncodeToString(sum[:]),
+			SizeBytes:   int64(len(data)),
+		}
+		if err := c.segments.PutSegment(ctx, record); err != nil {
+			t.Fatalf("failed to record %s: %v", id, err)
+		}
+	}
+	put("healthy", "node-a", []string{"node-b"}, "healthy segment")
+	put("corrupt", "node-b", []string{"node-a", "s3:bucket/corrupt"}, "corrupt segment")
+	put("missing", "node-a", []string{"node-b"}, "missing segment")
+	put("orphan", "node-a", nil, "orphan segment")
+	put("elsewhere", "node-b", []string{"node-c"}, "not ours")
+
+	if err := os.WriteFile(filepath.Join(local.root, "segments", "corrupt"), []byte("c0rrupt segment"), 0o644); err != nil {
+		t.Fatalf("failed to corrupt blob: %v", err)
+	}
+	if err := os.Remove(filepath.Join(local.root, "segments", "missing")); err != nil {
+		t.Fatalf("failed to remove blob: %v", err)
+	}
+	if err := os.Remove(filepath.Join(local.root, "segments", "orphan")); err != nil {
+		t.Fatalf("failed to remove blob: %v", err)
+	}
+
+	scrubber := &Scrubber{NodeID: "node-a", Filesystem: local, Segments: c.segments, Transport: c.transport, BytesPerSecond: -1}
+	report, err := scrubber.ScrubOnce(ctx)
+	if err != nil {
+		t.Fatalf("scrub failed: %v", err)
+	}
+	if report.Checked != 4 {
+		t.Fatalf("expected 4 segments checked, got %d", report.Checked)
+	}
+	if got := strings.Join(report.Corrupted, ","); got != "corrupt" {
+		t.Fatalf("unexpected corrupted segments %q", got)
+	}
+	if got := strings.Join(report.Missing, ","); got != "missing,orphan" {
+		t.Fatalf("unexpected missing segments %q", got)
+	}
+	if got := strings.Join(report.Repaired, ","); got != "corrupt,missing" {
+		t.Fatalf("unexpected repaired segments %q", got)
+	}
+	if len(report.Unrepaired) != 1 || report.Unrepaired["orphan"] == nil {
+		t.Fatalf("expected only orphan to be unrepaired, got %v", report.Unrepaired)
+	}
+	for _, id := range []string{"corrupt", "missing"} {
+		if _, err := local.Verify("segments", id); err != nil {
+			t.Fatalf("repaired segment %s does not verify: %v", id, err)
+		}
+	}
+
+	report, err = scrubber.ScrubOnce(ctx)
+	if err != nil {
+		t.Fatalf("second scrub failed: %v", err)
+	}
+	if len(report.Repaired) != 0 || len(report.Corrupted) != 0 || len(report.Missing) != 1 {
+		t.Fatalf("unexpected second pass report %+v", report)
+	}
+}
+
+func TestHeartbeatRequireRebalance(t *testing.T) {
+	ctx := context.Background()
+	svc := newTestService(t, ServiceConfig{ReplicationFactor: 2})
+	heartbeat := func(id string, vnodes []*storagepb.VirtualNode) bool {
+		t.Helper()
+		resp, err := svc.Heartbeat(ctx, &storagepb.HeartbeatRequest{NodeId: id, VirtualNodes: vnodes})
+		if err != nil {
+			t.Fatalf("heartbeat from %s failed: %v", id, err)
+		}
+		return resp.RequireRebalance
+	}
+	owned := func(id string) []*storagepb.VirtualNode {
+		var out []*storagepb.VirtualNode
+		assignments, _ := svc.ring.Assignments()
+		for _, a := range assignments {
+			if a.NodeID == id {
+				out = append(out, &storagepb.VirtualNode{Id: a.ID, Token: a.Token, OwnerNodeId: id})
+			}
+		}
+		return out
+	}
+
+	heartbeat("node-a", nil)
+	heartbeat("node-b", nil)
+	if !heartbeat("node-c", nil) {
+		t.Fatalf("expected a joining node to be told to rebalance")
+	}
+	involved := map[string]bool{}
+	for _, move := range mustPlan(t, svc.ring, 2).Moves {
+		involved[move.FromNodeId] = true
+		involved[move.ToNodeId] = true
+	}
+	for _, id := range []string{"node-a", "node-b"} {
+		if got := heartbeat(id, nil); got != involved[id] {
+			t.Fatalf("%s: RequireRebalance = %v after node-c joined, want %v", id, got, involved[id])
+		}
+		if heartbeat(id, nil) {
+			t.Fatalf("%s: expected RequireRebalance to clear once the change was reported", id)
+		}
+	}
+	if heartbeat("node-c", owned("node-c")) {
+		t.Fatalf("expected no rebalance when reported virtual nodes match the ring")
+	}
+	if !heartbeat("node-c", []*storagepb.VirtualNode{{Token: 42, OwnerNodeId: "node-c"}}) {
+		t.Fatalf("expected rebalance when reported virtual nodes differ from the ring")
+	}
+}
+
+func TestExpireNodes(t *testing.T) {
+	ctx := context.Background()
+	svc := newTestService(t, ServiceConfig{ReplicationFactor: 2})
+	ring := svc.ring
+	ttl := 50 * time.Millisecond
+	if _, err := svc.Heartbeat(ctx, &storagepb.HeartbeatRequest{NodeId: "node-b"}); err != nil {
+		t.Fatalf("heartbeat failed: %v", err)
+	}
+	time.Sleep(2 * ttl)
+	if _, err := svc.Heartbeat(ctx, &storagepb.HeartbeatRequest{NodeId: "node-a"}); err != nil {
+		t.Fatalf("heartbeat failed: %v", err)
+	}
+
+	suspect, removed, err := ring.ExpireNodes(ctx, time.Now(), ttl, time.Hour)
+	if err != nil {
+		t.Fatalf("expire failed: %v", err)
+	}
+	if strings.Join(suspect, ",") != "node-b" || len(removed) != 0 {
+		t.Fatalf("expected node-b suspect, got suspect=%v removed=%v", suspect, removed)
+	}
+	if node, _ := ring.Node("node-b"); !node.Suspect() {
+		t.Fatalf("expected node-b to be recorded as suspect")
+	}
+	if len(ring.Nodes()) != 2 {
+		t.Fatalf("suspect node must stay in the ring during the grace period")
+	}
+
+	_, before := ring.PreviousAssignments()
+	suspect, removed, err = ring.ExpireNodes(ctx, time.Now().Add(2*time.Hour), ttl, time.Hour)
+	if err != nil {
+		t.Fatalf("expire failed: %v", err)
+	}
+	if strings.Join(suspect, ",") != "node-a" || strings.Join(removed, ",") != "node-b" {
+		t.Fatalf("expected node-a suspect and node-b removed, got suspect=%v removed=%v", suspect, removed)
+	}
+	if _, ok := ring.Node("node-b"); ok {
+		t.Fatalf("expected node-b to leave the ring")
+	}
+	plan := mustPlan(t, ring, 2)
+	if plan.PreviousRingVersion == before || len(plan.Moves) == 0 {
+		t.Fatalf("expected removal to produce a rebalance plan, got %+v", plan)
+	}
+	for _, move := range plan.Moves {
+		if move.FromNodeId != "node-b" {
+			t.Fatalf("unexpected move %+v after removing node-b", move)
+		}
+	}
+
+	if _, err := svc.Heartbeat(ctx, &storagepb.HeartbeatRequest{NodeId: "node-a"}); err != nil {
+		t.Fatalf("heartbeat failed: %v", err)
+	}
+	if node, _ := ring.Node("node-a"); node.Suspect() {
+		t.Fatalf("expected heartbeat to clear suspicion")
+	}
+}
+
+func TestConcurrentRingManagers(t *testing.T) {
+	ctx := context.Background()
+	etcd, err := etcdsim.New(etcdsim.Config{})
+	if err != nil {
+		t.Fatalf("failed to create etcd sim: %v", err)
+	}
+	managers := make([]*RingManager, 4)
+	for i := range managers {
+		if managers[i], err = NewRingManager(RingManagerConfig{Etcd: etcd, VirtualNodes: 8, MaxAttempts: 64}); err != nil {
+			t.Fatalf("failed to create ring manager: %v", err)
+		}
+	}
+
+	// Every node heartbeats through its own manager without seeing the others' writes.
+	var wg sync.WaitGroup
+	for i, m := range managers {
+		wg.Add(1)
+		go func(i int, m *RingManager) {
+			defer wg.Done()
+			for round := 0; round < 5; round++ {
+				if _, err := m.UpsertNode(ctx, NodeDescriptor{ID: fmt.Sprintf("node-%d", i)}); err != nil {
+					t.Errorf("upsert failed: %v", err)
+					return
+				}
+			}
+		}(i, m)
+	}
+	wg.Wait()
+
+	var conflicts int64
+	for _, m := range managers {
+		conflicts += m.Conflicts()
+	}
+	if conflicts == 0 {
+		t.Fatalf("expected stale managers to hit compare-and-swap conflicts")
+	}
+	fresh, err := NewRingManager(RingManagerConfig{Etcd: etcd, VirtualNodes: 8})
+	if err != nil {
+		t.Fatalf("failed to create ring manager: %v", err)
+	}
+	if nodes := fresh.Nodes(); len(nodes) != len(managers) {
+		t.Fatalf("expected every node to survive concurrent heartbeats, got %v", nodes)
+	}
+	if _, version := fresh.Assignments(); version != int64(5*len(managers)) {
+		t.Fatalf("expected one ring version per heartbeat, got %d", version)
+	}
+
+	// A manager that cannot win the compare-and-swap surfaces the conflict.
+	stale, err := NewRingManager(RingManagerConfig{Etcd: etcd, VirtualNodes: 8, MaxAttempts: 1})
+	if err != nil {
+		t.Fatalf("failed to create ring manager: %v", err)
+	}
+	if _, err := fresh.UpsertNode(ctx, NodeDescriptor{ID: "node-x"}); err != nil {
+		t.Fatalf("upsert failed: %v", err)
+	}
+	if _, err := stale.UpsertNode(ctx, NodeDescriptor{ID: "node-y"}); !errors.Is(err, ErrRingConflict) {
+		t.Fatalf("expected ErrRingConflict, got %v", err)
+	}
+	if _, err := stale.UpsertNode(ctx, NodeDescriptor{ID: "node-y"}); err != nil {
+		t.Fatalf("expected retry after reload to succeed, got %v", err)
+	}
+	if _, ok := stale.Node("node-x"); !ok {
+		t.Fatalf("expected the retried update to keep node-x")
+	}
+}
+
+func TestRingUpdateFailureKeepsStoredState(t *testing.T) {
+	ctx := context.Background()
+	etcd, err := etcdsim.New(etcdsim.Config{})
+	if err != nil {
+		t.Fatalf("failed to create etcd sim: %v", err)
+	}
+	m, err := NewRingManager(RingManagerConfig{Etcd: etcd, VirtualNodes: 8})
+	if err != nil {
+		t.Fatalf("failed to create ring manager: %v", err)
+	}
+	if _, err := m.UpsertNode(ctx, NodeDescriptor{ID: "node-a"}); err != nil {
+		t.Fatalf("upsert failed: %v", err)
+	}
+	before := m.Snapshot()
+
+	// The write to etcd fails, so the new node must not be served either.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := m.UpsertNode(cancelled, NodeDescriptor{ID: "node-b"}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the failed write to be reported, got %v", err)
+	}
+	if _, ok := m.Node("node-b"); ok {
+		t.Fatalf("expected the unpersisted node to be dropped")
+	}
+	if _, version := m.Assignments(); version != before.Version {
+		t.Fatalf("expected ring version %d after the failed write, got %d", before.Version, version)
+	}
+	if got := m.Lookup([]byte("v1/720p/1"), 2); len(got) != 1 || got[0] != "node-a" {
+		t.Fatalf("expected lookups to use the stored ring, got %v", got)
+	}
+	if _, err := m.UpsertNode(ctx, NodeDescriptor{ID: "node-b"}); err != nil {
+		t.Fatalf("upsert after the failure failed: %v", err)
+	}
+	if _, version := m.Assignments(); version != before.Version+1 {
+		t.Fatalf("expected ring version %d, got %d", before.Version+1, version)
+	}
+}
+
+func TestRingPlacementIsClusterState(t *testing.T) {
+	ctx := context.Background()
+	etcd, err := etcdsim.New(etcdsim.Config{})
+	if err != nil {
+		t.Fatalf("failed to create etcd sim: %v", err)
+	}
+	creator, err := NewRingManager(RingManagerConfig{Etcd: etcd, VirtualNodes: 8, Placement: chash.AlgorithmBoundedLoad})
+	if err != nil {
+		t.Fatalf("failed to create ring manager: %v", err)
+	}
+	for _, id := range []string{"node-a", "node-b", "node-c"} {
+		if _, err := creator.UpsertNode(ctx, NodeDescriptor{ID: id}); err != nil {
+			t.Fatalf("upsert failed: %v", err)
+		}
+	}
+
+	// An unconfigured manager adopts the ring's algorithm and keeps it on heartbeats.
+	adopter, err := NewRingManager(RingManagerConfig{Etcd: etcd, VirtualNodes: 8})
+	if err != nil {
+		t.Fatalf("failed to create ring manager: %v", err)
+	}
+	if _, err := adopter.UpsertNode(ctx, NodeDescriptor{ID: "node-a"}); err != nil {
+		t.Fatalf("upsert failed: %v", err)
+	}
+	if got := adopter.Snapshot().Placement; got != chash.AlgorithmBoundedLoad {
+		t.Fatalf("expected the ring to keep bounded-load, got %s", got)
+	}
+	if _, err := NewRingManager(RingManagerConfig{Etcd: etcd, VirtualNodes: 8, Placement: chash.AlgorithmRendezvous}); err == nil {
+		t.Fatalf("expected a manager configured with another placement to fail")
+	}
+
+	before := adopter.Snapshot()
+	version, err := adopter.SetPlacement(ctx, chash.AlgorithmRendezvous)
+	if err != nil {
+		t.Fatalf("failed to switch placement: %v", err)
+	}
+	previous := adopter.PreviousSnapshot()
+	if adopter.Snapshot().Placement != chash.AlgorithmRendezvous || previous.Placement != chash.AlgorithmBoundedLoad || previous.Version != before.Version {
+		t.Fatalf("expected the switch at version %d to roll bounded-load into the previous ring, got %+v", version, previous)
+	}
+	if plan := mustPlan(t, adopter, 2); len(plan.Moves) == 0 {
+		t.Fatalf("expected switching placement to plan moves")
+	}
+	if _, err := adopter.SetPlacement(ctx, "round-robin"); err == nil {
+		t.Fatalf("expected an unknown placement to be rejected")
+	}
+
+	// A ring stored with an unknown algorithm is reported rather than loaded.
+	if _, err := etcd.Put(ctx, "/storage/corrupt/ring", `{"version":1,"placement":"round-robin"}`); err != nil {
+		t.Fatalf("failed to store ring: %v", err)
+	}
+	if _, err := NewRingManager(RingManagerConfig{Etcd: etcd, Prefix: "/storage/corrupt"}); err == nil {
+		t.Fatalf("expected a ring with an unknown placement to be rejected")
+	}
+}
+
+func TestCapacityWeightedRing(t *testing.T) {
+	ctx := context.Background()
+	const tb = int64(1) << 40
+	ring := newTestCluster(t, RingManagerConfig{VirtualNodes: 32, ReferenceCapacityBytes: tb, MaxVirtualNodes: 320}).ring
+	for _, node := range []NodeDescriptor{
+		{ID: "small", CapacityBytes: tb},
+		{ID: "large", CapacityBytes: 10 * tb, AvailableBytes: tb},
+		{ID: "huge", CapacityBytes: 100 * tb},
+		{ID: "unknown"},
+	} {
+		if _, err := ring.UpsertNode(ctx, node); err != nil {
+			t.Fatalf("upsert failed: %v", err)
+		}
+	}
+	assignments, _ := ring.Assignments()
+	vnodes := map[string]int{}
+	for _, a := range assignments {
+		vnodes[a.NodeID]++
+	}
+	if vnodes["small"] != 32 || vnodes["large"] != 320 || vnodes["huge"] != 320 || vnodes["unknown"] != 32 {
+		t.Fatalf("unexpected virtual node counts %v", vnodes)
+	}
+
+	if _, err := ring.RemoveNode(ctx, "huge"); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	owned := map[string]int{}
+	for i := 0; i < 20000; i++ {
+		owned[ring.Lookup([]byte(fmt.Sprintf("video-%d/720p/%d", i/8, i%8)), 1)[0]]++
+	}
+	if ratio := float64(owned["large"]) / float64(owned["small"]); ratio < 6 || ratio > 15 {
+		t.Fatalf("expected the 10 TB node to own about 10x the 1 TB node's segments, got %v", owned)
+	}
+
+	// Growing a node's capacity only adds tokens; its existing tokens stay put.
+	before := map[uint64]string{}
+	for _, a := range assignments {
+		before[a.Token] = a.NodeID
+	}
+	if _, err := ring.UpsertNode(ctx, NodeDescriptor{ID: "small", CapacityBytes: 2 * tb}); err != nil {
+		t.Fatalf("upsert failed: %v", err)
+	}
+	after, _ := ring.Assignments()
+	kept := 0
+	for _, a := range after {
+		if a.NodeID == "small" && before[a.Token] == "small" {
+			kept++
+		}
+	}
+	if kept != 32 {
+		t.Fatalf("expected all 32 original tokens of small to survive, kept %d", kept)
+	}
+}
+
+func TestZoneAwarePlacement(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCluster(t, RingManagerConfig{VirtualNodes: 16, ZoneAware: true})
+	ring := c.ring
+	svc := c.service(t, "node-a", ServiceConfig{Filesystem: NewFS(t.TempDir()), ReplicationFactor: 3})
+	heartbeat := func(id, zone, rack string) {
+		t.Helper()
+		if _, err := svc.Heartbeat(ctx, &storagepb.HeartbeatRequest{NodeId: id, Zone: zone, Rack: rack}); err != nil {
+			t.Fatalf("heartbeat failed: %v", err)
+		}
+	}
+	heartbeat("a1", "us-east-1a", "r1")
+	heartbeat("a2", "us-east-1a", "r1")
+	heartbeat("a3", "us-east-1a", "r2")
+	heartbeat("b1", "us-east-1b", "r1")
+	heartbeat("b2", "us-east-1b", "r1")
+
+	zoneOf := map[string]string{}
+	for _, node := range ring.Nodes() {
+		zoneOf[node.ID] = node.Zone + "/" + node.Rack
+	}
+	// Two zones for three replicas: both zones are used and the third replica goes to
+	// an unused rack before doubling up on one.
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("video-%d/720p/%d", i/4, i%4))
+		owners := ring.Lookup(key, 3)
+		if len(owners) != 3 {
+			t.Fatalf("expected 3 replicas, got %v", owners)
+		}
+		zones, racks := map[string]bool{}, map[string]bool{}
+		for _, node := range owners {
+			zones[strings.Split(zoneOf[node], "/")[0]] = true
+			racks[zoneOf[node]] = true
+		}
+		if len(zones) != 2 || len(racks) != 3 {
+			t.Fatalf("replicas %v not spread across zones and racks", owners)
+		}
+	}
+
+	heartbeat("c1", "us-east-1c", "r1")
+	zoneOf["c1"] = "us-east-1c/r1"
+	planRing, err := placementFor(ring.Snapshot())
+	if err != nil {
+		t.Fatalf("failed to rebuild placement: %v", err)
+	}
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("video-%d/1080p/%d", i/4, i%4))
+		owners := ring.Lookup(key, 3)
+		zones := map[string]bool{}
+		for _, node := range owners {
+			zones[strings.Split(zoneOf[node], "/")[0]] = true
+		}
+		if len(zones) != 3 {
+			t.Fatalf("expected one replica per zone, got %v", owners)
+		}
+		if planned := planRing.Lookup(key, 3); !equalStrings(planned, owners) {
+			t.Fatalf("rebalance plans place %s on %v, ring places it on %v", key, planned, owners)
+		}
+	}
+}
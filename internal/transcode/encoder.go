@@ -0,0 +1,267 @@
+package transcode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	webapipb "tritontube/internal/webapi/proto"
+)
+
+// Result is produced by an Encoder for a successfully transcoded job.
+type Result struct {
+	Renditions      []*webapipb.VideoRendition
+	ManifestPath    string
+	HLSManifestPath string
+	DurationSeconds int64
+}
+
+// ProgressFunc receives progress updates in percent (0-100).
+type ProgressFunc func(percent float64)
+
+// Encoder turns a mezzanine file into streamable renditions.
+type Encoder interface {
+	Transcode(ctx context.Context, job Job, progress ProgressFunc) (*Result, error)
+}
+
+// PermanentError marks a failure that retrying cannot fix, e.g. a corrupt source.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+// Permanent wraps err so the worker fails the job without further retries.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// IsPermanent reports whether err was marked with Permanent.
+func IsPermanent(err error) bool {
+	var pe *PermanentError
+	return errors.As(err, &pe)
+}
+
+// Rendition describes an output ladder rung.
+type Rendition struct {
+	Name        string
+	Height      int
+	BitrateKbps int32
+}
+
+// DefaultLadder is the 1080p/720p/480p ladder described in the architecture doc.
+var DefaultLadder = []Rendition{
+	{Name: "1080p", Height: 1080, BitrateKbps: 5000},
+	{Name: "720p", Height: 720, BitrateKbps: 2800},
+	{Name: "480p", Height: 480, BitrateKbps: 1400},
+}
+
+func ladderFor(job Job) []Rendition {
+	if len(job.Renditions) == 0 {
+		return DefaultLadder
+	}
+	var out []Rendition
+	for _, name := range job.Renditions {
+		for _, r := range DefaultLadder {
+			if r.Name == name {
+				out = append(out, r)
+			}
+		}
+	}
+	return out
+}
+
+func renditionsFor(job Job, ladder []Rendition, manifestPath string) []*webapipb.VideoRendition {
+	out := make([]*webapipb.VideoRendition, 0, len(ladder))
+	for _, r := range ladder {
+		out = append(out, &webapipb.VideoRendition{
+			Quality:      r.Name,
+			Codec:        "h264",
+			BitrateKbps:  r.BitrateKbps,
+			SegmentPath:  job.OutputPrefix + "/" + r.Name,
+			ManifestPath: manifestPath,
+		})
+	}
+	return out
+}
+
+// FakeEncoder produces renditions without running ffmpeg. It is used by tests and by
+// cmd/transcode-worker in environments without codecs.
+type FakeEncoder struct {
+	// Fail, when set, is consulted before every attempt and may return an error.
+	Fail func(job Job, attempt int) error
+
+	mu       sync.Mutex
+	attempts map[string]int
+}
+
+// Attempts returns how many times the job was handed to the encoder.
+func (e *FakeEncoder) Attempts(jobID string) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.attempts[jobID]
+}
+
+// Transcode implements Encoder.
+func (e *FakeEncoder) Transcode(ctx context.Context, job Job, progress ProgressFunc) (*Result, error) {
+	e.mu.Lock()
+	if e.attempts == nil {
+		e.attempts = map[string]int{}
+	}
+	e.attempts[job.ID]++
+	attempt := e.attempts[job.ID]
+	e.mu.Unlock()
+
+	if e.Fail != nil {
+		if err := e.Fail(job, attempt); err != nil {
+			return nil, err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ladder := ladderFor(job)
+	for i := range ladder {
+		progress(float64(i+1) * 100 / float64(len(ladder)))
+	}
+	return resultFor(job, ladder), nil
+}
+
+// resultFor points at the manifests cmd/web generates under the job's output prefix.
+func resultFor(job Job, ladder []Rendition) *Result {
+	manifest := job.OutputPrefix + "/manifest.mpd"
+	return &Result{
+		Renditions:      renditionsFor(job, ladder, manifest),
+		ManifestPath:    manifest,
+		HLSManifestPath: job.OutputPrefix + "/master.m3u8",
+	}
+}
+
+// SegmentUploader stores one generated segment; idx is "init" for initialization
+// segments and the 1-based segment number otherwise.
+type SegmentUploader func(ctx context.Context, videoID, rendition, idx string, body io.Reader) error
+
+// FFmpegEncoder runs ffmpeg once per job, producing fragmented MP4 DASH output for every
+// rendition, and uploads the resulting segments.
+type FFmpegEncoder struct {
+	// Binary is the ffmpeg executable (default "ffmpeg").
+	Binary string
+	// SourceURL resolves the mezzanine location passed to ffmpeg's -i.
+	SourceURL func(job Job) string
+	// Upload stores every generated segment.
+	Upload SegmentUploader
+	// WorkDir is the parent of per-job scratch directories (default os.TempDir()).
+	WorkDir string
+	// SegmentSeconds is the target DASH segment duration (default 4).
+	SegmentSeconds int
+}
+
+var ffmpegSegmentName = regexp.MustCompile(`^(init|chunk)-(\d+)(?:-(\d+))?\.m4s$`)
+
+// Transcode implements Encoder.
+func (e *FFmpegEncoder) Transcode(ctx context.Context, job Job, progress ProgressFunc) (*Result, error) {
+	if e.SourceURL == nil || e.Upload == nil {
+		return nil, Permanent(errors.New("transcode: ffmpeg encoder needs SourceURL and Upload"))
+	}
+	binary := e.Binary
+	if binary == "" {
+		binary = "ffmpeg"
+	}
+	segSeconds := e.SegmentSeconds
+	if segSeconds <= 0 {
+		segSeconds = 4
+	}
+	ladder := ladderFor(job)
+	if len(ladder) == 0 {
+		return nil, Permanent(fmt.Errorf("transcode: job %s requests no known renditions", job.ID))
+	}
+
+	dir, err := os.MkdirTemp(e.WorkDir, "transcode-"+job.ID+"-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	args := []string{"-hide_banner", "-nostdin", "-y", "-i", e.SourceURL(job)}
+	for range ladder {
+		args = append(args, "-map", "0:v:0")
+	}
+	for i, r := range ladder {
+		args = append(args,
+			fmt.Sprintf("-filter:v:%d", i), fmt.Sprintf("scale=-2:%d", r.Height),
+			fmt.Sprintf("-b:v:%d", i), fmt.Sprintf("%dk", r.BitrateKbps),
+		)
+	}
+	args = append(args,
+		"-c:v", "libx264", "-preset", "veryfast", "-an",
+		"-f", "dash",
+		"-seg_duration", fmt.Sprint(segSeconds),
+		"-use_template", "1", "-use_timeline", "1",
+		"-init_seg_name", "init-$RepresentationID$.m4s",
+		"-media_seg_name", "chunk-$RepresentationID$-$Number$.m4s",
+		filepath.Join(dir, "manifest.mpd"),
+	)
+	cmd := exec.CommandContext(ctx, binary, args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		tail := string(out)
+		if len(tail) > 512 {
+			tail = tail[len(tail)-512:]
+		}
+		return nil, fmt.Errorf("transcode: ffmpeg failed: %w: %s", err, strings.TrimSpace(tail))
+	}
+	progress(50)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if ffmpegSegmentName.MatchString(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		m := ffmpegSegmentName.FindStringSubmatch(name)
+		stream, _ := strconv.Atoi(m[2])
+		if stream >= len(ladder) {
+			continue
+		}
+		idx := "init"
+		if m[1] == "chunk" {
+			idx = m[3]
+		}
+		if err := e.uploadFile(ctx, job.VideoID, ladder[stream].Name, idx, filepath.Join(dir, name)); err != nil {
+			return nil, err
+		}
+		progress(50 + float64(i+1)*50/float64(len(names)))
+	}
+
+	return resultFor(job, ladder), nil
+}
+
+func (e *FFmpegEncoder) uploadFile(ctx context.Context, videoID, rendition, idx, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return e.Upload(ctx, videoID, rendition, idx, f)
+}
@@ -0,0 +1,264 @@
+package transcode
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"tritontube/internal/metadata"
+	grpc "tritontube/internal/metadata/grpcstub"
+)
+
+// MetadataQueue stores jobs as metadata items under queue/<name>/<job id>. Leases are
+// taken with version-guarded writes, so any number of workers can share the queue
+// through the metadata service without a separate broker.
+type MetadataQueue struct {
+	client metadata.MetadataServiceClient
+	name   string
+	clock  func() time.Time
+}
+
+// MetadataQueueConfig configures a MetadataQueue.
+type MetadataQueueConfig struct {
+	Client metadata.MetadataServiceClient
+	Name   string
+	Clock  func() time.Time
+}
+
+// NewMetadataQueue constructs a queue backed by the metadata service.
+func NewMetadataQueue(cfg MetadataQueueConfig) (*MetadataQueue, error) {
+	if cfg.Client == nil {
+		return nil, errors.New("transcode: metadata client is required")
+	}
+	if cfg.Name == "" {
+		cfg.Name = DefaultQueueName
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = time.Now
+	}
+	return &MetadataQueue{client: cfg.Client, name: cfg.Name, clock: cfg.Clock}, nil
+}
+
+func (q *MetadataQueue) prefix() string {
+	return "queue/" + q.name + "/"
+}
+
+func (q *MetadataQueue) deadPrefix() string {
+	return "queue/" + q.name + ".dlq/"
+}
+
+// Enqueue implements Queue.
+func (q *MetadataQueue) Enqueue(ctx context.Context, job Job) error {
+	if job.ID == "" {
+		return errors.New("transcode: job id is required")
+	}
+	now := q.clock().UTC()
+	if job.EnqueuedAt.IsZero() {
+		job.EnqueuedAt = now
+	}
+	encoded, err := json.Marshal(&message{Job: job, VisibleAt: now})
+	if err != nil {
+		return fmt.Errorf("transcode: failed to encode job: %w", err)
+	}
+	// The create-only write makes enqueueing a job that is already queued a no-op, even
+	// when two callers race.
+	_, err = q.client.PutMetadata(ctx, &metadata.PutMetadataRequest{
+		Item:                 &metadata.MetadataItem{Key: q.prefix() + job.ID, Value: string(encoded)},
+		ExpectedEtcdRevision: -1,
+		CreateOnly:           true,
+	})
+	if grpc.CodeOf(err) == grpc.AlreadyExists {
+		return nil
+	}
+	return err
+}
+
+// Receive implements Queue.
+func (q *MetadataQueue) Receive(ctx context.Context, visibility time.Duration) (*Delivery, error) {
+	now := q.clock().UTC()
+	type candidate struct {
+		msg     *message
+		version int64
+	}
+	var candidates []candidate
+	token := ""
+	for {
+		resp, err := q.client.ListMetadata(ctx, &metadata.ListMetadataRequest{Prefix: q.prefix(), Limit: 100, PageToken: token})
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range resp.Items {
+			var m message
+			if err := json.Unmarshal([]byte(item.Value), &m); err != nil {
+				continue
+			}
+			if !m.VisibleAt.After(now) {
+				candidates = append(candidates, candidate{msg: &m, version: item.Version})
+			}
+		}
+		if resp.NextPageToken == "" {
+			break
+		}
+		token = resp.NextPageToken
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].msg.Job.EnqueuedAt.Before(candidates[j].msg.Job.EnqueuedAt)
+	})
+	for _, c := range candidates {
+		receipt, err := newReceipt()
+		if err != nil {
+			return nil, err
+		}
+		m := c.msg
+		m.Attempts++
+		m.VisibleAt = now.Add(visibility)
+		m.Receipt = receipt
+		_, err = q.store(ctx, q.prefix()+m.Job.ID, m, c.version)
+		if err == nil {
+			return &Delivery{Job: m.Job, Attempt: m.Attempts, Receipt: receipt, LastError: m.LastError}, nil
+		}
+		// Another worker leased or acked the job first; try the next one.
+		if code := grpc.CodeOf(err); code != grpc.FailedPrecondition && code != grpc.NotFound {
+			return nil, err
+		}
+	}
+	return nil, ErrQueueEmpty
+}
+
+// Extend implements Queue.
+func (q *MetadataQueue) Extend(ctx context.Context, d *Delivery, visibility time.Duration) error {
+	return q.mutateLeased(ctx, d, func(m *message) {
+		m.VisibleAt = q.clock().UTC().Add(visibility)
+	})
+}
+
+// Ack implements Queue.
+func (q *MetadataQueue) Ack(ctx context.Context, d *Delivery) error {
+	_, version, err := q.leased(ctx, d)
+	if err != nil {
+		return err
+	}
+	_, err = q.client.DeleteMetadata(ctx, &metadata.DeleteMetadataRequest{Key: q.prefix() + d.Job.ID, ExpectedVersion: version, ExpectedEtcdRevision: -1})
+	return leaseErr(err)
+}
+
+// Retry implements Queue.
+func (q *MetadataQueue) Retry(ctx context.Context, d *Delivery, delay time.Duration, reason string) error {
+	return q.mutateLeased(ctx, d, func(m *message) {
+		m.VisibleAt = q.clock().UTC().Add(delay)
+		m.Receipt = ""
+		m.LastError = reason
+	})
+}
+
+// DeadLetter implements Queue.
+func (q *MetadataQueue) DeadLetter(ctx context.Context, d *Delivery, reason string) error {
+	m, version, err := q.leased(ctx, d)
+	if err != nil {
+		return err
+	}
+	dead := DeadLetter{Job: m.Job, Attempts: m.Attempts, Reason: reason, FailedAt: q.clock().UTC()}
+	encoded, err := json.Marshal(dead)
+	if err != nil {
+		return fmt.Errorf("transcode: failed to encode dead letter: %w", err)
+	}
+	if _, err := q.client.PutMetadata(ctx, &metadata.PutMetadataRequest{
+		Item:                 &metadata.MetadataItem{Key: q.deadPrefix() + d.Job.ID, Value: string(encoded)},
+		ExpectedEtcdRevision: -1,
+	}); err != nil {
+		return err
+	}
+	_, err = q.client.DeleteMetadata(ctx, &metadata.DeleteMetadataRequest{Key: q.prefix() + d.Job.ID, ExpectedVersion: version, ExpectedEtcdRevision: -1})
+	return leaseErr(err)
+}
+
+// DeadLetters lists the dead-lettered jobs.
+func (q *MetadataQueue) DeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	var out []DeadLetter
+	token := ""
+	for {
+		resp, err := q.client.ListMetadata(ctx, &metadata.ListMetadataRequest{Prefix: q.deadPrefix(), Limit: 100, PageToken: token})
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range resp.Items {
+			var dead DeadLetter
+			if err := json.Unmarshal([]byte(item.Value), &dead); err == nil {
+				out = append(out, dead)
+			}
+		}
+		if resp.NextPageToken == "" {
+			return out, nil
+		}
+		token = resp.NextPageToken
+	}
+}
+
+func (q *MetadataQueue) mutateLeased(ctx context.Context, d *Delivery, fn func(*message)) error {
+	m, version, err := q.leased(ctx, d)
+	if err != nil {
+		return err
+	}
+	fn(m)
+	_, err = q.store(ctx, q.prefix()+d.Job.ID, m, version)
+	return leaseErr(err)
+}
+
+func (q *MetadataQueue) leased(ctx context.Context, d *Delivery) (*message, int64, error) {
+	if d == nil {
+		return nil, 0, errors.New("transcode: delivery is required")
+	}
+	m, version, err := q.load(ctx, d.Job.ID)
+	if err != nil {
+		return nil, 0, leaseErr(err)
+	}
+	if m.Receipt != d.Receipt {
+		return nil, 0, ErrLeaseLost
+	}
+	return m, version, nil
+}
+
+func (q *MetadataQueue) load(ctx context.Context, id string) (*message, int64, error) {
+	resp, err := q.client.GetMetadata(ctx, &metadata.GetMetadataRequest{Key: q.prefix() + id})
+	if err != nil {
+		return nil, 0, err
+	}
+	var m message
+	if err := json.Unmarshal([]byte(resp.Item.Value), &m); err != nil {
+		return nil, 0, fmt.Errorf("transcode: failed to decode job %s: %w", id, err)
+	}
+	return &m, resp.Item.Version, nil
+}
+
+func (q *MetadataQueue) store(ctx context.Context, key string, m *message, expectedVersion int64) (int64, error) {
+	encoded, err := json.Marshal(m)
+	if err != nil {
+		return 0, fmt.Errorf("transcode: failed to encode job: %w", err)
+	}
+	resp, err := q.client.PutMetadata(ctx, &metadata.PutMetadataRequest{
+		Item:                 &metadata.MetadataItem{Key: key, Value: string(encoded)},
+		ExpectedVersion:      expectedVersion,
+		ExpectedEtcdRevision: -1,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Item.Version, nil
+}
+
+// leaseErr maps version conflicts on an existing lease to ErrLeaseLost.
+func leaseErr(err error) error {
+	switch grpc.CodeOf(err) {
+	case grpc.OK:
+		return nil
+	case grpc.FailedPrecondition, grpc.NotFound:
+		return fmt.Errorf("%w: %v", ErrLeaseLost, err)
+	default:
+		return err
+	}
+}
+
+var _ Queue = (*MetadataQueue)(nil)
@@ -0,0 +1,229 @@
+package transcode
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultQueueName is the queue used between the web tier and transcode workers.
+const DefaultQueueName = "transcode-jobs"
+
+// Job describes a single transcode request for an uploaded mezzanine file.
+type Job struct {
+	// ID identifies the job. The web tier uses the video id so that enqueueing is
+	// naturally idempotent.
+	ID           string    `json:"id"`
+	VideoID      string    `json:"video_id"`
+	SourceBucket string    `json:"source_bucket"`
+	SourceKey    string    `json:"source_key"`
+	Renditions   []string  `json:"renditions,omitempty"`
+	OutputPrefix string    `json:"output_prefix,omitempty"`
+	EnqueuedAt   time.Time `json:"enqueued_at"`
+}
+
+// Delivery is a job leased to a worker. The lease lasts until the visibility timeout
+// elapses, after which the job becomes receivable again.
+type Delivery struct {
+	Job     Job
+	Attempt int
+	// Receipt identifies this particular lease; stale receipts are rejected.
+	Receipt string
+	// LastError is the failure recorded by the previous attempt, if any.
+	LastError string
+}
+
+// ErrQueueEmpty is returned by Receive when no job is currently visible.
+var ErrQueueEmpty = errors.New("transcode: queue empty")
+
+// ErrLeaseLost is returned when a delivery's lease expired and was handed to another worker.
+var ErrLeaseLost = errors.New("transcode: lease lost")
+
+// Queue abstracts the transcode-jobs queue so that SQS/RabbitMQ can be swapped in for
+// the in-memory and metadata-backed implementations.
+type Queue interface {
+	// Enqueue adds a job. Enqueueing a job whose ID is already queued is a no-op.
+	Enqueue(ctx context.Context, job Job) error
+	// Receive leases the next visible job for the visibility timeout.
+	Receive(ctx context.Context, visibility time.Duration) (*Delivery, error)
+	// Extend pushes the lease deadline of an in-flight delivery.
+	Extend(ctx context.Context, d *Delivery, visibility time.Duration) error
+	// Ack removes a successfully processed job.
+	Ack(ctx context.Context, d *Delivery) error
+	// Retry releases the job so it becomes visible again after delay.
+	Retry(ctx context.Context, d *Delivery, delay time.Duration, reason string) error
+	// DeadLetter moves a job that cannot be processed to the dead-letter queue.
+	DeadLetter(ctx context.Context, d *Delivery, reason string) error
+}
+
+// DeadLetter is a job parked after exhausting its retries.
+type DeadLetter struct {
+	Job      Job       `json:"job"`
+	Attempts int       `json:"attempts"`
+	Reason   string    `json:"reason"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+type message struct {
+	Job       Job       `json:"job"`
+	Attempts  int       `json:"attempts"`
+	VisibleAt time.Time `json:"visible_at"`
+	Receipt   string    `json:"receipt,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// MemoryQueue is an in-process Queue, primarily useful for tests and single binary setups.
+type MemoryQueue struct {
+	mu       sync.Mutex
+	messages map[string]*message
+	dead     []DeadLetter
+	clock    func() time.Time
+}
+
+// NewMemoryQueue constructs an empty in-memory queue. A nil clock defaults to time.Now.
+func NewMemoryQueue(clock func() time.Time) *MemoryQueue {
+	if clock == nil {
+		clock = time.Now
+	}
+	return &MemoryQueue{messages: map[string]*message{}, clock: clock}
+}
+
+// Enqueue implements Queue.
+func (q *MemoryQueue) Enqueue(ctx context.Context, job Job) error {
+	if job.ID == "" {
+		return errors.New("transcode: job id is required")
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.messages[job.ID]; ok {
+		return nil
+	}
+	now := q.clock()
+	if job.EnqueuedAt.IsZero() {
+		job.EnqueuedAt = now
+	}
+	q.messages[job.ID] = &message{Job: job, VisibleAt: now}
+	return nil
+}
+
+// Receive implements Queue. Jobs are handed out in enqueue order.
+func (q *MemoryQueue) Receive(ctx context.Context, visibility time.Duration) (*Delivery, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.clock()
+	var candidates []*message
+	for _, m := range q.messages {
+		if !m.VisibleAt.After(now) {
+			candidates = append(candidates, m)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, ErrQueueEmpty
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Job.EnqueuedAt.Equal(candidates[j].Job.EnqueuedAt) {
+			return candidates[i].Job.ID < candidates[j].Job.ID
+		}
+		return candidates[i].Job.EnqueuedAt.Before(candidates[j].Job.EnqueuedAt)
+	})
+	m := candidates[0]
+	receipt, err := newReceipt()
+	if err != nil {
+		return nil, err
+	}
+	m.Attempts++
+	m.VisibleAt = now.Add(visibility)
+	m.Receipt = receipt
+	return &Delivery{Job: m.Job, Attempt: m.Attempts, Receipt: receipt, LastError: m.LastError}, nil
+}
+
+// Extend implements Queue.
+func (q *MemoryQueue) Extend(ctx context.Context, d *Delivery, visibility time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	m, err := q.leasedLocked(d)
+	if err != nil {
+		return err
+	}
+	m.VisibleAt = q.clock().Add(visibility)
+	return nil
+}
+
+// Ack implements Queue.
+func (q *MemoryQueue) Ack(ctx context.Context, d *Delivery) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, err := q.leasedLocked(d); err != nil {
+		return err
+	}
+	delete(q.messages, d.Job.ID)
+	return nil
+}
+
+// Retry implements Queue.
+func (q *MemoryQueue) Retry(ctx context.Context, d *Delivery, delay time.Duration, reason string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	m, err := q.leasedLocked(d)
+	if err != nil {
+		return err
+	}
+	m.VisibleAt = q.clock().Add(delay)
+	m.Receipt = ""
+	m.LastError = reason
+	return nil
+}
+
+// DeadLetter implements Queue.
+func (q *MemoryQueue) DeadLetter(ctx context.Context, d *Delivery, reason string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	m, err := q.leasedLocked(d)
+	if err != nil {
+		return err
+	}
+	delete(q.messages, d.Job.ID)
+	q.dead = append(q.dead, DeadLetter{Job: m.Job, Attempts: m.Attempts, Reason: reason, FailedAt: q.clock()})
+	return nil
+}
+
+// DeadLetters returns a copy of the dead-lettered jobs.
+func (q *MemoryQueue) DeadLetters() []DeadLetter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := make([]DeadLetter, len(q.dead))
+	copy(out, q.dead)
+	return out
+}
+
+// Len returns the number of jobs that are queued or in flight.
+func (q *MemoryQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.messages)
+}
+
+func (q *MemoryQueue) leasedLocked(d *Delivery) (*message, error) {
+	if d == nil {
+		return nil, errors.New("transcode: delivery is required")
+	}
+	m, ok := q.messages[d.Job.ID]
+	if !ok || m.Receipt != d.Receipt {
+		return nil, ErrLeaseLost
+	}
+	return m, nil
+}
+
+func newReceipt() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+var _ Queue = (*MemoryQueue)(nil)
@@ -0,0 +1,236 @@
+package transcode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"tritontube/internal/catalog"
+	grpc "tritontube/internal/metadata/grpcstub"
+	webapipb "tritontube/internal/webapi/proto"
+)
+
+// Worker consumes transcode jobs and drives the video status from PENDING_TRANSCODE
+// through TRANSCODING to READY or FAILED.
+type Worker struct {
+	Queue   Queue
+	Encoder Encoder
+	Videos  *catalog.Store
+
+	// MaxAttempts bounds deliveries per job before it is dead-lettered (default 5).
+	MaxAttempts int
+	// Visibility is the lease length; it is renewed at half-life while encoding
+	// (default 10 minutes).
+	Visibility time.Duration
+	// BaseBackoff and MaxBackoff shape the exponential retry delay (defaults 1s / 5m).
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// PollInterval is how long an idle worker waits before polling again (default 1s).
+	PollInterval time.Duration
+}
+
+func (w *Worker) withDefaults() Worker {
+	cfg := *w
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 5
+	}
+	if cfg.Visibility <= 0 {
+		cfg.Visibility = 10 * time.Minute
+	}
+	if cfg.BaseBackoff <= 0 {
+		cfg.BaseBackoff = time.Second
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 5 * time.Minute
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+	return cfg
+}
+
+// Backoff returns the retry delay after the given (1-based) attempt.
+func (w *Worker) Backoff(attempt int) time.Duration {
+	cfg := w.withDefaults()
+	delay := cfg.BaseBackoff
+	for i := 1; i < attempt && delay < cfg.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > cfg.MaxBackoff {
+		delay = cfg.MaxBackoff
+	}
+	return delay
+}
+
+// Run processes jobs until the context is cancelled.
+func (w *Worker) Run(ctx context.Context) error {
+	if w == nil || w.Queue == nil || w.Encoder == nil || w.Videos == nil {
+		return errors.New("transcode: worker requires a queue, encoder and video store")
+	}
+	cfg := w.withDefaults()
+	for {
+		processed, err := w.ProcessOne(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			log.Printf("transcode: %v", err)
+		}
+		if processed {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(cfg.PollInterval):
+		}
+	}
+}
+
+// ProcessOne receives and handles a single job. It reports whether a job was found.
+func (w *Worker) ProcessOne(ctx context.Context) (bool, error) {
+	cfg := w.withDefaults()
+	d, err := cfg.Queue.Receive(ctx, cfg.Visibility)
+	if errors.Is(err, ErrQueueEmpty) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := w.setStatus(ctx, d.Job.VideoID, func(v *catalog.Video) {
+		v.Status = webapipb.VideoStatus_VIDEO_STATUS_TRANSCODING
+		v.ProgressPercent = 0
+	}); err != nil {
+		switch {
+		case errors.Is(err, errVideoFinished):
+			// A stale delivery for a video that already reached a final state.
+			return true, cfg.Queue.Ack(ctx, d)
+		case grpc.CodeOf(err) == grpc.NotFound:
+			err = Permanent(err)
+		}
+		return true, w.fail(ctx, cfg, d, err)
+	}
+
+	result, err := w.encode(ctx, cfg, d)
+	if err != nil {
+		return true, w.fail(ctx, cfg, d, err)
+	}
+
+	if err := w.setStatus(ctx, d.Job.VideoID, func(v *catalog.Video) {
+		v.Status = webapipb.VideoStatus_VIDEO_STATUS_READY
+		v.ProgressPercent = 100
+		v.FailureReason = ""
+		v.Renditions = result.Renditions
+		v.ManifestPath = result.ManifestPath
+		v.HLSManifestPath = result.HLSManifestPath
+		if result.DurationSeconds > 0 {
+			v.DurationSeconds = result.DurationSeconds
+		}
+	}); err != nil && !errors.Is(err, errVideoFinished) {
+		return true, w.fail(ctx, cfg, d, err)
+	}
+	return true, cfg.Queue.Ack(ctx, d)
+}
+
+// encode runs the encoder while renewing the lease, so long encodes are not handed to
+// a second worker when the visibility timeout elapses. If the lease cannot be renewed
+// the encode is cancelled and fails with ErrLeaseLost.
+func (w *Worker) encode(ctx context.Context, cfg Worker, d *Delivery) (*Result, error) {
+	encCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(cfg.Visibility / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-encCtx.Done():
+				return
+			case <-ticker.C:
+				if err := cfg.Queue.Extend(encCtx, d, cfg.Visibility); err != nil && encCtx.Err() == nil {
+					log.Printf("transcode: job %s lost its lease: %v", d.Job.ID, err)
+					if !errors.Is(err, ErrLeaseLost) {
+						err = fmt.Errorf("%w: %v", ErrLeaseLost, err)
+					}
+					cancel(err)
+					return
+				}
+			}
+		}
+	}()
+
+	var lastReported float64
+	progress := func(percent float64) {
+		// Avoid a metadata write for every tiny step.
+		if percent < 100 && percent-lastReported < 5 {
+			return
+		}
+		lastReported = percent
+		_ = w.setStatus(encCtx, d.Job.VideoID, func(v *catalog.Video) {
+			v.ProgressPercent = percent
+		})
+	}
+	result, err := cfg.Encoder.Transcode(encCtx, d.Job, progress)
+	if cause := context.Cause(encCtx); err != nil && errors.Is(cause, ErrLeaseLost) {
+		err = cause
+	}
+	cancel(nil)
+	wg.Wait()
+	if err == nil && result == nil {
+		err = fmt.Errorf("transcode: encoder returned no result for job %s", d.Job.ID)
+	}
+	return result, err
+}
+
+// fail retries the job with exponential backoff, or dead-letters it and marks the video
+// FAILED once retries are exhausted or the error is permanent.
+func (w *Worker) fail(ctx context.Context, cfg Worker, d *Delivery, cause error) error {
+	if errors.Is(cause, ErrLeaseLost) {
+		return cause
+	}
+	if ctx.Err() != nil {
+		// Shutting down: leave the lease to expire so another worker picks the job up.
+		return cause
+	}
+	if !IsPermanent(cause) && d.Attempt < cfg.MaxAttempts {
+		_ = w.setStatus(ctx, d.Job.VideoID, func(v *catalog.Video) {
+			v.Status = webapipb.VideoStatus_VIDEO_STATUS_PENDING_TRANSCODE
+			v.FailureReason = cause.Error()
+		})
+		if err := cfg.Queue.Retry(ctx, d, w.Backoff(d.Attempt), cause.Error()); err != nil {
+			return fmt.Errorf("job %s: retry after %v: %w", d.Job.ID, cause, err)
+		}
+		return fmt.Errorf("job %s attempt %d failed: %w", d.Job.ID, d.Attempt, cause)
+	}
+
+	if err := w.setStatus(ctx, d.Job.VideoID, func(v *catalog.Video) {
+		v.Status = webapipb.VideoStatus_VIDEO_STATUS_FAILED
+		v.FailureReason = cause.Error()
+	}); err != nil && !errors.Is(err, errVideoFinished) && grpc.CodeOf(err) != grpc.NotFound {
+		return fmt.Errorf("job %s: mark failed: %w", d.Job.ID, err)
+	}
+	if err := cfg.Queue.DeadLetter(ctx, d, cause.Error()); err != nil {
+		return fmt.Errorf("job %s: dead-letter after %v: %w", d.Job.ID, cause, err)
+	}
+	return fmt.Errorf("job %s failed permanently after %d attempts: %w", d.Job.ID, d.Attempt, cause)
+}
+
+var errVideoFinished = errors.New("transcode: video already finished")
+
+func (w *Worker) setStatus(ctx context.Context, videoID string, fn func(*catalog.Video)) error {
+	_, err := w.Videos.Update(ctx, videoID, func(v *catalog.Video) error {
+		if v.Status == webapipb.VideoStatus_VIDEO_STATUS_READY || v.Status == webapipb.VideoStatus_VIDEO_STATUS_FAILED {
+			return errVideoFinished
+		}
+		fn(v)
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,226 @@
+package transcode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"tritontube/internal/catalog"
+	"tritontube/internal/metadata"
+	"tritontube/internal/metadata/etcdsim"
+	grpc "tritontube/internal/metadata/grpcstub"
+	"tritontube/internal/metadata/pgxsim"
+	webapipb "tritontube/internal/webapi/proto"
+)
+
+func newTestClient(t *testing.T) metadata.MetadataServiceClient {
+	t.Helper()
+	etcd, err := etcdsim.New(etcdsim.Config{})
+	if err != nil {
+		t.Fatalf("failed to create etcd sim: %v", err)
+	}
+	meta, err := metadata.NewService(metadata.ServiceConfig{WritePool: pgxsim.NewPool(pgxsim.NewStore()), Etcd: etcd})
+	if err != nil {
+		t.Fatalf("failed to create metadata service: %v", err)
+	}
+	rpc := grpc.NewServer()
+	metadata.RegisterMetadataServiceServer(rpc, meta)
+	return metadata.NewMetadataServiceClient(rpc.NewInProcessConn())
+}
+
+func newTestWorker(t *testing.T, queue Queue, encoder Encoder) (*Worker, *catalog.Store) {
+	t.Helper()
+	videos, err := catalog.NewStore(newTestClient(t))
+	if err != nil {
+		t.Fatalf("failed to create catalog: %v", err)
+	}
+	if err := videos.Put(context.Background(), &catalog.Video{ID: "v1", Status: webapipb.VideoStatus_VIDEO_STATUS_PENDING_TRANSCODE}); err != nil {
+		t.Fatalf("failed to create video: %v", err)
+	}
+	if err := queue.Enqueue(context.Background(), Job{ID: "v1", VideoID: "v1", OutputPrefix: "/v/v1"}); err != nil {
+		t.Fatalf("enqueue failed: %v", err)
+	}
+	return &Worker{Queue: queue, Encoder: encoder, Videos: videos, MaxAttempts: 3}, videos
+}
+
+func TestWorkerRetriesUntilReady(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	queue := NewMemoryQueue(func() time.Time { return now })
+	encoder := &FakeEncoder{Fail: func(job Job, attempt int) error {
+		if attempt < 3 {
+			return errors.New("encoder crashed")
+		}
+		return nil
+	}}
+	worker, videos := newTestWorker(t, queue, encoder)
+	ctx := context.Background()
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		processed, err := worker.ProcessOne(ctx)
+		if !processed {
+			t.Fatalf("attempt %d: expected a job", attempt)
+		}
+		if attempt < 3 && err == nil {
+			t.Fatalf("attempt %d: expected failure", attempt)
+		}
+		if attempt == 3 && err != nil {
+			t.Fatalf("attempt %d: unexpected error %v", attempt, err)
+		}
+		if processed, _ := worker.ProcessOne(ctx); processed {
+			t.Fatalf("attempt %d: job visible before its backoff elapsed", attempt)
+		}
+		now = now.Add(worker.Backoff(attempt))
+	}
+
+	v, err := videos.Get(ctx, "v1")
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if v.Status != webapipb.VideoStatus_VIDEO_STATUS_READY || v.ManifestPath != "/v/v1/manifest.mpd" || v.HLSManifestPath != "/v/v1/master.m3u8" || len(v.Renditions) != len(DefaultLadder) {
+		t.Fatalf("unexpected video %+v", v)
+	}
+	if queue.Len() != 0 || len(queue.DeadLetters()) != 0 {
+		t.Fatalf("expected job to be acked, len=%d dead=%d", queue.Len(), len(queue.DeadLetters()))
+	}
+}
+
+func TestWorkerPermanentFailure(t *testing.T) {
+	queue := NewMemoryQueue(nil)
+	encoder := &FakeEncoder{Fail: func(job Job, attempt int) error {
+		return Permanent(errors.New("corrupt source"))
+	}}
+	worker, videos := newTestWorker(t, queue, encoder)
+	ctx := context.Background()
+
+	if _, err := worker.ProcessOne(ctx); err == nil {
+		t.Fatalf("expected failure")
+	}
+	if encoder.Attempts("v1") != 1 {
+		t.Fatalf("permanent errors must not be retried, got %d attempts", encoder.Attempts("v1"))
+	}
+	v, err := videos.Get(ctx, "v1")
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if v.Status != webapipb.VideoStatus_VIDEO_STATUS_FAILED || v.FailureReason != "corrupt source" {
+		t.Fatalf("unexpected video %+v", v)
+	}
+	dead := queue.DeadLetters()
+	if len(dead) != 1 || dead[0].Job.ID != "v1" {
+		t.Fatalf("expected job to be dead-lettered, got %+v", dead)
+	}
+}
+
+// expiringQueue fails every lease renewal, as if the lease had been handed on.
+type expiringQueue struct {
+	Queue
+}
+
+func (q *expiringQueue) Extend(ctx context.Context, d *Delivery, visibility time.Duration) error {
+	return ErrLeaseLost
+}
+
+// blockingEncoder runs until its context is cancelled.
+type blockingEncoder struct{}
+
+func (blockingEncoder) Transcode(ctx context.Context, job Job, progress ProgressFunc) (*Result, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestWorkerReportsLostLease(t *testing.T) {
+	queue := &expiringQueue{Queue: NewMemoryQueue(nil)}
+	worker, videos := newTestWorker(t, queue, blockingEncoder{})
+	worker.Visibility = 20 * time.Millisecond
+	ctx := context.Background()
+
+	if _, err := worker.ProcessOne(ctx); !errors.Is(err, ErrLeaseLost) || errors.Is(err, context.Canceled) {
+		t.Fatalf("expected ErrLeaseLost rather than a cancellation, got %v", err)
+	}
+	// The job belongs to whoever holds the lease now, so it is neither retried nor failed.
+	v, err := videos.Get(ctx, "v1")
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if v.Status != webapipb.VideoStatus_VIDEO_STATUS_TRANSCODING || v.FailureReason != "" {
+		t.Fatalf("unexpected video %+v", v)
+	}
+}
+
+func TestMetadataQueueLease(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	queue, err := NewMetadataQueue(MetadataQueueConfig{Client: newTestClient(t), Clock: func() time.Time { return now }})
+	if err != nil {
+		t.Fatalf("failed to create queue: %v", err)
+	}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := queue.Enqueue(ctx, Job{ID: "j1", VideoID: "v1"}); err != nil {
+			t.Fatalf("enqueue #%d failed: %v", i, err)
+		}
+	}
+
+	first, err := queue.Receive(ctx, time.Minute)
+	if err != nil {
+		t.Fatalf("receive failed: %v", err)
+	}
+	if _, err := queue.Receive(ctx, time.Minute); !errors.Is(err, ErrQueueEmpty) {
+		t.Fatalf("expected leased job to be invisible, got %v", err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	second, err := queue.Receive(ctx, time.Minute)
+	if err != nil {
+		t.Fatalf("receive after lease expiry failed: %v", err)
+	}
+	if second.Attempt != 2 {
+		t.Fatalf("expected second attempt, got %d", second.Attempt)
+	}
+	if err := queue.Ack(ctx, first); !errors.Is(err, ErrLeaseLost) {
+		t.Fatalf("expected stale receipt to lose its lease, got %v", err)
+	}
+	if err := queue.DeadLetter(ctx, second, "boom"); err != nil {
+		t.Fatalf("dead-letter failed: %v", err)
+	}
+	dead, err := queue.DeadLetters(ctx)
+	if err != nil || len(dead) != 1 || dead[0].Attempts != 2 {
+		t.Fatalf("unexpected dead letters %+v, %v", dead, err)
+	}
+}
+
+func TestMetadataQueueConcurrentEnqueue(t *testing.T) {
+	queue, err := NewMetadataQueue(MetadataQueueConfig{Client: newTestClient(t)})
+	if err != nil {
+		t.Fatalf("failed to create queue: %v", err)
+	}
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := queue.Enqueue(ctx, Job{ID: "j1", VideoID: "v1", OutputPrefix: fmt.Sprintf("/v/%d", i)}); err != nil {
+				t.Errorf("enqueue #%d failed: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	d, err := queue.Receive(ctx, time.Minute)
+	if err != nil {
+		t.Fatalf("receive failed: %v", err)
+	}
+	// A later enqueue must leave the leased job alone.
+	if err := queue.Enqueue(ctx, Job{ID: "j1", VideoID: "v1"}); err != nil {
+		t.Fatalf("enqueue of a leased job failed: %v", err)
+	}
+	if _, err := queue.Receive(ctx, time.Minute); !errors.Is(err, ErrQueueEmpty) {
+		t.Fatalf("expected the job to stay leased, got %v", err)
+	}
+	if err := queue.Ack(ctx, d); err != nil {
+		t.Fatalf("ack failed: %v", err)
+	}
+}
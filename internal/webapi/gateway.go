@@ -0,0 +1,185 @@
+package webapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	grpc "tritontube/internal/metadata/grpcstub"
+	webapipb "tritontube/internal/webapi/proto"
+)
+
+// Gateway exposes a VideoServiceServer through the REST bindings declared by the
+// google.api.http annotations in proto/web.proto, in the style of grpc-gateway.
+type Gateway struct {
+	srv webapipb.VideoServiceServer
+}
+
+// NewGateway wraps srv with the REST routes.
+func NewGateway(srv webapipb.VideoServiceServer) *Gateway {
+	return &Gateway{srv: srv}
+}
+
+// ServeHTTP routes /v1/videos... requests to the matching RPC.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Path
+	switch {
+	case p == "/v1/videos:uploadURL":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		var req webapipb.CreateUploadURLRequest
+		if !decodeBody(w, r, &req) {
+			return
+		}
+		resp, err := g.srv.CreateUploadURL(r.Context(), &req)
+		writeResponse(w, resp, err)
+	case p == "/v1/videos:completeUpload":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		var req webapipb.CompleteUploadRequest
+		if !decodeBody(w, r, &req) {
+			return
+		}
+		resp, err := g.srv.CompleteUpload(r.Context(), &req)
+		writeResponse(w, resp, err)
+	case p == "/v1/videos:recommendations":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		q := r.URL.Query()
+		limit, ok := queryInt32(w, q.Get("limit"))
+		if !ok {
+			return
+		}
+		resp, err := g.srv.RecommendVideos(r.Context(), &webapipb.RecommendVideosRequest{
+			UserId: queryParam(q, "user_id", "userId"),
+			Limit:  limit,
+		})
+		writeResponse(w, resp, err)
+	case p == "/v1/videos:search":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		q := r.URL.Query()
+		pageSize, ok := queryInt32(w, queryParam(q, "page_size", "pageSize"))
+		if !ok {
+			return
+		}
+		resp, err := g.srv.SearchVideos(r.Context(), &webapipb.SearchVideosRequest{
+			Query:     q.Get("query"),
+			PageSize:  pageSize,
+			PageToken: queryParam(q, "page_token", "pageToken"),
+		})
+		writeResponse(w, resp, err)
+	case strings.HasPrefix(p, "/v1/videos/"):
+		g.routeVideo(w, r, strings.TrimPrefix(p, "/v1/videos/"))
+	default:
+		writeError(w, grpc.Errorf(grpc.NotFound, "webapi: no route for %s", p))
+	}
+}
+
+func (g *Gateway) routeVideo(w http.ResponseWriter, r *http.Request, rest string) {
+	parts := strings.Split(rest, "/")
+	if len(parts) != 2 || parts[0] == "" {
+		writeError(w, grpc.Errorf(grpc.NotFound, "webapi: no route for %s", r.URL.Path))
+		return
+	}
+	videoID, action := parts[0], parts[1]
+	var (
+		resp any
+		err  error
+	)
+	switch action {
+	case "transcodeStatus":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		resp, err = g.srv.GetTranscodeStatus(r.Context(), &webapipb.GetTranscodeStatusRequest{VideoId: videoID})
+	case "playbackInfo":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		resp, err = g.srv.GetPlaybackInfo(r.Context(), &webapipb.GetPlaybackInfoRequest{VideoId: videoID})
+	default:
+		writeError(w, grpc.Errorf(grpc.NotFound, "webapi: no route for %s", r.URL.Path))
+		return
+	}
+	writeResponse(w, resp, err)
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeJSON(w, http.StatusMethodNotAllowed, errorBody{Code: grpc.Unimplemented, Message: "method not allowed"})
+	return false
+}
+
+func decodeBody(w http.ResponseWriter, r *http.Request, dst any) bool {
+	if err := json.NewDecoder(r.Body).Decode(dst); err != nil {
+		writeError(w, grpc.Errorf(grpc.InvalidArgument, "webapi: invalid request body: %v", err))
+		return false
+	}
+	return true
+}
+
+// queryParam reads a query parameter by its proto field name, accepting the
+// lowerCamelCase JSON name as well.
+func queryParam(q map[string][]string, names ...string) string {
+	for _, name := range names {
+		if v := q[name]; len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+func queryInt32(w http.ResponseWriter, raw string) (int32, bool) {
+	if raw == "" {
+		return 0, true
+	}
+	n, err := strconv.ParseInt(raw, 10, 32)
+	if err != nil {
+		writeError(w, grpc.Errorf(grpc.InvalidArgument, "webapi: invalid integer %q", raw))
+		return 0, false
+	}
+	return int32(n), true
+}
+
+type errorBody struct {
+	Code    grpc.Code `json:"code"`
+	Message string    `json:"message"`
+}
+
+func writeResponse(w http.ResponseWriter, resp any, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := grpc.CodeOf(err)
+	if code == grpc.Unknown {
+		switch {
+		case errors.Is(err, context.Canceled):
+			code = grpc.Canceled
+		case errors.Is(err, context.DeadlineExceeded):
+			code = grpc.DeadlineExceeded
+		}
+	}
+	writeJSON(w, code.HTTPStatus(), errorBody{Code: code, Message: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
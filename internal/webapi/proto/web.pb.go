@@ -0,0 +1,341 @@
+// Code generated manually to emulate protoc output for offline builds.
+// source: proto/web.proto
+
+package webapipb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	grpc "tritontube/internal/metadata/grpcstub"
+)
+
+// VideoStatus mirrors web.v1.VideoStatus.
+type VideoStatus int32
+
+const (
+	VideoStatus_VIDEO_STATUS_UNSPECIFIED       VideoStatus = 0
+	VideoStatus_VIDEO_STATUS_UPLOADING         VideoStatus = 1
+	VideoStatus_VIDEO_STATUS_PENDING_TRANSCODE VideoStatus = 2
+	VideoStatus_VIDEO_STATUS_TRANSCODING       VideoStatus = 3
+	VideoStatus_VIDEO_STATUS_READY             VideoStatus = 4
+	VideoStatus_VIDEO_STATUS_FAILED            VideoStatus = 5
+)
+
+// VideoStatus_name maps enum values to their proto names.
+var VideoStatus_name = map[int32]string{
+	0: "VIDEO_STATUS_UNSPECIFIED",
+	1: "VIDEO_STATUS_UPLOADING",
+	2: "VIDEO_STATUS_PENDING_TRANSCODE",
+	3: "VIDEO_STATUS_TRANSCODING",
+	4: "VIDEO_STATUS_READY",
+	5: "VIDEO_STATUS_FAILED",
+}
+
+// VideoStatus_value maps proto names to enum values.
+var VideoStatus_value = map[string]int32{
+	"VIDEO_STATUS_UNSPECIFIED":       0,
+	"VIDEO_STATUS_UPLOADING":         1,
+	"VIDEO_STATUS_PENDING_TRANSCODE": 2,
+	"VIDEO_STATUS_TRANSCODING":       3,
+	"VIDEO_STATUS_READY":             4,
+	"VIDEO_STATUS_FAILED":            5,
+}
+
+func (x VideoStatus) String() string {
+	if name, ok := VideoStatus_name[int32(x)]; ok {
+		return name
+	}
+	return strconv.Itoa(int(x))
+}
+
+// MarshalJSON encodes the enum by name, matching protojson.
+func (x VideoStatus) MarshalJSON() ([]byte, error) {
+	return json.Marshal(x.String())
+}
+
+// UnmarshalJSON accepts either the enum name or its numeric value.
+func (x *VideoStatus) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		v, ok := VideoStatus_value[name]
+		if !ok {
+			return fmt.Errorf("webapipb: unknown VideoStatus %q", name)
+		}
+		*x = VideoStatus(v)
+		return nil
+	}
+	var n int32
+	if err := json.Unmarshal(b, &n); err != nil {
+		return fmt.Errorf("webapipb: invalid VideoStatus %s", string(b))
+	}
+	*x = VideoStatus(n)
+	return nil
+}
+
+// VideoRendition mirrors web.v1.VideoRendition.
+type VideoRendition struct {
+	Quality      string `json:"quality,omitempty"`
+	Codec        string `json:"codec,omitempty"`
+	BitrateKbps  int32  `json:"bitrate_kbps,omitempty"`
+	SegmentPath  string `json:"segment_path,omitempty"`
+	ManifestPath string `json:"manifest_path,omitempty"`
+}
+
+// VideoSummary mirrors web.v1.VideoSummary.
+type VideoSummary struct {
+	VideoId         string      `json:"video_id,omitempty"`
+	Title           string      `json:"title,omitempty"`
+	Description     string      `json:"description,omitempty"`
+	ThumbnailUrl    string      `json:"thumbnail_url,omitempty"`
+	Status          VideoStatus `json:"status,omitempty"`
+	Tags            []string    `json:"tags,omitempty"`
+	DurationSeconds int64       `json:"duration_seconds,omitempty"`
+	OwnerId         string      `json:"owner_id,omitempty"`
+}
+
+// CreateUploadURLRequest mirrors web.v1.CreateUploadURLRequest.
+type CreateUploadURLRequest struct {
+	OwnerId          string   `json:"owner_id,omitempty"`
+	Title            string   `json:"title,omitempty"`
+	Description      string   `json:"description,omitempty"`
+	Tags             []string `json:"tags,omitempty"`
+	OriginalFilename string   `json:"original_filename,omitempty"`
+	ContentType      string   `json:"content_type,omitempty"`
+	SizeBytes        int64    `json:"size_bytes,omitempty"`
+}
+
+// UploadCredentials mirrors web.v1.UploadCredentials.
+type UploadCredentials struct {
+	Url              string            `json:"url,omitempty"`
+	FormFields       map[string]string `json:"form_fields,omitempty"`
+	ExpiresInSeconds int64             `json:"expires_in_seconds,omitempty"`
+}
+
+// CreateUploadURLResponse mirrors web.v1.CreateUploadURLResponse.
+type CreateUploadURLResponse struct {
+	UploadId    string             `json:"upload_id,omitempty"`
+	Credentials *UploadCredentials `json:"credentials,omitempty"`
+}
+
+// CompleteUploadRequest mirrors web.v1.CompleteUploadRequest.
+type CompleteUploadRequest struct {
+	UploadId  string `json:"upload_id,omitempty"`
+	S3Bucket  string `json:"s3_bucket,omitempty"`
+	S3Key     string `json:"s3_key,omitempty"`
+	Checksum  string `json:"checksum,omitempty"`
+	SizeBytes int64  `json:"size_bytes,omitempty"`
+}
+
+// CompleteUploadResponse mirrors web.v1.CompleteUploadResponse.
+type CompleteUploadResponse struct {
+	VideoId string      `json:"video_id,omitempty"`
+	Status  VideoStatus `json:"status,omitempty"`
+}
+
+// GetTranscodeStatusRequest mirrors web.v1.GetTranscodeStatusRequest.
+type GetTranscodeStatusRequest struct {
+	VideoId string `json:"video_id,omitempty"`
+}
+
+// GetTranscodeStatusResponse mirrors web.v1.GetTranscodeStatusResponse.
+type GetTranscodeStatusResponse struct {
+	Status          VideoStatus       `json:"status,omitempty"`
+	ProgressPercent float64           `json:"progress_percent,omitempty"`
+	Renditions      []*VideoRendition `json:"renditions,omitempty"`
+	FailureReason   string            `json:"failure_reason,omitempty"`
+}
+
+// GetPlaybackInfoRequest mirrors web.v1.GetPlaybackInfoRequest.
+type GetPlaybackInfoRequest struct {
+	VideoId string `json:"video_id,omitempty"`
+}
+
+// GetPlaybackInfoResponse mirrors web.v1.GetPlaybackInfoResponse.
+type GetPlaybackInfoResponse struct {
+	ManifestUrl    string            `json:"manifest_url,omitempty"`
+	Renditions     []*VideoRendition `json:"renditions,omitempty"`
+	Subtitles      map[string]string `json:"subtitles,omitempty"`
+	HlsManifestUrl string            `json:"hls_manifest_url,omitempty"`
+}
+
+// RecommendVideosRequest mirrors web.v1.RecommendVideosRequest.
+type RecommendVideosRequest struct {
+	UserId string `json:"user_id,omitempty"`
+	Limit  int32  `json:"limit,omitempty"`
+}
+
+// RecommendVideosResponse mirrors web.v1.RecommendVideosResponse.
+type RecommendVideosResponse struct {
+	Videos []*VideoSummary `json:"videos,omitempty"`
+}
+
+// SearchVideosRequest mirrors web.v1.SearchVideosRequest.
+type SearchVideosRequest struct {
+	Query     string `json:"query,omitempty"`
+	PageSize  int32  `json:"page_size,omitempty"`
+	PageToken string `json:"page_token,omitempty"`
+}
+
+// SearchVideosResponse mirrors web.v1.SearchVideosResponse.
+type SearchVideosResponse struct {
+	Videos        []*VideoSummary `json:"videos,omitempty"`
+	NextPageToken string          `json:"next_page_token,omitempty"`
+}
+
+// VideoServiceServer is the server API for VideoService.
+type VideoServiceServer interface {
+	CreateUploadURL(context.Context, *CreateUploadURLRequest) (*CreateUploadURLResponse, error)
+	CompleteUpload(context.Context, *CompleteUploadRequest) (*CompleteUploadResponse, error)
+	GetTranscodeStatus(context.Context, *GetTranscodeStatusRequest) (*GetTranscodeStatusResponse, error)
+	GetPlaybackInfo(context.Context, *GetPlaybackInfoRequest) (*GetPlaybackInfoResponse, error)
+	RecommendVideos(context.Context, *RecommendVideosRequest) (*RecommendVideosResponse, error)
+	SearchVideos(context.Context, *SearchVideosRequest) (*SearchVideosResponse, error)
+	mustEmbedUnimplementedVideoServiceServer()
+}
+
+// UnimplementedVideoServiceServer provides forward compatible defaults.
+type UnimplementedVideoServiceServer struct{}
+
+func (UnimplementedVideoServiceServer) CreateUploadURL(context.Context, *CreateUploadURLRequest) (*CreateUploadURLResponse, error) {
+	return nil, errors.New("method CreateUploadURL not implemented")
+}
+
+func (UnimplementedVideoServiceServer) CompleteUpload(context.Context, *CompleteUploadRequest) (*CompleteUploadResponse, error) {
+	return nil, errors.New("method CompleteUpload not implemented")
+}
+
+func (UnimplementedVideoServiceServer) GetTranscodeStatus(context.Context, *GetTranscodeStatusRequest) (*GetTranscodeStatusResponse, error) {
+	return nil, errors.New("method GetTranscodeStatus not implemented")
+}
+
+func (UnimplementedVideoServiceServer) GetPlaybackInfo(context.Context, *GetPlaybackInfoRequest) (*GetPlaybackInfoResponse, error) {
+	return nil, errors.New("method GetPlaybackInfo not implemented")
+}
+
+func (UnimplementedVideoServiceServer) RecommendVideos(context.Context, *RecommendVideosRequest) (*RecommendVideosResponse, error) {
+	return nil, errors.New("method RecommendVideos not implemented")
+}
+
+func (UnimplementedVideoServiceServer) SearchVideos(context.Context, *SearchVideosRequest) (*SearchVideosResponse, error) {
+	return nil, errors.New("method SearchVideos not implemented")
+}
+
+func (UnimplementedVideoServiceServer) mustEmbedUnimplementedVideoServiceServer() {}
+
+// RegisterVideoServiceServer wires the server into the registrar.
+func RegisterVideoServiceServer(s grpc.ServiceRegistrar, srv VideoServiceServer) {
+	if srv == nil {
+		panic("webapipb: server is nil")
+	}
+	s.RegisterService(&VideoService_ServiceDesc, srv)
+}
+
+// VideoService_ServiceDesc describes the service for our lightweight gRPC stub.
+var VideoService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "web.v1.VideoService",
+	HandlerType: (*VideoServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "CreateUploadURL", Handler: _VideoService_CreateUploadURL_Handler},
+		{MethodName: "CompleteUpload", Handler: _VideoService_CompleteUpload_Handler},
+		{MethodName: "GetTranscodeStatus", Handler: _VideoService_GetTranscodeStatus_Handler},
+		{MethodName: "GetPlaybackInfo", Handler: _VideoService_GetPlaybackInfo_Handler},
+		{MethodName: "RecommendVideos", Handler: _VideoService_RecommendVideos_Handler},
+		{MethodName: "SearchVideos", Handler: _VideoService_SearchVideos_Handler},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "proto/web.proto",
+}
+
+func _VideoService_CreateUploadURL_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateUploadURLRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VideoServiceServer).CreateUploadURL(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/web.v1.VideoService/CreateUploadURL"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VideoServiceServer).CreateUploadURL(ctx, req.(*CreateUploadURLRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VideoService_CompleteUpload_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CompleteUploadRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VideoServiceServer).CompleteUpload(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/web.v1.VideoService/CompleteUpload"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VideoServiceServer).CompleteUpload(ctx, req.(*CompleteUploadRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VideoService_GetTranscodeStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetTranscodeStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VideoServiceServer).GetTranscodeStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/web.v1.VideoService/GetTranscodeStatus"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VideoServiceServer).GetTranscodeStatus(ctx, req.(*GetTranscodeStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VideoService_GetPlaybackInfo_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetPlaybackInfoRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VideoServiceServer).GetPlaybackInfo(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/web.v1.VideoService/GetPlaybackInfo"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VideoServiceServer).GetPlaybackInfo(ctx, req.(*GetPlaybackInfoRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VideoService_RecommendVideos_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RecommendVideosRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VideoServiceServer).RecommendVideos(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/web.v1.VideoService/RecommendVideos"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VideoServiceServer).RecommendVideos(ctx, req.(*RecommendVideosRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VideoService_SearchVideos_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SearchVideosRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VideoServiceServer).SearchVideos(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/web.v1.VideoService/SearchVideos"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VideoServiceServer).SearchVideos(ctx, req.(*SearchVideosRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
@@ -0,0 +1,451 @@
+package webapi
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"tritontube/internal/catalog"
+	"tritontube/internal/chash"
+	"tritontube/internal/metadata"
+	grpc "tritontube/internal/metadata/grpcstub"
+	"tritontube/internal/storage"
+	"tritontube/internal/transcode"
+	webapipb "tritontube/internal/webapi/proto"
+)
+
+// Service implements the web.v1.VideoService RPCs on top of the metadata service and
+// the storage cluster.
+type Service struct {
+	webapipb.UnimplementedVideoServiceServer
+
+	videos       *catalog.Store
+	sessions     *metadata.UploadSessionStore
+	jobs         transcode.Queue
+	storage      *chash.Ring
+	uploadBucket string
+	publicBase   string
+	httpClient   *http.Client
+}
+
+// ServiceConfig configures a new Service instance.
+type ServiceConfig struct {
+	Metadata metadata.MetadataServiceClient
+	// StorageRing maps object keys to storage node base URLs (e.g. http://localhost:8081).
+	StorageRing *chash.Ring
+	// UploadBucket is the storage bucket that receives mezzanine uploads.
+	UploadBucket string
+	// UploadTTL bounds how long upload sessions and their credentials stay valid.
+	UploadTTL time.Duration
+	// PublicBaseURL is prepended to manifest paths returned to players.
+	PublicBaseURL string
+	// Jobs receives a transcode job for every completed upload. Optional.
+	Jobs transcode.Queue
+	// HTTPClient is used to check uploaded objects on storage nodes (default
+	// http.DefaultClient).
+	HTTPClient *http.Client
+}
+
+// NewService constructs a Service with sane defaults.
+func NewService(cfg ServiceConfig) (*Service, error) {
+	if cfg.Metadata == nil {
+		return nil, errors.New("webapi: metadata client is required")
+	}
+	if cfg.StorageRing == nil {
+		return nil, errors.New("webapi: storage ring is required")
+	}
+	videos, err := catalog.NewStore(cfg.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := metadata.NewUploadSessionStore(metadata.UploadSessionStoreConfig{Client: cfg.Metadata, TTL: cfg.UploadTTL})
+	if err != nil {
+		return nil, err
+	}
+	svc := &Service{
+		videos:       videos,
+		sessions:     sessions,
+		jobs:         cfg.Jobs,
+		storage:      cfg.StorageRing,
+		uploadBucket: cfg.UploadBucket,
+		publicBase:   strings.TrimRight(cfg.PublicBaseURL, "/"),
+		httpClient:   cfg.HTTPClient,
+	}
+	if svc.uploadBucket == "" {
+		svc.uploadBucket = "uploads"
+	}
+	if svc.httpClient == nil {
+		svc.httpClient = http.DefaultClient
+	}
+	return svc, nil
+}
+
+// CreateUploadURL registers a new video, opens an upload session for it and returns
+// the storage endpoint the client should PUT the mezzanine file to.
+func (s *Service) CreateUploadURL(ctx context.Context, req *webapipb.CreateUploadURLRequest) (*webapipb.CreateUploadURLResponse, error) {
+	if req == nil {
+		return nil, grpc.Errorf(grpc.InvalidArgument, "webapi: request is required")
+	}
+	if req.OwnerId == "" {
+		return nil, grpc.Errorf(grpc.InvalidArgument, "webapi: owner_id is required")
+	}
+	if req.SizeBytes < 0 {
+		return nil, grpc.Errorf(grpc.InvalidArgument, "webapi: size_bytes must not be negative")
+	}
+	videoID, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	filename := path.Base("/" + req.OriginalFilename)
+	if filename == "/" || filename == "." {
+		filename = "source"
+	}
+	key := videoID + "/" + filename
+
+	nodes := s.storage.Lookup([]byte(key), 1)
+	if len(nodes) == 0 {
+		return nil, grpc.Errorf(grpc.Unavailable, "webapi: no storage nodes available")
+	}
+
+	video := &catalog.Video{
+		ID:              videoID,
+		OwnerID:         req.OwnerId,
+		Title:           req.Title,
+		Description:     req.Description,
+		Tags:            append([]string(nil), req.Tags...),
+		Status:          webapipb.VideoStatus_VIDEO_STATUS_UPLOADING,
+		SourceBucket:    s.uploadBucket,
+		SourceKey:       key,
+		SourceSizeBytes: req.SizeBytes,
+	}
+	if err := s.videos.Put(ctx, video); err != nil {
+		return nil, err
+	}
+	// The upload id doubles as the video id: CreateUploadURLResponse is the only place
+	// the client learns an identifier before CompleteUpload.
+	session := &metadata.UploadSession{
+		ID:      videoID,
+		VideoID: videoID,
+		OwnerID: req.OwnerId,
+		Bucket:  s.uploadBucket,
+		Key:     key,
+	}
+	if err := s.sessions.Create(ctx, session); err != nil {
+		return nil, err
+	}
+
+	fields := map[string]string{
+		"method":          "PUT",
+		"bucket":          s.uploadBucket,
+		"key":             key,
+		"checksum_header": storage.ChecksumHeader,
+	}
+	if req.ContentType != "" {
+		fields["content_type"] = req.ContentType
+	}
+	return &webapipb.CreateUploadURLResponse{
+		UploadId: session.ID,
+		Credentials: &webapipb.UploadCredentials{
+			Url:              blobURL(nodes[0], s.uploadBucket, key),
+			FormFields:       fields,
+			ExpiresInSeconds: int64(s.sessions.TTL().Seconds()),
+		},
+	}, nil
+}
+
+// CompleteUpload closes the upload session, marks the video as pending transcode and
+// enqueues its transcode job. The session is completed at most once and the job is
+// keyed by the video id, so repeated calls never enqueue a duplicate transcode, while a
+// retry after a failed enqueue still queues the job.
+func (s *Service) CompleteUpload(ctx context.Context, req *webapipb.CompleteUploadRequest) (*webapipb.CompleteUploadResponse, error) {
+	if req == nil || req.UploadId == "" {
+		return nil, grpc.Errorf(grpc.InvalidArgument, "webapi: upload_id is required")
+	}
+	session, err := s.sessions.Get(ctx, req.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	if req.S3Bucket != "" && req.S3Bucket != session.Bucket {
+		return nil, grpc.Errorf(grpc.InvalidArgument, "webapi: bucket %s does not match upload", req.S3Bucket)
+	}
+	if req.S3Key != "" && req.S3Key != session.Key {
+		return nil, grpc.Errorf(grpc.InvalidArgument, "webapi: key %s does not match upload", req.S3Key)
+	}
+	if req.Checksum != "" && session.State == metadata.UploadSessionOpen {
+		if err := s.verifyUpload(ctx, session, req.Checksum); err != nil {
+			return nil, err
+		}
+	}
+	session, _, err = s.sessions.Complete(ctx, req.UploadId, metadata.CompleteUploadSession{
+		Checksum:  req.Checksum,
+		SizeBytes: req.SizeBytes,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The video transition is guarded separately so that a retry after a crash between
+	// the two writes still moves the video on, while duplicates remain no-ops.
+	video, err := s.videos.Update(ctx, session.VideoID, func(v *catalog.Video) error {
+		if v.Status != webapipb.VideoStatus_VIDEO_STATUS_UPLOADING {
+			return errAlreadyCompleted
+		}
+		if session.SizeBytes > 0 {
+			v.SourceSizeBytes = session.SizeBytes
+		}
+		v.SourceChecksum = session.Checksum
+		v.Status = webapipb.VideoStatus_VIDEO_STATUS_PENDING_TRANSCODE
+		return nil
+	})
+	if errors.Is(err, errAlreadyCompleted) {
+		video, err = s.videos.Get(ctx, session.VideoID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.jobs != nil && video.Status == webapipb.VideoStatus_VIDEO_STATUS_PENDING_TRANSCODE {
+		job := transcode.Job{
+			ID:           video.ID,
+			VideoID:      video.ID,
+			SourceBucket: video.SourceBucket,
+			SourceKey:    video.SourceKey,
+			OutputPrefix: "/v/" + video.ID,
+		}
+		if err := s.jobs.Enqueue(ctx, job); err != nil {
+			return nil, grpc.Errorf(grpc.Unavailable, "webapi: failed to enqueue transcode for %s: %v", video.ID, err)
+		}
+	}
+	return &webapipb.CompleteUploadResponse{VideoId: video.ID, Status: video.Status}, nil
+}
+
+// GetTranscodeStatus reports the lifecycle state of a video.
+func (s *Service) GetTranscodeStatus(ctx context.Context, req *webapipb.GetTranscodeStatusRequest) (*webapipb.GetTranscodeStatusResponse, error) {
+	if req == nil || req.VideoId == "" {
+		return nil, grpc.Errorf(grpc.InvalidArgument, "webapi: video_id is required")
+	}
+	video, err := s.videos.Get(ctx, req.VideoId)
+	if err != nil {
+		return nil, err
+	}
+	progress := video.ProgressPercent
+	if video.Status == webapipb.VideoStatus_VIDEO_STATUS_READY {
+		progress = 100
+	}
+	return &webapipb.GetTranscodeStatusResponse{
+		Status:          video.Status,
+		ProgressPercent: progress,
+		Renditions:      video.Renditions,
+		FailureReason:   video.FailureReason,
+	}, nil
+}
+
+// GetPlaybackInfo returns the manifest location and renditions of a playable video.
+func (s *Service) GetPlaybackInfo(ctx context.Context, req *webapipb.GetPlaybackInfoRequest) (*webapipb.GetPlaybackInfoResponse, error) {
+	if req == nil || req.VideoId == "" {
+		return nil, grpc.Errorf(grpc.InvalidArgument, "webapi: video_id is required")
+	}
+	video, err := s.videos.Get(ctx, req.VideoId)
+	if err != nil {
+		return nil, err
+	}
+	if video.Status != webapipb.VideoStatus_VIDEO_STATUS_READY {
+		return nil, grpc.Errorf(grpc.FailedPrecondition, "webapi: video %s is %s", video.ID, video.Status)
+	}
+	resp := &webapipb.GetPlaybackInfoResponse{
+		ManifestUrl: s.publicBase + video.ManifestPath,
+		Renditions:  video.Renditions,
+	}
+	if video.HLSManifestPath != "" {
+		resp.HlsManifestUrl = s.publicBase + video.HLSManifestPath
+	}
+	return resp, nil
+}
+
+// RecommendVideos ranks ready videos by tag overlap with the user's own uploads and
+// then by recency.
+func (s *Service) RecommendVideos(ctx context.Context, req *webapipb.RecommendVideosRequest) (*webapipb.RecommendVideosResponse, error) {
+	if req == nil {
+		req = &webapipb.RecommendVideosRequest{}
+	}
+	limit := clampLimit(req.Limit, 10, 50)
+	videos, err := s.allVideos(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	interests := map[string]int{}
+	for _, v := range videos {
+		if req.UserId != "" && v.OwnerID == req.UserId {
+			for _, tag := range v.Tags {
+				interests[strings.ToLower(tag)]++
+			}
+		}
+	}
+
+	type scored struct {
+		video *catalog.Video
+		score int
+	}
+	candidates := make([]scored, 0, len(videos))
+	for _, v := range videos {
+		if v.Status != webapipb.VideoStatus_VIDEO_STATUS_READY {
+			continue
+		}
+		if req.UserId != "" && v.OwnerID == req.UserId {
+			continue
+		}
+		score := 0
+		for _, tag := range v.Tags {
+			score += interests[strings.ToLower(tag)]
+		}
+		candidates = append(candidates, scored{video: v, score: score})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		return candidates[i].video.CreatedAt.After(candidates[j].video.CreatedAt)
+	})
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+	resp := &webapipb.RecommendVideosResponse{}
+	for _, c := range candidates {
+		resp.Videos = append(resp.Videos, c.video.Summary())
+	}
+	return resp, nil
+}
+
+// SearchVideos matches ready videos whose title, description or tags contain every
+// query term. The page token is the id of the last video returned.
+func (s *Service) SearchVideos(ctx context.Context, req *webapipb.SearchVideosRequest) (*webapipb.SearchVideosResponse, error) {
+	if req == nil {
+		req = &webapipb.SearchVideosRequest{}
+	}
+	pageSize := clampLimit(req.PageSize, 20, 100)
+	terms := strings.Fields(strings.ToLower(req.Query))
+
+	resp := &webapipb.SearchVideosResponse{}
+	token := ""
+	if req.PageToken != "" {
+		// Resume strictly after the last video of the previous page.
+		token = catalog.VideoKey(req.PageToken) + "\x00"
+	}
+	for {
+		batch, next, err := s.videos.List(ctx, token, 100)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range batch {
+			if v.Status != webapipb.VideoStatus_VIDEO_STATUS_READY || !matchesAll(v, terms) {
+				continue
+			}
+			resp.Videos = append(resp.Videos, v.Summary())
+			if len(resp.Videos) == pageSize {
+				resp.NextPageToken = v.ID
+				return resp, nil
+			}
+		}
+		if next == "" {
+			return resp, nil
+		}
+		token = next
+	}
+}
+
+func (s *Service) allVideos(ctx context.Context) ([]*catalog.Video, error) {
+	var out []*catalog.Video
+	token := ""
+	for {
+		batch, next, err := s.videos.List(ctx, token, 100)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, batch...)
+		if next == "" {
+			return out, nil
+		}
+		token = next
+	}
+}
+
+var errAlreadyCompleted = errors.New("webapi: upload already completed")
+
+func matchesAll(v *catalog.Video, terms []string) bool {
+	if len(terms) == 0 {
+		return true
+	}
+	haystack := strings.ToLower(v.Title + " " + v.Description + " " + strings.Join(v.Tags, " "))
+	for _, term := range terms {
+		if !strings.Contains(haystack, term) {
+			return false
+		}
+	}
+	return true
+}
+
+func clampLimit(v int32, def, max int) int {
+	if v <= 0 {
+		return def
+	}
+	if int(v) > max {
+		return max
+	}
+	return int(v)
+}
+
+// verifyUpload compares the client's checksum with the sha256 the storage node recorded
+// for the uploaded object, which it reports as the ETag.
+func (s *Service) verifyUpload(ctx context.Context, session *metadata.UploadSession, checksum string) error {
+	nodes := s.storage.Lookup([]byte(session.Key), 1)
+	if len(nodes) == 0 {
+		return grpc.Errorf(grpc.Unavailable, "webapi: no storage nodes available")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, blobURL(nodes[0], session.Bucket, session.Key), nil)
+	if err != nil {
+		return grpc.Errorf(grpc.Internal, "webapi: %v", err)
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return grpc.Errorf(grpc.Unavailable, "webapi: failed to reach storage: %v", err)
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return grpc.Errorf(grpc.FailedPrecondition, "webapi: upload %s has not reached storage", session.ID)
+	case resp.StatusCode != http.StatusOK:
+		return grpc.Errorf(grpc.Unavailable, "webapi: storage answered %d for upload %s", resp.StatusCode, session.ID)
+	}
+	stored := strings.Trim(resp.Header.Get("ETag"), `"`)
+	if stored != storage.NormalizeChecksum(checksum) {
+		return grpc.Errorf(grpc.InvalidArgument, "webapi: checksum %s does not match uploaded object (%s)", checksum, stored)
+	}
+	return nil
+}
+
+func blobURL(base, bucket, key string) string {
+	return strings.TrimRight(base, "/") + "/blob/" + url.PathEscape(bucket) + "/" + escapeKey(key)
+}
+
+func escapeKey(key string) string {
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+func newID() (string, error) {
+	var b [12]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", grpc.Errorf(grpc.Internal, "webapi: failed to generate id: %v", err)
+	}
+	return hex.EncodeToString(b[:]), nil
+}
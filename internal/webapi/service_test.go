@@ -0,0 +1,263 @@
+package webapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"tritontube/internal/catalog"
+	"tritontube/internal/chash"
+	"tritontube/internal/metadata"
+	"tritontube/internal/metadata/etcdsim"
+	grpc "tritontube/internal/metadata/grpcstub"
+	"tritontube/internal/metadata/pgxsim"
+	"tritontube/internal/transcode"
+	webapipb "tritontube/internal/webapi/proto"
+)
+
+func newTestService(t *testing.T) (*Service, *catalog.Store, *transcode.MemoryQueue) {
+	t.Helper()
+	return newTestServiceWithNodes(t, "http://storage-a:8081", "http://storage-b:8081")
+}
+
+func newTestServiceWithNodes(t *testing.T, nodes ...string) (*Service, *catalog.Store, *transcode.MemoryQueue) {
+	t.Helper()
+	pool := pgxsim.NewPool(pgxsim.NewStore())
+	etcd, err := etcdsim.New(etcdsim.Config{})
+	if err != nil {
+		t.Fatalf("failed to create etcd sim: %v", err)
+	}
+	meta, err := metadata.NewService(metadata.ServiceConfig{WritePool: pool, Etcd: etcd})
+	if err != nil {
+		t.Fatalf("failed to create metadata service: %v", err)
+	}
+	rpc := grpc.NewServer()
+	metadata.RegisterMetadataServiceServer(rpc, meta)
+	client := metadata.NewMetadataServiceClient(rpc.NewInProcessConn())
+
+	ring := chash.NewRing(16)
+	for _, node := range nodes {
+		ring.AddNode(node)
+	}
+	jobs := transcode.NewMemoryQueue(nil)
+	svc, err := NewService(ServiceConfig{Metadata: client, StorageRing: ring, PublicBaseURL: "http://cdn.test", Jobs: jobs})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	videos, err := catalog.NewStore(client)
+	if err != nil {
+		t.Fatalf("failed to create catalog: %v", err)
+	}
+	return svc, videos, jobs
+}
+
+func TestUploadLifecycle(t *testing.T) {
+	svc, videos, jobs := newTestService(t)
+	ctx := context.Background()
+
+	created, err := svc.CreateUploadURL(ctx, &webapipb.CreateUploadURLRequest{
+		OwnerId:          "alice",
+		Title:            "Cat video",
+		OriginalFilename: "cat.mp4",
+	})
+	if err != nil {
+		t.Fatalf("create upload failed: %v", err)
+	}
+	if !strings.HasPrefix(created.Credentials.Url, "http://storage-") || !strings.HasSuffix(created.Credentials.Url, "/cat.mp4") {
+		t.Fatalf("unexpected upload url %s", created.Credentials.Url)
+	}
+
+	if _, err := svc.GetPlaybackInfo(ctx, &webapipb.GetPlaybackInfoRequest{VideoId: created.UploadId}); grpc.CodeOf(err) != grpc.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition before transcode, got %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		done, err := svc.CompleteUpload(ctx, &webapipb.CompleteUploadRequest{UploadId: created.UploadId})
+		if err != nil {
+			t.Fatalf("complete #%d failed: %v", i, err)
+		}
+		if done.Status != webapipb.VideoStatus_VIDEO_STATUS_PENDING_TRANSCODE {
+			t.Fatalf("complete #%d: unexpected status %s", i, done.Status)
+		}
+	}
+	if jobs.Len() != 1 {
+		t.Fatalf("expected exactly one transcode job, got %d", jobs.Len())
+	}
+
+	if _, err := videos.Update(ctx, created.UploadId, func(v *catalog.Video) error {
+		v.Status = webapipb.VideoStatus_VIDEO_STATUS_READY
+		v.ManifestPath = "/manifests/" + v.ID + ".mpd"
+		v.HLSManifestPath = "/manifests/" + v.ID + ".m3u8"
+		return nil
+	}); err != nil {
+		t.Fatalf("mark ready failed: %v", err)
+	}
+	info, err := svc.GetPlaybackInfo(ctx, &webapipb.GetPlaybackInfoRequest{VideoId: created.UploadId})
+	if err != nil {
+		t.Fatalf("playback info failed: %v", err)
+	}
+	if info.ManifestUrl != "http://cdn.test/manifests/"+created.UploadId+".mpd" || info.HlsManifestUrl != "http://cdn.test/manifests/"+created.UploadId+".m3u8" {
+		t.Fatalf("unexpected manifest urls %s, %s", info.ManifestUrl, info.HlsManifestUrl)
+	}
+
+	found, err := svc.SearchVideos(ctx, &webapipb.SearchVideosRequest{Query: "CAT"})
+	if err != nil {
+		t.Fatalf("search failed: %v", err)
+	}
+	if len(found.Videos) != 1 || found.Videos[0].VideoId != created.UploadId {
+		t.Fatalf("unexpected search results %+v", found.Videos)
+	}
+}
+
+func TestGatewayRoutes(t *testing.T) {
+	svc, _, _ := newTestService(t)
+	srv := httptest.NewServer(NewGateway(svc))
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/v1/videos:uploadURL", "application/json", strings.NewReader(`{"owner_id":"bob","title":"demo"}`))
+	if err != nil {
+		t.Fatalf("post failed: %v", err)
+	}
+	var created webapipb.CreateUploadURLResponse
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || created.UploadId == "" {
+		t.Fatalf("unexpected response %d %+v", resp.StatusCode, created)
+	}
+
+	resp, err = http.Get(srv.URL + "/v1/videos/" + created.UploadId + "/transcodeStatus")
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	var status webapipb.GetTranscodeStatusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	resp.Body.Close()
+	if status.Status != webapipb.VideoStatus_VIDEO_STATUS_UPLOADING {
+		t.Fatalf("unexpected status %s", status.Status)
+	}
+
+	resp, err = http.Get(srv.URL + "/v1/videos/missing/playbackInfo")
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for missing video, got %d", resp.StatusCode)
+	}
+}
+
+func TestCompleteUploadVerifiesChecksum(t *testing.T) {
+	const stored = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead || !strings.HasPrefix(r.URL.Path, "/blob/uploads/") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("ETag", `"`+stored+`"`)
+	}))
+	defer node.Close()
+	svc, _, jobs := newTestServiceWithNodes(t, node.URL)
+	ctx := context.Background()
+
+	created, err := svc.CreateUploadURL(ctx, &webapipb.CreateUploadURLRequest{OwnerId: "carol", OriginalFilename: "test.mp4"})
+	if err != nil {
+		t.Fatalf("create upload failed: %v", err)
+	}
+	if _, err := svc.CompleteUpload(ctx, &webapipb.CompleteUploadRequest{UploadId: created.UploadId, Checksum: strings.Repeat("0", 64)}); grpc.CodeOf(err) != grpc.InvalidArgument {
+		t.Fatalf("expected checksum mismatch to be rejected, got %v", err)
+	}
+	if jobs.Len() != 0 {
+		t.Fatalf("rejected upload must not be transcoded")
+	}
+	done, err := svc.CompleteUpload(ctx, &webapipb.CompleteUploadRequest{UploadId: created.UploadId, Checksum: "sha256:" + stored})
+	if err != nil {
+		t.Fatalf("complete failed: %v", err)
+	}
+	if done.Status != webapipb.VideoStatus_VIDEO_STATUS_PENDING_TRANSCODE || jobs.Len() != 1 {
+		t.Fatalf("unexpected completion %+v, jobs=%d", done, jobs.Len())
+	}
+}
+
+// countingQueue records every Enqueue, including the ones the queue dedupes, and fails
+// the first failures of them.
+type countingQueue struct {
+	transcode.Queue
+	enqueued int32
+	failures int32
+}
+
+func (q *countingQueue) Enqueue(ctx context.Context, job transcode.Job) error {
+	if atomic.AddInt32(&q.enqueued, 1) <= atomic.LoadInt32(&q.failures) {
+		return errors.New("queue unavailable")
+	}
+	return q.Queue.Enqueue(ctx, job)
+}
+
+func TestConcurrentCompleteUploadEnqueuesOnce(t *testing.T) {
+	svc, _, jobs := newTestService(t)
+	ctx := context.Background()
+
+	created, err := svc.CreateUploadURL(ctx, &webapipb.CreateUploadURLRequest{OwnerId: "dave", OriginalFilename: "race.mp4"})
+	if err != nil {
+		t.Fatalf("create upload failed: %v", err)
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = svc.CompleteUpload(ctx, &webapipb.CompleteUploadRequest{UploadId: created.UploadId})
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("complete #%d failed: %v", i, err)
+		}
+	}
+	if jobs.Len() != 1 {
+		t.Fatalf("expected exactly one transcode job, got %d", jobs.Len())
+	}
+}
+
+func TestCompleteUploadRetryEnqueuesAfterFailure(t *testing.T) {
+	svc, videos, jobs := newTestService(t)
+	counting := &countingQueue{Queue: jobs, failures: 1}
+	svc.jobs = counting
+	ctx := context.Background()
+
+	created, err := svc.CreateUploadURL(ctx, &webapipb.CreateUploadURLRequest{OwnerId: "erin", OriginalFilename: "retry.mp4"})
+	if err != nil {
+		t.Fatalf("create upload failed: %v", err)
+	}
+	if _, err := svc.CompleteUpload(ctx, &webapipb.CompleteUploadRequest{UploadId: created.UploadId}); grpc.CodeOf(err) != grpc.Unavailable {
+		t.Fatalf("expected Unavailable when the enqueue fails, got %v", err)
+	}
+	video, err := videos.Get(ctx, created.UploadId)
+	if err != nil || video.Status != webapipb.VideoStatus_VIDEO_STATUS_PENDING_TRANSCODE || jobs.Len() != 0 {
+		t.Fatalf("expected a pending video without a job, got %+v, jobs=%d, %v", video, jobs.Len(), err)
+	}
+
+	// The session is already completed, but the retry still queues the transcode.
+	done, err := svc.CompleteUpload(ctx, &webapipb.CompleteUploadRequest{UploadId: created.UploadId})
+	if err != nil {
+		t.Fatalf("retry failed: %v", err)
+	}
+	if done.Status != webapipb.VideoStatus_VIDEO_STATUS_PENDING_TRANSCODE || jobs.Len() != 1 {
+		t.Fatalf("expected the retry to enqueue the transcode, got %+v, jobs=%d", done, jobs.Len())
+	}
+	if _, err := svc.CompleteUpload(ctx, &webapipb.CompleteUploadRequest{UploadId: created.UploadId}); err != nil || jobs.Len() != 1 {
+		t.Fatalf("expected a repeated completion to be a no-op, got jobs=%d, %v", jobs.Len(), err)
+	}
+}